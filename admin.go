@@ -0,0 +1,213 @@
+package sessionmw
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminOptions are the options for the admin handler.
+type AdminOptions struct {
+	// Authorize authorizes admin requests (see AdminBasicAuth). All requests
+	// are refused when Authorize is nil.
+	Authorize func(*http.Request) bool
+
+	// Prefix is the path prefix the admin handler is mounted at.
+	Prefix string
+
+	// ShowValues includes the session values in session lookups, redacted
+	// using the patterns of the Manager (see Config.RedactKeys). Session
+	// values are not included by default, as they may contain sensitive
+	// data.
+	ShowValues bool
+}
+
+// AdminBasicAuth creates an authorization func for the admin handler using
+// HTTP basic authentication.
+func AdminBasicAuth(user, pass string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		u, p, ok := req.BasicAuth()
+		return ok &&
+			subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+	}
+}
+
+// adminSession is the admin handler's representation of a session.
+type adminSession struct {
+	ID         string                 `json:"id"`
+	Created    time.Time              `json:"created"`
+	LastActive time.Time              `json:"last_active"`
+	IP         string                 `json:"ip,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	User       string                 `json:"user,omitempty"`
+	Values     map[string]interface{} `json:"values,omitempty"`
+}
+
+// newAdminSession creates the admin representation of the session metadata.
+func newAdminSession(id string, md Metadata) adminSession {
+	return adminSession{
+		ID:         id,
+		Created:    md.Created,
+		LastActive: md.LastActive,
+		IP:         md.IP,
+		UserAgent:  md.UserAgent,
+		User:       md.User,
+	}
+}
+
+// adminHandler provides the admin endpoints.
+type adminHandler struct {
+	s    *Manager
+	opts AdminOptions
+}
+
+// AdminHandler creates a http.Handler providing endpoints for inspecting and
+// destroying the sessions of the Manager, for use by a support or operations
+// console. Requests must be authorized by opts.Authorize.
+//
+// The endpoints, relative to opts.Prefix, are:
+//
+//	GET    /sessions/{id}         the session's metadata (and values)
+//	DELETE /sessions/{id}         destroys the session
+//	GET    /users/{user}/sessions the user's sessions (see SetUser)
+//	DELETE /users/{user}/sessions destroys all of the user's sessions
+//	GET    /count                 the number of active sessions
+//
+// Counting sessions requires the store to be a CountableStore or a KeysStore
+// (see ActiveSessions).
+func AdminHandler(s *Manager, opts AdminOptions) http.Handler {
+	return &adminHandler{s: s, opts: opts}
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+func (ah *adminHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if ah.opts.Authorize == nil || !ah.opts.Authorize(req) {
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, ah.opts.Prefix) {
+		http.NotFound(res, req)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, ah.opts.Prefix), "/"), "/")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "sessions" && parts[1] != "":
+		ah.session(res, req, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[1] != "" && parts[2] == "sessions":
+		ah.user(res, req, parts[1])
+	case len(parts) == 1 && parts[0] == "count":
+		ah.count(res, req)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// session handles the session endpoints.
+func (ah *adminHandler) session(res http.ResponseWriter, req *http.Request, id string) {
+	// do not expose the user indexes
+	if !ah.s.idValidator(id) || strings.HasPrefix(id, metaKey) {
+		http.NotFound(res, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		d, err := ah.s.st.Read(id)
+		if err != nil {
+			http.NotFound(res, req)
+			return
+		}
+		data, ok := d.(map[string]interface{})
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+
+		as := newAdminSession(id, metadata(data))
+		if ah.opts.ShowValues {
+			as.Values = Redact(data, ah.s.redactKeys)
+			delete(as.Values, metaKey)
+		}
+		writeJSON(res, as)
+
+	case "DELETE":
+		switch err := ah.s.destroyID(id, ""); {
+		case err == ErrSessionNotFound:
+			http.NotFound(res, req)
+		case err != nil:
+			http.Error(res, "internal server error", http.StatusInternalServerError)
+		default:
+			res.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// user handles the user sessions endpoints.
+func (ah *adminHandler) user(res http.ResponseWriter, req *http.Request, user string) {
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "DELETE" {
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos, err := ah.s.userSessions(user, nil)
+	if err != nil {
+		http.Error(res, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Method == "DELETE" {
+		for _, info := range infos {
+			if err = ah.s.destroyID(info.ID, user); err != nil && err != ErrSessionNotFound {
+				http.Error(res, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sessions := make([]adminSession, len(infos))
+	for i, info := range infos {
+		sessions[i] = newAdminSession(info.ID, info.Metadata)
+	}
+	writeJSON(res, sessions)
+}
+
+// count handles the count endpoint.
+func (ah *adminHandler) count(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n, err := ActiveSessions(ah.s.st)
+	switch {
+	case err == ErrNotCountable:
+		http.Error(res, "not implemented", http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(res, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, map[string]int64{"count": n})
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(res http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(res, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(buf)
+}
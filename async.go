@@ -0,0 +1,108 @@
+package sessionmw
+
+const (
+	// DefaultAsyncQueueSize is the default size of the asynchronous save
+	// queue.
+	DefaultAsyncQueueSize = 1024
+
+	// maxAsyncBatch is the maximum number of sessions written in a single
+	// batch.
+	maxAsyncBatch = 64
+)
+
+// BatchStore is the interface for session stores that can write multiple
+// sessions at once (ie, in a single round trip).
+//
+// Batches are written with the store's default expiration, so asynchronous
+// saves are not batched when the store is a TTLStore and Config.MaxAge is set.
+type BatchStore interface {
+	Store
+
+	// WriteBatch saves the sessions with the provided ids.
+	WriteBatch(objs map[string]interface{}) error
+}
+
+// asyncSave is a queued session save.
+type asyncSave struct {
+	id  string
+	obj interface{}
+}
+
+// asyncSaver saves sessions to the store in the background.
+type asyncSaver struct {
+	s       *Manager
+	queue   chan asyncSave
+	onError func(string, error)
+}
+
+// newAsyncSaver creates and starts an asynchronous saver for s.
+func newAsyncSaver(s *Manager, size int, onError func(string, error)) *asyncSaver {
+	a := &asyncSaver{
+		s:       s,
+		queue:   make(chan asyncSave, size),
+		onError: onError,
+	}
+	go a.run()
+	return a
+}
+
+// write queues the session for saving, saving synchronously when the queue is
+// full.
+func (a *asyncSaver) write(id string, obj interface{}) error {
+	a.s.pending.add()
+	select {
+	case a.queue <- asyncSave{id, obj}:
+		return nil
+	default:
+	}
+
+	defer a.s.pending.done()
+	return a.s.writeStore(id, obj)
+}
+
+// run writes queued sessions, batching writes when the store is a
+// BatchStore, unless sessions are written with the TTL of Config.MaxAge (see
+// writeStore).
+func (a *asyncSaver) run() {
+	bs, batch := a.s.st.(BatchStore)
+	if _, ok := a.s.st.(TTLStore); ok && a.s.maxAge > 0 {
+		batch = false
+	}
+	for save := range a.queue {
+		if !batch {
+			a.err(save.id, a.s.writeStore(save.id, save.obj))
+			a.s.pending.done()
+			continue
+		}
+
+		// collect queued saves, keeping the last save for each id
+		objs := map[string]interface{}{save.id: save.obj}
+		n := 1
+	collect:
+		for n < maxAsyncBatch {
+			select {
+			case save = <-a.queue:
+				objs[save.id] = save.obj
+				n++
+			default:
+				break collect
+			}
+		}
+
+		if err := bs.WriteBatch(objs); err != nil {
+			for id := range objs {
+				a.err(id, err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			a.s.pending.done()
+		}
+	}
+}
+
+// err reports an error saving the session with the provided id.
+func (a *asyncSaver) err(id string, err error) {
+	if err != nil && a.onError != nil {
+		a.onError(id, err)
+	}
+}
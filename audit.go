@@ -0,0 +1,182 @@
+package sessionmw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the audit operations
+const (
+	AuditSet     = "set"
+	AuditDelete  = "delete"
+	AuditDestroy = "destroy"
+
+	// AuditCreate and AuditSave record a new session being saved for the
+	// first time, and an existing session being saved.
+	AuditCreate = "create"
+	AuditSave   = "save"
+
+	// AuditImpersonate and AuditStopImpersonate record the start and end of
+	// the impersonation of the user recorded as the event key.
+	AuditImpersonate     = "impersonate"
+	AuditStopImpersonate = "stop_impersonate"
+)
+
+// auditPrefix is the store key prefix of the audit records written by
+// AuditStore.
+const auditPrefix = ReservedPrefix + "audit:"
+
+// DefaultRequestIDHeader is the default header used to retrieve the request
+// id recorded in audit events.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// AuditEvent is a record of a session mutation.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	SessionID string    `json:"session_id"`
+	Key       string    `json:"key,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+
+	// Impersonator is the user impersonating User (see Impersonate).
+	Impersonator string `json:"impersonator,omitempty"`
+}
+
+// AuditSink is the common interface for audit event destinations.
+type AuditSink interface {
+	// Audit records the event.
+	Audit(AuditEvent)
+}
+
+// AuditFunc is a func that satisfies the AuditSink interface.
+type AuditFunc func(AuditEvent)
+
+// Audit satisfies the AuditSink interface.
+func (f AuditFunc) Audit(ev AuditEvent) {
+	f(ev)
+}
+
+// auditWriter writes audit events as JSON lines to an io.Writer.
+type auditWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// AuditWriter creates an AuditSink writing each audit event as a line of
+// JSON to w. The session id of each event is written as its hex encoded
+// SHA-256 hash, so that the id cannot be used to hijack the session.
+func AuditWriter(w io.Writer) AuditSink {
+	return &auditWriter{w: w}
+}
+
+// Audit satisfies the AuditSink interface.
+func (aw *auditWriter) Audit(ev AuditEvent) {
+	ev.SessionID = hashID(ev.SessionID)
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	aw.Lock()
+	defer aw.Unlock()
+	aw.w.Write(append(buf, '\n'))
+}
+
+// auditStore writes audit events to a Store.
+type auditStore struct {
+	st     Store
+	prefix string
+	ttl    time.Duration
+}
+
+// AuditStore creates an AuditSink writing each audit event to st, expiring
+// it after ttl, under a reserved key (see Reserved) composed of prefix, the
+// hashed session id, and the event time. As with AuditWriter, the session id
+// of each event is recorded as its hex encoded SHA-256 hash.
+//
+// Records are written with WriteTTL when st is a TTLStore, and otherwise
+// expire with st's own expiration, if any.
+func AuditStore(st Store, prefix string, ttl time.Duration) AuditSink {
+	return &auditStore{st: st, prefix: prefix, ttl: ttl}
+}
+
+// Audit satisfies the AuditSink interface.
+func (as *auditStore) Audit(ev AuditEvent) {
+	id := hashID(ev.SessionID)
+	key := fmt.Sprintf("%s%s%s:%d", auditPrefix, as.prefix, id, ev.Time.UnixNano())
+	rec := map[string]interface{}{
+		"time":       ev.Time.UnixNano(),
+		"op":         ev.Op,
+		"session_id": id,
+		"key":        ev.Key,
+		"request_id": ev.RequestID,
+		"user":       ev.User,
+
+		"impersonator": ev.Impersonator,
+	}
+
+	if ts, ok := as.st.(TTLStore); ok {
+		ts.WriteTTL(key, rec, as.ttl)
+		return
+	}
+	as.st.Write(key, rec)
+}
+
+// hashID returns the hex encoded SHA-256 hash of the session id.
+func hashID(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+// auditor is the per-request audit state stored in the context.
+type auditor struct {
+	sink      AuditSink
+	requestID string
+}
+
+// newAuditor creates the auditor for req.
+func (s *Manager) newAuditor(ctxt context.Context, req *http.Request) *auditor {
+	var id string
+	if s.requestIDFn != nil {
+		id = s.requestIDFn(ctxt, req)
+	} else {
+		id = req.Header.Get(DefaultRequestIDHeader)
+	}
+
+	return &auditor{
+		sink:      s.audit,
+		requestID: id,
+	}
+}
+
+// audit records a session mutation, if auditing is enabled for the context.
+func audit(ctxt context.Context, op, key string) {
+	ns, ok := ctxt.Value(sessionContextKey).(*namedSession)
+	if !ok || ns.auditor == nil {
+		return
+	}
+
+	a, sess := ns.auditor, ns.sess
+	sess.RLock()
+	id, md := sess.id, metadata(sess.data)
+	sess.RUnlock()
+
+	a.sink.Audit(AuditEvent{
+		Time:         sess.s.now(),
+		Op:           op,
+		SessionID:    id,
+		Key:          key,
+		RequestID:    a.requestID,
+		User:         md.User,
+		Impersonator: md.Impersonator,
+	})
+}
@@ -0,0 +1,110 @@
+package sessionmw
+
+import (
+	"net/http"
+	"time"
+
+	"goji.io"
+
+	"golang.org/x/net/context"
+)
+
+// the session metadata keys holding the authentication level
+const (
+	metaAuthLevelKey   = "authlevel"
+	metaAuthBaseKey    = "authbase"
+	metaAuthExpiresKey = "authexpires"
+)
+
+// SetAuthLevel sets the authentication level of the session (ie, 1 after the
+// user logs in, and 2 after the user reauthenticates). When ttl is not 0, the
+// level is downgraded after ttl to the level the session had before (ie, so
+// that a recent reauthentication expires without logging the user out).
+//
+// The session id should be regenerated when the level is raised (see
+// Regenerate).
+func SetAuthLevel(ctxt context.Context, level int, ttl time.Duration) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	defer sess.Unlock()
+
+	m := sess.meta()
+	now := sess.s.now()
+
+	// a temporary level set within the ttl of a previous temporary level
+	// downgrades to the level the session had before either
+	base := authLevel(m, now)
+	if n, ok := int64Value(m[metaAuthExpiresKey]); ok && now.Before(time.Unix(0, n)) {
+		b, _ := int64Value(m[metaAuthBaseKey])
+		base = int(b)
+	}
+	delete(m, metaAuthBaseKey)
+	delete(m, metaAuthExpiresKey)
+	m[metaAuthLevelKey] = int64(level)
+	if ttl > 0 {
+		m[metaAuthBaseKey], m[metaAuthExpiresKey] = int64(base), now.Add(ttl).UnixNano()
+	}
+	sess.modified = true
+	sess.dirty(metaKey)
+}
+
+// AuthLevel retrieves the authentication level of the session, or 0 when the
+// level was not set.
+func AuthLevel(ctxt context.Context) int {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	m, _ := sess.data[metaKey].(map[string]interface{})
+	return authLevel(m, sess.s.now())
+}
+
+// authLevel returns the authentication level recorded in the session
+// metadata at now.
+func authLevel(m map[string]interface{}, now time.Time) int {
+	if n, ok := int64Value(m[metaAuthExpiresKey]); ok && !now.Before(time.Unix(0, n)) {
+		base, _ := int64Value(m[metaAuthBaseKey])
+		return int(base)
+	}
+	level, _ := int64Value(m[metaAuthLevelKey])
+	return int(level)
+}
+
+// StepUp contains the configuration parameters for the step up
+// authentication middleware, requiring a minimum authentication level for
+// sensitive handlers (ie, billing pages).
+//
+// The step up middleware must be used after the session middleware.
+type StepUp struct {
+	// Level is the minimum authentication level (see SetAuthLevel).
+	Level int
+
+	// FailureHandler handles requests for sessions below the level (ie, by
+	// redirecting to reauthenticate). Defaults to responding with 401
+	// Unauthorized.
+	FailureHandler goji.Handler
+}
+
+// Handler provides the goji.Handler for the step up middleware.
+func (su StepUp) Handler(h goji.Handler) goji.Handler {
+	fail := su.FailureHandler
+	if fail == nil {
+		fail = goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			http.Error(res, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+
+	return goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if AuthLevel(ctxt) < su.Level {
+			fail.ServeHTTPC(ctxt, res, req)
+			return
+		}
+		h.ServeHTTPC(ctxt, res, req)
+	})
+}
+
+// RequireAuthLevel returns the step up middleware requiring the provided
+// authentication level (see StepUp).
+func RequireAuthLevel(level int) func(goji.Handler) goji.Handler {
+	return StepUp{Level: level}.Handler
+}
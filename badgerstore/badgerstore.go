@@ -0,0 +1,187 @@
+// Package badgerstore provides a Badger backed sessionmw.Store, for embedded
+// persistence of sessions using Badger's native entry TTLs.
+package badgerstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultGCDiscardRatio is the default value log discard ratio used when
+	// running value log garbage collection.
+	DefaultGCDiscardRatio = 0.5
+)
+
+// BadgerStore is a Badger backed session store.
+type BadgerStore struct {
+	db  *badger.DB
+	ttl time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Codec is the codec used to encode stored sessions. Use
+	// sessionmw.CodecJSON when non-Go services need to read sessions.
+	Codec sessionmw.Codec
+
+	// KeyBuilder builds the keys of sessions. New sets its Prefix to the
+	// provided prefix.
+	KeyBuilder sessionmw.KeyBuilder
+}
+
+// New creates a Badger store using db, storing sessions under prefix.
+//
+// Sessions expire ttl after they were last written, or never when ttl is 0 or
+// negative. The caller retains ownership of db, and is responsible for
+// closing it.
+func New(db *badger.DB, prefix string, ttl time.Duration) *BadgerStore {
+	return &BadgerStore{
+		db:         db,
+		ttl:        ttl,
+		done:       make(chan struct{}),
+		Codec:      sessionmw.CodecGob,
+		KeyBuilder: sessionmw.KeyBuilder{Prefix: prefix},
+	}
+}
+
+// Write saves the session for the provided id.
+func (bs *BadgerStore) Write(key string, obj interface{}) error {
+	buf, err := sessionmw.EncodePayload(bs.Codec, obj)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry([]byte(bs.KeyBuilder.Key(key)), buf)
+		if bs.ttl > 0 {
+			e = e.WithTTL(bs.ttl)
+		}
+		return txn.SetEntry(e)
+	})
+}
+
+// Read retrieves the session for the provided id.
+func (bs *BadgerStore) Read(key string) (interface{}, error) {
+	var data []byte
+	err := bs.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(bs.KeyBuilder.Key(key)))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	switch {
+	case err == badger.ErrKeyNotFound:
+		return nil, sessionmw.ErrSessionNotFound
+	case err != nil:
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, err)
+	}
+
+	obj, err := sessionmw.DecodePayload(data)
+	return obj, sessionmw.NewStoreError(sessionmw.ErrDecodeFailed, err)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (bs *BadgerStore) Erase(key string) error {
+	return bs.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(bs.KeyBuilder.Key(key)))
+	})
+}
+
+// keys returns the keys of all unexpired sessions in the store, excluding
+// reserved keys.
+func (bs *BadgerStore) keys() ([]string, error) {
+	var keys []string
+	err := bs.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(bs.KeyBuilder.Namespace())
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if key := string(it.Item().Key()); !bs.KeyBuilder.Reserved(key) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Keys returns the ids of all unexpired sessions in the store, or
+// sessionmw.ErrHashedIDs when ids are hashed. Satisfies the
+// sessionmw.KeysStore interface.
+func (bs *BadgerStore) Keys() ([]string, error) {
+	if bs.KeyBuilder.HashIDs {
+		return nil, sessionmw.ErrHashedIDs
+	}
+
+	keys, err := bs.keys()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i], _ = bs.KeyBuilder.ID(key)
+	}
+	return keys, nil
+}
+
+// Count returns the number of unexpired sessions in the store. Satisfies the
+// sessionmw.CountableStore interface.
+func (bs *BadgerStore) Count() (int64, error) {
+	keys, err := bs.keys()
+	return int64(len(keys)), err
+}
+
+// StartGC starts a goroutine running Badger's value log garbage collection
+// every interval, until the store is closed. If discardRatio is 0, then
+// DefaultGCDiscardRatio will be used.
+func (bs *BadgerStore) StartGC(interval time.Duration, discardRatio float64) {
+	if discardRatio == 0 {
+		discardRatio = DefaultGCDiscardRatio
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				// rewrite value log files until there is nothing left to
+				// collect
+				for bs.db.RunValueLogGC(discardRatio) == nil {
+				}
+			case <-bs.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the value log garbage collection. Subsequent calls to Close
+// have no effect.
+func (bs *BadgerStore) Close() error {
+	bs.closeOnce.Do(func() {
+		close(bs.done)
+	})
+	return nil
+}
+
+// Ping checks that the database is open. Satisfies the sessionmw.Pinger
+// interface.
+func (bs *BadgerStore) Ping(ctxt context.Context) error {
+	return bs.db.View(func(*badger.Txn) error {
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+package badgerstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/knq/sessionmw"
+)
+
+func newStore(ttl time.Duration, t *testing.T) (*BadgerStore, func()) {
+	dir, err := ioutil.TempDir("", "badgerstore")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	bs := New(db, "sess_", ttl)
+	return bs, func() {
+		bs.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore(t *testing.T) {
+	bs, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if _, err := bs.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	// reserved keys are not sessions
+	for _, key := range []string{"a", "b", sessionmw.ReservedPrefix + "user:a"} {
+		if err := bs.Write(key, map[string]interface{}{"name": key}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	obj, err := bs.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if m, ok := obj.(map[string]interface{}); !ok || m["name"] != "a" {
+		t.Errorf("expected name=a, got: %v", obj)
+	}
+
+	keys, err := bs.Keys()
+	if err != nil || len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected keys [a b], got: %v (%v)", keys, err)
+	}
+	if n, err := bs.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 sessions, got: %d (%v)", n, err)
+	}
+
+	if err = bs.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = bs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	bs, cleanup := newStore(time.Second, t)
+	defer cleanup()
+
+	if err := bs.Write("a", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	if _, err := bs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if keys, _ := bs.Keys(); len(keys) != 0 {
+		t.Errorf("expected no keys, got: %v", keys)
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	bs, cleanup := newStore(0, t)
+	defer cleanup()
+
+	if err := bs.Write("a", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := bs.Read("a"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if keys, _ := bs.Keys(); len(keys) != 1 {
+		t.Errorf("expected 1 key, got: %v", keys)
+	}
+}
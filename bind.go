@@ -0,0 +1,69 @@
+package sessionmw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// RemoteIP returns the IP address of the remote end of req.
+func RemoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// ProxyIP returns a func for use with Config.RemoteIPFn that retrieves the
+// client IP address from the provided header (ie, "X-Forwarded-For" or
+// "X-Real-IP") set by a trusted reverse proxy, falling back to RemoteIP.
+//
+// When the header contains a list of addresses, the last address (added by
+// the trusted proxy) is used.
+func ProxyIP(header string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		v := req.Header.Get(header)
+		if i := strings.LastIndex(v, ","); i >= 0 {
+			v = v[i+1:]
+		}
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+		return RemoteIP(req)
+	}
+}
+
+// userAgentHash returns the hex encoded SHA-256 hash of the req's User-Agent
+// header.
+func userAgentHash(req *http.Request) string {
+	h := sha256.Sum256([]byte(req.UserAgent()))
+	return hex.EncodeToString(h[:])
+}
+
+// BindMismatch reports whether the request did not match the IP address or
+// User-Agent the session was bound to, and the session was retained by
+// Config.OnBindMismatch.
+func BindMismatch(ctxt context.Context) bool {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return sess.mismatch
+}
+
+// bound determines if req matches the bound IP and User-Agent of the session
+// data.
+func (s *Manager) bound(req *http.Request, data map[string]interface{}) bool {
+	md := metadata(data)
+	if s.bindIP && md.IP != s.remoteIPFn(req) {
+		return false
+	}
+	if s.bindUserAgent && md.UserAgent != userAgentHash(req) {
+		return false
+	}
+	return true
+}
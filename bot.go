@@ -0,0 +1,18 @@
+package sessionmw
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// botUserAgentRE matches the User-Agent headers of common crawlers, bots, and
+// HTTP libraries.
+var botUserAgentRE = regexp.MustCompile(`(?i)bot\b|bot/|crawl|spider|slurp|archiver|facebookexternalhit|mediapartners|bingpreview|lighthouse|headless|curl/|wget/|python-requests|python-urllib|go-http-client|java/|okhttp|libwww|httpclient`)
+
+// IsBot is a func for use with Config.BotClassifier that classifies requests
+// without a User-Agent or Accept header, or with the User-Agent of a common
+// crawler, bot, or HTTP library, as bots.
+func IsBot(req *http.Request) bool {
+	ua := req.Header.Get("User-Agent")
+	return ua == "" || req.Header.Get("Accept") == "" || botUserAgentRE.MatchString(ua)
+}
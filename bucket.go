@@ -0,0 +1,72 @@
+package sessionmw
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// bucketSep separates the bucket name from the keys of its values.
+const bucketSep = "/"
+
+// BucketAccessor provides access to the values of a session bucket (see
+// Bucket).
+type BucketAccessor struct {
+	ctxt   context.Context
+	prefix string
+}
+
+// Bucket returns an accessor for the values of the named bucket of the
+// session in the context, so that independent features (ie, a cart and an
+// A/B test) can share a session without key collisions, and can be cleared
+// independently.
+//
+// Bucket values are stored in the session under the key <name>/<key>.
+func Bucket(ctxt context.Context, name string) *BucketAccessor {
+	return &BucketAccessor{ctxt: ctxt, prefix: name + bucketSep}
+}
+
+// Get retrieves a previously stored bucket value.
+func (b *BucketAccessor) Get(key string) (interface{}, bool) {
+	return Get(b.ctxt, b.prefix+key)
+}
+
+// Has determines if a bucket value is stored for key.
+func (b *BucketAccessor) Has(key string) bool {
+	return Has(b.ctxt, b.prefix+key)
+}
+
+// Set stores a bucket value.
+func (b *BucketAccessor) Set(key string, val interface{}) {
+	Set(b.ctxt, b.prefix+key, val)
+}
+
+// SetWithTTL stores a bucket value expiring after ttl (see SetWithTTL).
+func (b *BucketAccessor) SetWithTTL(key string, val interface{}, ttl time.Duration) {
+	SetWithTTL(b.ctxt, b.prefix+key, val, ttl)
+}
+
+// Delete deletes a stored bucket value.
+func (b *BucketAccessor) Delete(key string) {
+	Delete(b.ctxt, b.prefix+key)
+}
+
+// Keys retrieves the sorted keys of the stored bucket values.
+func (b *BucketAccessor) Keys() []string {
+	var keys []string
+	for _, k := range Keys(b.ctxt) {
+		if strings.HasPrefix(k, b.prefix) {
+			keys = append(keys, strings.TrimPrefix(k, b.prefix))
+		}
+	}
+	return keys
+}
+
+// Clear deletes all stored bucket values, leaving the other session values
+// intact.
+func (b *BucketAccessor) Clear() {
+	for _, k := range b.Keys() {
+		Delete(b.ctxt, b.prefix+k)
+	}
+}
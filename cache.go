@@ -0,0 +1,112 @@
+package sessionmw
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDecodeCacheTTL is the default time decoded cookie values are
+	// cached for.
+	DefaultDecodeCacheTTL = 30 * time.Second
+)
+
+// decodeCache is a bounded LRU cache of raw cookie values to their decoded
+// session ids, allowing repeated requests from the same client to skip
+// securecookie verification and decryption.
+//
+// The cache is purged when the middleware's secrets are rotated (see Rotate).
+type decodeCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	clock Clock
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// cacheEntry is a decodeCache entry.
+type cacheEntry struct {
+	value   string
+	id      string
+	expires time.Time
+}
+
+// newDecodeCache creates a decodeCache holding at most size entries for ttl,
+// as determined by clock.
+func newDecodeCache(size int, ttl time.Duration, clock Clock) *decodeCache {
+	if ttl == 0 {
+		ttl = DefaultDecodeCacheTTL
+	}
+
+	return &decodeCache{
+		size:  size,
+		ttl:   ttl,
+		clock: clock,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get retrieves the session id for the raw cookie value.
+func (c *decodeCache) get(value string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.items[value]
+	if !ok {
+		return "", false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if c.clock.Now().After(e.expires) {
+		c.remove(el)
+		return "", false
+	}
+
+	c.ll.MoveToFront(el)
+	return e.id, true
+}
+
+// add caches the session id for the raw cookie value until the cache TTL or
+// the cookie's expiration (if non-zero), whichever is first, evicting the
+// least recently used entry when the cache is full.
+func (c *decodeCache) add(value, id string, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.items[value]; ok {
+		c.remove(el)
+	}
+
+	exp := c.clock.Now().Add(c.ttl)
+	if !expires.IsZero() && expires.Before(exp) {
+		exp = expires
+	}
+
+	c.items[value] = c.ll.PushFront(&cacheEntry{
+		value:   value,
+		id:      id,
+		expires: exp,
+	})
+
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// purge removes all entries from the cache.
+func (c *decodeCache) purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// remove removes el from the cache. The cache must be locked.
+func (c *decodeCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).value)
+}
@@ -0,0 +1,171 @@
+// Package chachasealer provides a sessionmw.Sealer encrypting cookie values
+// with XChaCha20-Poly1305, as an alternative to gorilla/securecookie.
+//
+// Sealed values are the unpadded base64url encoding of:
+//
+//	| Bytes  | Value                                  |
+//	|--------|----------------------------------------|
+//	| 0      | format version (currently 1)           |
+//	| 1-4    | key id (big endian)                    |
+//	| 5-28   | random nonce                           |
+//	| 29-    | ciphertext and Poly1305 tag            |
+//
+// The cookie name is used as the additional authenticated data, and the
+// plaintext is the big endian Unix time the value was sealed followed by the
+// JSON encoded value.
+package chachasealer
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// DefaultMaxAge is the default maximum age of sealed values.
+	DefaultMaxAge = 30 * 24 * time.Hour
+
+	// version is the sealed value format version.
+	version = 1
+
+	// headerLen is the length of the version and key id.
+	headerLen = 1 + 4
+
+	// tsLen is the length of the timestamp prefixed to the plaintext.
+	tsLen = 8
+)
+
+var (
+	// ErrNoKeys is the error returned when no keys are provided.
+	ErrNoKeys = errors.New("no keys provided")
+
+	// ErrInvalidKey is the error returned when a key secret is not
+	// chacha20poly1305.KeySize bytes.
+	ErrInvalidKey = errors.New("key secret must be 32 bytes")
+
+	// ErrDuplicateKey is the error returned when multiple keys share the
+	// same id.
+	ErrDuplicateKey = errors.New("duplicate key id")
+
+	// ErrInvalidValue is the error returned when a sealed value is
+	// malformed or fails authentication.
+	ErrInvalidValue = errors.New("invalid sealed value")
+
+	// ErrUnknownKey is the error returned when a sealed value was sealed
+	// with an unknown key id.
+	ErrUnknownKey = errors.New("unknown key id")
+
+	// ErrExpired is the error returned when a sealed value is older than the
+	// sealer's MaxAge.
+	ErrExpired = errors.New("sealed value expired")
+)
+
+// Key is a versioned sealing key.
+type Key struct {
+	// ID is the key id embedded in sealed values.
+	ID uint32
+
+	// Secret is the 32 byte key secret.
+	Secret []byte
+}
+
+// Sealer is an XChaCha20-Poly1305 sealer.
+type Sealer struct {
+	id    uint32
+	aeads map[uint32]cipher.AEAD
+
+	// MaxAge is the maximum age of sealed values accepted by Decode. Values
+	// are not checked for expiration when 0.
+	MaxAge time.Duration
+}
+
+// New creates a sealer for the provided keys. Values are sealed with the
+// first key, and opened with any of the keys, allowing keys to be rotated by
+// prepending a new key and later removing the old key.
+func New(keys ...Key) (*Sealer, error) {
+	if len(keys) < 1 {
+		return nil, ErrNoKeys
+	}
+
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	for _, k := range keys {
+		if len(k.Secret) != chacha20poly1305.KeySize {
+			return nil, ErrInvalidKey
+		}
+		if _, ok := aeads[k.ID]; ok {
+			return nil, ErrDuplicateKey
+		}
+
+		aead, err := chacha20poly1305.NewX(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aeads[k.ID] = aead
+	}
+
+	return &Sealer{
+		id:     keys[0].ID,
+		aeads:  aeads,
+		MaxAge: DefaultMaxAge,
+	}, nil
+}
+
+// Encode satisfies the sessionmw.Sealer interface.
+func (s *Sealer) Encode(name string, value interface{}) (string, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	plain := make([]byte, tsLen+len(buf))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	copy(plain[tsLen:], buf)
+
+	out := make([]byte, headerLen+chacha20poly1305.NonceSizeX, headerLen+chacha20poly1305.NonceSizeX+len(plain)+chacha20poly1305.Overhead)
+	out[0] = version
+	binary.BigEndian.PutUint32(out[1:], s.id)
+	nonce := out[headerLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	out = s.aeads[s.id].Seal(out, nonce, plain, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Decode satisfies the sessionmw.Sealer interface.
+func (s *Sealer) Decode(name, value string, dst interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return ErrInvalidValue
+	}
+	if len(buf) < headerLen+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead+tsLen || buf[0] != version {
+		return ErrInvalidValue
+	}
+
+	aead, ok := s.aeads[binary.BigEndian.Uint32(buf[1:])]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	nonce := buf[headerLen : headerLen+chacha20poly1305.NonceSizeX]
+	plain, err := aead.Open(nil, nonce, buf[headerLen+chacha20poly1305.NonceSizeX:], []byte(name))
+	if err != nil {
+		return ErrInvalidValue
+	}
+
+	if s.MaxAge > 0 {
+		ts := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+		if time.Since(ts) > s.MaxAge {
+			return ErrExpired
+		}
+	}
+
+	return json.Unmarshal(plain[tsLen:], dst)
+}
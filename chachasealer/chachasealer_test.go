@@ -0,0 +1,137 @@
+package chachasealer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+// statically assert the Sealer satisfies the sessionmw.Sealer interface.
+var _ sessionmw.Sealer = (*Sealer)(nil)
+
+func key(id uint32, b byte) Key {
+	return Key{ID: id, Secret: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys, got: %v", err)
+	}
+	if _, err := New(Key{ID: 1, Secret: []byte("short")}); err != ErrInvalidKey {
+		t.Errorf("expected ErrInvalidKey, got: %v", err)
+	}
+	if _, err := New(key(1, 'a'), key(1, 'b')); err != ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, got: %v", err)
+	}
+}
+
+func TestSealer(t *testing.T) {
+	s, err := New(key(7, 'a'))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	v1, err := s.Encode("SESSID", map[string]string{"id": "foo"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	v2, err := s.Encode("SESSID", map[string]string{"id": "foo"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v1 == v2 {
+		t.Errorf("expected values sealed with different nonces")
+	}
+
+	// check header
+	buf, err := base64.RawURLEncoding.DecodeString(v1)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if buf[0] != version || binary.BigEndian.Uint32(buf[1:]) != 7 {
+		t.Errorf("expected version 1 and key id 7, got: %d, %d", buf[0], binary.BigEndian.Uint32(buf[1:]))
+	}
+
+	v := make(map[string]string)
+	if err := s.Decode("SESSID", v1, &v); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v["id"] != "foo" {
+		t.Errorf("expected id foo, got: %v", v)
+	}
+
+	// name is authenticated
+	if err := s.Decode("OTHER", v1, &v); err != ErrInvalidValue {
+		t.Errorf("expected ErrInvalidValue, got: %v", err)
+	}
+
+	// tampered
+	buf[len(buf)-1] ^= 1
+	if err := s.Decode("SESSID", base64.RawURLEncoding.EncodeToString(buf), &v); err != ErrInvalidValue {
+		t.Errorf("expected ErrInvalidValue, got: %v", err)
+	}
+
+	// malformed
+	for _, val := range []string{"", "!!!", "AQ"} {
+		if err := s.Decode("SESSID", val, &v); err != ErrInvalidValue {
+			t.Errorf("value %q expected ErrInvalidValue, got: %v", val, err)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, err := New(key(1, 'a'))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	val, err := old.Encode("SESSID", "foo")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// new key seals, old key still opens
+	s, err := New(key(2, 'b'), key(1, 'a'))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var v string
+	if err := s.Decode("SESSID", val, &v); err != nil || v != "foo" {
+		t.Errorf("expected foo, got: %q, %v", v, err)
+	}
+
+	// old key removed
+	val, err = s.Encode("SESSID", "bar")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := old.Decode("SESSID", val, &v); err != ErrUnknownKey {
+		t.Errorf("expected ErrUnknownKey, got: %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	s, err := New(key(1, 'a'))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	val, err := s.Encode("SESSID", "foo")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	s.MaxAge = 0
+	var v string
+	if err := s.Decode("SESSID", val, &v); err != nil {
+		t.Errorf("expected no error with 0 MaxAge, got: %v", err)
+	}
+
+	s.MaxAge = time.Nanosecond
+	time.Sleep(1100 * time.Millisecond)
+	if err := s.Decode("SESSID", val, &v); err != ErrExpired {
+		t.Errorf("expected ErrExpired, got: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+// Package chimw provides the sessionmw session middleware for
+// github.com/go-chi/chi routers (and any router using the standard
+// func(http.Handler) http.Handler middleware signature).
+//
+// Handlers access the session using the request's context, ie:
+//
+//	sessionmw.Get(req.Context(), "name")
+package chimw
+
+import (
+	"net/http"
+
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"golang.org/x/net/context"
+)
+
+// contextKey is the context key type.
+type contextKey int
+
+// nextContextKey is the context key for the next handler.
+const nextContextKey contextKey = 0
+
+// New creates the session middleware for the configuration.
+func New(c sessionmw.Config) (func(http.Handler) http.Handler, error) {
+	mw, err := sessionmw.NewMiddleware(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session middleware is created once, and passed the next handler
+	// via the context
+	h := mw(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		next := ctxt.Value(nextContextKey).(http.Handler)
+		next.ServeHTTP(res, req.WithContext(ctxt))
+	}))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			h.ServeHTTPC(context.WithValue(req.Context(), nextContextKey, next), res, req)
+		})
+	}, nil
+}
+
+// Middleware creates the session middleware for the configuration, panicking
+// if the configuration is invalid.
+func Middleware(c sessionmw.Config) func(http.Handler) http.Handler {
+	mw, err := New(c)
+	if err != nil {
+		panic(err)
+	}
+	return mw
+}
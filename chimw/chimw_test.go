@@ -0,0 +1,75 @@
+package chimw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+)
+
+const cookieName = "SESSID"
+
+var conf = sessionmw.Config{
+	Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+	BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+	Name:        cookieName,
+}
+
+// serve serves a request for path with cookie c, returning the response
+// recorder.
+func serve(h http.Handler, path string, c *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// cookie returns the session cookie set on the response.
+func cookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
+	for _, c := range (&http.Response{Header: rr.Header()}).Cookies() {
+		if c.Name == cookieName {
+			return c
+		}
+	}
+	t.Fatalf("expected session cookie")
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	if _, err := New(sessionmw.Config{}); err == nil {
+		t.Errorf("expected error for invalid config")
+	}
+
+	c := conf
+	c.Store = kv.NewMemStore()
+
+	r := chi.NewRouter()
+	r.Use(Middleware(c))
+	r.Get("/set/{name}", func(res http.ResponseWriter, req *http.Request) {
+		sessionmw.Set(req.Context(), "name", chi.URLParam(req, "name"))
+		res.Write([]byte("ok"))
+	})
+	r.Get("/", func(res http.ResponseWriter, req *http.Request) {
+		name, _ := sessionmw.Get(req.Context(), "name")
+		s, _ := name.(string)
+		res.Write([]byte(s))
+	})
+
+	rr := serve(r, "/set/foo", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Fatalf("expected ok, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr = serve(r, "/", cookie(rr, t)); rr.Body.String() != "foo" {
+		t.Errorf("expected foo, got: %s", rr.Body.String())
+	}
+	if rr = serve(r, "/", nil); rr.Body.String() != "" {
+		t.Errorf("expected no name, got: %s", rr.Body.String())
+	}
+}
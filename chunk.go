@@ -0,0 +1,104 @@
+package sessionmw
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// DefaultCookieChunkSize is the default maximum length of the value of
+	// each cookie chunk, leaving room for the cookie attributes within the
+	// ~4KB per cookie limit of browsers.
+	DefaultCookieChunkSize = 3800
+)
+
+// ErrCookieTooLarge is the error returned when a cookie value cannot be split
+// into the maximum number of chunks.
+var ErrCookieTooLarge = errors.New("cookie too large")
+
+// chunkName returns the name of chunk i of the named cookie.
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+// SetChunkedCookie adds c to the response headers, splitting its value across
+// the cookies <name>.0, <name>.1, ... when it is longer than
+// DefaultCookieChunkSize, and expiring any chunks (or the unchunked cookie)
+// sent in req that are no longer used. Returns ErrCookieTooLarge when more
+// than maxChunks chunks would be needed.
+//
+// This allows large encoded values (such as sessions stored entirely in the
+// cookie) to be stored by browsers. Use ReadChunkedCookie to read the value.
+func SetChunkedCookie(res http.ResponseWriter, req *http.Request, c *http.Cookie, maxChunks int) error {
+	// split value
+	var chunks []string
+	for v := c.Value; len(v) > 0 || len(chunks) == 0; {
+		n := DefaultCookieChunkSize
+		if n > len(v) {
+			n = len(v)
+		}
+		chunks, v = append(chunks, v[:n]), v[n:]
+	}
+	if len(chunks) > maxChunks {
+		return ErrCookieTooLarge
+	}
+
+	expire := func(name string) {
+		if _, err := req.Cookie(name); err == nil {
+			e := *c
+			e.Name, e.Value, e.MaxAge = name, "-", -1
+			http.SetCookie(res, &e)
+		}
+	}
+
+	if len(chunks) == 1 {
+		http.SetCookie(res, c)
+	} else {
+		expire(c.Name)
+		for i, v := range chunks {
+			cc := *c
+			cc.Name, cc.Value = chunkName(c.Name, i), v
+			http.SetCookie(res, &cc)
+		}
+	}
+
+	// expire unused chunks
+	i := len(chunks)
+	if i == 1 {
+		i = 0
+	}
+	for ; ; i++ {
+		if _, err := req.Cookie(chunkName(c.Name, i)); err != nil {
+			break
+		}
+		expire(chunkName(c.Name, i))
+	}
+
+	return nil
+}
+
+// ReadChunkedCookie retrieves the value of the named cookie previously set
+// with SetChunkedCookie, reassembling the value from its chunks. Returns
+// http.ErrNoCookie when the cookie is not present, or its chunks exceed
+// maxChunks.
+func ReadChunkedCookie(req *http.Request, name string, maxChunks int) (string, error) {
+	if c, err := req.Cookie(name); err == nil {
+		return c.Value, nil
+	}
+
+	var v string
+	for i := 0; ; i++ {
+		c, err := req.Cookie(chunkName(name, i))
+		if err != nil {
+			if i == 0 {
+				return "", http.ErrNoCookie
+			}
+			return v, nil
+		}
+		if i == maxChunks {
+			return "", http.ErrNoCookie
+		}
+		v += c.Value
+	}
+}
@@ -0,0 +1,21 @@
+package sessionmw
+
+import "time"
+
+// Clock is the interface for time sources, allowing tests to simulate the
+// passing of time (ie, for session expiration) without sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// ClockFunc is a func that satisfies the Clock interface.
+type ClockFunc func() time.Time
+
+// Now satisfies the Clock interface.
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the Clock reporting the system time.
+var SystemClock Clock = ClockFunc(time.Now)
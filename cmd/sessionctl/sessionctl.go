@@ -0,0 +1,305 @@
+// Command sessionctl inspects and manages the sessions in a sessionmw store,
+// for operators debugging production issues.
+//
+// Usage:
+//
+//	sessionctl -store <url> [flags] <command> [args]
+//
+// The store url is one of:
+//
+//	redis://[:password@]host[:port][/db][?prefix=<prefix>][&hash=1]
+//	file:///path/to/dir
+//	sqlite:///path/to/sessions.db
+//	badger:///path/to/dir[?prefix=<prefix>]
+//
+// where prefix is the key prefix the application's store was created with,
+// and hash=1 selects a redisstore.HashStore.
+//
+// The flags are:
+//
+//	-ttl <duration>  expiration of written sessions (default 24h)
+//	-rate <n>        maximum sessions processed per second by dump, restore,
+//	                 and copy (default unlimited)
+//	-dry-run         count the sessions restore and copy would write
+//	-redact <keys>   comma separated patterns of the session keys redacted by
+//	                 get and dump (see sessionmw.Redact)
+//
+// The commands are:
+//
+//	get <id>       print the session as JSON
+//	del <id>       erase the session
+//	list           print the ids of all sessions
+//	purge-expired  delete all expired sessions
+//	dump           print all sessions as JSON, one per line
+//	restore        write the sessions of a dump read from stdin
+//	copy <url>     copy all sessions to the store at url
+//
+// Sessions are dumped and copied with the migrate package, preserving the
+// remaining lifetime of sessions where both stores support it (see
+// sessionmw.TTLStore). Otherwise, sessions expire ttl after they were
+// written, for stores that expire sessions on write.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/knq/sessionmw"
+	"github.com/knq/sessionmw/badgerstore"
+	"github.com/knq/sessionmw/filestore"
+	"github.com/knq/sessionmw/migrate"
+	"github.com/knq/sessionmw/redisstore"
+	"github.com/knq/sessionmw/sqlitestore"
+)
+
+// DefaultTTL is the default expiration of written sessions.
+const DefaultTTL = 24 * time.Hour
+
+// the usage message
+const usage = `usage: sessionctl -store <url> [flags] <command> [args]
+
+commands:
+  get <id>       print the session as JSON
+  del <id>       erase the session
+  list           print the ids of all sessions
+  purge-expired  delete all expired sessions
+  dump           print all sessions as JSON, one per line
+  restore        write the sessions of a dump read from stdin
+  copy <url>     copy all sessions to the store at url
+
+flags:
+`
+
+var (
+	// ErrUsage is the error returned when the command line is invalid.
+	ErrUsage = errors.New("invalid usage")
+
+	// ErrUnsupported is the error returned when the store does not support
+	// the command.
+	ErrUnsupported = errors.New("command not supported by store")
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if err != ErrUsage {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command line args.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("sessionctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	storeURL := fs.String("store", "", "store url")
+	ttl := fs.Duration("ttl", DefaultTTL, "expiration of written sessions")
+	var opts migrate.Options
+	fs.IntVar(&opts.Rate, "rate", 0, "maximum sessions processed per second")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "count the sessions restore and copy would write")
+	redact := fs.String("redact", "", "comma separated patterns of the session keys redacted by get and dump")
+	if err := fs.Parse(args); err != nil {
+		return ErrUsage
+	}
+
+	if *redact != "" {
+		opts.RedactKeys = strings.Split(*redact, ",")
+	}
+
+	args = fs.Args()
+	if *storeURL == "" || len(args) == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	cmd, n := args[0], 0
+	switch cmd {
+	case "get", "del", "copy":
+		n = 1
+	case "list", "purge-expired", "dump", "restore":
+	default:
+		fs.Usage()
+		return ErrUsage
+	}
+	if len(args)-1 != n {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	st, closeFn, err := openStore(*storeURL, *ttl)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	switch cmd {
+	case "get":
+		return get(st, args[1], opts.RedactKeys, stdout)
+	case "del":
+		return st.Erase(args[1])
+	case "list":
+		return list(st, stdout)
+	case "purge-expired":
+		return purgeExpired(st, stdout)
+	case "dump":
+		_, err = migrate.Export(st, stdout, opts)
+		return err
+	case "restore":
+		return report(stdout)(migrate.Import(stdin, st, opts))
+	}
+
+	dst, dstClose, err := openStore(args[1], *ttl)
+	if err != nil {
+		return err
+	}
+	defer dstClose()
+
+	return report(stdout)(migrate.Copy(st, dst, opts))
+}
+
+// report returns a func writing the migration stats to w.
+func report(w io.Writer) func(migrate.Stats, error) error {
+	return func(stats migrate.Stats, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "copied %d sessions (%d skipped)\n", stats.Copied, stats.Skipped)
+		return err
+	}
+}
+
+// openStore opens the store identified by the url, returning the store and a
+// func closing it.
+func openStore(rawurl string, ttl time.Duration) (sessionmw.Store, func(), error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := u.Query()
+
+	var st sessionmw.Store
+	closeFn := func() {
+		sessionmw.CloseStore(st)
+	}
+
+	switch u.Scheme {
+	case "redis":
+		du := *u
+		du.RawQuery = ""
+		conn, err := redis.DialURL(du.String())
+		if err != nil {
+			return nil, nil, err
+		}
+		if q.Get("hash") == "1" {
+			st = redisstore.NewHash(conn, q.Get("prefix"), ttl)
+		} else {
+			st = redisstore.New(conn, q.Get("prefix"), ttl)
+		}
+
+	case "file":
+		if st, err = filestore.New(u.Path, ttl, 0); err != nil {
+			return nil, nil, err
+		}
+
+	case "sqlite":
+		if st, err = sqlitestore.New(u.Path, ttl, 0); err != nil {
+			return nil, nil, err
+		}
+
+	case "badger":
+		db, err := badger.Open(badger.DefaultOptions(u.Path).WithLogger(nil))
+		if err != nil {
+			return nil, nil, err
+		}
+		st = badgerstore.New(db, q.Get("prefix"), ttl)
+		closeFn = func() {
+			sessionmw.CloseStore(st)
+			db.Close()
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported store url scheme %q", u.Scheme)
+	}
+
+	return st, closeFn, nil
+}
+
+// get writes the session with the provided id as JSON to w, redacting the
+// values of the keys matching the patterns.
+func get(st sessionmw.Store, id string, patterns []string, w io.Writer) error {
+	obj, err := st.Read(id)
+	if err != nil {
+		return err
+	}
+	if m, ok := obj.(map[string]interface{}); ok && len(patterns) > 0 {
+		obj = sessionmw.Redact(m, patterns)
+	}
+
+	buf, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", buf)
+	return err
+}
+
+// keys returns the sorted ids of all sessions in the store.
+func keys(st sessionmw.Store) ([]string, error) {
+	ks, ok := st.(sessionmw.KeysStore)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	ids, err := ks.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// list writes the ids of all sessions in the store to w.
+func list(st sessionmw.Store, w io.Writer) error {
+	ids, err := keys(st)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err = fmt.Fprintln(w, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeExpired deletes all expired sessions in the store, writing the number
+// of deleted sessions to w.
+func purgeExpired(st sessionmw.Store, w io.Writer) error {
+	gs, ok := st.(sessionmw.GCStore)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	n, err := gs.DeleteExpiredBefore(time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "deleted %d expired sessions\n", n)
+	return err
+}
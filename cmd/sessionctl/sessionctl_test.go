@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw/filestore"
+)
+
+// sessionctl runs the command line args, returning stdout.
+func sessionctl(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessionctl")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := filestore.New(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer fs.Close()
+	for _, id := range []string{"b", "a"} {
+		if err = fs.Write(id, map[string]interface{}{"name": id, "n": 1}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	store := "file://" + dir
+
+	out, err := sessionctl("", "-store", store, "list")
+	if err != nil || out != "a\nb\n" {
+		t.Errorf("expected a and b, got: %q (%v)", out, err)
+	}
+
+	out, err = sessionctl("", "-store", store, "get", "a")
+	if err != nil || !strings.Contains(out, `"name": "a"`) {
+		t.Errorf("expected session a, got: %q (%v)", out, err)
+	}
+
+	out, err = sessionctl("", "-store", store, "-redact", "nam*,other", "get", "a")
+	if err != nil || !strings.Contains(out, `"name": "[REDACTED]"`) || !strings.Contains(out, `"n": 1`) {
+		t.Errorf("expected redacted session a, got: %q (%v)", out, err)
+	}
+
+	dump, err := sessionctl("", "-store", store, "dump")
+	exp := `{"id":"a","data":{"n":1,"name":"a"}}` + "\n" + `{"id":"b","data":{"n":1,"name":"b"}}` + "\n"
+	if err != nil || dump != exp {
+		t.Errorf("expected %q, got: %q (%v)", exp, dump, err)
+	}
+
+	if _, err = sessionctl("", "-store", store, "del", "a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if out, err = sessionctl("", "-store", store, "list"); err != nil || out != "b\n" {
+		t.Errorf("expected b, got: %q (%v)", out, err)
+	}
+
+	// restore
+	if out, err = sessionctl(dump, "-store", store, "restore"); err != nil || out != "copied 2 sessions (0 skipped)\n" {
+		t.Fatalf("expected 2 copied sessions, got: %q (%v)", out, err)
+	}
+	obj, err := fs.Read("a")
+	if m, ok := obj.(map[string]interface{}); err != nil || !ok || m["name"] != "a" || m["n"] != int64(1) {
+		t.Errorf("expected restored session a, got: %v (%v)", obj, err)
+	}
+
+	// copy
+	dst := "sqlite://" + dir + "/sessions.db"
+	if out, err = sessionctl("", "-store", store, "copy", dst); err != nil || out != "copied 2 sessions (0 skipped)\n" {
+		t.Fatalf("expected 2 copied sessions, got: %q (%v)", out, err)
+	}
+	if out, err = sessionctl("", "-store", dst, "list"); err != nil || out != "a\nb\n" {
+		t.Errorf("expected a and b, got: %q (%v)", out, err)
+	}
+
+	// purge expired
+	out, err = sessionctl("", "-store", store, "-ttl", "1ns", "purge-expired")
+	if err != nil || out != "deleted 2 expired sessions\n" {
+		t.Errorf("expected 2 deleted sessions, got: %q (%v)", out, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for i, args := range [][]string{
+		{},
+		{"list"},
+		{"-store", "file:///tmp", "get"},
+		{"-store", "file:///tmp", "list", "a"},
+		{"-store", "file:///tmp", "unknown"},
+	} {
+		if _, err := sessionctl("", args...); err != ErrUsage {
+			t.Errorf("test %d expected ErrUsage, got: %v", i, err)
+		}
+	}
+
+	if _, err := sessionctl("", "-store", "memcache://localhost", "list"); err == nil {
+		t.Errorf("expected error for unsupported store")
+	}
+}
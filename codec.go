@@ -0,0 +1,144 @@
+package sessionmw
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+func init() {
+	gob.Register(map[string]interface{}{})
+}
+
+// Codec identifies the encoding of a stored session payload.
+type Codec byte
+
+// Codec values.
+const (
+	// CodecGob is the encoding/gob codec.
+	CodecGob Codec = 1
+
+	// CodecJSON is the JSON codec, readable by non-Go services.
+	CodecJSON Codec = 2
+)
+
+// PayloadVersion is the current version of the payload format.
+const PayloadVersion = 1
+
+// payloadMagic is the magic prefix of encoded payloads.
+const payloadMagic = "SMW"
+
+// payloadHeaderLen is the length of the payload header.
+const payloadHeaderLen = len(payloadMagic) + 2
+
+// payloadHeaders are the payload headers of the codecs.
+var payloadHeaders = map[Codec][]byte{
+	CodecGob:  []byte(payloadMagic + string([]byte{PayloadVersion, byte(CodecGob)})),
+	CodecJSON: []byte(payloadMagic + string([]byte{PayloadVersion, byte(CodecJSON)})),
+}
+
+// ErrUnknownCodec is the error returned when a payload uses an unknown codec
+// or format version.
+var ErrUnknownCodec = errors.New("unknown session payload codec")
+
+// EncodePayload encodes obj as a session payload using codec c.
+//
+// Session payloads written by the stores in this package's subpackages have
+// a stable, versioned format:
+//
+//	+-----+---------+-------+---------+
+//	| SMW | version | codec | payload |
+//	+-----+---------+-------+---------+
+//
+// where SMW is the 3 byte ASCII magic, version is a single byte (currently
+// 1), codec is a single byte Codec, and payload is the encoded session data.
+// For CodecJSON, the payload is the JSON encoded session, allowing non-Go
+// services sharing a store to read session data by skipping the 5 byte
+// header.
+func EncodePayload(c Codec, obj interface{}) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer putBuf(buf)
+	if err := WritePayload(buf, c, obj); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// WritePayload writes obj as a session payload using codec c to w (see
+// EncodePayload), allowing stores to encode payloads into reused buffers.
+func WritePayload(w io.Writer, c Codec, obj interface{}) error {
+	hdr, ok := payloadHeaders[c]
+	if !ok {
+		return ErrUnknownCodec
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	if c == CodecGob {
+		return gob.NewEncoder(w).Encode(&obj)
+	}
+	return json.NewEncoder(w).Encode(obj)
+}
+
+// maxPooledBuf is the maximum capacity of buffers returned to bufPool.
+const maxPooledBuf = 64 << 10
+
+// bufPool is the pool of payload encoding buffers.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// putBuf resets buf, returning it to bufPool unless it grew too large.
+func putBuf(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuf {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// DecodePayload decodes a session payload previously encoded with
+// EncodePayload. Payloads without a header are decoded as encoding/gob, for
+// compatibility with data written before the payload format was introduced.
+//
+// Malformed payloads (ie, truncated or corrupted) return an error, and never
+// panic.
+func DecodePayload(buf []byte) (obj interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			obj, err = nil, fmt.Errorf("session payload decode panic: %v", r)
+		}
+	}()
+
+	c := CodecGob
+	if len(buf) >= payloadHeaderLen && string(buf[:len(payloadMagic)]) == payloadMagic {
+		if buf[len(payloadMagic)] != PayloadVersion {
+			return nil, ErrUnknownCodec
+		}
+		c, buf = Codec(buf[len(payloadMagic)+1]), buf[payloadHeaderLen:]
+	}
+
+	switch c {
+	case CodecGob:
+		if err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&obj); err != nil {
+			return nil, err
+		}
+	case CodecJSON:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		if err = dec.Decode(&obj); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownCodec
+	}
+
+	return obj, nil
+}
@@ -0,0 +1,47 @@
+package sessionmw
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// ConsentCookie returns a func for use with Config.Consent, that determines
+// the client consented to cookies when the request has the named cookie with
+// value (or with any non-empty value, when value is empty).
+func ConsentCookie(name, value string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		c, err := req.Cookie(name)
+		return err == nil && c.Value != "" && (value == "" || c.Value == value)
+	}
+}
+
+// ConsentHeader returns a func for use with Config.Consent, that determines
+// the client consented to cookies when the request has the named header with
+// value (or with any non-empty value, when value is empty).
+func ConsentHeader(name, value string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		v := req.Header.Get(name)
+		return v != "" && (value == "" || v == value)
+	}
+}
+
+// IsEphemeral determines if the session is ephemeral, as the client has not
+// yet consented to cookies (see Config.Consent).
+func IsEphemeral(ctxt context.Context) bool {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return sess.ephemeral
+}
+
+// GrantConsent records that the client consented to cookies during the
+// request, so that the ephemeral session is saved and issued a cookie (ie,
+// from the handler that also sets the consent cookie). Withdrawing consent
+// should Destroy the session.
+func GrantConsent(ctxt context.Context) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	defer sess.Unlock()
+	sess.ephemeral = false
+}
@@ -0,0 +1,44 @@
+package sessionmw
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ClearCookie expires the session cookie on the client when the response
+// headers are written, without erasing the stored session (see Destroy). New
+// sessions with a cleared cookie are not saved.
+//
+// Handlers should use ClearCookie or Destroy to remove the session cookie,
+// as cookies with the session cookie name set directly by the handler are
+// removed from the response.
+func ClearCookie(ctxt context.Context) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	sess.cleared = true
+	sess.Unlock()
+}
+
+// removeSetCookie removes the Set-Cookie headers for the named cookie from h.
+func removeSetCookie(h http.Header, name string) {
+	vals := h["Set-Cookie"]
+	if len(vals) == 0 {
+		return
+	}
+
+	prefix := name + "="
+	kept := vals[:0]
+	for _, v := range vals {
+		if !strings.HasPrefix(strings.TrimSpace(v), prefix) {
+			kept = append(kept, v)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(h, "Set-Cookie")
+		return
+	}
+	h["Set-Cookie"] = kept
+}
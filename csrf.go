@@ -0,0 +1,146 @@
+package sessionmw
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"goji.io"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultCSRFField is the default form field containing the CSRF token.
+	DefaultCSRFField = "csrf_token"
+
+	// DefaultCSRFHeader is the default header containing the CSRF token.
+	DefaultCSRFHeader = "X-CSRF-Token"
+)
+
+// metaCSRFKey is the session metadata key holding the CSRF token.
+const metaCSRFKey = "csrf"
+
+// newToken generates a new random token (ie, a CSRF token, or an OAuth state
+// parameter).
+func newToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// CSRFToken retrieves the CSRF token for the session, generating one if the
+// session does not yet have a token.
+//
+// Generating a token modifies the session, so that a new session is saved
+// and issued a cookie, even when the response is an error or the visitor is
+// anonymous. CSRFToken should therefore only be called when rendering a page
+// or form that submits the token.
+func CSRFToken(ctxt context.Context) string {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	defer sess.Unlock()
+
+	m := sess.meta()
+	if tok, ok := m[metaCSRFKey].(string); ok && tok != "" {
+		return tok
+	}
+
+	tok := newToken()
+	m[metaCSRFKey] = tok
+	sess.modified = true
+	sess.dirty(metaKey)
+	return tok
+}
+
+// RotateCSRFToken replaces the CSRF token for the session, returning the new
+// token. The token should be rotated whenever the privilege level of the
+// session changes (such as on login). Regenerate discards the token, so that
+// a new token is generated on the next call to CSRFToken.
+func RotateCSRFToken(ctxt context.Context) string {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	defer sess.Unlock()
+
+	tok := newToken()
+	sess.meta()[metaCSRFKey] = tok
+	sess.modified = true
+	sess.dirty(metaKey)
+	return tok
+}
+
+// storedCSRFToken retrieves the CSRF token for the session, without
+// generating one.
+func storedCSRFToken(ctxt context.Context) string {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	m, _ := sess.data[metaKey].(map[string]interface{})
+	tok, _ := m[metaCSRFKey].(string)
+	return tok
+}
+
+// CSRF contains the configuration parameters for the CSRF middleware.
+//
+// The CSRF middleware must be used after the session middleware.
+type CSRF struct {
+	// Field is the form field containing the token. Defaults to
+	// DefaultCSRFField.
+	Field string
+
+	// Header is the header containing the token. Defaults to
+	// DefaultCSRFHeader.
+	Header string
+
+	// FailureHandler handles requests with a missing or mismatched token.
+	// Defaults to responding with 403 Forbidden.
+	FailureHandler goji.Handler
+}
+
+// Handler provides the goji.Handler for the CSRF middleware, validating the
+// session's CSRF token for requests with unsafe methods (ie, anything other
+// than GET, HEAD, OPTIONS, or TRACE). Requests for sessions without a token
+// fail, and do not generate one.
+func (c CSRF) Handler(h goji.Handler) goji.Handler {
+	field := c.Field
+	if field == "" {
+		field = DefaultCSRFField
+	}
+
+	header := c.Header
+	if header == "" {
+		header = DefaultCSRFHeader
+	}
+
+	fail := c.FailureHandler
+	if fail == nil {
+		fail = goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			http.Error(res, "forbidden", http.StatusForbidden)
+		})
+	}
+
+	return goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			h.ServeHTTPC(ctxt, res, req)
+			return
+		}
+
+		tok := req.Header.Get(header)
+		if tok == "" {
+			tok = req.PostFormValue(field)
+		}
+
+		exp := storedCSRFToken(ctxt)
+		if tok == "" || exp == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(exp)) != 1 {
+			fail.ServeHTTPC(ctxt, res, req)
+			return
+		}
+
+		h.ServeHTTPC(ctxt, res, req)
+	})
+}
@@ -0,0 +1,106 @@
+package sessionmw
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/securecookie"
+)
+
+// DefaultMaxCookieLength is the default maximum length of session cookie
+// values, matching the securecookie default.
+const DefaultMaxCookieLength = 4096
+
+// decodeCookie decodes the session cookie value, rejecting oversized values
+// before decoding, and recovering from decoding panics (ie, in a Sealer).
+func (s *Manager) decodeCookie(value string) (v map[string]string, err error) {
+	max := s.scMaxLength
+	if max == 0 {
+		max = DefaultMaxCookieLength
+	}
+	if len(value) > max {
+		return nil, ErrMalformedCookie
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("session cookie decode panic: %v", r)
+		}
+	}()
+
+	v = make(map[string]string)
+	if err = s.codec().Decode(s.name, value, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DecodePolicy is the policy for requests with a session cookie that could
+// not be decoded. Such cookies are always counted (see
+// Manager.DecodeFailures) and passed to Config.OnSuspiciousCookie, before
+// the policy is applied.
+type DecodePolicy int
+
+// DecodePolicy values.
+const (
+	// DecodeRotate serves the request with a new session.
+	DecodeRotate DecodePolicy = iota
+
+	// DecodeReject rejects the request, passing ErrMalformedCookie to
+	// Config.ErrorHandler (by default responding with 400 Bad Request), as
+	// repeated undecodable cookies usually indicate attack traffic. Cookies
+	// that could not be decoded because they expired are rotated.
+	DecodeReject
+)
+
+// expired determines if err is a cookie decoding error caused by an expired
+// cookie (ie, the securecookie expired timestamp error). The errors are not
+// exported, and are identified by their message.
+func expired(err error) bool {
+	return strings.Contains(err.Error(), "expired")
+}
+
+// suspicious counts the session cookie of req that failed decoding, and
+// passes it to the suspicious cookie func, if any, returning
+// ErrMalformedCookie when the request must be rejected.
+func (s *Manager) suspicious(req *http.Request, err error) error {
+	atomic.AddInt64(&s.decodeFailures, 1)
+	if s.onSuspiciousCookie != nil {
+		s.onSuspiciousCookie(req, err)
+	}
+	if s.decodePolicy == DecodeReject && !expired(err) {
+		return ErrMalformedCookie
+	}
+	return nil
+}
+
+// DecodeFailures returns the number of session cookies and stored sessions
+// that failed decoding, for exporting as a metric.
+func (s *Manager) DecodeFailures() int64 {
+	return atomic.LoadInt64(&s.decodeFailures)
+}
+
+// JSONSerializer is a securecookie serializer encoding cookie values as JSON
+// (as securecookie.JSONEncoder), which decode with far fewer allocations than
+// the default encoding/gob. Cookies previously issued with
+// securecookie.GobEncoder are still decoded, allowing existing deployments to
+// switch without invalidating sessions.
+//
+// Note that other readers of the session cookies (ie, gorillacompat) must
+// then use a JSON serializer.
+type JSONSerializer struct{}
+
+// Serialize satisfies the securecookie.Serializer interface.
+func (JSONSerializer) Serialize(src interface{}) ([]byte, error) {
+	return securecookie.JSONEncoder{}.Serialize(src)
+}
+
+// Deserialize satisfies the securecookie.Serializer interface.
+func (JSONSerializer) Deserialize(src []byte, dst interface{}) error {
+	if len(src) != 0 && src[0] == '{' {
+		return securecookie.JSONEncoder{}.Deserialize(src, dst)
+	}
+	return securecookie.GobEncoder{}.Deserialize(src, dst)
+}
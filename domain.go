@@ -0,0 +1,74 @@
+package sessionmw
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NormalizeDomain normalizes a cookie domain, lower casing it and removing
+// any surrounding whitespace and leading dot, returning the domain and
+// whether it is valid. The empty domain (ie, a host only cookie) is valid.
+//
+// Note that a domain cookie (ie, for example.com) is sent by browsers to the
+// domain and to all of its subdomains.
+func NormalizeDomain(domain string) (string, bool) {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return "", true
+	}
+	if net.ParseIP(domain) != nil {
+		return domain, !strings.Contains(domain, ":")
+	}
+	if len(domain) > 253 {
+		return "", false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", false
+			}
+		}
+	}
+	return domain, true
+}
+
+// MatchDomain returns a func for use with Config.DomainFn that scopes the
+// session cookie to the first of the provided domains that is, or is a parent
+// domain of, the request host (ie, "example.com" matches the "example.com"
+// and "app.example.com" hosts), so that sessions are shared across the
+// subdomains of each domain of a multi-domain site. Requests for other hosts
+// are issued host only cookies.
+func MatchDomain(domains ...string) func(*http.Request) string {
+	normalized := make([]string, len(domains))
+	for i, d := range domains {
+		normalized[i], _ = NormalizeDomain(d)
+	}
+	return func(req *http.Request) string {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		for _, d := range normalized {
+			if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+				return d
+			}
+		}
+		return ""
+	}
+}
+
+// cookieDomain returns the cookie domain for req.
+func (s *Manager) cookieDomain(req *http.Request) string {
+	if s.domainFn == nil {
+		return s.domain
+	}
+	if domain, ok := NormalizeDomain(s.domainFn(req)); ok {
+		return domain
+	}
+	return ""
+}
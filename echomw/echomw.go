@@ -0,0 +1,89 @@
+// Package echomw provides the sessionmw session middleware for
+// github.com/labstack/echo.
+//
+// Handlers access the session using the request's context (see Context),
+// ie:
+//
+//	sessionmw.Get(echomw.Context(c), "name")
+package echomw
+
+import (
+	"net/http"
+
+	"github.com/knq/sessionmw"
+	"github.com/labstack/echo/v4"
+	"goji.io"
+	"golang.org/x/net/context"
+)
+
+// contextKey is the context key type.
+type contextKey int
+
+// callContextKey is the context key for the echo call.
+const callContextKey contextKey = 0
+
+// call is an invocation of the next echo handler.
+type call struct {
+	c    echo.Context
+	next echo.HandlerFunc
+	err  error
+}
+
+// New creates the session middleware for the configuration.
+func New(conf sessionmw.Config) (echo.MiddlewareFunc, error) {
+	mw, err := sessionmw.NewMiddleware(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session middleware is created once, and passed the echo call via
+	// the context
+	h := mw(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		cl := ctxt.Value(callContextKey).(*call)
+
+		// route writes through the session middleware's response writer,
+		// so the session cookie is set before the headers are written
+		r := cl.c.Response()
+		w := r.Writer
+		r.Writer = res
+		defer func() {
+			r.Writer = w
+		}()
+
+		cl.c.SetRequest(req.WithContext(ctxt))
+		cl.err = cl.next(cl.c)
+
+		// handle errors while the response is being buffered, as the
+		// buffered response is written before the error would otherwise be
+		// handled by echo
+		if cl.err != nil && conf.BufferResponse {
+			cl.c.Error(cl.err)
+			cl.err = nil
+		}
+	}))
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cl := &call{c: c, next: next}
+			req := c.Request()
+			h.ServeHTTPC(context.WithValue(req.Context(), callContextKey, cl), c.Response().Writer, req)
+			return cl.err
+		}
+	}, nil
+}
+
+// Middleware creates the session middleware for the configuration, panicking
+// if the configuration is invalid.
+func Middleware(conf sessionmw.Config) echo.MiddlewareFunc {
+	mw, err := New(conf)
+	if err != nil {
+		panic(err)
+	}
+	return mw
+}
+
+// Context returns the context of the echo request, for use with the sessionmw
+// session funcs.
+func Context(c echo.Context) context.Context {
+	return c.Request().Context()
+}
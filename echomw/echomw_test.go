@@ -0,0 +1,82 @@
+package echomw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+	"github.com/labstack/echo/v4"
+)
+
+const cookieName = "SESSID"
+
+var conf = sessionmw.Config{
+	Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+	BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+	Name:        cookieName,
+}
+
+// serve serves a request for path with cookie c, returning the response
+// recorder.
+func serve(h http.Handler, path string, c *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// cookie returns the session cookie set on the response.
+func cookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
+	for _, c := range (&http.Response{Header: rr.Header()}).Cookies() {
+		if c.Name == cookieName {
+			return c
+		}
+	}
+	t.Fatalf("expected session cookie")
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	if _, err := New(sessionmw.Config{}); err == nil {
+		t.Errorf("expected error for invalid config")
+	}
+
+	for i, buffer := range []bool{false, true} {
+		c := conf
+		c.Store, c.BufferResponse = kv.NewMemStore(), buffer
+
+		e := echo.New()
+		e.Use(Middleware(c))
+		e.GET("/set/:name", func(c echo.Context) error {
+			sessionmw.Set(Context(c), "name", c.Param("name"))
+			return c.String(http.StatusOK, "ok")
+		})
+		e.GET("/", func(c echo.Context) error {
+			name, _ := sessionmw.Get(Context(c), "name")
+			s, _ := name.(string)
+			return c.String(http.StatusOK, s)
+		})
+		e.GET("/error", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusTeapot)
+		})
+
+		rr := serve(e, "/set/foo", nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+			t.Fatalf("test %d expected ok, got: %d %s", i, rr.Code, rr.Body.String())
+		}
+
+		if rr = serve(e, "/", cookie(rr, t)); rr.Body.String() != "foo" {
+			t.Errorf("test %d expected foo, got: %s", i, rr.Body.String())
+		}
+
+		// handler errors are returned to echo
+		if rr = serve(e, "/error", nil); rr.Code != http.StatusTeapot {
+			t.Errorf("test %d expected %d, got: %d", i, http.StatusTeapot, rr.Code)
+		}
+	}
+}
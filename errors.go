@@ -5,3 +5,87 @@ import "errors"
 // ErrSessionNotFound is the error returned by sessionmw.Store providers when a
 // session cannot be found.
 var ErrSessionNotFound = errors.New("session not found")
+
+// ErrNotCountable is the error returned by ActiveSessions when the store can
+// neither count nor list its sessions.
+var ErrNotCountable = errors.New("store cannot count sessions")
+
+// ErrHashedIDs is the error returned by stores when listing the sessions of a
+// store with hashed session ids (see KeyBuilder).
+var ErrHashedIDs = errors.New("session ids are hashed")
+
+// ErrTampered is the error returned by IntegrityStore when a stored session
+// fails integrity verification, ie, when it was modified or corrupted.
+var ErrTampered = errors.New("session failed integrity check")
+
+// ErrStoreUnavailable is the error kind of store errors caused by the store
+// being unavailable (ie, a network error), as opposed to the session not
+// being found.
+var ErrStoreUnavailable = errors.New("session store unavailable")
+
+// ErrDecodeFailed is the error kind of store errors caused by a stored
+// session that could not be decoded.
+var ErrDecodeFailed = errors.New("session could not be decoded")
+
+// ErrMalformedCookie is the error passed to Config.OnSuspiciousCookie for
+// session cookies that are oversized, or that decode to an invalid session
+// id.
+var ErrMalformedCookie = errors.New("malformed session cookie")
+
+// StoreError is a store error of a Kind (ie, ErrStoreUnavailable or
+// ErrDecodeFailed), wrapping the underlying error. StoreError satisfies
+// errors.Is for its Kind, and errors.As for the underlying error.
+type StoreError struct {
+	// Kind is the kind of error.
+	Kind error
+
+	// Err is the underlying error.
+	Err error
+}
+
+// NewStoreError creates a StoreError of kind wrapping err, returning nil when
+// err is nil.
+func NewStoreError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StoreError{Kind: kind, Err: err}
+}
+
+// Error satisfies the error interface.
+func (err *StoreError) Error() string {
+	return err.Kind.Error() + ": " + err.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (err *StoreError) Unwrap() error {
+	return err.Err
+}
+
+// Is determines if target is the kind of the error.
+func (err *StoreError) Is(target error) bool {
+	return target == err.Kind
+}
+
+// isError determines if err is, or wraps, target, following the Is and Unwrap
+// methods of errors the same as errors.Is.
+func isError(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		if e, ok := err.(interface {
+			Is(error) bool
+		}); ok && e.Is(target) {
+			return true
+		}
+		u, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Package etcdstore provides an etcd backed sessionmw.Store, using etcd
+// leases for session expiration.
+package etcdstore
+
+import (
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultTimeout is the default timeout for etcd requests.
+	DefaultTimeout = 5 * time.Second
+
+	// pingKey is the key read when pinging the cluster.
+	pingKey = "__sessionmw_ping__"
+)
+
+// EtcdStore is an etcd backed session store.
+type EtcdStore struct {
+	cli *clientv3.Client
+	ttl time.Duration
+
+	// Timeout is the timeout for each etcd request.
+	Timeout time.Duration
+
+	// Codec is the codec used to encode stored sessions. Use
+	// sessionmw.CodecJSON when non-Go services need to read sessions.
+	Codec sessionmw.Codec
+
+	// KeyBuilder builds the keys of sessions. New sets its Prefix to the
+	// provided prefix.
+	KeyBuilder sessionmw.KeyBuilder
+}
+
+// New creates an etcd store using the provided client, storing sessions under
+// prefix.
+//
+// Sessions are attached to a lease expiring ttl after they were last written.
+func New(cli *clientv3.Client, prefix string, ttl time.Duration) *EtcdStore {
+	return &EtcdStore{
+		cli:        cli,
+		ttl:        ttl,
+		Timeout:    DefaultTimeout,
+		Codec:      sessionmw.CodecGob,
+		KeyBuilder: sessionmw.KeyBuilder{Prefix: prefix},
+	}
+}
+
+// newContext returns a context for a single etcd request.
+func (es *EtcdStore) newContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), es.Timeout)
+}
+
+// Write saves the session for the provided id.
+//
+// The lease of an existing session is refreshed and reused, so that only a
+// single lease is live per session.
+func (es *EtcdStore) Write(key string, obj interface{}) error {
+	buf, err := sessionmw.EncodePayload(es.Codec, obj)
+	if err != nil {
+		return err
+	}
+
+	ctxt, cancel := es.newContext()
+	defer cancel()
+
+	// refresh existing lease
+	res, err := es.cli.Get(ctxt, es.KeyBuilder.Key(key), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	if len(res.Kvs) != 0 && res.Kvs[0].Lease != 0 {
+		id := clientv3.LeaseID(res.Kvs[0].Lease)
+		if _, err = es.cli.KeepAliveOnce(ctxt, id); err == nil {
+			_, err = es.cli.Put(ctxt, es.KeyBuilder.Key(key), string(buf), clientv3.WithLease(id))
+			return err
+		}
+
+		// lease is expiring or gone, so replace it
+		es.cli.Revoke(ctxt, id)
+	}
+
+	// etcd leases have a minimum granularity of one second
+	secs := int64(es.ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	lease, err := es.cli.Grant(ctxt, secs)
+	if err != nil {
+		return err
+	}
+
+	if _, err = es.cli.Put(ctxt, es.KeyBuilder.Key(key), string(buf), clientv3.WithLease(lease.ID)); err != nil {
+		es.cli.Revoke(ctxt, lease.ID)
+		return err
+	}
+
+	return nil
+}
+
+// Read retrieves the session for the provided id.
+func (es *EtcdStore) Read(key string) (interface{}, error) {
+	ctxt, cancel := es.newContext()
+	defer cancel()
+
+	res, err := es.cli.Get(ctxt, es.KeyBuilder.Key(key))
+	if err != nil {
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, err)
+	}
+	if len(res.Kvs) == 0 {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	obj, err := sessionmw.DecodePayload(res.Kvs[0].Value)
+	return obj, sessionmw.NewStoreError(sessionmw.ErrDecodeFailed, err)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (es *EtcdStore) Erase(key string) error {
+	ctxt, cancel := es.newContext()
+	defer cancel()
+
+	_, err := es.cli.Delete(ctxt, es.KeyBuilder.Key(key))
+	return err
+}
+
+// Ping checks the health of the etcd cluster with a linearizable read of a
+// single key. Satisfies the sessionmw.Pinger interface.
+func (es *EtcdStore) Ping(ctxt context.Context) error {
+	ctxt, cancel := context.WithTimeout(ctxt, es.Timeout)
+	defer cancel()
+
+	_, err := es.cli.Get(ctxt, es.KeyBuilder.Key(pingKey), clientv3.WithCountOnly())
+	return err
+}
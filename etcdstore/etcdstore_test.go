@@ -0,0 +1,96 @@
+package etcdstore
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/knq/sessionmw"
+)
+
+// newStore creates a store connected to the etcd servers listed in the
+// ETCD_ENDPOINTS environment variable, skipping the test when not set.
+func newStore(ttl time.Duration, t *testing.T) *EtcdStore {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS not set")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: DefaultTimeout,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	return New(cli, "sessionmw_test/"+t.Name()+"/", ttl)
+}
+
+func TestStore(t *testing.T) {
+	es := newStore(time.Minute, t)
+	defer es.cli.Close()
+
+	if _, err := es.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	for _, name := range []string{"foo", "bar"} {
+		if err := es.Write("a", map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		obj, err := es.Read("a")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if m, ok := obj.(map[string]interface{}); !ok || m["name"] != name {
+			t.Errorf("expected name=%s, got: %v", name, obj)
+		}
+	}
+
+	// lease reused
+	ctxt, cancel := es.newContext()
+	defer cancel()
+	leases, err := es.cli.Leases(ctxt)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res, err := es.cli.Get(ctxt, es.KeyBuilder.Key("a"))
+	if err != nil || len(res.Kvs) != 1 || res.Kvs[0].Lease == 0 {
+		t.Fatalf("expected key with lease, got: %v (%v)", res, err)
+	}
+	n := 0
+	for _, l := range leases.Leases {
+		if int64(l.ID) == res.Kvs[0].Lease {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected session lease to be live")
+	}
+
+	if err = es.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = es.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	es := newStore(time.Second, t)
+	defer es.cli.Close()
+
+	if err := es.Write("a", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	time.Sleep(3 * time.Second)
+	if _, err := es.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+// Package expresscompat provides interop with Node.js services using
+// express-session (or koa-session) and connect-redis, allowing a Go service to
+// share sessions issued by a Node.js front end using the same Redis.
+//
+// Signer is a sessionmw.Sealer producing and verifying express-session style
+// "s:<id>.<signature>" cookies, where the signature is the unpadded base64
+// HMAC-SHA256 of the id (as produced by the cookie-signature package). Store
+// is a sessionmw.Store reading and writing sessions in connect-redis's JSON
+// format.
+//
+// As the session ids issued by express-session are not in the format of the
+// default sessionmw ids, the middleware's Config.IDValidator must be set to
+// sessionmw.ValidID (or a validator accepting express-session's ids).
+package expresscompat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+	"github.com/knq/sessionmw/redisstore"
+)
+
+const (
+	// DefaultPrefix is the default connect-redis key prefix.
+	DefaultPrefix = "sess:"
+
+	// signedPrefix is the prefix of express-session signed cookie values.
+	signedPrefix = "s:"
+
+	// cookieKey is the session key express-session uses to store the session
+	// cookie settings.
+	cookieKey = "cookie"
+)
+
+var (
+	// ErrNoSecrets is the error returned when no secrets are provided.
+	ErrNoSecrets = errors.New("no secrets provided")
+
+	// ErrInvalidSignature is the error returned when a cookie value is not
+	// signed, or its signature does not match any of the secrets.
+	ErrInvalidSignature = errors.New("invalid cookie signature")
+
+	// ErrUnsupportedValue is the error returned when encoding or decoding a
+	// cookie value of an unsupported type.
+	ErrUnsupportedValue = errors.New("unsupported cookie value")
+)
+
+// Signer signs and verifies express-session style cookies.
+type Signer struct {
+	secrets [][]byte
+}
+
+// NewSigner creates a signer for the provided secrets, which should be the
+// same as express-session's secret option. Cookies are signed with the first
+// secret, and verified with any of the secrets.
+func NewSigner(secrets ...[]byte) (*Signer, error) {
+	if len(secrets) < 1 {
+		return nil, ErrNoSecrets
+	}
+	for _, secret := range secrets {
+		if len(secret) < 1 {
+			return nil, ErrNoSecrets
+		}
+	}
+
+	return &Signer{secrets: secrets}, nil
+}
+
+// signature returns the cookie-signature signature of id using secret.
+func signature(secret []byte, id string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(id))
+	return strings.TrimRight(base64.StdEncoding.EncodeToString(h.Sum(nil)), "=")
+}
+
+// Sign returns the signed, unescaped cookie value for id.
+func (s *Signer) Sign(id string) string {
+	return signedPrefix + id + "." + signature(s.secrets[0], id)
+}
+
+// Unsign verifies the signed, unescaped cookie value v, returning the session
+// id.
+func (s *Signer) Unsign(v string) (string, error) {
+	if !strings.HasPrefix(v, signedPrefix) {
+		return "", ErrInvalidSignature
+	}
+	v = v[len(signedPrefix):]
+
+	i := strings.LastIndex(v, ".")
+	if i < 0 {
+		return "", ErrInvalidSignature
+	}
+
+	id, sig := v[:i], v[i+1:]
+	for _, secret := range s.secrets {
+		if hmac.Equal([]byte(sig), []byte(signature(secret, id))) {
+			return id, nil
+		}
+	}
+
+	return "", ErrInvalidSignature
+}
+
+// Encode satisfies the sessionmw.Sealer interface, encoding the "id" of the
+// cookie value (as provided by the session middleware) as a signed and URL
+// escaped cookie value, as written by express-session.
+func (s *Signer) Encode(name string, value interface{}) (string, error) {
+	v, ok := value.(map[string]string)
+	if !ok || v["id"] == "" {
+		return "", ErrUnsupportedValue
+	}
+
+	return url.QueryEscape(s.Sign(v["id"])), nil
+}
+
+// Decode satisfies the sessionmw.Sealer interface, decoding the session id of
+// the express-session cookie value into the "id" of dst, which must be a
+// *map[string]string.
+func (s *Signer) Decode(name, value string, dst interface{}) error {
+	m, ok := dst.(*map[string]string)
+	if !ok {
+		return ErrUnsupportedValue
+	}
+
+	// unescape as decodeURIComponent, which does not decode '+' as a space
+	v, err := url.QueryUnescape(strings.Replace(value, "+", "%2B", -1))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	id, err := s.Unsign(v)
+	if err != nil {
+		return err
+	}
+
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)["id"] = id
+	return nil
+}
+
+// EncodeSession encodes obj in connect-redis's JSON session format, expiring
+// after ttl.
+//
+// express-session requires sessions to have a "cookie" value. The "cookie"
+// value of obj is preserved when present, with its expiration updated to
+// ttl from now, otherwise a default cookie value is added.
+func EncodeSession(obj interface{}, ttl time.Duration) ([]byte, error) {
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return json.Marshal(obj)
+	}
+
+	cookie := make(map[string]interface{})
+	if c, ok := data[cookieKey].(map[string]interface{}); ok {
+		for k, v := range c {
+			cookie[k] = v
+		}
+	} else {
+		cookie["originalMaxAge"] = int64(ttl / time.Millisecond)
+		cookie["httpOnly"] = true
+		cookie["path"] = "/"
+	}
+	cookie["expires"] = time.Now().Add(ttl).UTC().Format("2006-01-02T15:04:05.000Z")
+
+	m := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		m[k] = v
+	}
+	m[cookieKey] = cookie
+
+	return json.Marshal(m)
+}
+
+// DecodeSession decodes a session in connect-redis's JSON session format.
+// Numbers are decoded as json.Number.
+func DecodeSession(buf []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Store is a connect-redis compatible session store.
+//
+// Sessions are stored as JSON (see EncodeSession) under the key prefix,
+// which should be the same as the connect-redis prefix option.
+type Store struct {
+	conn   redisstore.Conn
+	prefix string
+	ttl    time.Duration
+}
+
+// NewStore creates a connect-redis compatible store using conn, storing
+// sessions under prefix. If prefix is empty, then DefaultPrefix will be used.
+//
+// Sessions expire ttl after they were last written.
+func NewStore(conn redisstore.Conn, prefix string, ttl time.Duration) *Store {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	return &Store{
+		conn:   conn,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Write saves the session for the provided id.
+func (s *Store) Write(key string, obj interface{}) error {
+	buf, err := EncodeSession(obj, s.ttl)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.Do("SET", s.prefix+key, buf, "PX", int64(s.ttl/time.Millisecond))
+	return err
+}
+
+// Read retrieves the session for the provided id.
+func (s *Store) Read(key string) (interface{}, error) {
+	v, err := s.conn.Do("GET", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	buf, ok := v.([]byte)
+	if !ok {
+		return nil, redisstore.ErrUnexpectedReply
+	}
+
+	return DecodeSession(buf)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (s *Store) Erase(key string) error {
+	_, err := s.conn.Do("DEL", s.prefix+key)
+	return err
+}
+
+// Close closes the underlying connection, if it is an io.Closer.
+func (s *Store) Close() error {
+	if c, ok := s.conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Ping checks the health of the Redis server with PING. Satisfies the
+// sessionmw.Pinger interface.
+func (s *Store) Ping(ctxt context.Context) error {
+	_, err := s.conn.Do("PING")
+	return err
+}
@@ -0,0 +1,217 @@
+package expresscompat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// statically assert the Signer satisfies the sessionmw.Sealer interface, and
+// the Store satisfies the sessionmw.Store interface.
+var (
+	_ sessionmw.Sealer = (*Signer)(nil)
+	_ sessionmw.Store  = (*Store)(nil)
+)
+
+type fakeConn struct {
+	sync.Mutex
+	closed  bool
+	strings map[string][]byte
+	ttls    map[string]int64
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		strings: make(map[string][]byte),
+		ttls:    make(map[string]int64),
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch cmd {
+	case "SET":
+		c.strings[args[0].(string)] = args[1].([]byte)
+		c.ttls[args[0].(string)] = args[3].(int64)
+		return "OK", nil
+
+	case "GET":
+		if buf, ok := c.strings[args[0].(string)]; ok {
+			return buf, nil
+		}
+		return nil, nil
+
+	case "DEL":
+		delete(c.strings, args[0].(string))
+		return int64(1), nil
+	}
+
+	return nil, redisErr(cmd)
+}
+
+type redisErr string
+
+func (e redisErr) Error() string {
+	return "unknown command " + string(e)
+}
+
+func TestSigner(t *testing.T) {
+	if _, err := NewSigner(); err != ErrNoSecrets {
+		t.Errorf("expected ErrNoSecrets, got: %v", err)
+	}
+
+	s, err := NewSigner([]byte("tobiiscool"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// cookie-signature reference value
+	v := s.Sign("hello")
+	if v != "s:hello.DGDUkGlIkCzPz+C0B064FNgHdEjox7ch8tOBGslZ5QI" {
+		t.Errorf("expected signed value, got: %s", v)
+	}
+
+	id, err := s.Unsign(v)
+	if err != nil || id != "hello" {
+		t.Errorf("expected hello, got: %q %v", id, err)
+	}
+
+	for _, val := range []string{"hello", "s:hello", "s:hello.bad", "s:hellp.DGDUkGlIkCzPz+C0B064FNgHdEjox7ch8tOBGslZ5QI"} {
+		if _, err := s.Unsign(val); err != ErrInvalidSignature {
+			t.Errorf("value %q expected ErrInvalidSignature, got: %v", val, err)
+		}
+	}
+
+	// rotated secrets
+	r, err := NewSigner([]byte("new secret"), []byte("tobiiscool"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if id, err := r.Unsign(v); err != nil || id != "hello" {
+		t.Errorf("expected hello, got: %q %v", id, err)
+	}
+	if _, err := s.Unsign(r.Sign("hello")); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature, got: %v", err)
+	}
+
+	// escaped cookie value
+	enc, err := s.Encode("connect.sid", map[string]string{"id": "hello"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if enc != "s%3Ahello.DGDUkGlIkCzPz%2BC0B064FNgHdEjox7ch8tOBGslZ5QI" {
+		t.Errorf("expected escaped value, got: %s", enc)
+	}
+	m := make(map[string]string)
+	if err := s.Decode("connect.sid", enc, &m); err != nil || m["id"] != "hello" {
+		t.Errorf("expected hello, got: %v %v", m, err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	conn := newFakeConn()
+	st := NewStore(conn, "", time.Hour)
+
+	if _, err := st.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	// session written by express-session
+	conn.strings["sess:a"] = []byte(`{"cookie":{"originalMaxAge":60000,"expires":"2016-01-01T00:00:00.000Z","httpOnly":true,"path":"/"},"views":3}`)
+
+	obj, err := st.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := obj.(map[string]interface{})
+	if m["views"] != json.Number("3") {
+		t.Errorf("expected views 3, got: %v", m["views"])
+	}
+
+	m["name"] = "foo"
+	if err := st.Write("a", m); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if conn.ttls["sess:a"] != int64(time.Hour/time.Millisecond) {
+		t.Errorf("expected ttl of 1h, got: %d", conn.ttls["sess:a"])
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(conn.strings["sess:a"], &v); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cookie := v["cookie"].(map[string]interface{})
+	if v["name"] != "foo" || cookie["originalMaxAge"] != float64(60000) || cookie["expires"] == "2016-01-01T00:00:00.000Z" {
+		t.Errorf("expected cookie preserved with updated expiration, got: %v", v)
+	}
+
+	// new sessions get a cookie
+	if err := st.Write("b", map[string]interface{}{"name": "bar"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	v = nil
+	if err := json.Unmarshal(conn.strings["sess:b"], &v); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cookie, ok := v["cookie"].(map[string]interface{}); !ok || cookie["path"] != "/" {
+		t.Errorf("expected default cookie, got: %v", v)
+	}
+
+	if err := st.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := st.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := st.Close(); err != nil || !conn.closed {
+		t.Errorf("expected conn closed, got: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	signer, err := NewSigner([]byte("keyboard cat"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	conn := newFakeConn()
+	conn.strings["sess:nodeid"] = []byte(`{"cookie":{"path":"/"},"name":"node"}`)
+
+	mux := goji.NewMux()
+	mux.UseC((&sessionmw.Config{
+		Sealer:      signer,
+		Store:       NewStore(conn, "", time.Hour),
+		Name:        "connect.sid",
+		IDValidator: sessionmw.ValidID,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		name, _ := sessionmw.Get(ctxt, "name")
+		res.Write([]byte(sessionmw.ID(ctxt) + " " + name.(string)))
+	})
+
+	// session issued by the Node.js front end
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "connect.sid", Value: "s%3Anodeid." + signature([]byte("keyboard cat"), "nodeid")})
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "nodeid node" {
+		t.Errorf("expected node session, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,273 @@
+// Package failoverstore provides a replicated sessionmw.Store that writes to
+// a primary and secondary store, falling back to the secondary when the
+// primary fails.
+package failoverstore
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// probeKey is the key read when probing the primary store.
+const probeKey = "__sessionmw_probe__"
+
+// ProbeFn is a store health check func.
+type ProbeFn func(sessionmw.Store) error
+
+// DefaultProbe checks a store's health by writing, reading, and erasing a
+// probe key.
+func DefaultProbe(st sessionmw.Store) error {
+	if err := st.Write(probeKey, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if _, err := st.Read(probeKey); err != nil {
+		return err
+	}
+	return st.Erase(probeKey)
+}
+
+// FailoverStore is a replicated session store.
+//
+// Sessions are written to both the primary and secondary stores, and read
+// from the primary, falling back to the secondary when the primary read
+// fails. When a write to the primary fails, the store fails over to the
+// secondary until a probe of the primary succeeds (see StartProbe).
+//
+// The sessions written or erased while failed over are replayed to the
+// primary before failing back, so that the primary does not serve stale
+// sessions, nor sessions destroyed during the outage.
+//
+// As stores do not consistently distinguish missing sessions from other
+// errors, failed reads do not trigger a fail over.
+type FailoverStore struct {
+	primary   sessionmw.Store
+	secondary sessionmw.Store
+	async     bool
+
+	mu     sync.RWMutex
+	failed bool
+
+	// pending are the keys written (false) or erased (true) while failed
+	// over, to replay to the primary before failing back.
+	pmu     sync.Mutex
+	pending map[string]bool
+
+	// OnStateChange is called when the store fails over to the secondary
+	// (failed is true), or fails back to the primary (failed is false).
+	OnStateChange func(failed bool)
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a failover store. If async is true, then writes to the
+// secondary store are made in the background while the primary is healthy.
+func New(primary, secondary sessionmw.Store, async bool) *FailoverStore {
+	return &FailoverStore{
+		primary:   primary,
+		secondary: secondary,
+		async:     async,
+		pending:   make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// Failed determines if the store has failed over to the secondary.
+func (fs *FailoverStore) Failed() bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.failed
+}
+
+// setFailed sets the failed state, calling OnStateChange when changed.
+func (fs *FailoverStore) setFailed(failed bool) {
+	fs.mu.Lock()
+	changed := fs.failed != failed
+	fs.failed = failed
+	fs.mu.Unlock()
+
+	if changed && fs.OnStateChange != nil {
+		fs.OnStateChange(failed)
+	}
+}
+
+// addPending records key as written or erased while failed over.
+func (fs *FailoverStore) addPending(key string, erased bool) {
+	fs.pmu.Lock()
+	defer fs.pmu.Unlock()
+	fs.pending[key] = erased
+}
+
+// failedOver runs f while failed over, recording key as pending, returning
+// false when not failed over. Replays are excluded while f runs.
+func (fs *FailoverStore) failedOver(key string, erased bool, f func() error) (bool, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if !fs.failed {
+		return false, nil
+	}
+	err := f()
+	fs.addPending(key, erased)
+	return true, err
+}
+
+// Write saves the session for the provided id to both stores.
+func (fs *FailoverStore) Write(key string, obj interface{}) error {
+	write := func() error {
+		return fs.secondary.Write(key, obj)
+	}
+	if ok, err := fs.failedOver(key, false, write); ok {
+		return err
+	}
+
+	if err := fs.primary.Write(key, obj); err != nil {
+		fs.setFailed(true)
+		if ok, err := fs.failedOver(key, false, write); ok {
+			return err
+		}
+		return fs.Write(key, obj)
+	}
+
+	if fs.async {
+		go fs.secondary.Write(key, obj)
+		return nil
+	}
+
+	fs.secondary.Write(key, obj)
+	return nil
+}
+
+// Read retrieves the session for the provided id from the primary store,
+// falling back to the secondary store if the primary read fails or the
+// primary has failed.
+func (fs *FailoverStore) Read(key string) (interface{}, error) {
+	if !fs.Failed() {
+		if obj, err := fs.primary.Read(key); err == nil {
+			return obj, nil
+		}
+	}
+
+	return fs.secondary.Read(key)
+}
+
+// Erase permanently destroys the session with the provided id in both
+// stores.
+func (fs *FailoverStore) Erase(key string) error {
+	erase := func() error {
+		return fs.secondary.Erase(key)
+	}
+	if ok, err := fs.failedOver(key, true, erase); ok {
+		return err
+	}
+
+	serr := fs.secondary.Erase(key)
+	if err := fs.primary.Erase(key); err != nil {
+		fs.setFailed(true)
+		fs.addPending(key, true)
+		return serr
+	}
+
+	return nil
+}
+
+// Probe checks the health of the primary store using probe (or DefaultProbe
+// if nil), failing back to the primary when healthy, after replaying the
+// sessions written or erased while failed over.
+func (fs *FailoverStore) Probe(probe ProbeFn) error {
+	if probe == nil {
+		probe = DefaultProbe
+	}
+
+	if err := probe(fs.primary); err != nil {
+		fs.setFailed(true)
+		return err
+	}
+
+	fs.mu.Lock()
+	err := fs.replay()
+	changed := fs.failed != (err != nil)
+	fs.failed = err != nil
+	fs.mu.Unlock()
+
+	if changed && fs.OnStateChange != nil {
+		fs.OnStateChange(err != nil)
+	}
+	return err
+}
+
+// replay replays the pending sessions to the primary store, copying the
+// sessions written to the secondary, and erasing the erased sessions. The
+// sessions that could not be replayed remain pending. The state mutex must
+// be held.
+func (fs *FailoverStore) replay() error {
+	fs.pmu.Lock()
+	defer fs.pmu.Unlock()
+
+	for key, erased := range fs.pending {
+		var err error
+		if erased {
+			err = fs.primary.Erase(key)
+		} else {
+			var obj interface{}
+			if obj, err = fs.secondary.Read(key); err == nil {
+				err = fs.primary.Write(key, obj)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		delete(fs.pending, key)
+	}
+	return nil
+}
+
+// StartProbe starts a goroutine probing the primary store every interval
+// until the store is closed.
+func (fs *FailoverStore) StartProbe(interval time.Duration, probe ProbeFn) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				fs.Probe(probe)
+			case <-fs.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops probing, and closes the primary and secondary stores.
+// Subsequent calls to Close have no effect.
+func (fs *FailoverStore) Close() error {
+	var err error
+	fs.closeOnce.Do(func() {
+		close(fs.done)
+		err = sessionmw.CloseStore(fs.primary)
+		if e := sessionmw.CloseStore(fs.secondary); err == nil {
+			err = e
+		}
+	})
+	return err
+}
+
+// Ping checks the health of the primary and secondary stores, succeeding
+// when either is healthy, as sessions are then still served. Satisfies the
+// sessionmw.Pinger interface.
+func (fs *FailoverStore) Ping(ctxt context.Context) error {
+	err := sessionmw.PingStore(ctxt, fs.primary)
+	if err == nil {
+		return nil
+	}
+	if sessionmw.PingStore(ctxt, fs.secondary) == nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package failoverstore
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/kv"
+)
+
+// flakyStore fails all operations when down.
+type flakyStore struct {
+	*kv.MemStore
+	down bool
+}
+
+var errDown = errors.New("down")
+
+func (fs *flakyStore) Write(key string, obj interface{}) error {
+	if fs.down {
+		return errDown
+	}
+	return fs.MemStore.Write(key, obj)
+}
+
+func (fs *flakyStore) Read(key string) (interface{}, error) {
+	if fs.down {
+		return nil, errDown
+	}
+	return fs.MemStore.Read(key)
+}
+
+func (fs *flakyStore) Erase(key string) error {
+	if fs.down {
+		return errDown
+	}
+	return fs.MemStore.Erase(key)
+}
+
+func (fs *flakyStore) Ping(ctxt context.Context) error {
+	if fs.down {
+		return errDown
+	}
+	return nil
+}
+
+func TestFailover(t *testing.T) {
+	primary, secondary := &flakyStore{MemStore: kv.NewMemStore()}, kv.NewMemStore()
+	fs := New(primary, secondary, false)
+
+	var changes []bool
+	fs.OnStateChange = func(failed bool) {
+		changes = append(changes, failed)
+	}
+
+	if err := fs.Write("a", "foo"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if primary.Data["a"] != "foo" || secondary.Data["a"] != "foo" {
+		t.Errorf("expected write to both stores")
+	}
+
+	// fall back on read
+	primary.down = true
+	if v, err := fs.Read("a"); err != nil || v != "foo" {
+		t.Errorf("expected foo from secondary, got: %v (%v)", v, err)
+	}
+
+	// fail over on write
+	if err := fs.Write("b", "bar"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if !fs.Failed() {
+		t.Errorf("expected failed over")
+	}
+	if v, err := fs.Read("b"); err != nil || v != "bar" {
+		t.Errorf("expected bar from secondary, got: %v (%v)", v, err)
+	}
+
+	// probe keeps failed state while down
+	if err := fs.Probe(nil); err == nil || !fs.Failed() {
+		t.Errorf("expected probe error while down")
+	}
+
+	// fail back
+	primary.down = false
+	if err := fs.Probe(nil); err != nil || fs.Failed() {
+		t.Errorf("expected fail back, got: %v", err)
+	}
+
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("expected state changes [true false], got: %v", changes)
+	}
+}
+
+func TestFailBack(t *testing.T) {
+	primary, secondary := &flakyStore{MemStore: kv.NewMemStore()}, kv.NewMemStore()
+	fs := New(primary, secondary, false)
+
+	for _, key := range []string{"a", "b"} {
+		if err := fs.Write(key, "foo"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	// update and destroy sessions during the outage
+	primary.down = true
+	if err := fs.Write("a", "bar"); err != nil || !fs.Failed() {
+		t.Fatalf("expected fail over, got: %v", err)
+	}
+	if err := fs.Erase("b"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// replayed before failing back
+	primary.down = false
+	if err := fs.Probe(nil); err != nil || fs.Failed() {
+		t.Fatalf("expected fail back, got: %v", err)
+	}
+	if v, err := fs.Read("a"); err != nil || v != "bar" {
+		t.Errorf("expected bar from primary, got: %v (%v)", v, err)
+	}
+	if _, ok := primary.Data["b"]; ok {
+		t.Errorf("expected destroyed session to be erased from the primary")
+	}
+	if _, err := fs.Read("b"); err == nil {
+		t.Errorf("expected destroyed session to not be found")
+	}
+}
+
+func TestPing(t *testing.T) {
+	primary, secondary := &flakyStore{MemStore: kv.NewMemStore()}, &flakyStore{MemStore: kv.NewMemStore()}
+	fs := New(primary, secondary, false)
+
+	primary.down = true
+	if err := fs.Ping(context.Background()); err != nil {
+		t.Errorf("expected healthy with the secondary, got: %v", err)
+	}
+	secondary.down = true
+	if err := fs.Ping(context.Background()); err != errDown {
+		t.Errorf("expected errDown, got: %v", err)
+	}
+}
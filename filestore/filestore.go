@@ -0,0 +1,301 @@
+// Package filestore provides a file system backed sessionmw.Store, writing
+// each session to its own file (similar to PHP's default session handler).
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultSweepInterval is the default interval between sweeps of expired
+	// session files.
+	DefaultSweepInterval = 10 * time.Minute
+
+	// filePrefix is the prefix of session file names.
+	filePrefix = "sess_"
+
+	// tempPrefix is the prefix of temporary files used for atomic writes.
+	tempPrefix = ".tmp_"
+
+	// tempTTL is the time after which temporary files are abandoned when
+	// sessions do not expire.
+	tempTTL = time.Hour
+)
+
+// ErrInvalidKey is the error returned when a session id cannot be safely used
+// as a file name.
+var ErrInvalidKey = errors.New("invalid session key")
+
+// FileStore is a file system backed session store.
+//
+// Session files are sharded into 256 subdirectories, based on a hash of the
+// session id, to avoid large flat directories. Sessions expire ttl after
+// their file was last modified, or never when ttl is 0 or negative.
+type FileStore struct {
+	dir string
+	ttl time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Codec is the codec used to encode stored sessions. Use
+	// sessionmw.CodecJSON when non-Go services need to read sessions.
+	Codec sessionmw.Codec
+
+	// Clock is the time source determining which sessions have expired.
+	Clock sessionmw.Clock
+}
+
+// New creates a file store writing sessions under dir, creating it if it
+// does not exist, and starts a janitor that removes expired session files
+// every sweepInterval.
+//
+// If sweepInterval is 0, then DefaultSweepInterval will be used.
+func New(dir string, ttl, sweepInterval time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		dir:   dir,
+		ttl:   ttl,
+		done:  make(chan struct{}),
+		Codec: sessionmw.CodecGob,
+		Clock: sessionmw.SystemClock,
+	}
+
+	if sweepInterval == 0 {
+		sweepInterval = DefaultSweepInterval
+	}
+	go fs.janitor(sweepInterval)
+
+	return fs, nil
+}
+
+// path returns the shard directory and file path for key.
+func (fs *FileStore) path(key string) (string, string, error) {
+	if key == "" || strings.ContainsAny(key, `/\:`) || strings.Contains(key, "..") {
+		return "", "", ErrInvalidKey
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := filepath.Join(fs.dir, fmt.Sprintf("%02x", h.Sum32()&0xff))
+
+	return shard, filepath.Join(shard, filePrefix+key), nil
+}
+
+// Write saves the session for the provided id.
+//
+// The session is written to a temporary file that is then renamed, so that
+// readers never see a partially written session.
+func (fs *FileStore) Write(key string, obj interface{}) error {
+	shard, path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	buf, err := sessionmw.EncodePayload(fs.Codec, obj)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(shard, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(shard, tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Read retrieves the session for the provided id.
+func (fs *FileStore) Read(key string) (interface{}, error) {
+	_, path, err := fs.path(key)
+	if err != nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, sessionmw.ErrSessionNotFound
+	case err != nil:
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, err)
+	case fs.expired(fi, fs.Clock.Now()):
+		os.Remove(path)
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, sessionmw.ErrSessionNotFound
+		}
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, err)
+	}
+
+	obj, err := sessionmw.DecodePayload(data)
+	return obj, sessionmw.NewStoreError(sessionmw.ErrDecodeFailed, err)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (fs *FileStore) Erase(key string) error {
+	_, path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Keys returns the ids of all unexpired sessions in the store. Satisfies the
+// sessionmw.KeysStore interface.
+func (fs *FileStore) Keys() ([]string, error) {
+	var keys []string
+	now := fs.Clock.Now()
+	err := filepath.Walk(fs.dir, func(path string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			// skip files removed during the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		case fi.IsDir():
+			return nil
+		}
+
+		name := fi.Name()
+		key := strings.TrimPrefix(name, filePrefix)
+		if strings.HasPrefix(name, filePrefix) && !sessionmw.Reserved(key) && !fs.expired(fi, now) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Count returns the number of unexpired sessions in the store. Satisfies the
+// sessionmw.CountableStore interface.
+func (fs *FileStore) Count() (int64, error) {
+	keys, err := fs.Keys()
+	return int64(len(keys)), err
+}
+
+// expired determines if the file has expired at t. Files do not expire when
+// the store's ttl is 0 or negative, except for temporary files, which are
+// abandoned after tempTTL.
+func (fs *FileStore) expired(fi os.FileInfo, t time.Time) bool {
+	ttl := fs.ttl
+	if ttl <= 0 {
+		if !strings.HasPrefix(fi.Name(), tempPrefix) {
+			return false
+		}
+		ttl = tempTTL
+	}
+	return t.Sub(fi.ModTime()) > ttl
+}
+
+// Sweep removes all expired session files, and any abandoned temporary
+// files.
+func (fs *FileStore) Sweep() error {
+	_, err := fs.DeleteExpiredBefore(fs.Clock.Now())
+	return err
+}
+
+// DeleteExpiredBefore removes all session files (and abandoned temporary
+// files) expiring before t, returning the number of removed sessions.
+// Satisfies the sessionmw.GCStore interface.
+func (fs *FileStore) DeleteExpiredBefore(t time.Time) (int, error) {
+	var n int
+	err := filepath.Walk(fs.dir, func(path string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			// skip files removed during the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		case fi.IsDir():
+			return nil
+		}
+
+		name := fi.Name()
+		isSession := strings.HasPrefix(name, filePrefix)
+		if (isSession || strings.HasPrefix(name, tempPrefix)) && fs.expired(fi, t) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if isSession {
+				n++
+			}
+		}
+
+		return nil
+	})
+	return n, err
+}
+
+// janitor periodically sweeps expired sessions until the store is closed.
+func (fs *FileStore) janitor(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			fs.Sweep()
+		case <-fs.done:
+			return
+		}
+	}
+}
+
+// Close stops the janitor. Subsequent calls to Close have no effect.
+func (fs *FileStore) Close() error {
+	fs.closeOnce.Do(func() {
+		close(fs.done)
+	})
+	return nil
+}
+
+// Ping checks that the store directory is accessible. Satisfies the
+// sessionmw.Pinger interface.
+func (fs *FileStore) Ping(ctxt context.Context) error {
+	_, err := os.Stat(fs.dir)
+	return err
+}
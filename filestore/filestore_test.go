@@ -0,0 +1,169 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+func newStore(ttl time.Duration, t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	fs, err := New(dir, ttl, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	return fs, func() {
+		fs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore(t *testing.T) {
+	fs, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if _, err := fs.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := fs.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	obj, err := fs.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if m, ok := obj.(map[string]interface{}); !ok || m["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %v", obj)
+	}
+
+	// sharded
+	shard, path, _ := fs.path("a")
+	if filepath.Dir(shard) != fs.dir || filepath.Dir(path) != shard {
+		t.Errorf("expected %s to be in a shard of %s", path, fs.dir)
+	}
+
+	if err = fs.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = fs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	fs, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	for _, key := range []string{"", "../a", "a/b", `a\b`, ".."} {
+		if err := fs.Write(key, map[string]interface{}{}); err != ErrInvalidKey {
+			t.Errorf("key %q expected ErrInvalidKey, got: %v", key, err)
+		}
+		if _, err := fs.Read(key); err != sessionmw.ErrSessionNotFound {
+			t.Errorf("key %q expected ErrSessionNotFound, got: %v", key, err)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	fs, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	// reserved keys are not sessions
+	for _, key := range []string{"a", "b", sessionmw.ReservedPrefix + "watermark"} {
+		if err := fs.Write(key, map[string]interface{}{}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	// age a
+	_, path, _ := fs.path("a")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if keys, err := fs.Keys(); err != nil || len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("expected keys [b], got: %v (%v)", keys, err)
+	}
+	if n, err := fs.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 session, got: %d (%v)", n, err)
+	}
+
+	if n, err := fs.DeleteExpiredBefore(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted session, got: %d (%v)", n, err)
+	}
+	if err := fs.Sweep(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be swept", path)
+	}
+	if _, err := fs.Read("b"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	// simulated time
+	fs.Clock = sessionmw.ClockFunc(func() time.Time {
+		return time.Now().Add(2 * time.Hour)
+	})
+	if _, err := fs.Read("b"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected b to be expired, got: %v", err)
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	fs, cleanup := newStore(0, t)
+	defer cleanup()
+
+	if err := fs.Write("a", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	dir, path, _ := fs.path("a")
+	temp := filepath.Join(dir, tempPrefix+"a")
+	if err := ioutil.WriteFile(temp, nil, 0600); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, p := range []string{path, temp} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	if err := fs.Sweep(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := fs.Read("a"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be swept", temp)
+	}
+}
+
+func TestPing(t *testing.T) {
+	fs, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if err := fs.Ping(context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	os.RemoveAll(fs.dir)
+	if err := fs.Ping(context.Background()); err == nil {
+		t.Errorf("expected error for missing directory")
+	}
+}
@@ -0,0 +1,169 @@
+package sessionmw
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGCJitter is the default fraction of the interval that garbage
+	// collection runs are randomly offset by.
+	DefaultGCJitter = 0.1
+)
+
+// GCStore is the interface for session stores without native expiration,
+// that require expired sessions to be periodically deleted.
+type GCStore interface {
+	Store
+
+	// DeleteExpiredBefore deletes all sessions expiring before t, returning
+	// the number of deleted sessions.
+	DeleteExpiredBefore(t time.Time) (int, error)
+}
+
+// GCStats are the statistics of a garbage collector.
+type GCStats struct {
+	// Runs is the number of times garbage collection ran.
+	Runs int
+
+	// Skipped is the number of times garbage collection was skipped because
+	// the instance was not the leader.
+	Skipped int
+
+	// Deleted is the total number of deleted sessions.
+	Deleted int
+
+	// Errors is the number of runs that failed.
+	Errors int
+
+	// LastRun is the time of the last run.
+	LastRun time.Time
+
+	// LastError is the error of the last run, if any.
+	LastError error
+}
+
+// GCConfig contains the configuration parameters for a garbage collector.
+type GCConfig struct {
+	// Interval is the time between garbage collection runs.
+	Interval time.Duration
+
+	// Jitter is the fraction of Interval that each run is randomly offset
+	// by, so that multiple instances do not run at the same time.
+	Jitter float64
+
+	// Leader is the optional func determining if this instance should run
+	// garbage collection, allowing the leader election of multi-instance
+	// deployments to restrict garbage collection to a single instance.
+	Leader func() bool
+
+	// OnRun is the optional func called after each run with the number of
+	// deleted sessions, and any error encountered.
+	OnRun func(deleted int, err error)
+
+	// Clock is the time source determining which sessions have expired.
+	// Defaults to SystemClock.
+	Clock Clock
+}
+
+// GC is a running garbage collector.
+type GC struct {
+	st   GCStore
+	conf GCConfig
+
+	mu    sync.Mutex
+	stats GCStats
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartGC starts a garbage collector deleting expired sessions from st every
+// interval (with DefaultGCJitter).
+func StartGC(st GCStore, interval time.Duration) *GC {
+	return GCConfig{
+		Interval: interval,
+		Jitter:   DefaultGCJitter,
+	}.Start(st)
+}
+
+// Start starts a garbage collector deleting expired sessions from st.
+func (c GCConfig) Start(st GCStore) *GC {
+	if c.Clock == nil {
+		c.Clock = SystemClock
+	}
+	gc := &GC{
+		st:   st,
+		conf: c,
+		done: make(chan struct{}),
+	}
+	go gc.run()
+	return gc
+}
+
+// next returns the time until the next run.
+func (gc *GC) next() time.Duration {
+	d := gc.conf.Interval
+	if j := int64(float64(d) * gc.conf.Jitter); j > 0 {
+		d += time.Duration(rand.Int63n(2*j+1) - j)
+	}
+	return d
+}
+
+// run runs the garbage collector until stopped.
+func (gc *GC) run() {
+	t := time.NewTimer(gc.next())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			gc.Run()
+			t.Reset(gc.next())
+		case <-gc.done:
+			return
+		}
+	}
+}
+
+// Run immediately deletes expired sessions, unless this instance is not the
+// leader.
+func (gc *GC) Run() {
+	if gc.conf.Leader != nil && !gc.conf.Leader() {
+		gc.mu.Lock()
+		gc.stats.Skipped++
+		gc.mu.Unlock()
+		return
+	}
+
+	now := gc.conf.Clock.Now()
+	n, err := gc.st.DeleteExpiredBefore(now)
+
+	gc.mu.Lock()
+	gc.stats.Runs++
+	gc.stats.Deleted += n
+	gc.stats.LastRun, gc.stats.LastError = now, err
+	if err != nil {
+		gc.stats.Errors++
+	}
+	gc.mu.Unlock()
+
+	if gc.conf.OnRun != nil {
+		gc.conf.OnRun(n, err)
+	}
+}
+
+// Stats returns the garbage collector's statistics.
+func (gc *GC) Stats() GCStats {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.stats
+}
+
+// Stop stops the garbage collector. Subsequent calls to Stop have no effect.
+func (gc *GC) Stop() {
+	gc.stopOnce.Do(func() {
+		close(gc.done)
+	})
+}
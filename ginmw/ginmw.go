@@ -0,0 +1,135 @@
+// Package ginmw provides the sessionmw session middleware for
+// github.com/gin-gonic/gin.
+//
+// Handlers access the session using the request's context (see Context),
+// ie:
+//
+//	sessionmw.Get(ginmw.Context(c), "name")
+package ginmw
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"golang.org/x/net/context"
+)
+
+// contextKey is the context key type.
+type contextKey int
+
+// callContextKey is the context key for the gin call.
+const callContextKey contextKey = 0
+
+// call is an invocation of the remaining gin handlers.
+type call struct {
+	c      *gin.Context
+	called bool
+}
+
+// New creates the session middleware for the configuration.
+func New(conf sessionmw.Config) (gin.HandlerFunc, error) {
+	mw, err := sessionmw.NewMiddleware(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session middleware is created once, and passed the gin call via
+	// the context
+	h := mw(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		cl := ctxt.Value(callContextKey).(*call)
+		cl.called = true
+		c := cl.c
+
+		// route writes through the session middleware's response writer,
+		// so the session cookie is set before the headers are written
+		w := c.Writer
+		c.Writer = &responseWriter{ResponseWriter: w, w: res}
+		defer func() {
+			c.Writer = w
+		}()
+
+		c.Request = req.WithContext(ctxt)
+		c.Next()
+	}))
+
+	return func(c *gin.Context) {
+		cl := &call{c: c}
+		h.ServeHTTPC(context.WithValue(c.Request.Context(), callContextKey, cl), c.Writer, c.Request)
+
+		// abort the remaining handlers when the session middleware did not
+		// call them (ie, on a session store error)
+		if !cl.called {
+			c.Abort()
+		}
+	}, nil
+}
+
+// Middleware creates the session middleware for the configuration, panicking
+// if the configuration is invalid.
+func Middleware(conf sessionmw.Config) gin.HandlerFunc {
+	mw, err := New(conf)
+	if err != nil {
+		panic(err)
+	}
+	return mw
+}
+
+// Context returns the context of the gin request, for use with the sessionmw
+// session funcs.
+func Context(c *gin.Context) context.Context {
+	return c.Request.Context()
+}
+
+// responseWriter is a gin.ResponseWriter writing the response through the
+// session middleware's http.ResponseWriter.
+type responseWriter struct {
+	gin.ResponseWriter
+	w http.ResponseWriter
+}
+
+// Header satisfies the http.ResponseWriter interface.
+func (w *responseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+// WriteHeader satisfies the http.ResponseWriter interface.
+func (w *responseWriter) WriteHeader(code int) {
+	w.w.WriteHeader(code)
+}
+
+// Write satisfies the http.ResponseWriter interface.
+func (w *responseWriter) Write(buf []byte) (int, error) {
+	return w.w.Write(buf)
+}
+
+// WriteString satisfies the gin.ResponseWriter interface.
+func (w *responseWriter) WriteString(s string) (int, error) {
+	return w.w.Write([]byte(s))
+}
+
+// WriteHeaderNow satisfies the gin.ResponseWriter interface. The headers are
+// passed to the session middleware's http.ResponseWriter, and are written
+// with the first write of the response body (or when gin finishes the
+// request), as the session middleware may be buffering the response.
+func (w *responseWriter) WriteHeaderNow() {
+	w.w.WriteHeader(w.Status())
+}
+
+// Flush satisfies the http.Flusher interface.
+func (w *responseWriter) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack satisfies the http.Hijacker interface.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return w.ResponseWriter.Hijack()
+}
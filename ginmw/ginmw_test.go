@@ -0,0 +1,127 @@
+package ginmw
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+)
+
+const cookieName = "SESSID"
+
+var conf = sessionmw.Config{
+	Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+	BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+	Name:        cookieName,
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// lockFailStore is a store that cannot be locked.
+type lockFailStore struct {
+	*kv.MemStore
+}
+
+func (lockFailStore) Lock(string, time.Duration) (func(), error) {
+	return nil, errors.New("lock failed")
+}
+
+// serve serves a request for path with cookie c, returning the response
+// recorder.
+func serve(h http.Handler, path string, c *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// cookie returns the session cookie set on the response.
+func cookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
+	for _, c := range (&http.Response{Header: rr.Header()}).Cookies() {
+		if c.Name == cookieName {
+			return c
+		}
+	}
+	t.Fatalf("expected session cookie")
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	if _, err := New(sessionmw.Config{}); err == nil {
+		t.Errorf("expected error for invalid config")
+	}
+
+	for i, buffer := range []bool{false, true} {
+		c := conf
+		c.Store, c.BufferResponse = kv.NewMemStore(), buffer
+
+		r := gin.New()
+		r.Use(Middleware(c))
+		r.GET("/set/:name", func(c *gin.Context) {
+			sessionmw.Set(Context(c), "name", c.Param("name"))
+			c.String(http.StatusOK, "ok")
+		})
+		r.GET("/", func(c *gin.Context) {
+			name, _ := sessionmw.Get(Context(c), "name")
+			s, _ := name.(string)
+			c.String(http.StatusOK, s)
+		})
+		r.GET("/abort", func(c *gin.Context) {
+			sessionmw.Set(Context(c), "name", "bar")
+			c.AbortWithStatus(http.StatusTeapot)
+		})
+
+		rr := serve(r, "/set/foo", nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+			t.Fatalf("test %d expected ok, got: %d %s", i, rr.Code, rr.Body.String())
+		}
+
+		if rr = serve(r, "/", cookie(rr, t)); rr.Body.String() != "foo" {
+			t.Errorf("test %d expected foo, got: %s", i, rr.Body.String())
+		}
+
+		// headers written without a body
+		rr = serve(r, "/abort", nil)
+		if rr.Code != http.StatusTeapot {
+			t.Errorf("test %d expected %d, got: %d", i, http.StatusTeapot, rr.Code)
+		}
+		if rr = serve(r, "/", cookie(rr, t)); rr.Body.String() != "bar" {
+			t.Errorf("test %d expected bar, got: %s", i, rr.Body.String())
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	// issue a session cookie
+	ok := conf
+	ok.Store, ok.SaveUninitialized = kv.NewMemStore(), true
+	r := gin.New()
+	r.Use(Middleware(ok))
+	r.GET("/", func(*gin.Context) {})
+	sc := cookie(serve(r, "/", nil), t)
+
+	c := conf
+	c.Store, c.Locking = lockFailStore{kv.NewMemStore()}, true
+
+	called := false
+	r = gin.New()
+	r.Use(Middleware(c))
+	r.GET("/", func(c *gin.Context) {
+		called = true
+	})
+
+	rr := serve(r, "/", sc)
+	if rr.Code != http.StatusServiceUnavailable || called {
+		t.Errorf("expected %d without calling the handler, got: %d %t", http.StatusServiceUnavailable, rr.Code, called)
+	}
+}
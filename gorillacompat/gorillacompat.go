@@ -0,0 +1,167 @@
+// Package gorillacompat provides a github.com/gorilla/sessions Store backed by
+// a sessionmw.Store, so that code written against gorilla's API can share
+// sessions with the sessionmw middleware while being migrated incrementally.
+//
+// The Store reads and writes the same session cookie and store data as the
+// middleware, provided it is created with the same store, sealer, and cookie
+// name, so values saved by either API are visible to the other.
+package gorillacompat
+
+import (
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/knq/sessionmw"
+)
+
+// ErrNonStringKey is the error returned when saving a gorilla session with
+// values keyed by a non-string key, which cannot be stored in a sessionmw
+// session.
+var ErrNonStringKey = errors.New("session values must have string keys")
+
+// Store is a gorilla/sessions Store backed by a sessionmw.Store.
+type Store struct {
+	st     sessionmw.Store
+	sealer sessionmw.Sealer
+
+	// Options is the default configuration of the sessions.
+	Options *sessions.Options
+
+	// IDFn is the id generation func for new sessions.
+	IDFn sessionmw.IDFn
+}
+
+// NewStore creates a gorilla/sessions Store backed by st, encoding cookies
+// with sealer.
+//
+// To share sessions with the session middleware, st must be the Config.Store,
+// and sealer must be the Config.Sealer, or a securecookie created with the
+// Config.Secret and Config.BlockSecret (see securecookie.New). The
+// Config.IDValidator must accept the ids generated by the Store's IDFn (ie,
+// sessionmw.ValidID).
+func NewStore(st sessionmw.Store, sealer sessionmw.Sealer) *Store {
+	return &Store{
+		st:     st,
+		sealer: sealer,
+		Options: &sessions.Options{
+			Path:     "/",
+			HttpOnly: true,
+		},
+		IDFn: newID,
+	}
+}
+
+// newID generates a new session id.
+func newID() string {
+	return base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(30))
+}
+
+// Get returns the named session after adding it to the request's session
+// registry. Satisfies the sessions.Store interface.
+func (s *Store) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+// New returns the named session without adding it to the request's session
+// registry, loading its values from the sessionmw.Store when the request has
+// a valid session cookie. Satisfies the sessions.Store interface.
+func (s *Store) New(req *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options, sess.IsNew = &opts, true
+
+	c, err := req.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+
+	v := make(map[string]string)
+	if err = s.sealer.Decode(name, c.Value, &v); err != nil {
+		return sess, err
+	}
+	if v["id"] == "" {
+		return sess, nil
+	}
+
+	obj, err := s.st.Read(v["id"])
+	switch {
+	case err == sessionmw.ErrSessionNotFound:
+		return sess, nil
+	case err != nil:
+		return sess, err
+	}
+
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return sess, nil
+	}
+
+	sess.ID, sess.Values, sess.IsNew = v["id"], ToValues(data), false
+	return sess, nil
+}
+
+// Save writes the session values to the sessionmw.Store and adds the session
+// cookie to the response, or erases the session when its Options.MaxAge is
+// negative. Satisfies the sessions.Store interface.
+func (s *Store) Save(req *http.Request, res http.ResponseWriter, sess *sessions.Session) error {
+	if sess.Options.MaxAge < 0 {
+		if sess.ID != "" {
+			if err := s.st.Erase(sess.ID); err != nil && err != sessionmw.ErrSessionNotFound {
+				return err
+			}
+		}
+		http.SetCookie(res, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	data, err := FromValues(sess.Values)
+	if err != nil {
+		return err
+	}
+
+	if sess.ID == "" {
+		sess.ID = s.IDFn()
+	}
+	if err = s.st.Write(sess.ID, data); err != nil {
+		return err
+	}
+
+	val, err := s.sealer.Encode(sess.Name(), map[string]string{
+		"id": sess.ID,
+		"ts": strconv.FormatInt(time.Now().Unix(), 10),
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(res, sessions.NewCookie(sess.Name(), val, sess.Options))
+	return nil
+}
+
+// ToValues converts sessionmw session data to gorilla session values.
+func ToValues(data map[string]interface{}) map[interface{}]interface{} {
+	values := make(map[interface{}]interface{}, len(data))
+	for k, v := range data {
+		values[k] = v
+	}
+	return values
+}
+
+// FromValues converts gorilla session values to sessionmw session data,
+// returning ErrNonStringKey if any of the values has a non-string key.
+func FromValues(values map[interface{}]interface{}) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, ErrNonStringKey
+		}
+		data[key] = v
+	}
+	return data, nil
+}
@@ -0,0 +1,139 @@
+package gorillacompat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// statically assert the Store satisfies the sessions.Store interface.
+var _ sessions.Store = (*Store)(nil)
+
+const cookieName = "SESSID"
+
+var (
+	secret      = []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7")
+	blockSecret = []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp")
+)
+
+// serve serves a request for path with cookie c, returning the response
+// recorder.
+func serve(h http.Handler, path string, c *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// cookie returns the session cookie set on the response.
+func cookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
+	for _, c := range (&http.Response{Header: rr.Header()}).Cookies() {
+		if c.Name == cookieName {
+			return c
+		}
+	}
+	t.Fatalf("expected session cookie")
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	ms := kv.NewMemStore()
+
+	// middleware
+	mux := goji.NewMux()
+	mux.UseC((&sessionmw.Config{
+		Secret:      secret,
+		BlockSecret: blockSecret,
+		Store:       ms,
+		Name:        cookieName,
+		IDValidator: sessionmw.ValidID,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/mw/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		sessionmw.Set(ctxt, "mw", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/mw/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := sessionmw.Get(ctxt, "gorilla")
+		s, _ := v.(string)
+		res.Write([]byte(s))
+	})
+
+	// gorilla
+	gs := NewStore(ms, securecookie.New(secret, blockSecret))
+	gmux := http.NewServeMux()
+	gmux.HandleFunc("/gorilla/set", func(res http.ResponseWriter, req *http.Request) {
+		sess, err := gs.Get(req, cookieName)
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		sess.Values["gorilla"] = "bar"
+		if err = sess.Save(req, res); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	})
+	gmux.HandleFunc("/gorilla/get", func(res http.ResponseWriter, req *http.Request) {
+		sess, err := gs.Get(req, cookieName)
+		if err != nil || sess.IsNew {
+			t.Errorf("expected existing session, got: %v", err)
+		}
+		s, _ := sess.Values["mw"].(string)
+		res.Write([]byte(s))
+	})
+	gmux.HandleFunc("/gorilla/delete", func(res http.ResponseWriter, req *http.Request) {
+		sess, _ := gs.Get(req, cookieName)
+		sess.Options.MaxAge = -1
+		if err := sess.Save(req, res); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	})
+
+	// session created by the middleware is visible to gorilla
+	c := cookie(serve(mux, "/mw/set", nil), t)
+	if rr := serve(gmux, "/gorilla/get", c); rr.Body.String() != "foo" {
+		t.Errorf("expected foo, got: %s", rr.Body.String())
+	}
+
+	// and values saved by gorilla are visible to the middleware
+	serve(gmux, "/gorilla/set", c)
+	if rr := serve(mux, "/mw/get", c); rr.Body.String() != "bar" {
+		t.Errorf("expected bar, got: %s", rr.Body.String())
+	}
+
+	// session created by gorilla is visible to the middleware
+	c2 := cookie(serve(gmux, "/gorilla/set", nil), t)
+	if rr := serve(mux, "/mw/get", c2); rr.Body.String() != "bar" {
+		t.Errorf("expected bar, got: %s", rr.Body.String())
+	}
+
+	// deleted by gorilla
+	id := ""
+	v := make(map[string]string)
+	if err := securecookie.New(secret, blockSecret).Decode(cookieName, c2.Value, &v); err == nil {
+		id = v["id"]
+	}
+	serve(gmux, "/gorilla/delete", c2)
+	if _, err := ms.Read(id); err == nil {
+		t.Errorf("expected session %q to be erased", id)
+	}
+}
+
+func TestValues(t *testing.T) {
+	data, err := FromValues(ToValues(map[string]interface{}{"a": 1}))
+	if err != nil || data["a"] != 1 {
+		t.Errorf("expected a=1, got: %v %v", data, err)
+	}
+
+	if _, err := FromValues(map[interface{}]interface{}{1: "a"}); err != ErrNonStringKey {
+		t.Errorf("expected ErrNonStringKey, got: %v", err)
+	}
+}
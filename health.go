@@ -0,0 +1,35 @@
+package sessionmw
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultHealthzTimeout is the default timeout for the store health check of
+// Healthz.
+const DefaultHealthzTimeout = 5 * time.Second
+
+// Healthz returns a http.Handler checking the health of st (see PingStore),
+// responding 200 OK when healthy, or 503 Service Unavailable otherwise, for
+// load balancer health checks and readiness probes:
+//
+//	http.Handle("/healthz", sessionmw.Healthz(st))
+//
+// The check times out after DefaultHealthzTimeout.
+func Healthz(st Store) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctxt, cancel := context.WithTimeout(req.Context(), DefaultHealthzTimeout)
+		defer cancel()
+
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.Header().Set("Cache-Control", "no-store")
+		if err := PingStore(ctxt, st); err != nil {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			res.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		res.Write([]byte(http.StatusText(http.StatusOK)))
+	})
+}
@@ -0,0 +1,113 @@
+package sessionmw
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxIDLength is the maximum length of the session ids accepted by ValidID.
+const MaxIDLength = 128
+
+// ValidID determines if id is a plausible session id, consisting of 1 to
+// MaxIDLength ASCII letters, digits, or '-', '_', ',' and '=' characters.
+//
+// ValidID is the default Config.IDValidator when Config.IDFn is set, and
+// accepts the ids of common id formats (ie, UUIDs, and base32 or URL-safe
+// base64 encoded random bytes), while rejecting ids that could be used for
+// path traversal in file based stores.
+func ValidID(id string) bool {
+	if id == "" || len(id) > MaxIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case isAlnum(c), c == '-', c == '_', c == ',', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validDefaultID determines if id could have been generated by defaultIDGen,
+// ie, is a base62 encoded uint64.
+func validDefaultID(id string) bool {
+	if id == "" || len(id) > 11 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !isAlnum(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAlnum determines if c is an ASCII letter or digit.
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// randomBytes fills buf with random bytes from crypto/rand, panicking when
+// the system's random source fails, as an id cannot safely be generated.
+func randomBytes(buf []byte) {
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(fmt.Sprintf("sessionmw could not generate random id: %v", err))
+	}
+}
+
+// UUIDIDFn generates random (version 4) UUIDs as session ids, ie,
+// "3d2a9c3e-5d2f-4c1a-9e7b-8f0a1b2c3d4e".
+//
+// UUIDs have 122 random bits, so that the probability of a collision is less
+// than 1 in 10^17 after generating 2^32 (4 billion) ids.
+func UUIDIDFn() string {
+	var b [16]byte
+	randomBytes(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDIDFn generates ULIDs as session ids, ie, "01ARZ3NDEKTSV4RRFFQ69G5FAV".
+//
+// ULIDs are a 48 bit millisecond timestamp followed by 80 random bits,
+// encoded as 26 Crockford base32 characters, so that ids sort by their
+// creation time. Ids only collide when generated in the same millisecond,
+// with a probability of less than 1 in 10^12 for 2^20 (1 million) ids
+// generated in the same millisecond. As the creation time can be read from the id,
+// ULIDs should not be used when that would disclose sensitive information.
+func ULIDIDFn() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	randomBytes(b[6:])
+
+	// encode the 128 bits as 26 characters of 5 bits, with the first
+	// character holding the top 3 bits
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// PrefixIDFn creates an IDFn prefixing the ids generated by idFn with prefix
+// (ie, "sess_"), so that session ids are recognizable in logs and stores.
+//
+// The prefix must be accepted by the Config.IDValidator (see ValidID).
+func PrefixIDFn(prefix string, idFn IDFn) IDFn {
+	return func() string {
+		return prefix + idFn()
+	}
+}
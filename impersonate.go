@@ -0,0 +1,91 @@
+package sessionmw
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// metaImpersonatorKey is the session metadata key holding the user
+// impersonating the session's user.
+const metaImpersonatorKey = "impersonator"
+
+var (
+	// ErrNoUser is the error returned by Impersonate when the session is not
+	// bound to a user.
+	ErrNoUser = errors.New("session has no user")
+
+	// ErrNotImpersonating is the error returned by StopImpersonating when
+	// the session is not impersonating a user.
+	ErrNotImpersonating = errors.New("session is not impersonating a user")
+)
+
+// Impersonate switches the user of the session to target (ie, for an
+// administrator acting as a user for support), retaining the session's user
+// as the impersonator (see Impersonator), until StopImpersonating is called.
+// Impersonating while already impersonating switches the target, retaining
+// the original impersonator.
+//
+// The session remains in the impersonator's index of sessions (see
+// Sessions), and audit events record the impersonator. Binding the session
+// to a user (see SetUser) stops the impersonation.
+func Impersonate(ctxt context.Context, target string) error {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	m := sess.meta()
+	user, _ := m[metaUserKey].(string)
+	if user == "" {
+		sess.Unlock()
+		return ErrNoUser
+	}
+	if imp, _ := m[metaImpersonatorKey].(string); imp == "" {
+		m[metaImpersonatorKey] = user
+	}
+	m[metaUserKey] = target
+	sess.modified = true
+	sess.dirty(metaKey)
+	sess.Unlock()
+
+	audit(ctxt, AuditImpersonate, target)
+	return nil
+}
+
+// StopImpersonating restores the user of the session to the impersonator.
+func StopImpersonating(ctxt context.Context) error {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	m := sess.meta()
+	imp, _ := m[metaImpersonatorKey].(string)
+	if imp == "" {
+		sess.Unlock()
+		return ErrNotImpersonating
+	}
+	target, _ := m[metaUserKey].(string)
+	sess.Unlock()
+
+	// record the event while still impersonating
+	audit(ctxt, AuditStopImpersonate, target)
+
+	sess.Lock()
+	m[metaUserKey] = imp
+	delete(m, metaImpersonatorKey)
+	sess.modified = true
+	sess.dirty(metaKey)
+	sess.Unlock()
+	return nil
+}
+
+// indexed returns the user whose index of sessions contains the session,
+// being the impersonator when impersonating.
+func (md Metadata) indexed() string {
+	if md.Impersonator != "" {
+		return md.Impersonator
+	}
+	return md.User
+}
+
+// Impersonator retrieves the user impersonating the session's user, or an
+// empty string when the session is not impersonating a user.
+func Impersonator(ctxt context.Context) string {
+	return Meta(ctxt).Impersonator
+}
@@ -0,0 +1,113 @@
+package sessionmw
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// integrityVersion is the version byte of sealed payloads.
+	integrityVersion = 1
+
+	// integrityOverhead is the size of the version byte and the MAC of sealed
+	// payloads.
+	integrityOverhead = 1 + sha256.Size
+)
+
+// integrityStore is a store encrypting and authenticating its sessions.
+type integrityStore struct {
+	Store
+	block  cipher.Block
+	macKey []byte
+}
+
+// IntegrityStore wraps st, protecting stored sessions with encrypt-then-MAC.
+// Sessions are encoded (see EncodePayload), encrypted with AES-256-CTR, and
+// authenticated with HMAC-SHA256 over the ciphertext and the store key, so
+// that modified, corrupted, or swapped store entries are detected. Reading a
+// session that fails verification returns ErrTampered.
+//
+// The encryption and MAC keys are derived from secret, which should be at
+// least 32 random bytes. The wrapped store must store []byte values as is,
+// and only the Store interface is provided by the wrapped store. Entries
+// written without IntegrityStore fail verification.
+func IntegrityStore(st Store, secret []byte) Store {
+	// aes.NewCipher only fails for invalid key sizes
+	block, _ := aes.NewCipher(deriveKey(secret, "integrity encryption"))
+	return &integrityStore{
+		Store:  st,
+		block:  block,
+		macKey: deriveKey(secret, "integrity mac"),
+	}
+}
+
+// mac returns the MAC of the sealed payload buf stored under key.
+func (is *integrityStore) mac(key string, buf []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(key)))
+
+	h := hmac.New(sha256.New, is.macKey)
+	h.Write(n[:])
+	h.Write([]byte(key))
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+// Write satisfies the Store interface.
+func (is *integrityStore) Write(key string, obj interface{}) error {
+	payload, err := EncodePayload(CodecGob, obj)
+	if err != nil {
+		return err
+	}
+
+	// version | iv | ciphertext | mac
+	buf := make([]byte, 1+aes.BlockSize+len(payload), 1+aes.BlockSize+len(payload)+sha256.Size)
+	buf[0] = integrityVersion
+	iv := buf[1 : 1+aes.BlockSize]
+	randomBytes(iv)
+	cipher.NewCTR(is.block, iv).XORKeyStream(buf[1+aes.BlockSize:], payload)
+
+	return is.Store.Write(key, append(buf, is.mac(key, buf)...))
+}
+
+// Read satisfies the Store interface.
+func (is *integrityStore) Read(key string) (interface{}, error) {
+	obj, err := is.Store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, ok := obj.([]byte)
+	if !ok || len(buf) < integrityOverhead+aes.BlockSize || buf[0] != integrityVersion {
+		return nil, ErrTampered
+	}
+
+	n := len(buf) - sha256.Size
+	if !hmac.Equal(buf[n:], is.mac(key, buf[:n])) {
+		return nil, ErrTampered
+	}
+
+	payload := make([]byte, n-1-aes.BlockSize)
+	cipher.NewCTR(is.block, buf[1:1+aes.BlockSize]).XORKeyStream(payload, buf[1+aes.BlockSize:n])
+
+	obj, err = DecodePayload(payload)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return obj, nil
+}
+
+// Close closes the wrapped store, if it is an io.Closer.
+func (is *integrityStore) Close() error {
+	return CloseStore(is.Store)
+}
+
+// Ping checks the health of the wrapped store, if it is a Pinger.
+func (is *integrityStore) Ping(ctxt context.Context) error {
+	return PingStore(ctxt, is.Store)
+}
@@ -0,0 +1,117 @@
+package sessionmw
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// KeyBuilder builds the store keys of sessions, so that stores (and the
+// applications sharing them) namespace their keys identically.
+//
+// Keys are of the form <Prefix>[<Tenant>:]<id>. Reserved keys (see Reserved)
+// are never hashed, so that stores can skip them when listing, counting, and
+// destroying sessions.
+type KeyBuilder struct {
+	// Prefix is the prefix of all keys (ie, "sess:").
+	Prefix string
+
+	// Tenant is the optional tenant segment following the prefix, separating
+	// the sessions of tenants sharing a store.
+	Tenant string
+
+	// HashIDs toggles hashing session ids with SHA-256 (or HMAC-SHA256, when
+	// HashSecret is set), so that valid session ids cannot be recovered from
+	// the store (ie, by operators, or from a backup) and used to hijack
+	// sessions.
+	//
+	// As ids cannot be recovered, stores cannot list the ids of sessions
+	// with hashed keys (see KeysStore).
+	HashIDs    bool
+	HashSecret []byte
+}
+
+// Namespace returns the common prefix of the keys built by kb, including the
+// tenant segment.
+func (kb KeyBuilder) Namespace() string {
+	if kb.Tenant == "" {
+		return kb.Prefix
+	}
+	return kb.Prefix + kb.Tenant + ":"
+}
+
+// Key returns the store key for the session id.
+func (kb KeyBuilder) Key(id string) string {
+	if kb.HashIDs && !Reserved(id) {
+		var h []byte
+		if len(kb.HashSecret) != 0 {
+			mac := hmac.New(sha256.New, kb.HashSecret)
+			mac.Write([]byte(id))
+			h = mac.Sum(nil)
+		} else {
+			sum := sha256.Sum256([]byte(id))
+			h = sum[:]
+		}
+		id = hex.EncodeToString(h)
+	}
+	return kb.Namespace() + id
+}
+
+// Reserved determines if the store key is a reserved key in kb's namespace
+// (see Reserved).
+func (kb KeyBuilder) Reserved(key string) bool {
+	return strings.HasPrefix(key, kb.Namespace()+ReservedPrefix)
+}
+
+// ID returns the session id of the store key, returning false when the key
+// is not in kb's namespace, or ids are hashed.
+func (kb KeyBuilder) ID(key string) (string, bool) {
+	ns := kb.Namespace()
+	if kb.HashIDs || !strings.HasPrefix(key, ns) {
+		return "", false
+	}
+	return key[len(ns):], true
+}
+
+// namespacedStore is a store namespacing its keys with a KeyBuilder.
+type namespacedStore struct {
+	Store
+	kb KeyBuilder
+}
+
+// NamespacedStore wraps st, storing sessions under the keys built by kb.
+//
+// Only the Store interface is provided by the wrapped store. Stores building
+// their own keys (ie, redisstore) should instead be configured with kb
+// directly, to retain their other interfaces.
+func NamespacedStore(st Store, kb KeyBuilder) Store {
+	return &namespacedStore{Store: st, kb: kb}
+}
+
+// Write satisfies the Store interface.
+func (ns *namespacedStore) Write(key string, obj interface{}) error {
+	return ns.Store.Write(ns.kb.Key(key), obj)
+}
+
+// Read satisfies the Store interface.
+func (ns *namespacedStore) Read(key string) (interface{}, error) {
+	return ns.Store.Read(ns.kb.Key(key))
+}
+
+// Erase satisfies the Store interface.
+func (ns *namespacedStore) Erase(key string) error {
+	return ns.Store.Erase(ns.kb.Key(key))
+}
+
+// Close closes the wrapped store, if it is an io.Closer.
+func (ns *namespacedStore) Close() error {
+	return CloseStore(ns.Store)
+}
+
+// Ping checks the health of the wrapped store, if it is a Pinger.
+func (ns *namespacedStore) Ping(ctxt context.Context) error {
+	return PingStore(ctxt, ns.Store)
+}
@@ -0,0 +1,109 @@
+package sessionmw
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultLockTimeout is the default time to wait to acquire a session
+	// lock.
+	DefaultLockTimeout = 10 * time.Second
+)
+
+// ErrLockTimeout is the error returned by LockingStore providers when a
+// session lock could not be acquired before the timeout.
+var ErrLockTimeout = errors.New("session lock timeout")
+
+// LockingStore is the interface for session stores that can lock a session
+// for the duration of a request, serializing concurrent requests for the same
+// session.
+//
+// Distributed stores should implement the lock in the backing service (ie,
+// with Redis SET NX and an expiry), so that it is held across processes.
+type LockingStore interface {
+	Store
+
+	// Lock acquires the lock for the provided id, waiting up to timeout,
+	// returning the func releasing the lock.
+	Lock(key string, timeout time.Duration) (func(), error)
+}
+
+// localLock is a lock held in process.
+type localLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// localLockStore wraps a Store with in process session locks.
+type localLockStore struct {
+	Store
+
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+// LocalLocking wraps st, providing session locks that are held in process.
+//
+// This is only suitable for stores (such as github.com/knq/kv.MemStore) that
+// are used by a single process.
+func LocalLocking(st Store) LockingStore {
+	return &localLockStore{
+		Store: st,
+		locks: make(map[string]*localLock),
+	}
+}
+
+// Lock satisfies the LockingStore interface.
+func (ls *localLockStore) Lock(key string, timeout time.Duration) (func(), error) {
+	ls.mu.Lock()
+	l, ok := ls.locks[key]
+	if !ok {
+		l = &localLock{ch: make(chan struct{}, 1)}
+		ls.locks[key] = l
+	}
+	l.refs++
+	ls.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case l.ch <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				<-l.ch
+				ls.release(key, l)
+			})
+		}, nil
+
+	case <-t.C:
+		ls.release(key, l)
+		return nil, ErrLockTimeout
+	}
+}
+
+// release releases a reference to the lock for key.
+func (ls *localLockStore) release(key string, l *localLock) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(ls.locks, key)
+	}
+}
+
+// Close closes the wrapped store.
+func (ls *localLockStore) Close() error {
+	return CloseStore(ls.Store)
+}
+
+// Ping checks the health of the wrapped store, if it is a Pinger.
+func (ls *localLockStore) Ping(ctxt context.Context) error {
+	return PingStore(ctxt, ls.Store)
+}
@@ -0,0 +1,173 @@
+package sessionmw
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrMachineUnlocked is the error returned when transitioning a Machine in a
+// session of a Manager that does not lock sessions (see Config.Locking).
+var ErrMachineUnlocked = errors.New("sessionmw machine transitions require session locking")
+
+// TransitionError is the error returned when a Machine transition is not
+// allowed.
+type TransitionError struct {
+	Machine string
+	From    string
+	To      string
+}
+
+// Error satisfies the error interface.
+func (err *TransitionError) Error() string {
+	return fmt.Sprintf("sessionmw machine %s cannot transition from '%s' to '%s'", err.Machine, err.From, err.To)
+}
+
+// GuardFn is a Machine transition guard func. A non-nil error prevents the
+// transition.
+type GuardFn func(ctxt context.Context, from, to string) error
+
+// Machine is a state machine persisted in the session, useful for multi-step
+// flows (such as checkout and payment) where double submission must be
+// prevented.
+//
+// The current state and the time it was entered are stored under Name in the
+// session.
+type Machine struct {
+	// Name is the session key the machine is stored under.
+	Name string
+
+	// Initial is the state of a machine not yet stored in the session.
+	Initial string
+
+	// Transitions are the allowed transitions, keyed by the from state.
+	Transitions map[string][]string
+
+	// Guards are the optional guards checked before entering a state, keyed
+	// by the to state.
+	Guards map[string]GuardFn
+}
+
+// the machine state keys
+const (
+	machineStateKey   = "state"
+	machineChangedKey = "changed"
+)
+
+// load returns the current state and changed time of the machine. The
+// session must be locked.
+func (m *Machine) load(sess *session) (string, time.Time) {
+	v, ok := sess.data[m.Name].(map[string]interface{})
+	if !ok {
+		return m.Initial, time.Time{}
+	}
+
+	state, _ := v[machineStateKey].(string)
+	changed, ok := int64Value(v[machineChangedKey])
+	if !ok {
+		return state, time.Time{}
+	}
+	return state, time.Unix(0, changed)
+}
+
+// State returns the current state of the machine.
+func (m *Machine) State(ctxt context.Context) string {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	state, _ := m.load(sess)
+	return state
+}
+
+// Changed returns the time the current state was entered, or the zero time
+// if the machine is in its initial state.
+func (m *Machine) Changed(ctxt context.Context) time.Time {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	_, changed := m.load(sess)
+	return changed
+}
+
+// Can determines if the machine can transition to the to state from its
+// current state, not including any guards.
+func (m *Machine) Can(ctxt context.Context, to string) bool {
+	return m.allowed(m.State(ctxt), to)
+}
+
+// allowed determines if the transition is allowed.
+func (m *Machine) allowed(from, to string) bool {
+	for _, s := range m.Transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition transitions the machine to the to state, returning a
+// *TransitionError if the transition is not allowed, or the error of the
+// guard for the to state.
+//
+// Transitions are serialized per session, so concurrent requests attempting
+// the same transition will not both succeed. As this relies on the session
+// being locked for the duration of each request, Transition returns
+// ErrMachineUnlocked when Config.Locking is not set. Guards are called without
+// the session locked, and may freely use Get, Set, and the other accessors.
+func (m *Machine) Transition(ctxt context.Context, to string) error {
+	sess := fromContext(ctxt)
+	if sess.s != nil && !sess.s.locking {
+		return ErrMachineUnlocked
+	}
+
+	sess.machine.Lock()
+	defer sess.machine.Unlock()
+
+	from := m.State(ctxt)
+	if !m.allowed(from, to) {
+		return &TransitionError{
+			Machine: m.Name,
+			From:    from,
+			To:      to,
+		}
+	}
+
+	if g, ok := m.Guards[to]; ok {
+		if err := g(ctxt, from, to); err != nil {
+			return err
+		}
+	}
+
+	sess.Lock()
+
+	// recheck, as the guard (or a handler) may have changed the state
+	if cur, _ := m.load(sess); cur != from {
+		sess.Unlock()
+		return &TransitionError{
+			Machine: m.Name,
+			From:    cur,
+			To:      to,
+		}
+	}
+
+	sess.data[m.Name] = map[string]interface{}{
+		machineStateKey:   to,
+		machineChangedKey: sess.s.now().UnixNano(),
+	}
+	sess.modified = true
+	sess.dirty(m.Name)
+	sess.Unlock()
+
+	audit(ctxt, AuditSet, m.Name)
+	return nil
+}
+
+// Reset removes the machine from the session, returning it to its initial
+// state.
+func (m *Machine) Reset(ctxt context.Context) {
+	Delete(ctxt, m.Name)
+}
@@ -0,0 +1,230 @@
+package sessionmw
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"goji.io"
+	"golang.org/x/net/context"
+)
+
+// managed is the state of a session loaded by a Manager.
+type managed struct {
+	sess *session
+	once sync.Once
+}
+
+// HandlerManager returns the Manager of the session middleware h, as
+// previously returned by Config.Handler or Manager.Handler.
+func HandlerManager(h goji.Handler) (*Manager, error) {
+	s, ok := h.(*sessMiddleware)
+	if !ok {
+		return nil, errors.New("sessionmw HandlerManager requires a session middleware handler")
+	}
+	return s.Manager, nil
+}
+
+// Load loads the session of the session middleware h identified by the
+// session cookie in the provided Cookie header value. Load is shorthand for
+// HandlerManager followed by Manager.Load.
+func Load(ctxt context.Context, h goji.Handler, cookie string) (context.Context, error) {
+	s, err := HandlerManager(h)
+	if err != nil {
+		return nil, err
+	}
+	return s.Load(ctxt, cookie)
+}
+
+// NewSession creates a new session, returning a context for use with the
+// session funcs. The session is saved by Save only when modified, or when
+// Config.SaveUninitialized is set.
+func (s *Manager) NewSession(ctxt context.Context) (context.Context, error) {
+	sess := s.newSession()
+	sess.id, sess.s = s.idFn(), s
+	sess.touch(nil, s.now())
+	return s.manage(ctxt, sess), nil
+}
+
+// Load loads the session identified by the session cookie in the provided
+// Cookie header value (ie, the Cookie header of a WebSocket upgrade request),
+// returning a context for use with the session funcs.
+//
+// ErrSessionNotFound is returned when there is no valid session cookie (see
+// LoadID for other errors). As there is no request, the session is not
+// checked against its bound IP address or User-Agent (see Config.BindIP).
+func (s *Manager) Load(ctxt context.Context, cookie string) (context.Context, error) {
+	sessID, ok, _ := s.sessionID(&http.Request{Header: http.Header{"Cookie": {cookie}}})
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s.LoadID(ctxt, sessID)
+}
+
+// LoadID loads the session with the provided id, returning a context for use
+// with the session funcs.
+//
+// The store's error is returned when the session cannot be read (ie,
+// ErrSessionNotFound, or ErrTampered after destroying the session), and
+// ErrSessionNotFound when the id is not valid (see Config.IDValidator) or the
+// session has exceeded its maximum lifetime (see Config.MaxLifetime).
+func (s *Manager) LoadID(ctxt context.Context, id string) (context.Context, error) {
+	if !s.idValidator(id) {
+		return nil, ErrSessionNotFound
+	}
+
+	// lock before reading from storage
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := s.read(id)
+	return s.load(ctxt, id, d, err, unlock)
+}
+
+// lock locks the session with the provided id when locking is enabled (see
+// Config.Locking), returning the func releasing the lock, if any.
+func (s *Manager) lock(id string) (func(), error) {
+	if !s.locking {
+		return nil, nil
+	}
+	return s.st.(LockingStore).Lock(id, s.lockTimeout)
+}
+
+// load creates the session with the provided id from the data d read from
+// the store (or the error err returned reading it), returning a context for
+// use with the session funcs. The unlock func releases the session lock, if
+// any, and is called when the session cannot be loaded.
+func (s *Manager) load(ctxt context.Context, id string, d interface{}, err error, unlock func()) (context.Context, error) {
+	release := func() {
+		if unlock != nil {
+			unlock()
+		}
+	}
+
+	if err == ErrTampered {
+		s.tampered(ctxt, id)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	data, ok := d.(map[string]interface{})
+	if !ok || revoked(data) || s.belowWatermark(data) {
+		release()
+		return nil, ErrSessionNotFound
+	}
+
+	sess := &session{id: id, s: s, data: copyData(data).(map[string]interface{}), unlock: unlock, version: Version(data)}
+
+	// enforce maximum lifetime
+	now := s.now()
+	if created := sess.created(now); s.maxLifetime > 0 && now.Sub(created) > s.maxLifetime {
+		s.st.Erase(id)
+		if s.onExpire != nil {
+			s.onExpire(ctxt, id)
+		}
+		release()
+		return nil, ErrSessionNotFound
+	}
+	s.migrate(sess)
+	sess.expireKeys(now)
+	sess.touch(nil, now)
+
+	return s.manage(ctxt, sess), nil
+}
+
+// manage adds the session to the context as a session managed by s.
+func (s *Manager) manage(ctxt context.Context, sess *session) context.Context {
+	s.pending.add()
+
+	ns := &namedSession{sess: sess, managed: &managed{sess: sess}}
+	if s.audit != nil {
+		ns.auditor = &auditor{sink: s.audit}
+	}
+	return ns.withValue(ctxt)
+}
+
+// managed returns the managed session state of the context.
+func (s *Manager) managed(ctxt context.Context) (*managed, error) {
+	ns, _ := ctxt.Value(sessionContextKey).(*namedSession)
+	for ns != nil && ns.managed == nil {
+		ns = ns.parent
+	}
+	if ns == nil || ns.managed.sess.s != s {
+		return nil, errors.New("sessionmw context was not loaded by the Manager")
+	}
+	return ns.managed, nil
+}
+
+// Save saves the session loaded by the Manager to the store, unless it was
+// destroyed, and releases it.
+func (s *Manager) Save(ctxt context.Context) error {
+	ms, err := s.managed(ctxt)
+	if err != nil {
+		return err
+	}
+
+	ms.once.Do(func() {
+		defer s.release(ms.sess)
+		err = s.save(ctxt, nil, ms.sess)
+	})
+	return err
+}
+
+// Release releases the session loaded by the Manager without saving it.
+func (s *Manager) Release(ctxt context.Context) error {
+	ms, err := s.managed(ctxt)
+	if err != nil {
+		return err
+	}
+
+	ms.once.Do(func() {
+		s.release(ms.sess)
+	})
+	return nil
+}
+
+// Destroy permanently destroys the session loaded by the Manager (see
+// Destroy), and releases it.
+func (s *Manager) Destroy(ctxt context.Context) error {
+	ms, err := s.managed(ctxt)
+	if err != nil {
+		return err
+	}
+
+	ms.once.Do(func() {
+		defer s.release(ms.sess)
+		err = Destroy(ctxt)
+	})
+	return err
+}
+
+// RenewID changes the id of the session loaded by the Manager, keeping the
+// session values (see Regenerate). The cookie for the new id is available
+// with Cookie.
+func (s *Manager) RenewID(ctxt context.Context) error {
+	if _, err := s.managed(ctxt); err != nil {
+		return err
+	}
+	return Regenerate(ctxt)
+}
+
+// Cookie returns the session cookie for the session loaded by the Manager,
+// for use with custom transports.
+func (s *Manager) Cookie(ctxt context.Context) (*http.Cookie, error) {
+	if _, err := s.managed(ctxt); err != nil {
+		return nil, err
+	}
+	return s.newCookie(ID(ctxt))
+}
+
+// release unlocks the session and marks it as no longer pending.
+func (s *Manager) release(sess *session) {
+	if sess.unlock != nil {
+		sess.unlock()
+	}
+	s.pending.done()
+}
@@ -0,0 +1,186 @@
+package sessionmw
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// metaKey is the reserved session key holding the session metadata.
+const metaKey = "_sessionmw"
+
+// the session metadata keys
+const (
+	metaCreatedKey   = "created"
+	metaActiveKey    = "active"
+	metaIPKey        = "ip"
+	metaUserAgentKey = "ua"
+	metaUserKey      = "user"
+	metaIssuedKey    = "issued"
+)
+
+// Metadata is the metadata recorded for a session.
+type Metadata struct {
+	// Created is the time the session was created.
+	Created time.Time
+
+	// LastActive is the time of the last request for the session.
+	LastActive time.Time
+
+	// IP is the remote IP address of the request that created the session
+	// (see Config.RemoteIPFn).
+	IP string
+
+	// UserAgent is the hex encoded SHA-256 hash of the User-Agent header of
+	// the request that created the session.
+	UserAgent string
+
+	// User is the user the session was bound to with SetUser, or the
+	// impersonated user (see Impersonate).
+	User string
+
+	// Impersonator is the user impersonating User.
+	Impersonator string
+}
+
+// Meta retrieves the metadata for the session from the context.
+//
+// The last active time is saved with the session, but does not by itself
+// mark the session as modified. As such, it is not saved for new sessions
+// that are not otherwise persisted, nor for unmodified sessions on read only
+// requests (see Config.ReadOnly).
+func Meta(ctxt context.Context) Metadata {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return metadata(sess.data)
+}
+
+// metadata returns the metadata recorded in the session data.
+func metadata(data map[string]interface{}) Metadata {
+	m, _ := data[metaKey].(map[string]interface{})
+	md := Metadata{}
+	if n, ok := int64Value(m[metaCreatedKey]); ok {
+		md.Created = time.Unix(0, n)
+	}
+	if n, ok := int64Value(m[metaActiveKey]); ok {
+		md.LastActive = time.Unix(0, n)
+	}
+	md.IP, _ = m[metaIPKey].(string)
+	md.UserAgent, _ = m[metaUserAgentKey].(string)
+	md.User, _ = m[metaUserKey].(string)
+	md.Impersonator, _ = m[metaImpersonatorKey].(string)
+
+	return md
+}
+
+// copyData returns a copy of the session data obj, copying its nested maps,
+// so that changes to a loaded session are not made to the object held by
+// stores returning references to their stored objects (ie, kv.MemStore).
+func copyData(obj interface{}) interface{} {
+	d, ok := obj.(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	c := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		c[k] = copyData(v)
+	}
+	return c
+}
+
+// meta returns the session metadata, creating it if it does not exist. The
+// session must be locked.
+func (sess *session) meta() map[string]interface{} {
+	m, ok := sess.data[metaKey].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		sess.data[metaKey] = m
+	}
+	return m
+}
+
+// created returns the creation time of the session, recording now as the
+// creation time if not previously recorded. The session must be locked.
+func (sess *session) created(now time.Time) time.Time {
+	m := sess.meta()
+	if n, ok := int64Value(m[metaCreatedKey]); ok {
+		return time.Unix(0, n)
+	}
+	m[metaCreatedKey] = now.UnixNano()
+	return now
+}
+
+// issue sets the pending cookie for the session, recording now as the time
+// the cookie was issued. The session must be locked.
+func (sess *session) issue(c *http.Cookie, now time.Time) {
+	sess.cookie = c
+	sess.meta()[metaIssuedKey] = now.UnixNano()
+	sess.dirty(metaKey)
+}
+
+// ExpiresAt returns the time the session in the context expires, being the
+// earliest of the cookie's expiration (see Config.Expires and
+// Config.MaxAge), and the end of the session's maximum lifetime (see
+// Config.MaxLifetime), so that handlers can notify users of, or
+// preemptively extend (see Touch), expiring sessions.
+//
+// The zero time is returned when the session does not expire (ie, when the
+// cookie lasts until the browser is closed).
+func ExpiresAt(ctxt context.Context) time.Time {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	s := sess.s
+	m, _ := sess.data[metaKey].(map[string]interface{})
+	var t []time.Time
+	if !s.expires.IsZero() {
+		t = append(t, s.expires)
+	}
+	if n, ok := int64Value(m[metaIssuedKey]); ok && s.scMaxAge > 0 {
+		t = append(t, time.Unix(0, n).Add(time.Duration(s.scMaxAge)*time.Second))
+	}
+	if n, ok := int64Value(m[metaCreatedKey]); ok && s.maxLifetime > 0 {
+		t = append(t, time.Unix(0, n).Add(s.maxLifetime))
+	}
+
+	var expires time.Time
+	for _, v := range t {
+		if expires.IsZero() || v.Before(expires) {
+			expires = v
+		}
+	}
+	return expires
+}
+
+// touch records req as the last activity for the session at now, and the
+// origin of new sessions. The req is nil for sessions loaded by a Manager.
+// The session must be locked.
+func (sess *session) touch(req *http.Request, now time.Time) {
+	m := sess.meta()
+	if sess.isNew && req != nil {
+		m[metaIPKey], m[metaUserAgentKey] = sess.s.remoteIPFn(req), userAgentHash(req)
+	}
+	m[metaActiveKey] = now.UnixNano()
+	sess.dirty(metaKey)
+}
+
+// int64Value converts v to an int64, accounting for the representations of
+// integers produced by the different payload codecs.
+func int64Value(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
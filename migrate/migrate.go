@@ -0,0 +1,236 @@
+// Package migrate provides utilities for copying sessions between
+// sessionmw.Store implementations, and for exporting and importing sessions
+// as JSON, so that applications can move to a different store without
+// logging out their users.
+//
+// The source store must be a sessionmw.KeysStore. When the source is a
+// sessionmw.TTLStore, the remaining lifetime of each session is preserved
+// when writing to a destination that is also a sessionmw.TTLStore. Otherwise
+// sessions are written with the destination's default expiration.
+//
+// Reserved keys (see sessionmw.Reserved), such as the per user session
+// indexes, are not listed by the source store and are not copied.
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+// ErrNotListable is the error returned when the source store cannot list its
+// sessions (see sessionmw.KeysStore).
+var ErrNotListable = errors.New("source store cannot list sessions")
+
+// Options are the options for copying, exporting, and importing sessions.
+type Options struct {
+	// Rate is the maximum number of sessions processed per second, limiting
+	// the load on the stores. If 0, then the rate is not limited.
+	Rate int
+
+	// DryRun reads the sessions without writing them to the destination, so
+	// that the number of sessions to be copied can be checked beforehand.
+	DryRun bool
+
+	// RedactKeys are the patterns of the session keys whose values are
+	// redacted by Export (see sessionmw.Redact), for exports used for
+	// debugging. Redacted exports cannot be imported without losing the
+	// redacted values.
+	RedactKeys []string
+}
+
+// Stats are the statistics of a copy, export, or import.
+type Stats struct {
+	// Copied is the number of sessions copied (or that would have been
+	// copied, for a dry run).
+	Copied int
+
+	// Skipped is the number of sessions that expired or were erased while
+	// copying.
+	Skipped int
+}
+
+// Entry is an exported session.
+type Entry struct {
+	// ID is the session id.
+	ID string `json:"id"`
+
+	// TTL is the remaining lifetime of the session in milliseconds at the
+	// time of the export, if known.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// Data is the session data.
+	Data interface{} `json:"data"`
+}
+
+// limiter limits the rate of operations.
+type limiter struct {
+	t *time.Ticker
+}
+
+// newLimiter creates a limiter allowing rate operations per second. If rate
+// is 0, then the limiter does not limit operations.
+func newLimiter(rate int) *limiter {
+	l := &limiter{}
+	if rate > 0 {
+		l.t = time.NewTicker(time.Second / time.Duration(rate))
+	}
+	return l
+}
+
+// wait waits until the next operation is allowed.
+func (l *limiter) wait() {
+	if l.t != nil {
+		<-l.t.C
+	}
+}
+
+// stop stops the limiter.
+func (l *limiter) stop() {
+	if l.t != nil {
+		l.t.Stop()
+	}
+}
+
+// each calls fn with the id, data, and remaining lifetime (0 if unknown) of
+// each session in src.
+func each(src sessionmw.Store, opts Options, fn func(string, interface{}, time.Duration) error) (Stats, error) {
+	var stats Stats
+
+	ks, ok := src.(sessionmw.KeysStore)
+	if !ok {
+		return stats, ErrNotListable
+	}
+	ids, err := ks.Keys()
+	if err != nil {
+		return stats, err
+	}
+	sort.Strings(ids)
+
+	ts, _ := src.(sessionmw.TTLStore)
+
+	l := newLimiter(opts.Rate)
+	defer l.stop()
+
+	for _, id := range ids {
+		l.wait()
+
+		obj, err := src.Read(id)
+		if err == sessionmw.ErrSessionNotFound {
+			stats.Skipped++
+			continue
+		} else if err != nil {
+			return stats, err
+		}
+
+		var ttl time.Duration
+		if ts != nil {
+			ttl, err = ts.TTL(id)
+			if err == sessionmw.ErrSessionNotFound {
+				stats.Skipped++
+				continue
+			} else if err != nil {
+				return stats, err
+			}
+		}
+
+		if err = fn(id, obj, ttl); err != nil {
+			return stats, err
+		}
+		stats.Copied++
+	}
+
+	return stats, nil
+}
+
+// write writes the session to dst, expiring it after ttl when ttl is not 0
+// and dst is a sessionmw.TTLStore.
+func write(dst sessionmw.Store, id string, obj interface{}, ttl time.Duration) error {
+	if ts, ok := dst.(sessionmw.TTLStore); ok && ttl > 0 {
+		return ts.WriteTTL(id, obj, ttl)
+	}
+	return dst.Write(id, obj)
+}
+
+// Copy copies all sessions in src to dst.
+func Copy(src, dst sessionmw.Store, opts Options) (Stats, error) {
+	return each(src, opts, func(id string, obj interface{}, ttl time.Duration) error {
+		if opts.DryRun {
+			return nil
+		}
+		return write(dst, id, obj, ttl)
+	})
+}
+
+// Export writes all sessions in src to w as JSON encoded Entry values, one
+// per line.
+func Export(src sessionmw.Store, w io.Writer, opts Options) (Stats, error) {
+	enc := json.NewEncoder(w)
+	return each(src, opts, func(id string, obj interface{}, ttl time.Duration) error {
+		if m, ok := obj.(map[string]interface{}); ok && len(opts.RedactKeys) > 0 {
+			obj = sessionmw.Redact(m, opts.RedactKeys)
+		}
+		return enc.Encode(Entry{ID: id, TTL: int64(ttl / time.Millisecond), Data: obj})
+	})
+}
+
+// Import writes the sessions exported with Export read from r to dst.
+//
+// As JSON does not preserve Go types, numbers are written as int64 (or
+// float64 when not integral), and other values as their JSON types.
+func Import(r io.Reader, dst sessionmw.Store, opts Options) (Stats, error) {
+	var stats Stats
+
+	l := newLimiter(opts.Rate)
+	defer l.stop()
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var e Entry
+		switch err := dec.Decode(&e); {
+		case err == io.EOF:
+			return stats, nil
+		case err != nil:
+			return stats, err
+		}
+		if e.ID == "" {
+			return stats, errors.New("exported session has no id")
+		}
+
+		l.wait()
+		if !opts.DryRun {
+			err := write(dst, e.ID, fromJSON(e.Data), time.Duration(e.TTL)*time.Millisecond)
+			if err != nil {
+				return stats, err
+			}
+		}
+		stats.Copied++
+	}
+}
+
+// fromJSON converts the json.Number values in the decoded JSON value v to
+// int64 (or float64 when not integral).
+func fromJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, val := range x {
+			x[k] = fromJSON(val)
+		}
+	case []interface{}:
+		for i, val := range x {
+			x[i] = fromJSON(val)
+		}
+	}
+	return v
+}
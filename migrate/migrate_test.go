@@ -0,0 +1,158 @@
+package migrate
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+// ttlStore is a sessionmw.TTLStore and sessionmw.KeysStore.
+type ttlStore struct {
+	sync.Mutex
+	data map[string]interface{}
+	ttls map[string]time.Duration
+}
+
+func newTTLStore() *ttlStore {
+	return &ttlStore{
+		data: make(map[string]interface{}),
+		ttls: make(map[string]time.Duration),
+	}
+}
+
+func (ts *ttlStore) Write(key string, obj interface{}) error {
+	return ts.WriteTTL(key, obj, time.Hour)
+}
+
+func (ts *ttlStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.data[key], ts.ttls[key] = obj, ttl
+	return nil
+}
+
+func (ts *ttlStore) Read(key string) (interface{}, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	obj, ok := ts.data[key]
+	if !ok {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+	return obj, nil
+}
+
+func (ts *ttlStore) Erase(key string) error {
+	ts.Lock()
+	defer ts.Unlock()
+	delete(ts.data, key)
+	delete(ts.ttls, key)
+	return nil
+}
+
+func (ts *ttlStore) Keys() ([]string, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	var keys []string
+	for k := range ts.data {
+		keys = append(keys, k)
+	}
+	// include an erased session
+	return append(keys, "erased"), nil
+}
+
+func (ts *ttlStore) TTL(key string) (time.Duration, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	ttl, ok := ts.ttls[key]
+	if !ok {
+		return 0, sessionmw.ErrSessionNotFound
+	}
+	return ttl, nil
+}
+
+func newSrc() *ttlStore {
+	src := newTTLStore()
+	src.WriteTTL("a", map[string]interface{}{"name": "a"}, time.Minute)
+	src.WriteTTL("b", map[string]interface{}{"name": "b"}, 2*time.Minute)
+	return src
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := newSrc(), newTTLStore()
+
+	stats, err := Copy(src, dst, Options{DryRun: true})
+	if err != nil || stats.Copied != 2 || stats.Skipped != 1 || len(dst.data) != 0 {
+		t.Errorf("expected 2 sessions not to be copied, got: %+v %d (%v)", stats, len(dst.data), err)
+	}
+
+	stats, err = Copy(src, dst, Options{Rate: 1000})
+	if err != nil || stats.Copied != 2 || stats.Skipped != 1 {
+		t.Fatalf("expected 2 copied sessions, got: %+v (%v)", stats, err)
+	}
+	if dst.ttls["a"] != time.Minute || dst.ttls["b"] != 2*time.Minute {
+		t.Errorf("expected ttls to be preserved, got: %v", dst.ttls)
+	}
+	if dst.data["b"].(map[string]interface{})["name"] != "b" {
+		t.Errorf("expected name=b, got: %v", dst.data["b"])
+	}
+
+	// default ttl without a TTLStore source
+	dst = newTTLStore()
+	if _, err = Copy(struct{ sessionmw.KeysStore }{src}, dst, Options{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if dst.ttls["a"] != time.Hour {
+		t.Errorf("expected default ttl, got: %v", dst.ttls["a"])
+	}
+
+	if _, err = Copy(struct{ sessionmw.Store }{src}, dst, Options{}); err != ErrNotListable {
+		t.Errorf("expected ErrNotListable, got: %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, dst := newSrc(), newTTLStore()
+	src.Write("c", map[string]interface{}{"n": 1, "f": 1.5, "l": []interface{}{2}})
+
+	var buf bytes.Buffer
+	stats, err := Export(src, &buf, Options{})
+	if err != nil || stats.Copied != 3 {
+		t.Fatalf("expected 3 exported sessions, got: %+v (%v)", stats, err)
+	}
+	exp := `{"id":"a","ttl":60000,"data":{"name":"a"}}` + "\n"
+	if s := buf.String(); !strings.HasPrefix(s, exp) {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+
+	if stats, err = Import(strings.NewReader(buf.String()), dst, Options{DryRun: true}); err != nil || stats.Copied != 3 || len(dst.data) != 0 {
+		t.Errorf("expected 3 sessions not to be imported, got: %+v %d (%v)", stats, len(dst.data), err)
+	}
+
+	if stats, err = Import(&buf, dst, Options{}); err != nil || stats.Copied != 3 {
+		t.Fatalf("expected 3 imported sessions, got: %+v (%v)", stats, err)
+	}
+	if dst.ttls["a"] != time.Minute || dst.ttls["c"] != time.Hour {
+		t.Errorf("expected ttls to be preserved, got: %v", dst.ttls)
+	}
+	c := dst.data["c"].(map[string]interface{})
+	if c["n"] != int64(1) || c["f"] != 1.5 || c["l"].([]interface{})[0] != int64(2) {
+		t.Errorf("expected converted numbers, got: %v", c)
+	}
+
+	buf.Reset()
+	if _, err = Export(src, &buf, Options{RedactKeys: []string{"NAME"}}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp = `{"id":"a","ttl":60000,"data":{"name":"[REDACTED]"}}` + "\n"
+	if s := buf.String(); !strings.HasPrefix(s, exp) {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+
+	if _, err = Import(strings.NewReader(`{"data":{}}`), dst, Options{}); err == nil {
+		t.Errorf("expected error importing session without id")
+	}
+}
@@ -0,0 +1,143 @@
+package sessionmw
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultMirrorCookieName is the default mirror cookie name.
+	DefaultMirrorCookieName = "SESSPUB"
+)
+
+// ErrInvalidMirror is the error returned when a mirror cookie value cannot be
+// verified.
+var ErrInvalidMirror = errors.New("invalid mirror cookie")
+
+// mirror provides the JavaScript readable (ie, non-HttpOnly) cookie that
+// mirrors a subset of non-sensitive session values.
+//
+// The mirror cookie value is formatted as "<payload>.<signature>", where
+// payload is the base64 (URL encoding, no padding) encoded JSON of the
+// mirrored values, and signature is the base64 encoded HMAC-SHA256 of the
+// cookie name and payload.
+type mirror struct {
+	secret []byte
+	name   string
+	keys   []string
+}
+
+// deriveKey derives a separate key from secret for the named purpose.
+func deriveKey(secret []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// signMirror returns the HMAC-SHA256 of the cookie name and payload.
+func signMirror(secret []byte, name, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(name + "|" + payload))
+	return h.Sum(nil)
+}
+
+// encode encodes and signs vals.
+func (m *mirror) encode(vals map[string]interface{}) (string, error) {
+	buf, err := json.Marshal(vals)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	sig := signMirror(m.secret, m.name, payload)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// values returns the mirrored values from sess, or nil if sess was
+// destroyed.
+func (m *mirror) values(sess *session) map[string]interface{} {
+	sess.RLock()
+	defer sess.RUnlock()
+
+	if sess.destroyed {
+		return nil
+	}
+
+	vals := make(map[string]interface{})
+	for _, k := range m.keys {
+		if v, ok := sess.data[k]; ok {
+			vals[k] = v
+		}
+	}
+
+	return vals
+}
+
+// setCookie writes the mirror cookie for sess to res, expiring any existing
+// mirror cookie when there are no values to mirror, the session was
+// destroyed, or the values could not be encoded.
+func (m *mirror) setCookie(s *Manager, res http.ResponseWriter, req *http.Request, sess *session) {
+	c := &http.Cookie{
+		Name:   m.name,
+		Path:   s.path,
+		Domain: sess.domain,
+		Secure: s.secure,
+	}
+
+	prev, _ := req.Cookie(m.name)
+
+	var v string
+	var err error
+	if vals := m.values(sess); len(vals) != 0 {
+		v, err = m.encode(vals)
+	}
+
+	if v == "" || err != nil {
+		// only expire when the client sent a mirror cookie
+		if prev == nil {
+			return
+		}
+		c.Value, c.Expires, c.MaxAge = "-", s.destroyExpires, -1
+		http.SetCookie(res, c)
+		return
+	}
+
+	// skip when unchanged
+	if prev != nil && prev.Value == v {
+		return
+	}
+
+	c.Value, c.Expires, c.MaxAge = v, s.expires, s.scMaxAge
+	http.SetCookie(res, c)
+}
+
+// DecodeMirror verifies and decodes the value of the mirror cookie with the
+// provided name, previously signed using secret (see Config.MirrorSecret).
+func DecodeMirror(secret []byte, name, value string) (map[string]interface{}, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil, ErrInvalidMirror
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, signMirror(secret, name, value[:i])) {
+		return nil, ErrInvalidMirror
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, ErrInvalidMirror
+	}
+
+	vals := make(map[string]interface{})
+	if err = json.Unmarshal(buf, &vals); err != nil {
+		return nil, ErrInvalidMirror
+	}
+
+	return vals, nil
+}
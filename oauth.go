@@ -0,0 +1,108 @@
+package sessionmw
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultOAuthTTL is the default lifetime of pending OAuth logins.
+const DefaultOAuthTTL = 10 * time.Minute
+
+// metaOAuthKey is the session metadata key holding the pending OAuth login.
+const metaOAuthKey = "oauth"
+
+// ErrInvalidOAuthState is the error returned by CompleteOAuth when the
+// session has no pending OAuth login, or when the login expired or its state
+// does not match.
+var ErrInvalidOAuthState = errors.New("invalid oauth state")
+
+// OAuthLogin is a pending OAuth2 (or OpenID Connect) authorization code login.
+type OAuthLogin struct {
+	// State is the state parameter of the authorization request.
+	State string
+
+	// Nonce is the nonce parameter of the OpenID Connect authorization
+	// request, to compare with the nonce claim of the ID token.
+	Nonce string
+
+	// Verifier is the PKCE code verifier, for the code_verifier parameter of
+	// the token request.
+	Verifier string
+}
+
+// Challenge returns the S256 PKCE code challenge of the verifier, for the
+// code_challenge parameter (with a code_challenge_method of S256) of the
+// authorization request.
+func (l OAuthLogin) Challenge() string {
+	sum := sha256.Sum256([]byte(l.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// BeginOAuth starts an OAuth login for the session, storing a new random
+// state, nonce, and PKCE verifier that expire after the Config.OAuthTTL, and
+// marking the response (ie, the redirect to the authorization endpoint) as
+// not cacheable. Only one login may be pending at a time: beginning a login
+// replaces any pending login.
+func BeginOAuth(ctxt context.Context, res http.ResponseWriter) OAuthLogin {
+	l := OAuthLogin{
+		State:    newToken(),
+		Nonce:    newToken(),
+		Verifier: newToken(),
+	}
+
+	sess := fromContext(ctxt)
+	sess.Lock()
+	sess.meta()[metaOAuthKey] = map[string]interface{}{
+		"state":    l.State,
+		"nonce":    l.Nonce,
+		"verifier": l.Verifier,
+		"expires":  sess.s.now().Add(sess.s.oauthTTL).UnixNano(),
+	}
+	sess.modified = true
+	sess.dirty(metaKey)
+	sess.Unlock()
+
+	res.Header().Set("Cache-Control", "no-store")
+	return l
+}
+
+// CompleteOAuth completes the pending OAuth login of the session, returning
+// the login for the state parameter of the authorization response, or
+// ErrInvalidOAuthState. The pending login is consumed, whether or not it
+// matches, so that the state cannot be guessed, or replayed.
+//
+// The session is regenerated (see Regenerate) once the login is completed,
+// preventing session fixation.
+func CompleteOAuth(ctxt context.Context, state string) (OAuthLogin, error) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	m := sess.meta()
+	v, _ := m[metaOAuthKey].(map[string]interface{})
+	if v != nil {
+		delete(m, metaOAuthKey)
+		sess.modified = true
+		sess.dirty(metaKey)
+	}
+	now := sess.s.now()
+	sess.Unlock()
+
+	l := OAuthLogin{}
+	l.State, _ = v["state"].(string)
+	l.Nonce, _ = v["nonce"].(string)
+	l.Verifier, _ = v["verifier"].(string)
+	expires, _ := int64Value(v["expires"])
+	if l.State == "" || now.UnixNano() >= expires || subtle.ConstantTimeCompare([]byte(state), []byte(l.State)) != 1 {
+		return OAuthLogin{}, ErrInvalidOAuthState
+	}
+
+	if err := Regenerate(ctxt); err != nil {
+		return OAuthLogin{}, err
+	}
+	return l, nil
+}
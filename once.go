@@ -0,0 +1,80 @@
+package sessionmw
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// metaOnceKey is the session metadata key holding the keys of the session
+// values set with SetOnce.
+const metaOnceKey = "once"
+
+// SetOnce stores a session value into the context that is removed from the
+// session after it is first retrieved with Get (ie, for OAuth state, download
+// tokens, or post-redirect-get payloads). Has and Values do not remove the
+// value.
+//
+// Storing the value again with Set (or deleting it) makes it a regular value.
+func SetOnce(ctxt context.Context, key string, val interface{}) {
+	setOnce(ctxt, key, val, 0)
+}
+
+// SetOnceWithTTL stores a session value into the context as SetOnce, also
+// expiring the value after ttl when it is not retrieved (see SetWithTTL).
+func SetOnceWithTTL(ctxt context.Context, key string, val interface{}, ttl time.Duration) {
+	setOnce(ctxt, key, val, ttl)
+}
+
+// setOnce stores a session value removed after it is first retrieved,
+// expiring the value after ttl, if not 0.
+func setOnce(ctxt context.Context, key string, val interface{}, ttl time.Duration) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	sess.persistKey(key)
+	if ttl != 0 {
+		sess.expireKey(key, sess.s.now().Add(ttl))
+	}
+	m, _ := sess.meta()[metaOnceKey].(map[string]interface{})
+	if m == nil {
+		m = make(map[string]interface{})
+		sess.meta()[metaOnceKey] = m
+	}
+	m[key] = true
+	sess.data[key] = sess.s.normalize(val)
+	sess.modified = true
+	sess.dirty(key)
+	sess.dirty(metaKey)
+	sess.Unlock()
+
+	audit(ctxt, AuditSet, key)
+}
+
+// isOnce determines if the session value for key was set with SetOnce. The
+// session must be locked (for reading).
+func (sess *session) isOnce(key string) bool {
+	md, _ := sess.data[metaKey].(map[string]interface{})
+	m, _ := md[metaOnceKey].(map[string]interface{})
+	_, ok := m[key]
+	return ok
+}
+
+// take removes the session value for key when it was set with SetOnce,
+// returning the value.
+func (sess *session) take(ctxt context.Context, key string) (interface{}, bool) {
+	sess.Lock()
+	val, ok := sess.data[key]
+	once := ok && sess.isOnce(key)
+	if once {
+		delete(sess.data, key)
+		sess.persistKey(key)
+		sess.modified = true
+		sess.dirty(key)
+	}
+	sess.Unlock()
+
+	if once {
+		audit(ctxt, AuditDelete, key)
+	}
+	return val, ok
+}
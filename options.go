@@ -0,0 +1,160 @@
+package sessionmw
+
+import (
+	"net/http"
+	"time"
+
+	"goji.io"
+)
+
+// Option is a session middleware option.
+type Option func(*Config)
+
+// New creates the session middleware using the provided options, returning
+// an error when the resulting configuration is not valid.
+func New(opts ...Option) (func(goji.Handler) goji.Handler, error) {
+	var c Config
+	for _, o := range opts {
+		o(&c)
+	}
+	return NewMiddleware(c)
+}
+
+// Options combines multiple options into a single option, allowing options
+// to be shared.
+func Options(opts ...Option) Option {
+	return func(c *Config) {
+		for _, o := range opts {
+			o(c)
+		}
+	}
+}
+
+// WithStore is a session middleware option to set the session store.
+func WithStore(st Store) Option {
+	return func(c *Config) {
+		c.Store = st
+	}
+}
+
+// WithSecret is a session middleware option to set the secrets used to sign
+// and encrypt cookies. Cookies are only signed when blockSecret is empty.
+func WithSecret(secret, blockSecret []byte) Option {
+	return func(c *Config) {
+		c.Secret, c.BlockSecret = secret, blockSecret
+	}
+}
+
+// WithIDFn is a session middleware option to set the id generation func.
+func WithIDFn(idFn IDFn) Option {
+	return func(c *Config) {
+		c.IDFn = idFn
+	}
+}
+
+// WithIDValidator is a session middleware option to set the session id
+// validation func.
+func WithIDValidator(idValidator func(string) bool) Option {
+	return func(c *Config) {
+		c.IDValidator = idValidator
+	}
+}
+
+// WithCookieName is a session middleware option to set the cookie name.
+func WithCookieName(name string) Option {
+	return func(c *Config) {
+		c.Name = name
+	}
+}
+
+// WithCookiePrefix is a session middleware option to set the cookie name
+// prefix (see Config.CookiePrefix).
+func WithCookiePrefix(prefix string) Option {
+	return func(c *Config) {
+		c.CookiePrefix = prefix
+	}
+}
+
+// WithPath is a session middleware option to set the cookie path.
+func WithPath(path string) Option {
+	return func(c *Config) {
+		c.Path = path
+	}
+}
+
+// WithDomain is a session middleware option to set the cookie domain.
+func WithDomain(domain string) Option {
+	return func(c *Config) {
+		c.Domain = domain
+	}
+}
+
+// WithCookieFn is a session middleware option to set the func invoked with
+// the session cookie before it is written (see Config.CookieFn).
+func WithCookieFn(cookieFn func(*http.Request, *http.Cookie)) Option {
+	return func(c *Config) {
+		c.CookieFn = cookieFn
+	}
+}
+
+// WithDomainFn is a session middleware option to set the func selecting the
+// cookie domain per request (see Config.DomainFn).
+func WithDomainFn(domainFn func(*http.Request) string) Option {
+	return func(c *Config) {
+		c.DomainFn = domainFn
+	}
+}
+
+// WithMaxAge is a session middleware option to set the cookie max age.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(c *Config) {
+		c.MaxAge = maxAge
+	}
+}
+
+// WithMaxAgeSeconds is a session middleware option to set the cookie max age
+// in seconds.
+func WithMaxAgeSeconds(maxAge int) Option {
+	return func(c *Config) {
+		c.MaxAgeSeconds = maxAge
+	}
+}
+
+// WithSecure is a session middleware option to set the cookie secure flag.
+func WithSecure(secure bool) Option {
+	return func(c *Config) {
+		c.Secure = secure
+	}
+}
+
+// WithHttpOnly is a session middleware option to set the cookie http only
+// flag.
+func WithHttpOnly(httpOnly bool) Option {
+	return func(c *Config) {
+		c.HttpOnly = httpOnly
+	}
+}
+
+// WithSaveUninitialized is a session middleware option to issue cookies for
+// and save new sessions that were not modified.
+func WithSaveUninitialized(saveUninitialized bool) Option {
+	return func(c *Config) {
+		c.SaveUninitialized = saveUninitialized
+	}
+}
+
+// WithSkip is a session middleware option to set the func determining which
+// requests bypass the session middleware.
+func WithSkip(skip func(*http.Request) bool) Option {
+	return func(c *Config) {
+		c.Skip = skip
+	}
+}
+
+// WithReadOnly is a session middleware option to set the func determining
+// which requests only save modified sessions.
+func WithReadOnly(readOnly func(*http.Request) bool) Option {
+	return func(c *Config) {
+		c.ReadOnly = readOnly
+	}
+}
@@ -0,0 +1,26 @@
+package sessionmw
+
+// dirty records key as changed. The session must be locked.
+func (sess *session) dirty(key string) {
+	if sess.changed == nil {
+		sess.changed = make(map[string]bool)
+	}
+	sess.changed[key] = true
+}
+
+// patch saves the changed values of the session to the patch store.
+func (s *Manager) patch(ps PatchStore, id string, sess *session) error {
+	sess.RLock()
+	set := make(map[string]interface{})
+	var del []string
+	for k := range sess.changed {
+		if v, ok := sess.data[k]; ok {
+			set[k] = v
+		} else {
+			del = append(del, k)
+		}
+	}
+	sess.RUnlock()
+
+	return ps.Patch(id, set, del)
+}
@@ -0,0 +1,546 @@
+// Package phpcompat provides interop with PHP applications using the phpredis
+// session handler, allowing a Go service and a PHP application to share the
+// same sessions during a gradual migration.
+//
+// Marshal and Unmarshal implement PHP's native serialize() format, and
+// EncodeSession and DecodeSession implement PHP's default "php" session
+// serialize handler. Store is a sessionmw.Store reading and writing sessions
+// under the phpredis PHPREDIS_SESSION: key convention, and IDSealer is a
+// sessionmw.Sealer using the plain session id as the cookie value (ie, as the
+// PHPSESSID cookie).
+//
+// As the session ids issued by PHP are not in the format of the default
+// sessionmw ids, the middleware's Config.IDValidator must be set to
+// sessionmw.ValidID (or a validator accepting PHP's ids).
+package phpcompat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+	"github.com/knq/sessionmw/redisstore"
+)
+
+const (
+	// DefaultPrefix is the default phpredis session key prefix.
+	DefaultPrefix = "PHPREDIS_SESSION:"
+
+	// DefaultCookieName is the default PHP session cookie name.
+	DefaultCookieName = "PHPSESSID"
+)
+
+var (
+	// ErrUnsupportedType is the error returned when marshaling a value that
+	// cannot be represented in PHP's serialize() format, or unmarshaling a
+	// serialized PHP object.
+	ErrUnsupportedType = errors.New("unsupported type")
+
+	// ErrInvalidKey is the error returned when encoding a session key that
+	// cannot be used with PHP's "php" session serialize handler.
+	ErrInvalidKey = errors.New("invalid session key")
+
+	// ErrInvalidID is the error returned when a session id is not a valid
+	// PHP session id.
+	ErrInvalidID = errors.New("invalid session id")
+)
+
+// SyntaxError is the error returned when unmarshaling malformed serialized
+// data.
+type SyntaxError struct {
+	// Offset is the offset in the data where the error occurred.
+	Offset int
+}
+
+// Error satisfies the error interface.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid serialized data at offset %d", e.Offset)
+}
+
+// Marshal returns the PHP serialize() encoding of v.
+//
+// Maps with string keys are serialized as associative arrays (with keys in
+// sorted order), and slices as indexed arrays. json.Number values are
+// serialized as integers or floats.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := marshal(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// marshal writes the serialized v to buf.
+func marshal(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("N;")
+		return nil
+	case bool:
+		if x {
+			buf.WriteString("b:1;")
+		} else {
+			buf.WriteString("b:0;")
+		}
+		return nil
+	case string:
+		fmt.Fprintf(buf, "s:%d:\"%s\";", len(x), x)
+		return nil
+	case []byte:
+		fmt.Fprintf(buf, "s:%d:\"%s\";", len(x), x)
+		return nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return marshal(buf, i)
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return err
+		}
+		return marshal(buf, f)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(buf, "i:%d;", rv.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return ErrUnsupportedType
+		}
+		fmt.Fprintf(buf, "i:%d;", rv.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		switch {
+		case math.IsNaN(f):
+			buf.WriteString("d:NAN;")
+		case math.IsInf(f, 1):
+			buf.WriteString("d:INF;")
+		case math.IsInf(f, -1):
+			buf.WriteString("d:-INF;")
+		default:
+			fmt.Fprintf(buf, "d:%s;", strconv.FormatFloat(f, 'g', -1, 64))
+		}
+
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(buf, "a:%d:{", rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			fmt.Fprintf(buf, "i:%d;", i)
+			if err := marshal(buf, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return ErrUnsupportedType
+		}
+
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(buf, "a:%d:{", len(keys))
+		for _, k := range keys {
+			marshal(buf, k)
+			if err := marshal(buf, rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface()); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+
+	default:
+		return ErrUnsupportedType
+	}
+
+	return nil
+}
+
+// Unmarshal decodes the PHP serialize() encoded data.
+//
+// Integers are decoded as int64, and floats as float64. Arrays with the
+// sequential keys 0 through n-1 are decoded as []interface{}, and all other
+// arrays (including empty arrays) as map[string]interface{}, with integer
+// keys converted to strings. Serialized PHP objects are not supported.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.syntaxError()
+	}
+	return v, nil
+}
+
+// decoder decodes PHP serialize() encoded data.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// syntaxError returns a syntax error at the current offset.
+func (d *decoder) syntaxError() error {
+	return &SyntaxError{Offset: d.pos}
+}
+
+// expect consumes s.
+func (d *decoder) expect(s string) error {
+	if !bytes.HasPrefix(d.data[d.pos:], []byte(s)) {
+		return d.syntaxError()
+	}
+	d.pos += len(s)
+	return nil
+}
+
+// until consumes and returns the data up to the delimiter c.
+func (d *decoder) until(c byte) (string, error) {
+	i := bytes.IndexByte(d.data[d.pos:], c)
+	if i < 0 {
+		return "", d.syntaxError()
+	}
+	s := string(d.data[d.pos : d.pos+i])
+	d.pos += i + 1
+	return s, nil
+}
+
+// int consumes an integer terminated by c.
+func (d *decoder) int(c byte) (int64, error) {
+	s, err := d.until(c)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, d.syntaxError()
+	}
+	return i, nil
+}
+
+// value decodes the next value.
+func (d *decoder) value() (interface{}, error) {
+	if d.pos+2 > len(d.data) {
+		return nil, d.syntaxError()
+	}
+
+	typ := d.data[d.pos]
+	if typ == 'N' {
+		return nil, d.expect("N;")
+	}
+	if d.data[d.pos+1] != ':' {
+		return nil, d.syntaxError()
+	}
+	d.pos += 2
+
+	switch typ {
+	case 'b':
+		i, err := d.int(';')
+		if err != nil {
+			return nil, err
+		}
+		return i != 0, nil
+
+	case 'i':
+		return d.int(';')
+
+	case 'd':
+		s, err := d.until(';')
+		if err != nil {
+			return nil, err
+		}
+		switch s {
+		case "NAN":
+			return math.NaN(), nil
+		case "INF":
+			return math.Inf(1), nil
+		case "-INF":
+			return math.Inf(-1), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, d.syntaxError()
+		}
+		return f, nil
+
+	case 's':
+		return d.string()
+
+	case 'a':
+		return d.array()
+
+	case 'O', 'C':
+		return nil, ErrUnsupportedType
+	}
+
+	return nil, d.syntaxError()
+}
+
+// string decodes the remainder of a string value.
+func (d *decoder) string() (string, error) {
+	n, err := d.int(':')
+	if err != nil {
+		return "", err
+	}
+	if err = d.expect("\""); err != nil {
+		return "", err
+	}
+	if n < 0 || int64(len(d.data)-d.pos) < n {
+		return "", d.syntaxError()
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	if err = d.expect("\";"); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// array decodes the remainder of an array value.
+func (d *decoder) array() (interface{}, error) {
+	n, err := d.int(':')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, d.syntaxError()
+	}
+	if err = d.expect("{"); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	indexed := true
+	for i := int64(0); i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		var key string
+		switch x := k.(type) {
+		case int64:
+			indexed = indexed && x == i
+			key = strconv.FormatInt(x, 10)
+		case string:
+			indexed = false
+			key = x
+		default:
+			return nil, d.syntaxError()
+		}
+
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	if err = d.expect("}"); err != nil {
+		return nil, err
+	}
+
+	if !indexed || n == 0 {
+		return m, nil
+	}
+
+	l := make([]interface{}, n)
+	for i := range l {
+		l[i] = m[strconv.Itoa(i)]
+	}
+	return l, nil
+}
+
+// EncodeSession encodes data using PHP's default "php" session serialize
+// handler, as the concatenation of each key, a '|', and the serialized value,
+// with keys in sorted order.
+func EncodeSession(data map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		if strings.Contains(k, "|") {
+			return nil, ErrInvalidKey
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := new(bytes.Buffer)
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte('|')
+		if err := marshal(buf, data[k]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeSession decodes session data encoded with PHP's default "php"
+// session serialize handler (see Unmarshal).
+func DecodeSession(buf []byte) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	d := &decoder{data: buf}
+	for d.pos < len(d.data) {
+		k, err := d.until('|')
+		if err != nil {
+			return nil, err
+		}
+		if data[k], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// Store is a phpredis compatible session store.
+//
+// Sessions are stored using PHP's default "php" session serialize handler
+// (see EncodeSession) under the key prefix, which should be the same as the
+// phpredis session prefix.
+type Store struct {
+	conn   redisstore.Conn
+	prefix string
+	ttl    time.Duration
+}
+
+// NewStore creates a phpredis compatible store using conn, storing sessions
+// under prefix. If prefix is empty, then DefaultPrefix will be used.
+//
+// Sessions expire ttl after they were last written, or never when ttl is 0 or
+// negative, and ttl should be the same as PHP's session.gc_maxlifetime.
+func NewStore(conn redisstore.Conn, prefix string, ttl time.Duration) *Store {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	return &Store{
+		conn:   conn,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Write saves the session for the provided id.
+func (s *Store) Write(key string, obj interface{}) error {
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return ErrUnsupportedType
+	}
+
+	buf, err := EncodeSession(data)
+	if err != nil {
+		return err
+	}
+
+	if s.ttl <= 0 {
+		_, err = s.conn.Do("SET", s.prefix+key, buf)
+	} else {
+		_, err = s.conn.Do("SET", s.prefix+key, buf, "PX", int64(s.ttl/time.Millisecond))
+	}
+	return err
+}
+
+// Read retrieves the session for the provided id.
+func (s *Store) Read(key string) (interface{}, error) {
+	v, err := s.conn.Do("GET", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	buf, ok := v.([]byte)
+	if !ok {
+		return nil, redisstore.ErrUnexpectedReply
+	}
+
+	return DecodeSession(buf)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (s *Store) Erase(key string) error {
+	_, err := s.conn.Do("DEL", s.prefix+key)
+	return err
+}
+
+// Close closes the underlying connection, if it is an io.Closer.
+func (s *Store) Close() error {
+	if c, ok := s.conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Ping checks the health of the Redis server with PING. Satisfies the
+// sessionmw.Pinger interface.
+func (s *Store) Ping(ctxt context.Context) error {
+	_, err := s.conn.Do("PING")
+	return err
+}
+
+// IDSealer is a sessionmw.Sealer using the plain session id as the cookie
+// value, as PHP does for the PHPSESSID cookie.
+//
+// Cookies are neither signed nor encrypted, so session ids must be
+// unguessable (as with the default sessionmw id generation), and may only
+// contain the characters a-z, A-Z, 0-9, ',' and '-' accepted by PHP.
+type IDSealer struct{}
+
+// validID determines if id is a valid PHP session id.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == ',', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Encode satisfies the sessionmw.Sealer interface, encoding the "id" of the
+// cookie value (as provided by the session middleware).
+func (IDSealer) Encode(name string, value interface{}) (string, error) {
+	v, ok := value.(map[string]string)
+	if !ok || !validID(v["id"]) {
+		return "", ErrInvalidID
+	}
+	return v["id"], nil
+}
+
+// Decode satisfies the sessionmw.Sealer interface, decoding the cookie value
+// into the "id" of dst, which must be a *map[string]string.
+func (IDSealer) Decode(name, value string, dst interface{}) error {
+	m, ok := dst.(*map[string]string)
+	if !ok {
+		return ErrUnsupportedType
+	}
+	if !validID(value) {
+		return ErrInvalidID
+	}
+
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)["id"] = value
+	return nil
+}
@@ -0,0 +1,283 @@
+package phpcompat
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// statically assert the IDSealer satisfies the sessionmw.Sealer interface,
+// and the Store satisfies the sessionmw.Store interface.
+var (
+	_ sessionmw.Sealer = IDSealer{}
+	_ sessionmw.Store  = (*Store)(nil)
+)
+
+type fakeConn struct {
+	sync.Mutex
+	closed  bool
+	strings map[string][]byte
+	ttls    map[string]int64
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		strings: make(map[string][]byte),
+		ttls:    make(map[string]int64),
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch cmd {
+	case "SET":
+		ttl := int64(-1)
+		if len(args) > 3 && args[2] == "PX" {
+			if ttl = args[3].(int64); ttl <= 0 {
+				return nil, &SyntaxError{}
+			}
+		}
+		c.strings[args[0].(string)] = args[1].([]byte)
+		c.ttls[args[0].(string)] = ttl
+		return "OK", nil
+
+	case "GET":
+		if buf, ok := c.strings[args[0].(string)]; ok {
+			return buf, nil
+		}
+		return nil, nil
+
+	case "DEL":
+		delete(c.strings, args[0].(string))
+		return int64(1), nil
+	}
+
+	return nil, &SyntaxError{}
+}
+
+func TestMarshal(t *testing.T) {
+	for i, z := range []struct {
+		v   interface{}
+		exp string
+	}{
+		{nil, `N;`},
+		{true, `b:1;`},
+		{false, `b:0;`},
+		{42, `i:42;`},
+		{int64(-7), `i:-7;`},
+		{uint8(255), `i:255;`},
+		{1.5, `d:1.5;`},
+		{float64(1), `d:1;`},
+		{math.Inf(-1), `d:-INF;`},
+		{json.Number("12"), `i:12;`},
+		{json.Number("0.25"), `d:0.25;`},
+		{"héllo", `s:6:"héllo";`},
+		{[]string{"a", "b"}, `a:2:{i:0;s:1:"a";i:1;s:1:"b";}`},
+		{map[string]interface{}{"b": 1, "a": []interface{}{}}, `a:2:{s:1:"a";a:0:{}s:1:"b";i:1;}`},
+	} {
+		buf, err := Marshal(z.v)
+		if err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+			continue
+		}
+		if string(buf) != z.exp {
+			t.Errorf("test %d expected %s, got: %s", i, z.exp, buf)
+		}
+	}
+
+	for i, v := range []interface{}{struct{}{}, map[int]string{1: "a"}, uint64(math.MaxUint64), func() {}} {
+		if _, err := Marshal(v); err != ErrUnsupportedType {
+			t.Errorf("test %d expected ErrUnsupportedType, got: %v", i, err)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for i, z := range []struct {
+		s   string
+		exp interface{}
+	}{
+		{`N;`, nil},
+		{`b:1;`, true},
+		{`i:-42;`, int64(-42)},
+		{`d:0.5;`, 0.5},
+		{`d:INF;`, math.Inf(1)},
+		{`s:6:"héllo";`, "héllo"},
+		{`s:5:"a";b|";`, `a";b|`},
+		{`a:0:{}`, map[string]interface{}{}},
+		{`a:2:{i:0;s:1:"a";i:1;b:0;}`, []interface{}{"a", false}},
+		{`a:2:{i:1;s:1:"a";s:1:"k";N;}`, map[string]interface{}{"1": "a", "k": nil}},
+		{`a:1:{s:1:"m";a:1:{i:0;i:1;}}`, map[string]interface{}{"m": []interface{}{int64(1)}}},
+	} {
+		v, err := Unmarshal([]byte(z.s))
+		if err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, z.exp) {
+			t.Errorf("test %d expected %#v, got: %#v", i, z.exp, v)
+		}
+	}
+
+	for i, s := range []string{``, `i:1`, `i:x;`, `s:10:"abc";`, `a:1:{i:0;}`, `b:1;extra`, `x:1;`} {
+		if _, err := Unmarshal([]byte(s)); err == nil {
+			t.Errorf("test %d expected error for %q", i, s)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("test %d expected SyntaxError, got: %v", i, err)
+		}
+	}
+
+	if _, err := Unmarshal([]byte(`O:8:"stdClass":0:{}`)); err != ErrUnsupportedType {
+		t.Errorf("expected ErrUnsupportedType, got: %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	// as written by PHP's "php" session serialize handler
+	const s = `count|i:3;user|a:2:{s:2:"id";i:7;s:4:"name";s:3:"foo";}`
+
+	data, err := DecodeSession([]byte(s))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp := map[string]interface{}{
+		"count": int64(3),
+		"user":  map[string]interface{}{"id": int64(7), "name": "foo"},
+	}
+	if !reflect.DeepEqual(data, exp) {
+		t.Errorf("expected %v, got: %v", exp, data)
+	}
+
+	buf, err := EncodeSession(data)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if string(buf) != s {
+		t.Errorf("expected %s, got: %s", s, buf)
+	}
+
+	if _, err := EncodeSession(map[string]interface{}{"a|b": 1}); err != ErrInvalidKey {
+		t.Errorf("expected ErrInvalidKey, got: %v", err)
+	}
+	if _, err := DecodeSession([]byte(`count|i:3`)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestStore(t *testing.T) {
+	conn := newFakeConn()
+	st := NewStore(conn, "", time.Hour)
+
+	if _, err := st.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := st.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if string(conn.strings["PHPREDIS_SESSION:a"]) != `name|s:3:"foo";` {
+		t.Errorf("expected php session, got: %s", conn.strings["PHPREDIS_SESSION:a"])
+	}
+	if conn.ttls["PHPREDIS_SESSION:a"] != int64(time.Hour/time.Millisecond) {
+		t.Errorf("expected ttl of 1h, got: %d", conn.ttls["PHPREDIS_SESSION:a"])
+	}
+
+	obj, err := st.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if m, ok := obj.(map[string]interface{}); !ok || m["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %v", obj)
+	}
+
+	if err := st.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := st.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := st.Close(); err != nil || !conn.closed {
+		t.Errorf("expected conn closed, got: %v", err)
+	}
+
+	// a ttl of 0 does not expire
+	st = NewStore(conn, "", 0)
+	if err := st.Write("b", map[string]interface{}{"name": "bar"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if conn.ttls["PHPREDIS_SESSION:b"] != -1 {
+		t.Errorf("expected no ttl, got: %d", conn.ttls["PHPREDIS_SESSION:b"])
+	}
+}
+
+func TestIDSealer(t *testing.T) {
+	var s IDSealer
+	if v, err := s.Encode(DefaultCookieName, map[string]string{"id": "abc-1,2"}); err != nil || v != "abc-1,2" {
+		t.Errorf("expected abc-1,2, got: %q %v", v, err)
+	}
+	if _, err := s.Encode(DefaultCookieName, map[string]string{"id": "a b"}); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got: %v", err)
+	}
+
+	m := make(map[string]string)
+	if err := s.Decode(DefaultCookieName, "abc", &m); err != nil || m["id"] != "abc" {
+		t.Errorf("expected abc, got: %v %v", m, err)
+	}
+	if err := s.Decode(DefaultCookieName, "../abc", &m); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	conn := newFakeConn()
+	conn.strings["PHPREDIS_SESSION:phpid"] = []byte(`name|s:3:"php";`)
+
+	mux := goji.NewMux()
+	mux.UseC((&sessionmw.Config{
+		Sealer:      IDSealer{},
+		Store:       NewStore(conn, "", time.Hour),
+		Name:        DefaultCookieName,
+		IDValidator: sessionmw.ValidID,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		name, _ := sessionmw.Get(ctxt, "name")
+		sessionmw.Set(ctxt, "go", true)
+		res.Write([]byte(sessionmw.ID(ctxt) + " " + name.(string)))
+	})
+
+	// session issued by the PHP application
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "phpid"})
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "phpid php" {
+		t.Errorf("expected php session, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	data, err := DecodeSession(conn.strings["PHPREDIS_SESSION:phpid"])
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if data["name"] != "php" || data["go"] != true {
+		t.Errorf("expected session readable by PHP, got: %v", data)
+	}
+}
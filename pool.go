@@ -0,0 +1,57 @@
+package sessionmw
+
+import (
+	"net/http"
+	"sync"
+)
+
+// request is the per-request state of the session middleware, pooled to
+// reduce allocations in the request path.
+type request struct {
+	s    *sessMiddleware
+	req  *http.Request
+	sess session
+	ns   namedSession
+	w    hookWriter
+}
+
+// requestPool is the pool of request states.
+var requestPool = sync.Pool{
+	New: func() interface{} {
+		r := new(request)
+		r.ns.sess = &r.sess
+		r.w.hook = r.hook
+		return r
+	},
+}
+
+// acquire retrieves a request state for res and req from the pool.
+func (s *sessMiddleware) acquire(res http.ResponseWriter, req *http.Request) *request {
+	r := requestPool.Get().(*request)
+	r.s, r.req = s, req
+	r.w.ResponseWriter = res
+	return r
+}
+
+// hook writes the session cookies before the response headers are written.
+// The mirror cookie is only written for sessions that are persisted.
+func (r *request) hook(res http.ResponseWriter) {
+	r.s.setCookie(res, r.req, &r.sess)
+	if r.s.mirror != nil && (!r.sess.isNew || r.s.persist(&r.sess)) {
+		r.s.mirror.setCookie(r.s.Manager, res, r.req, &r.sess)
+	}
+}
+
+// release resets the request state, returning it to the pool. The changed
+// keys map of the session is cleared and reused.
+func (r *request) release() {
+	changed := r.sess.changed
+	for k := range changed {
+		delete(changed, k)
+	}
+	r.sess = session{changed: changed}
+	r.ns.auditor, r.ns.parent = nil, nil
+	r.w.ResponseWriter, r.w.done = nil, false
+	r.s, r.req = nil, nil
+	requestPool.Put(r)
+}
@@ -0,0 +1,80 @@
+package sessionmw
+
+import "golang.org/x/net/context"
+
+// BatchReadStore is the interface for session stores that can read multiple
+// sessions at once (ie, in a single round trip).
+type BatchReadStore interface {
+	Store
+
+	// ReadBatch retrieves the sessions with the provided ids, keyed by id.
+	// Sessions that cannot be found are omitted.
+	ReadBatch(keys []string) (map[string]interface{}, error)
+}
+
+// Preload loads the sessions with the provided ids, returning a context for
+// use with the session funcs for each loaded session, keyed by id. Preload is
+// intended for background jobs processing sessions in bulk, and each
+// returned session must be saved or released with the Manager (see Save and
+// Release).
+//
+// When the store is a BatchReadStore, the sessions are read at once, and the
+// store's error is returned when the batch cannot be read. Otherwise, the
+// sessions are read in turn. Sessions that cannot be loaded (see LoadID) are
+// omitted.
+func (s *Manager) Preload(ctxt context.Context, ids []string) (map[string]context.Context, error) {
+	ctxts := make(map[string]context.Context, len(ids))
+
+	bs, ok := baseStore(s.st).(BatchReadStore)
+	if !ok {
+		for _, id := range ids {
+			if _, ok := ctxts[id]; ok {
+				continue
+			}
+			if c, err := s.LoadID(ctxt, id); err == nil {
+				ctxts[id] = c
+			}
+		}
+		return ctxts, nil
+	}
+
+	// lock before reading from storage
+	var keys []string
+	unlocks := make(map[string]func(), len(ids))
+	releaseAll := func() {
+		for _, unlock := range unlocks {
+			if unlock != nil {
+				unlock()
+			}
+		}
+	}
+	for _, id := range ids {
+		if _, ok := unlocks[id]; ok || !s.idValidator(id) {
+			continue
+		}
+		unlock, err := s.lock(id)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		keys, unlocks[id] = append(keys, id), unlock
+	}
+
+	objs, err := bs.ReadBatch(keys)
+	if err != nil {
+		releaseAll()
+		return nil, err
+	}
+
+	for _, id := range keys {
+		var readErr error
+		d, ok := objs[id]
+		if !ok {
+			readErr = ErrSessionNotFound
+		}
+		if c, err := s.load(ctxt, id, d, readErr, unlocks[id]); err == nil {
+			ctxts[id] = c
+		}
+	}
+	return ctxts, nil
+}
@@ -0,0 +1,167 @@
+package sessionmw
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCreateLimitWindow is the default window new sessions are counted
+// over.
+const DefaultCreateLimitWindow = time.Minute
+
+// RateCounter is the interface for counters of events in fixed time windows,
+// shared by the processes limiting session creation (see CreateLimit).
+type RateCounter interface {
+	// Count returns the number of events counted for key in the current
+	// window.
+	Count(key string, window time.Duration) (int64, error)
+
+	// Incr counts an event for key, returning the number of events in the
+	// current window. The window starts with the first event.
+	Incr(key string, window time.Duration) (int64, error)
+}
+
+// CreateLimit limits the number of new sessions created per client (ie, per
+// IP address), so that bots cannot flood the store with sessions.
+//
+// New sessions are counted when the request creating them starts, whether or
+// not they are saved, so that a burst of concurrent requests cannot exceed the
+// limit. Requests without a session from a client that has reached the limit
+// are refused with 429 Too Many Requests, or, when Cookieless is set, served
+// without a session cookie and without saving the session.
+type CreateLimit struct {
+	// Counter counts the created sessions (see MemRateCounter).
+	Counter RateCounter
+
+	// Max is the maximum number of sessions created per client in Window.
+	Max int64
+
+	// Window is the window sessions are counted over. Defaults to
+	// DefaultCreateLimitWindow.
+	Window time.Duration
+
+	// KeyFn returns the client key of a request (ie, a fingerprint).
+	// Defaults to the IP address of the request (see Config.RemoteIPFn).
+	KeyFn func(*http.Request) string
+
+	// Cookieless serves limited requests without a session cookie, instead
+	// of refusing them.
+	Cookieless bool
+}
+
+// limit counts the new session of req against the creation limit, returning
+// false when the request was refused. Counter errors do not limit requests.
+func (s *Manager) limit(res http.ResponseWriter, req *http.Request, sess *session) bool {
+	cl := s.createLimit
+	if cl == nil || !sess.isNew || sess.cookieless {
+		return true
+	}
+
+	key := s.remoteIPFn(req)
+	if cl.KeyFn != nil {
+		key = cl.KeyFn(req)
+	}
+	if n, err := cl.Counter.Incr(key, s.createLimitWindow()); err != nil || n <= cl.Max {
+		return true
+	}
+
+	if !cl.Cookieless {
+		http.Error(res, "too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	sess.cookieless = true
+	return true
+}
+
+// createLimitWindow returns the window new sessions are counted over.
+func (s *Manager) createLimitWindow() time.Duration {
+	if s.createLimit.Window == 0 {
+		return DefaultCreateLimitWindow
+	}
+	return s.createLimit.Window
+}
+
+// memCounter is an in process RateCounter.
+type memCounter struct {
+	sync.Mutex
+	windows map[string]*memWindow
+	swept   time.Time
+
+	// clock is the time source, set to the Clock of the Manager the counter
+	// is first used with (see Config.Clock).
+	clock Clock
+}
+
+// memWindow is a memCounter window.
+type memWindow struct {
+	n   int64
+	end time.Time
+}
+
+// MemRateCounter creates a RateCounter counting in process.
+//
+// This is only suitable when session creation is limited by a single
+// process. Windows are timed with the Manager's Config.Clock.
+func MemRateCounter() RateCounter {
+	return &memCounter{windows: make(map[string]*memWindow)}
+}
+
+// Count satisfies the RateCounter interface.
+func (mc *memCounter) Count(key string, window time.Duration) (int64, error) {
+	mc.Lock()
+	defer mc.Unlock()
+
+	if w, ok := mc.windows[key]; ok && mc.now().Before(w.end) {
+		return w.n, nil
+	}
+	return 0, nil
+}
+
+// Incr satisfies the RateCounter interface.
+func (mc *memCounter) Incr(key string, window time.Duration) (int64, error) {
+	mc.Lock()
+	defer mc.Unlock()
+
+	now := mc.now()
+	mc.sweep(now, window)
+
+	w, ok := mc.windows[key]
+	if !ok || !now.Before(w.end) {
+		w = &memWindow{end: now.Add(window)}
+		mc.windows[key] = w
+	}
+	w.n++
+	return w.n, nil
+}
+
+// setClock sets the time source of the counter, when not already set.
+func (mc *memCounter) setClock(clock Clock) {
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.clock == nil {
+		mc.clock = clock
+	}
+}
+
+// now returns the current time. The counter must be locked.
+func (mc *memCounter) now() time.Time {
+	if mc.clock == nil {
+		return time.Now()
+	}
+	return mc.clock.Now()
+}
+
+// sweep removes the ended windows, at most once per window. The counter must
+// be locked.
+func (mc *memCounter) sweep(now time.Time, window time.Duration) {
+	if now.Sub(mc.swept) < window {
+		return
+	}
+	for k, w := range mc.windows {
+		if !now.Before(w.end) {
+			delete(mc.windows, k)
+		}
+	}
+	mc.swept = now
+}
@@ -0,0 +1,79 @@
+package sessionmw
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// RedactedValue is the value replacing redacted session values.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactKeys are the default patterns of the session keys redacted
+// when rendering session data (see Config.RedactKeys).
+var DefaultRedactKeys = []string{"*token*", "*password*", "*secret*", "csrf"}
+
+// Redact returns a copy of the session data, replacing the values of the keys
+// matching any of the patterns with RedactedValue, so that session data can
+// be logged or inspected without leaking secrets. Nested maps (ie, the
+// session metadata) are redacted recursively.
+//
+// Patterns are matched case insensitively against the whole key, and may
+// contain the * wildcard, matching any sequence of characters (ie,
+// "*token*" matches "access_token" and "cart/Token").
+func Redact(data map[string]interface{}, patterns []string) map[string]interface{} {
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		switch m, ok := v.(map[string]interface{}); {
+		case redacted(k, patterns):
+			res[k] = RedactedValue
+		case ok:
+			res[k] = Redact(m, patterns)
+		default:
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// Redacted retrieves a copy of the session values from the context, redacted
+// using the patterns of the session middleware (see Config.RedactKeys), for
+// logging.
+func Redacted(ctxt context.Context) map[string]interface{} {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return Redact(sess.data, sess.s.redactKeys)
+}
+
+// redacted determines if key matches any of the patterns.
+func redacted(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range patterns {
+		if globMatch(strings.ToLower(p), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch determines if s matches the pattern, where * matches any
+// sequence of characters.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,65 @@
+package redisstore
+
+import (
+	"strconv"
+	"time"
+)
+
+// incrScript increments KEYS[1], expiring it after ARGV[1] milliseconds when
+// first incremented.
+const incrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n`
+
+// RateCounter is a Redis backed sessionmw.RateCounter, for limiting session
+// creation across processes (see sessionmw.CreateLimit).
+type RateCounter struct {
+	conn   Conn
+	prefix string
+}
+
+// NewRateCounter creates a Redis rate counter using conn, storing counts
+// under prefix.
+func NewRateCounter(conn Conn, prefix string) *RateCounter {
+	return &RateCounter{
+		conn:   errConn{conn},
+		prefix: prefix,
+	}
+}
+
+// Count satisfies the sessionmw.RateCounter interface.
+func (rc *RateCounter) Count(key string, window time.Duration) (int64, error) {
+	v, err := rc.conn.Do("GET", rc.prefix+key)
+	switch {
+	case err != nil:
+		return 0, err
+	case v == nil:
+		return 0, nil
+	}
+
+	buf, ok := v.([]byte)
+	if !ok {
+		return 0, ErrUnexpectedReply
+	}
+	n, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil {
+		return 0, ErrUnexpectedReply
+	}
+	return n, nil
+}
+
+// Incr satisfies the sessionmw.RateCounter interface.
+func (rc *RateCounter) Incr(key string, window time.Duration) (int64, error) {
+	v, err := rc.conn.Do("EVAL", incrScript, 1, rc.prefix+key, millis(window))
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	if !ok {
+		return 0, ErrUnexpectedReply
+	}
+	return n, nil
+}
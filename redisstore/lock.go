@@ -0,0 +1,133 @@
+package redisstore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultLockTTL is the default time after which a lock that was not
+	// unlocked (ie, by a crashed process) expires.
+	DefaultLockTTL = 30 * time.Second
+
+	// LockPrefix is the prefix of lock keys, preceding the key built by the
+	// store's KeyBuilder, such that locks are not enumerated as sessions.
+	LockPrefix = "lock:"
+
+	// lockRetryInterval is the interval between attempts to acquire a held
+	// lock.
+	lockRetryInterval = 25 * time.Millisecond
+)
+
+// ErrLockNotHeld is the error returned when unlocking a lock that expired,
+// and that may since have been acquired by another owner.
+var ErrLockNotHeld = errors.New("lock not held")
+
+// unlockScript deletes KEYS[1] when its value is the owner token ARGV[1].
+const unlockScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// Lock is a distributed lock held in Redis.
+//
+// Locks are acquired with SET NX PX, storing a random owner token, so that
+// a lock that expired and was acquired by another owner is not released by
+// Unlock.
+type Lock struct {
+	conn  Conn
+	key   string
+	token string
+}
+
+// acquire acquires the lock for key, expiring it after ttl, waiting up to
+// timeout.
+func acquire(conn Conn, key string, ttl, timeout time.Duration) (*Lock, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	l := &Lock{conn: conn, key: key, token: base64.RawURLEncoding.EncodeToString(buf)}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		v, err := conn.Do("SET", key, l.token, "PX", millis(ttl), "NX")
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			return l, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, sessionmw.ErrLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Unlock releases the lock, returning ErrLockNotHeld if the lock expired
+// before it was released.
+func (l *Lock) Unlock() error {
+	v, err := l.conn.Do("EVAL", unlockScript, 1, l.key, l.token)
+	if err != nil {
+		return err
+	}
+
+	n, ok := v.(int64)
+	switch {
+	case !ok:
+		return ErrUnexpectedReply
+	case n == 0:
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// unlockFunc returns the func releasing l, for the sessionmw.LockingStore
+// interface.
+func (l *Lock) unlockFunc() func() {
+	return func() {
+		l.Unlock()
+	}
+}
+
+// Acquire acquires the distributed lock for the provided key, waiting up to
+// timeout, returning sessionmw.ErrLockTimeout if the lock is still held by
+// another owner. The lock expires after ttl unless released with Unlock.
+//
+// Acquire can be used by applications for short critical sections tied to a
+// session (ie, when key is the session id), and shares its locks with the
+// session locks held by the middleware.
+func (rs *RedisStore) Acquire(key string, ttl, timeout time.Duration) (*Lock, error) {
+	return acquire(rs.conn, LockPrefix+rs.KeyBuilder.Key(key), ttl, timeout)
+}
+
+// Lock acquires the lock for the provided id, waiting up to timeout. The lock
+// expires after LockTTL. Satisfies the sessionmw.LockingStore interface.
+func (rs *RedisStore) Lock(key string, timeout time.Duration) (func(), error) {
+	l, err := rs.Acquire(key, rs.LockTTL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return l.unlockFunc(), nil
+}
+
+// Acquire acquires the distributed lock for the provided key. See
+// RedisStore.Acquire.
+func (hs *HashStore) Acquire(key string, ttl, timeout time.Duration) (*Lock, error) {
+	return acquire(hs.conn, LockPrefix+hs.KeyBuilder.Key(key), ttl, timeout)
+}
+
+// Lock acquires the lock for the provided id, waiting up to timeout. The lock
+// expires after LockTTL. Satisfies the sessionmw.LockingStore interface.
+func (hs *HashStore) Lock(key string, timeout time.Duration) (func(), error) {
+	l, err := hs.Acquire(key, hs.LockTTL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return l.unlockFunc(), nil
+}
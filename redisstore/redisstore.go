@@ -0,0 +1,791 @@
+// Package redisstore provides a Redis backed sessionmw.Store, storing
+// sessions either as opaque payload blobs, or as Redis hashes with a field per
+// session key.
+//
+// The stores use a minimal Conn interface compatible with the Do method
+// provided by most Redis clients (ie, github.com/garyburd/redigo), so that
+// any client can be used.
+package redisstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// Conn is the interface for issuing Redis commands.
+//
+// Conn must be safe for concurrent use. Bulk string replies must be returned
+// as []byte, and array replies as []interface{}. The []byte args are reused
+// by the stores once Do returns, and must not be retained.
+type Conn interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+}
+
+// ErrUnexpectedReply is the error returned when Redis returns a reply of an
+// unexpected type.
+var ErrUnexpectedReply = errors.New("unexpected redis reply")
+
+// Error is a Redis store error. Error satisfies errors.Is for its Kind
+// (sessionmw.ErrStoreUnavailable or sessionmw.ErrDecodeFailed), and
+// errors.As for the underlying error.
+type Error struct {
+	// Op is the failed operation, ie, the Redis command.
+	Op string
+
+	// Kind is the kind of error.
+	Kind error
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error satisfies the error interface.
+func (err *Error) Error() string {
+	return fmt.Sprintf("redisstore %s: %v", err.Op, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Is determines if target is the kind of the error.
+func (err *Error) Is(target error) bool {
+	return target == err.Kind
+}
+
+// errConn wraps the errors returned by a Conn as sessionmw.ErrStoreUnavailable
+// errors.
+type errConn struct {
+	Conn
+}
+
+// Do satisfies the Conn interface.
+func (c errConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	v, err := c.Conn.Do(cmd, args...)
+	if err != nil {
+		return nil, &Error{Op: cmd, Kind: sessionmw.ErrStoreUnavailable, Err: err}
+	}
+	return v, nil
+}
+
+// Close closes the wrapped conn, if it is an io.Closer.
+func (c errConn) Close() error {
+	return closeConn(c.Conn)
+}
+
+// closeConn closes conn, if it is an io.Closer.
+func closeConn(conn Conn) error {
+	if c, ok := conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ping checks the health of the server with PING.
+func ping(conn Conn) error {
+	_, err := conn.Do("PING")
+	return err
+}
+
+// millis returns d in milliseconds.
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// pttl returns the remaining lifetime of key, or 0 if key does not expire.
+func pttl(conn Conn, key string) (time.Duration, error) {
+	v, err := conn.Do("PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	switch {
+	case !ok:
+		return 0, ErrUnexpectedReply
+	case n == -2:
+		return 0, sessionmw.ErrSessionNotFound
+	case n < 0:
+		return 0, nil
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// globEscaper escapes the special characters of Redis glob patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// scanPages calls fn with each page of keys matching pattern, using SCAN so
+// that Redis is not blocked while iterating large databases. Keys may be
+// passed more than once.
+func scanPages(conn Conn, pattern string, fn func(keys []interface{}) error) error {
+	cursor := []byte("0")
+	for {
+		v, err := conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		if err != nil {
+			return err
+		}
+
+		r, ok := v.([]interface{})
+		if !ok || len(r) != 2 {
+			return ErrUnexpectedReply
+		}
+		next, ok := r[0].([]byte)
+		if !ok {
+			return ErrUnexpectedReply
+		}
+		items, ok := r[1].([]interface{})
+		if !ok {
+			return ErrUnexpectedReply
+		}
+		for _, item := range items {
+			if _, ok := item.([]byte); !ok {
+				return ErrUnexpectedReply
+			}
+		}
+
+		if err = fn(items); err != nil {
+			return err
+		}
+		if string(next) == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// scan returns the keys in the namespace of kb, excluding reserved keys.
+func scan(conn Conn, kb sessionmw.KeyBuilder) ([]string, error) {
+	seen := make(map[string]bool)
+
+	var keys []string
+	err := scanPages(conn, globEscaper.Replace(kb.Namespace())+"*", func(items []interface{}) error {
+		for _, item := range items {
+			// SCAN may return a key more than once
+			if key := string(item.([]byte)); !seen[key] && !kb.Reserved(key) {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// unlink states.
+const (
+	unlinkUnknown int32 = iota
+	unlinkSupported
+	unlinkUnsupported
+)
+
+// unlinker deletes keys with UNLINK, so that Redis frees the memory of large
+// sessions in the background without blocking its event loop, falling back to
+// DEL for Redis versions before 4.0. Support is detected by probing with the
+// first UNLINK.
+type unlinker struct {
+	state int32
+}
+
+// del deletes keys, returning the number of deleted keys.
+func (u *unlinker) del(conn Conn, keys ...interface{}) (int64, error) {
+	state := atomic.LoadInt32(&u.state)
+	var v interface{}
+	var err error
+	if state != unlinkUnsupported {
+		v, err = conn.Do("UNLINK", keys...)
+		switch {
+		case err != nil && strings.Contains(err.Error(), "unknown command"):
+			atomic.StoreInt32(&u.state, unlinkUnsupported)
+			state = unlinkUnsupported
+		case err == nil && state == unlinkUnknown:
+			atomic.StoreInt32(&u.state, unlinkSupported)
+		}
+	}
+	if state == unlinkUnsupported {
+		v, err = conn.Do("DEL", keys...)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	if !ok {
+		return 0, ErrUnexpectedReply
+	}
+	return n, nil
+}
+
+// destroy destroys the sessions in the namespace of kb with ids starting with
+// prefix, returning the number of destroyed sessions. Reserved keys are
+// skipped, and the keys of each SCAN page are deleted in a single command.
+func destroy(conn Conn, u *unlinker, kb sessionmw.KeyBuilder, prefix string) (int64, error) {
+	if kb.HashIDs && prefix != "" {
+		return 0, sessionmw.ErrHashedIDs
+	}
+
+	var n int64
+	err := scanPages(conn, globEscaper.Replace(kb.Namespace()+prefix)+"*", func(items []interface{}) error {
+		var keys []interface{}
+		for _, item := range items {
+			if !kb.Reserved(string(item.([]byte))) {
+				keys = append(keys, item)
+			}
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		c, err := u.del(conn, keys...)
+		if err != nil {
+			return err
+		}
+		n += c
+		return nil
+	})
+	return n, err
+}
+
+// scanIDs returns the session ids of the keys in the namespace of kb.
+func scanIDs(conn Conn, kb sessionmw.KeyBuilder) ([]string, error) {
+	if kb.HashIDs {
+		return nil, sessionmw.ErrHashedIDs
+	}
+
+	keys, err := scan(conn, kb)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i], _ = kb.ID(key)
+	}
+	return keys, nil
+}
+
+// maxPooledBuf is the maximum capacity of buffers returned to bufPool.
+const maxPooledBuf = 64 << 10
+
+// bufPool is the pool of buffers for encoding payloads and hash fields.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuf retrieves a buffer from bufPool.
+func getBuf() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// putBuf resets buf, returning it to bufPool unless it grew too large.
+func putBuf(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuf {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// RedisStore is a Redis backed session store, storing each session as an
+// opaque payload (see sessionmw.EncodePayload).
+type RedisStore struct {
+	conn   Conn
+	ttl    time.Duration
+	unlink unlinker
+
+	// Codec is the codec used to encode stored sessions. Use
+	// sessionmw.CodecJSON when non-Go services need to read sessions.
+	Codec sessionmw.Codec
+
+	// KeyBuilder builds the keys of sessions. New sets its Prefix to the
+	// provided prefix.
+	KeyBuilder sessionmw.KeyBuilder
+	// LockTTL is the time after which session locks expire (see Lock).
+	LockTTL time.Duration
+
+	// Clock is the time source for the last access times recorded by
+	// ReadRefresh.
+	Clock sessionmw.Clock
+}
+
+// New creates a Redis store using conn, storing sessions as payload blobs
+// under prefix.
+//
+// Sessions expire ttl after they were last written, or never when ttl is 0 or
+// negative.
+func New(conn Conn, prefix string, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		conn:       errConn{conn},
+		ttl:        ttl,
+		Codec:      sessionmw.CodecGob,
+		KeyBuilder: sessionmw.KeyBuilder{Prefix: prefix},
+		LockTTL:    DefaultLockTTL,
+		Clock:      sessionmw.SystemClock,
+	}
+}
+
+// Write saves the session for the provided id.
+func (rs *RedisStore) Write(key string, obj interface{}) error {
+	return rs.WriteTTL(key, obj, rs.ttl)
+}
+
+// WriteTTL saves the session for the provided id, expiring it after ttl, or
+// never when ttl is 0 or negative. Satisfies the sessionmw.TTLStore interface.
+func (rs *RedisStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	buf := getBuf()
+	defer putBuf(buf)
+	if err := sessionmw.WritePayload(buf, rs.Codec, obj); err != nil {
+		return err
+	}
+
+	var err error
+	if ttl <= 0 {
+		_, err = rs.conn.Do("SET", rs.KeyBuilder.Key(key), buf.Bytes())
+	} else {
+		_, err = rs.conn.Do("SET", rs.KeyBuilder.Key(key), buf.Bytes(), "PX", millis(ttl))
+	}
+	return err
+}
+
+// TTL returns the remaining lifetime of the session with the provided id.
+// Satisfies the sessionmw.TTLStore interface.
+func (rs *RedisStore) TTL(key string) (time.Duration, error) {
+	return pttl(rs.conn, rs.KeyBuilder.Key(key))
+}
+
+// batchWriteScript sets each of KEYS to the corresponding ARGV[2:] value,
+// expiring after ARGV[1] milliseconds, or never when ARGV[1] is not positive.
+const batchWriteScript = `local ttl = tonumber(ARGV[1])
+for i = 1, #KEYS do
+	if ttl > 0 then
+		redis.call('SET', KEYS[i], ARGV[i+1], 'PX', ttl)
+	else
+		redis.call('SET', KEYS[i], ARGV[i+1])
+	end
+end
+return #KEYS`
+
+// WriteBatch saves the sessions with the provided ids in a single round
+// trip. Satisfies the sessionmw.BatchStore interface.
+func (rs *RedisStore) WriteBatch(objs map[string]interface{}) error {
+	buf := getBuf()
+	defer putBuf(buf)
+
+	// encode all payloads into buf, slicing them once encoded
+	keys := make([]interface{}, 0, len(objs))
+	ends := make([]int, 0, len(objs))
+	for key, obj := range objs {
+		if err := sessionmw.WritePayload(buf, rs.Codec, obj); err != nil {
+			return err
+		}
+		keys, ends = append(keys, rs.KeyBuilder.Key(key)), append(ends, buf.Len())
+	}
+	vals, start := []interface{}{millis(rs.ttl)}, 0
+	for _, end := range ends {
+		vals, start = append(vals, buf.Bytes()[start:end]), end
+	}
+
+	args := append([]interface{}{batchWriteScript, len(keys)}, keys...)
+	_, err := rs.conn.Do("EVAL", append(args, vals...)...)
+	return err
+}
+
+// Read retrieves the session for the provided id.
+func (rs *RedisStore) Read(key string) (interface{}, error) {
+	return rs.decode(rs.conn.Do("GET", rs.KeyBuilder.Key(key)))
+}
+
+// ReadRefresh retrieves the session for the provided id, extending its
+// expiration and recording its last access (see LastAccess) atomically, in
+// a single round trip. Satisfies the sessionmw.RefreshStore interface.
+func (rs *RedisStore) ReadRefresh(key string) (interface{}, error) {
+	k := rs.KeyBuilder.Key(key)
+	return rs.decode(touchScript.do(rs.conn, []interface{}{k, AccessPrefix + k}, millis(rs.ttl), rs.Clock.Now().UnixNano()/int64(time.Millisecond)))
+}
+
+// Take retrieves and erases the session for the provided id in a single
+// atomic operation (using GETDEL, requiring Redis 6.2 or later). Satisfies the
+// sessionmw.TakeStore interface.
+func (rs *RedisStore) Take(key string) (interface{}, error) {
+	return rs.decode(rs.conn.Do("GETDEL", rs.KeyBuilder.Key(key)))
+}
+
+// ReadBatch retrieves the sessions with the provided ids in a single round
+// trip, omitting sessions that cannot be found. Satisfies the
+// sessionmw.BatchReadStore interface.
+func (rs *RedisStore) ReadBatch(keys []string) (map[string]interface{}, error) {
+	objs := make(map[string]interface{}, len(keys))
+	if len(keys) == 0 {
+		return objs, nil
+	}
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = rs.KeyBuilder.Key(key)
+	}
+	v, err := rs.conn.Do("MGET", args...)
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := v.([]interface{})
+	if !ok || len(vals) != len(keys) {
+		return nil, ErrUnexpectedReply
+	}
+
+	for i, v := range vals {
+		obj, err := rs.decode(v, nil)
+		switch {
+		case err == sessionmw.ErrSessionNotFound:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		objs[keys[i]] = obj
+	}
+	return objs, nil
+}
+
+// decode decodes the session payload reply.
+func (rs *RedisStore) decode(v interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	buf, ok := v.([]byte)
+	if !ok {
+		return nil, ErrUnexpectedReply
+	}
+
+	obj, err := sessionmw.DecodePayload(buf)
+	if err != nil {
+		return nil, &Error{Op: "decode", Kind: sessionmw.ErrDecodeFailed, Err: err}
+	}
+	return obj, nil
+}
+
+// Erase permanently destroys the session with the provided id, using UNLINK
+// when supported by the server.
+func (rs *RedisStore) Erase(key string) error {
+	k := rs.KeyBuilder.Key(key)
+	_, err := rs.unlink.del(rs.conn, k, AccessPrefix+k)
+	return err
+}
+
+// Keys returns the ids of all sessions in the store, or
+// sessionmw.ErrHashedIDs when ids are hashed. Satisfies the
+// sessionmw.KeysStore interface.
+func (rs *RedisStore) Keys() ([]string, error) {
+	return scanIDs(rs.conn, rs.KeyBuilder)
+}
+
+// Count returns the number of sessions in the store, scanning the keys in
+// the store's namespace. Satisfies the sessionmw.CountableStore interface.
+func (rs *RedisStore) Count() (int64, error) {
+	keys, err := scan(rs.conn, rs.KeyBuilder)
+	return int64(len(keys)), err
+}
+
+// DestroyAll destroys all sessions in the store's namespace (ie, to
+// invalidate all sessions after a security incident), returning the number
+// of destroyed sessions. Keys are deleted with UNLINK, so that Redis reclaims
+// their memory without blocking.
+func (rs *RedisStore) DestroyAll() (int64, error) {
+	return destroy(rs.conn, &rs.unlink, rs.KeyBuilder, "")
+}
+
+// DestroyByPrefix destroys the sessions with ids starting with p, returning
+// the number of destroyed sessions, or sessionmw.ErrHashedIDs when ids are
+// hashed. See DestroyAll.
+func (rs *RedisStore) DestroyByPrefix(p string) (int64, error) {
+	return destroy(rs.conn, &rs.unlink, rs.KeyBuilder, p)
+}
+
+// Close closes the connection (or pool), if it is an io.Closer.
+func (rs *RedisStore) Close() error {
+	return closeConn(rs.conn)
+}
+
+// Ping checks the health of the server with PING. Satisfies the
+// sessionmw.Pinger interface.
+func (rs *RedisStore) Ping(ctxt context.Context) error {
+	return ping(rs.conn)
+}
+
+// hashWriteScript replaces the hash at KEYS[1] with the field/value pairs in
+// ARGV[2:], expiring it after ARGV[1] milliseconds, or never when ARGV[1] is
+// not positive.
+const hashWriteScript = `redis.call('DEL', KEYS[1])
+for i = 2, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i+1])
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1`
+
+// hashPatchScript sets the ARGV[3:3+ARGV[2]*2] field/value pairs and deletes
+// the remaining ARGV fields of the hash at KEYS[1], if it exists, expiring it
+// after ARGV[1] milliseconds, or never when ARGV[1] is not positive.
+const hashPatchScript = `if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local n = 3 + tonumber(ARGV[2]) * 2
+for i = 3, n - 1, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i+1])
+end
+for i = n, #ARGV do
+	redis.call('HDEL', KEYS[1], ARGV[i])
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1`
+
+// HashStore is a Redis backed session store, storing each session as a Redis
+// hash with a JSON encoded field per session key, allowing individual values
+// to be read and updated, and sessions to be inspected with redis-cli.
+//
+// HashStore is a sessionmw.PatchStore, and only the changed values of a
+// session are written after the session was first saved.
+type HashStore struct {
+	conn   Conn
+	ttl    time.Duration
+	unlink unlinker
+
+	// KeyBuilder builds the keys of sessions. NewHash sets its Prefix to the
+	// provided prefix.
+	KeyBuilder sessionmw.KeyBuilder
+	// LockTTL is the time after which session locks expire (see Lock).
+	LockTTL time.Duration
+
+	// Clock is the time source for the last access times recorded by
+	// ReadRefresh.
+	Clock sessionmw.Clock
+}
+
+// NewHash creates a Redis store using conn, storing sessions as hashes under
+// prefix.
+//
+// Sessions expire ttl after they were last written, or never when ttl is 0 or
+// negative.
+func NewHash(conn Conn, prefix string, ttl time.Duration) *HashStore {
+	return &HashStore{
+		conn:       errConn{conn},
+		ttl:        ttl,
+		KeyBuilder: sessionmw.KeyBuilder{Prefix: prefix},
+		LockTTL:    DefaultLockTTL,
+		Clock:      sessionmw.SystemClock,
+	}
+}
+
+// data returns obj as session data.
+func data(obj interface{}) (map[string]interface{}, error) {
+	d, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redisstore cannot store %T as a hash", obj)
+	}
+	return d, nil
+}
+
+// appendFields appends the field/value pairs of d to args, encoding the
+// values into buf.
+func appendFields(args []interface{}, buf *bytes.Buffer, d map[string]interface{}) ([]interface{}, error) {
+	enc := json.NewEncoder(buf)
+	fields := make([]string, 0, len(d))
+	ends := make([]int, 0, len(d))
+	for k, v := range d {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		// strip the newline added by Encode
+		buf.Truncate(buf.Len() - 1)
+		fields, ends = append(fields, k), append(ends, buf.Len())
+	}
+
+	start := 0
+	for i, k := range fields {
+		args, start = append(args, k, buf.Bytes()[start:ends[i]]), ends[i]
+	}
+	return args, nil
+}
+
+// Write saves the session for the provided id.
+func (hs *HashStore) Write(key string, obj interface{}) error {
+	return hs.WriteTTL(key, obj, hs.ttl)
+}
+
+// WriteTTL saves the session for the provided id, expiring it after ttl.
+// Satisfies the sessionmw.TTLStore interface.
+func (hs *HashStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	d, err := data(obj)
+	if err != nil {
+		return err
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	args, err := appendFields([]interface{}{hashWriteScript, 1, hs.KeyBuilder.Key(key), millis(ttl)}, buf, d)
+	if err != nil {
+		return err
+	}
+
+	_, err = hs.conn.Do("EVAL", args...)
+	return err
+}
+
+// TTL returns the remaining lifetime of the session with the provided id.
+// Satisfies the sessionmw.TTLStore interface.
+func (hs *HashStore) TTL(key string) (time.Duration, error) {
+	return pttl(hs.conn, hs.KeyBuilder.Key(key))
+}
+
+// Patch satisfies the sessionmw.PatchStore interface.
+func (hs *HashStore) Patch(key string, set map[string]interface{}, del []string) error {
+	buf := getBuf()
+	defer putBuf(buf)
+	args, err := appendFields([]interface{}{hashPatchScript, 1, hs.KeyBuilder.Key(key), millis(hs.ttl), len(set)}, buf, set)
+	if err != nil {
+		return err
+	}
+	for _, k := range del {
+		args = append(args, k)
+	}
+
+	v, err := hs.conn.Do("EVAL", args...)
+	if err != nil {
+		return err
+	}
+	if n, ok := v.(int64); ok && n == 0 {
+		return sessionmw.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Read retrieves the session for the provided id.
+func (hs *HashStore) Read(key string) (interface{}, error) {
+	return hs.decode(hs.conn.Do("HGETALL", hs.KeyBuilder.Key(key)))
+}
+
+// ReadRefresh retrieves the session for the provided id, extending its
+// expiration and recording its last access (see LastAccess) atomically, in
+// a single round trip. Satisfies the sessionmw.RefreshStore interface.
+func (hs *HashStore) ReadRefresh(key string) (interface{}, error) {
+	k := hs.KeyBuilder.Key(key)
+	return hs.decode(hashTouchScript.do(hs.conn, []interface{}{k, AccessPrefix + k}, millis(hs.ttl), hs.Clock.Now().UnixNano()/int64(time.Millisecond)))
+}
+
+// hashTakeScript returns all fields of the hash at KEYS[1], deleting it.
+const hashTakeScript = `local vals = redis.call('HGETALL', KEYS[1])
+if #vals ~= 0 then
+	redis.call('DEL', KEYS[1])
+end
+return vals`
+
+// Take retrieves and erases the session for the provided id in a single
+// atomic operation. Satisfies the sessionmw.TakeStore interface.
+func (hs *HashStore) Take(key string) (interface{}, error) {
+	return hs.decode(hs.conn.Do("EVAL", hashTakeScript, 1, hs.KeyBuilder.Key(key)))
+}
+
+// decode decodes the hash reply.
+func (hs *HashStore) decode(v interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	vals, ok := v.([]interface{})
+	if !ok || len(vals)%2 != 0 {
+		return nil, ErrUnexpectedReply
+	}
+	if len(vals) == 0 {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	d := make(map[string]interface{}, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		k, ok := vals[i].([]byte)
+		if !ok {
+			return nil, ErrUnexpectedReply
+		}
+		buf, ok := vals[i+1].([]byte)
+		if !ok {
+			return nil, ErrUnexpectedReply
+		}
+
+		var val interface{}
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		if err = dec.Decode(&val); err != nil {
+			return nil, &Error{Op: "decode", Kind: sessionmw.ErrDecodeFailed, Err: err}
+		}
+		d[string(k)] = val
+	}
+
+	return d, nil
+}
+
+// Erase permanently destroys the session with the provided id, using UNLINK
+// when supported by the server.
+func (hs *HashStore) Erase(key string) error {
+	k := hs.KeyBuilder.Key(key)
+	_, err := hs.unlink.del(hs.conn, k, AccessPrefix+k)
+	return err
+}
+
+// Keys returns the ids of all sessions in the store, or
+// sessionmw.ErrHashedIDs when ids are hashed. Satisfies the
+// sessionmw.KeysStore interface.
+func (hs *HashStore) Keys() ([]string, error) {
+	return scanIDs(hs.conn, hs.KeyBuilder)
+}
+
+// Count returns the number of sessions in the store, scanning the keys in
+// the store's namespace. Satisfies the sessionmw.CountableStore interface.
+func (hs *HashStore) Count() (int64, error) {
+	keys, err := scan(hs.conn, hs.KeyBuilder)
+	return int64(len(keys)), err
+}
+
+// DestroyAll destroys all sessions in the store's namespace (ie, to
+// invalidate all sessions after a security incident), returning the number
+// of destroyed sessions. Keys are deleted with UNLINK, so that Redis reclaims
+// their memory without blocking.
+func (hs *HashStore) DestroyAll() (int64, error) {
+	return destroy(hs.conn, &hs.unlink, hs.KeyBuilder, "")
+}
+
+// DestroyByPrefix destroys the sessions with ids starting with p, returning
+// the number of destroyed sessions, or sessionmw.ErrHashedIDs when ids are
+// hashed. See DestroyAll.
+func (hs *HashStore) DestroyByPrefix(p string) (int64, error) {
+	return destroy(hs.conn, &hs.unlink, hs.KeyBuilder, p)
+}
+
+// Close closes the connection (or pool), if it is an io.Closer.
+func (hs *HashStore) Close() error {
+	return closeConn(hs.conn)
+}
+
+// Ping checks the health of the server with PING. Satisfies the
+// sessionmw.Pinger interface.
+func (hs *HashStore) Ping(ctxt context.Context) error {
+	return ping(hs.conn)
+}
@@ -0,0 +1,962 @@
+package redisstore
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// fakeConn emulates the Redis commands used by the stores.
+type fakeConn struct {
+	sync.Mutex
+	closed  bool
+	strings map[string][]byte
+	hashes  map[string]map[string][]byte
+	ttls    map[string]int64
+	streams map[string][][]interface{}
+
+	// scripts are the cached scripts by hash, and evalsha the number of
+	// scripts run from the cache.
+	scripts map[string]string
+	evalsha int
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		strings: make(map[string][]byte),
+		hashes:  make(map[string]map[string][]byte),
+		ttls:    make(map[string]int64),
+		streams: make(map[string][][]interface{}),
+		scripts: make(map[string]string),
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if cmd == "EVALSHA" {
+		src, ok := c.scripts[args[0].(string)]
+		if !ok {
+			return nil, errors.New("NOSCRIPT No matching script")
+		}
+		c.evalsha++
+		cmd, args = "EVAL", append([]interface{}{src}, args[1:]...)
+	}
+
+	switch cmd {
+	case "PING":
+		if c.closed {
+			return nil, errors.New("closed")
+		}
+		return "PONG", nil
+
+	case "SCRIPT":
+		hash := newScript(args[1].(string)).hash
+		c.scripts[hash] = args[1].(string)
+		return []byte(hash), nil
+
+	case "SET":
+		if _, ok := c.strings[args[0].(string)]; ok && len(args) > 4 && args[4] == "NX" {
+			return nil, nil
+		}
+		ttl := int64(-1)
+		if len(args) > 3 && args[2] == "PX" {
+			if ttl = args[3].(int64); ttl <= 0 {
+				return nil, errors.New("ERR invalid expire time in 'set' command")
+			}
+		}
+		c.strings[args[0].(string)] = copyBytes(args[1])
+		c.ttls[args[0].(string)] = ttl
+		return "OK", nil
+
+	case "GET":
+		if buf, ok := c.strings[args[0].(string)]; ok {
+			return buf, nil
+		}
+		return nil, nil
+
+	case "XADD":
+		c.streams[args[0].(string)] = append(c.streams[args[0].(string)], args[1:])
+		return []byte("1-0"), nil
+
+	case "MGET":
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			if buf, ok := c.strings[arg.(string)]; ok {
+				vals[i] = buf
+			}
+		}
+		return vals, nil
+
+	case "GETDEL":
+		buf, ok := c.strings[args[0].(string)]
+		if !ok {
+			return nil, nil
+		}
+		delete(c.strings, args[0].(string))
+		return buf, nil
+
+	case "DEL", "UNLINK":
+		var n int64
+		for _, arg := range args {
+			var key string
+			switch k := arg.(type) {
+			case string:
+				key = k
+			case []byte:
+				key = string(k)
+			}
+			_, isString := c.strings[key]
+			_, isHash := c.hashes[key]
+			if isString || isHash {
+				n++
+			}
+			delete(c.strings, key)
+			delete(c.hashes, key)
+		}
+		return n, nil
+
+	case "PTTL":
+		key := args[0].(string)
+		_, isString := c.strings[key]
+		_, isHash := c.hashes[key]
+		if !isString && !isHash {
+			return int64(-2), nil
+		}
+		return c.ttls[key], nil
+
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[2].(string), "*")
+		var keys []interface{}
+		for k := range c.strings {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		for k := range c.hashes {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+
+	case "HGETALL":
+		var vals []interface{}
+		for k, v := range c.hashes[args[0].(string)] {
+			vals = append(vals, []byte(k), v)
+		}
+		return vals, nil
+
+	case "EVAL":
+		if src, ok := args[0].(string); ok {
+			c.scripts[newScript(src).hash] = src
+		}
+		key, _ := args[2].(string)
+		var ttl int64
+		if len(args) > 3 {
+			ttl, _ = args[3].(int64)
+		}
+		switch args[0].(string) {
+		case batchWriteScript:
+			n := args[1].(int)
+			ttl := expiry(args[2+n].(int64))
+			for i := 0; i < n; i++ {
+				k := args[2+i].(string)
+				c.strings[k], c.ttls[k] = copyBytes(args[3+n+i]), ttl
+			}
+			return int64(n), nil
+
+		case incrScript:
+			n, _ := strconv.ParseInt(string(c.strings[key]), 10, 64)
+			n++
+			c.strings[key] = []byte(strconv.FormatInt(n, 10))
+			if n == 1 {
+				c.ttls[key] = ttl
+			}
+			return n, nil
+
+		case touchScript.src:
+			buf, ok := c.strings[key]
+			if !ok {
+				return nil, nil
+			}
+			ttl := expiry(args[4].(int64))
+			c.ttls[key] = ttl
+			c.strings[args[3].(string)] = []byte(strconv.FormatInt(args[5].(int64), 10))
+			c.ttls[args[3].(string)] = ttl
+			return buf, nil
+
+		case hashTouchScript.src:
+			var vals []interface{}
+			for k, v := range c.hashes[key] {
+				vals = append(vals, []byte(k), v)
+			}
+			if len(vals) != 0 {
+				ttl := expiry(args[4].(int64))
+				c.ttls[key] = ttl
+				c.strings[args[3].(string)] = []byte(strconv.FormatInt(args[5].(int64), 10))
+				c.ttls[args[3].(string)] = ttl
+			}
+			return vals, nil
+
+		case unlockScript:
+			if string(c.strings[key]) != args[3].(string) {
+				return int64(0), nil
+			}
+			delete(c.strings, key)
+			return int64(1), nil
+
+		case hashTakeScript:
+			var vals []interface{}
+			for k, v := range c.hashes[key] {
+				vals = append(vals, []byte(k), v)
+			}
+			delete(c.hashes, key)
+			return vals, nil
+
+		case hashWriteScript:
+			h := make(map[string][]byte)
+			for i := 4; i < len(args); i += 2 {
+				h[args[i].(string)] = copyBytes(args[i+1])
+			}
+			c.hashes[key], c.ttls[key] = h, expiry(ttl)
+			return int64(1), nil
+
+		case hashPatchScript:
+			h, ok := c.hashes[key]
+			if !ok {
+				return int64(0), nil
+			}
+			n := 5 + args[4].(int)*2
+			for i := 5; i < n; i += 2 {
+				h[args[i].(string)] = copyBytes(args[i+1])
+			}
+			for _, k := range args[n:] {
+				delete(h, k.(string))
+			}
+			c.ttls[key] = expiry(ttl)
+			return int64(1), nil
+		}
+	}
+
+	panic("unsupported command " + cmd)
+}
+
+// expiry returns the PTTL of a key expired after ttl milliseconds by a script,
+// which is -1 when the key does not expire.
+func expiry(ttl int64) int64 {
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// copyBytes copies the []byte arg, as it is reused once Do returns.
+func copyBytes(arg interface{}) []byte {
+	if s, ok := arg.(string); ok {
+		return []byte(s)
+	}
+	return append([]byte(nil), arg.([]byte)...)
+}
+
+func TestRedisStore(t *testing.T) {
+	conn := newFakeConn()
+	rs := New(conn, "sess_", time.Hour)
+
+	if _, err := rs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := rs.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if conn.ttls["sess_a"] != 3600000 {
+		t.Errorf("expected ttl 3600000, got: %d", conn.ttls["sess_a"])
+	}
+
+	d, err := rs.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if d.(map[string]interface{})["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %v", d)
+	}
+
+	conn.ttls["sess_a"] = 0
+	if d, err = rs.ReadRefresh("a"); err != nil || d.(map[string]interface{})["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %v (%v)", d, err)
+	}
+	if conn.ttls["sess_a"] != 3600000 {
+		t.Errorf("expected ttl to be refreshed, got: %d", conn.ttls["sess_a"])
+	}
+
+	if err = rs.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = rs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	err = rs.WriteBatch(map[string]interface{}{
+		"b": map[string]interface{}{"name": "b"},
+		"c": map[string]interface{}{"name": "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, key := range []string{"b", "c"} {
+		d, err := rs.Read(key)
+		if err != nil || d.(map[string]interface{})["name"] != key {
+			t.Errorf("expected name=%s, got: %v (%v)", key, d, err)
+		}
+		if conn.ttls["sess_"+key] != 3600000 {
+			t.Errorf("expected ttl 3600000, got: %d", conn.ttls["sess_"+key])
+		}
+	}
+
+	objs, err := rs.ReadBatch([]string{"a", "b", "c"})
+	if err != nil || len(objs) != 2 || objs["b"].(map[string]interface{})["name"] != "b" || objs["c"].(map[string]interface{})["name"] != "c" {
+		t.Errorf("expected sessions b and c, got: %v (%v)", objs, err)
+	}
+
+	if err = rs.Close(); err != nil || !conn.closed {
+		t.Errorf("expected conn to be closed, got: %v", err)
+	}
+}
+
+func TestHashStore(t *testing.T) {
+	conn := newFakeConn()
+	hs := NewHash(conn, "sess_", time.Minute)
+
+	if _, err := hs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if err := hs.Patch("a", map[string]interface{}{"x": 1}, nil); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	err := hs.Write("a", map[string]interface{}{"name": "foo", "n": 1, "del": true})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if s := string(conn.hashes["sess_a"]["name"]); s != `"foo"` {
+		t.Errorf("expected name field to be JSON encoded, got: %s", s)
+	}
+
+	err = hs.Patch("a", map[string]interface{}{"name": "bar"}, []string{"del"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	d, err := hs.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := d.(map[string]interface{})
+	if len(m) != 2 || m["name"] != "bar" || m["n"] != json.Number("1") {
+		t.Errorf("expected name=bar n=1, got: %v", m)
+	}
+
+	conn.ttls["sess_a"] = 0
+	if d, err = hs.ReadRefresh("a"); err != nil || d.(map[string]interface{})["name"] != "bar" {
+		t.Errorf("expected name=bar, got: %v (%v)", d, err)
+	}
+	if conn.ttls["sess_a"] != 60000 {
+		t.Errorf("expected ttl to be refreshed, got: %d", conn.ttls["sess_a"])
+	}
+
+	if err = hs.Write("a", "foo"); err == nil {
+		t.Errorf("expected error writing non session data")
+	}
+
+	if err = hs.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = hs.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
+
+func TestReadRefresh(t *testing.T) {
+	for i, load := range []bool{false, true} {
+		now := time.Unix(1500000000, 0)
+		clock := sessionmw.ClockFunc(func() time.Time { return now })
+		conn := newFakeConn()
+		rs, hs := New(conn, "sess_", time.Hour), NewHash(conn, "hash_", time.Hour)
+		rs.Clock, hs.Clock = clock, clock
+		stores := []interface {
+			sessionmw.RefreshStore
+			LoadScripts() error
+			LastAccess(string) (time.Time, error)
+		}{rs, hs}
+
+		for j, st := range stores {
+			if load {
+				if err := st.LoadScripts(); err != nil {
+					t.Fatalf("test %d expected no error, got: %v", i, err)
+				}
+			}
+			if _, err := st.ReadRefresh("a"); err != sessionmw.ErrSessionNotFound {
+				t.Errorf("test %d store %d expected ErrSessionNotFound, got: %v", i, j, err)
+			}
+			if at, err := st.LastAccess("a"); err != nil || !at.IsZero() {
+				t.Errorf("test %d store %d expected no last access, got: %v (%v)", i, j, at, err)
+			}
+
+			if err := st.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+				t.Fatalf("test %d store %d expected no error, got: %v", i, j, err)
+			}
+			if d, err := st.ReadRefresh("a"); err != nil || d.(map[string]interface{})["name"] != "foo" {
+				t.Errorf("test %d store %d expected name=foo, got: %v (%v)", i, j, d, err)
+			}
+			if at, err := st.LastAccess("a"); err != nil || !at.Equal(now) {
+				t.Errorf("test %d store %d expected last access to be recorded, got: %v (%v)", i, j, at, err)
+			}
+
+			if err := st.Erase("a"); err != nil {
+				t.Fatalf("test %d store %d expected no error, got: %v", i, j, err)
+			}
+			if at, err := st.LastAccess("a"); err != nil || !at.IsZero() {
+				t.Errorf("test %d store %d expected last access to be erased, got: %v (%v)", i, j, at, err)
+			}
+		}
+
+		// scripts not loaded at startup are cached when first run
+		exp := 2
+		if load {
+			exp = 4
+		}
+		if conn.evalsha != exp {
+			t.Errorf("test %d expected %d cached script runs, got: %d", i, exp, conn.evalsha)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	conn := newFakeConn()
+	for i, st := range []sessionmw.Pinger{New(conn, "sess_", time.Hour), NewHash(conn, "sess_", time.Hour)} {
+		if err := st.Ping(context.Background()); err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+		}
+	}
+
+	conn.closed = true
+	err := New(conn, "sess_", time.Hour).Ping(context.Background())
+	if !errors.Is(err, sessionmw.ErrStoreUnavailable) {
+		t.Errorf("expected ErrStoreUnavailable, got: %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	conn := newFakeConn()
+	rs, hs := New(conn, "sess_", time.Hour), NewHash(conn, "hash_", time.Hour)
+
+	// reserved keys are not sessions
+	for _, key := range []string{"b", "a", sessionmw.ReservedPrefix + "user:a"} {
+		if err := rs.Write(key, map[string]interface{}{}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if err := hs.Write("c", map[string]interface{}{"name": "c"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	keys, err := rs.Keys()
+	sort.Strings(keys)
+	if err != nil || len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected keys [a b], got: %v (%v)", keys, err)
+	}
+
+	keys, err = hs.Keys()
+	if err != nil || len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("expected keys [c], got: %v (%v)", keys, err)
+	}
+
+	if n, err := rs.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 sessions, got: %d (%v)", n, err)
+	}
+	if n, err := hs.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 session, got: %d (%v)", n, err)
+	}
+
+	// tenant and hashed ids
+	ts := New(conn, "sess_", time.Hour)
+	ts.KeyBuilder.Tenant = "acme"
+	if err = ts.Write("d", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := conn.strings["sess_acme:d"]; !ok {
+		t.Errorf("expected session to be stored under sess_acme:d")
+	}
+	if keys, err = ts.Keys(); err != nil || len(keys) != 1 || keys[0] != "d" {
+		t.Errorf("expected keys [d], got: %v (%v)", keys, err)
+	}
+	ts.KeyBuilder.HashIDs = true
+	if _, err = ts.Keys(); err != sessionmw.ErrHashedIDs {
+		t.Errorf("expected ErrHashedIDs, got: %v", err)
+	}
+	if err = ts.Write(sessionmw.ReservedPrefix+"user:d", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n, err := ts.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 session, got: %d (%v)", n, err)
+	}
+
+	if s := globEscaper.Replace(`a*b?[c]\`); s != `a\*b\?\[c\]\\` {
+		t.Errorf("expected escaped pattern, got: %s", s)
+	}
+}
+
+// delConn is a Conn for Redis versions without UNLINK.
+type delConn struct {
+	*fakeConn
+	cmds []string
+}
+
+func (c *delConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.cmds = append(c.cmds, cmd)
+	if cmd == "UNLINK" {
+		return nil, errors.New("ERR unknown command 'UNLINK'")
+	}
+	return c.fakeConn.Do(cmd, args...)
+}
+
+func TestDestroyAll(t *testing.T) {
+	conn := &delConn{fakeConn: newFakeConn()}
+	for i, c := range []Conn{newFakeConn(), conn} {
+		rs, hs := New(c, "sess_", time.Hour), NewHash(c, "hash_", time.Hour)
+		for _, id := range []string{"a1", "a2", "b1", "c1"} {
+			if err := rs.Write(id, map[string]interface{}{"name": id}); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			if err := hs.Write(id, map[string]interface{}{"name": id}); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+
+		if err := rs.Erase("c1"); err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+		}
+		if err := hs.Erase("c1"); err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+		}
+		if n, err := rs.DestroyByPrefix("a"); err != nil || n != 2 {
+			t.Errorf("test %d expected 2 destroyed, got: %d %v", i, n, err)
+		}
+		if keys, err := rs.Keys(); err != nil || len(keys) != 1 || keys[0] != "b1" {
+			t.Errorf("test %d expected b1, got: %v %v", i, keys, err)
+		}
+
+		// reserved keys are not destroyed
+		reserved := sessionmw.ReservedPrefix + "user:a"
+		if err := rs.Write(reserved, map[string]interface{}{}); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if n, err := rs.DestroyAll(); err != nil || n != 1 {
+			t.Errorf("test %d expected 1 destroyed, got: %d %v", i, n, err)
+		}
+		if _, err := rs.Read(reserved); err != nil {
+			t.Errorf("test %d expected reserved key, got: %v", i, err)
+		}
+		rs.Erase(reserved)
+		if n, err := rs.Count(); err != nil || n != 0 {
+			t.Errorf("test %d expected no sessions, got: %d %v", i, n, err)
+		}
+
+		// hash sessions are in a distinct namespace
+		if n, err := hs.DestroyAll(); err != nil || n != 3 {
+			t.Errorf("test %d expected 3 destroyed, got: %d %v", i, n, err)
+		}
+	}
+	// UNLINK is probed once per store
+	if s := strings.Join(conn.cmds, " "); strings.Count(s, "UNLINK DEL") != 2 || strings.Count(s, "UNLINK") != 2 {
+		t.Errorf("expected fallback to DEL, got: %s", s)
+	}
+
+	rs := New(newFakeConn(), "sess_", time.Hour)
+	rs.KeyBuilder.HashIDs = true
+	if _, err := rs.DestroyByPrefix("a"); err != sessionmw.ErrHashedIDs {
+		t.Errorf("expected ErrHashedIDs, got: %v", err)
+	}
+}
+
+func TestTake(t *testing.T) {
+	conn := newFakeConn()
+	for _, st := range []sessionmw.TakeStore{New(conn, "sess_", time.Hour), NewHash(conn, "hash_", time.Hour)} {
+		if err := st.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		d, err := st.Take("a")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if m := d.(map[string]interface{}); m["name"] != "foo" {
+			t.Errorf("expected name=foo, got: %v", m)
+		}
+		if _, err = st.Take("a"); err != sessionmw.ErrSessionNotFound {
+			t.Errorf("expected ErrSessionNotFound, got: %v", err)
+		}
+		if _, err = st.Read("a"); err != sessionmw.ErrSessionNotFound {
+			t.Errorf("expected ErrSessionNotFound, got: %v", err)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	conn := newFakeConn()
+	rs, hs := New(conn, "sess_", time.Hour), NewHash(conn, "hash_", time.Hour)
+
+	l, err := rs.Acquire("a", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if conn.ttls[LockPrefix+"sess_a"] != 60000 {
+		t.Errorf("expected lock to expire after 60000ms, got: %d", conn.ttls[LockPrefix+"sess_a"])
+	}
+	if _, err = rs.Acquire("a", time.Minute, 50*time.Millisecond); err != sessionmw.ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout, got: %v", err)
+	}
+	if _, err = hs.Acquire("a", time.Minute, 0); err != nil {
+		t.Errorf("expected hash store lock to be independent, got: %v", err)
+	}
+	if keys, _ := rs.Keys(); len(keys) != 0 {
+		t.Errorf("expected locks to not be enumerated as sessions, got: %v", keys)
+	}
+
+	// simulate expiry and reacquisition by another owner
+	conn.Lock()
+	conn.strings[LockPrefix+"sess_a"] = []byte("other")
+	conn.Unlock()
+	if err = l.Unlock(); err != ErrLockNotHeld {
+		t.Errorf("expected ErrLockNotHeld, got: %v", err)
+	}
+	if _, ok := conn.strings[LockPrefix+"sess_a"]; !ok {
+		t.Errorf("expected lock held by other owner to not be released")
+	}
+	delete(conn.strings, LockPrefix+"sess_a")
+
+	// sessionmw.LockingStore
+	var st sessionmw.LockingStore = rs
+	unlock, err := st.Lock("a", 0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if conn.ttls[LockPrefix+"sess_a"] != millis(DefaultLockTTL) {
+		t.Errorf("expected lock to expire after LockTTL, got: %d", conn.ttls[LockPrefix+"sess_a"])
+	}
+	unlock()
+	if _, err = rs.Acquire("a", time.Minute, 0); err != nil {
+		t.Errorf("expected lock to be released, got: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	conn := newFakeConn()
+	for i, st := range []sessionmw.TTLStore{New(conn, "sess_", time.Hour), NewHash(conn, "hash_", time.Hour)} {
+		if _, err := st.TTL("a"); err != sessionmw.ErrSessionNotFound {
+			t.Errorf("test %d expected ErrSessionNotFound, got: %v", i, err)
+		}
+		if err := st.WriteTTL("a", map[string]interface{}{"name": "foo"}, time.Minute); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if ttl, err := st.TTL("a"); err != nil || ttl != time.Minute {
+			t.Errorf("test %d expected ttl 1m, got: %v (%v)", i, ttl, err)
+		}
+		if err := st.WriteTTL("a", map[string]interface{}{"name": "foo"}, 0); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if ttl, err := st.TTL("a"); err != nil || ttl != 0 {
+			t.Errorf("test %d expected no ttl, got: %v (%v)", i, ttl, err)
+		}
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	conn := newFakeConn()
+	for i, st := range []sessionmw.Store{New(conn, "sess_", 0), NewHash(conn, "hash_", 0)} {
+		for _, key := range []string{"a", "b"} {
+			if err := st.Write(key, map[string]interface{}{"name": key}); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+		if bs, ok := st.(sessionmw.BatchStore); ok {
+			if err := bs.WriteBatch(map[string]interface{}{"c": map[string]interface{}{"name": "c"}}); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+		obj, err := st.Read("a")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if obj.(map[string]interface{})["name"] != "a" {
+			t.Errorf("test %d expected name a, got: %v", i, obj)
+		}
+	}
+	for key, ttl := range conn.ttls {
+		if ttl != -1 {
+			t.Errorf("expected %s to not expire, got: %d", key, ttl)
+		}
+	}
+}
+
+// errorConn is a conn failing all commands.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, c.err
+}
+
+func TestError(t *testing.T) {
+	cause := errors.New("connection refused")
+	for i, st := range []sessionmw.Store{New(errorConn{cause}, "sess_", time.Hour), NewHash(errorConn{cause}, "sess_", time.Hour)} {
+		_, err := st.Read("a")
+		e, ok := err.(*Error)
+		if !ok || e.Op == "" || e.Kind != sessionmw.ErrStoreUnavailable || e.Err != cause || !e.Is(sessionmw.ErrStoreUnavailable) {
+			t.Errorf("test %d expected unavailable error, got: %#v", i, err)
+		}
+		if err := st.Erase("a"); err == nil || !err.(*Error).Is(sessionmw.ErrStoreUnavailable) {
+			t.Errorf("test %d expected unavailable error, got: %v", i, err)
+		}
+	}
+
+	conn := newFakeConn()
+	conn.strings["sess_a"] = []byte("SMW\x01\x09{}")
+	_, err := New(conn, "sess_", time.Hour).Read("a")
+	if e, ok := err.(*Error); !ok || !e.Is(sessionmw.ErrDecodeFailed) || e.Unwrap() != sessionmw.ErrUnknownCodec {
+		t.Errorf("expected decode error, got: %v", err)
+	}
+}
+
+// fakePubSubConn emulates a Redis pub/sub connection.
+type fakePubSubConn struct {
+	msgs      chan []interface{}
+	closed    chan bool
+	closeOnce sync.Once
+	sent      []string
+}
+
+func newFakePubSubConn() *fakePubSubConn {
+	return &fakePubSubConn{msgs: make(chan []interface{}, 10), closed: make(chan bool)}
+}
+
+func (c *fakePubSubConn) Send(cmd string, args ...interface{}) error {
+	c.sent = append(c.sent, cmd+" "+args[0].(string))
+	c.msgs <- []interface{}{[]byte("psubscribe"), []byte(args[0].(string)), int64(1)}
+	return nil
+}
+
+func (c *fakePubSubConn) Flush() error {
+	return nil
+}
+
+func (c *fakePubSubConn) Receive() (interface{}, error) {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return nil, errors.New("connection reset")
+		}
+		return msg, nil
+	case <-c.closed:
+		return nil, errors.New("connection closed")
+	}
+}
+
+func (c *fakePubSubConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *fakePubSubConn) notify(key, event string) {
+	c.msgs <- []interface{}{[]byte("pmessage"), []byte("__keyspace@2__:sess:*"), []byte("__keyspace@2__:" + key), []byte(event)}
+}
+
+func TestSubscriber(t *testing.T) {
+	conns := []*fakePubSubConn{newFakePubSubConn(), newFakePubSubConn()}
+	var dials int
+	dial := func() (PubSubConn, error) {
+		if dials++; dials > len(conns) {
+			return nil, errors.New("connection refused")
+		}
+		return conns[dials-1], nil
+	}
+
+	events := make(chan Event, 10)
+	errs := make(chan error, 10)
+	s := NewSubscriber(dial, sessionmw.KeyBuilder{Prefix: "sess:"}, func(e Event) {
+		events <- e
+	}, SubscriberOptions{
+		DB:         2,
+		MinBackoff: time.Millisecond,
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("expected event")
+		}
+		return Event{}
+	}
+
+	conns[0].notify("sess:a", "expired")
+	conns[0].notify("sess:b", "set")
+	conns[0].notify("sess:b", "del")
+	if e := next(); e != (Event{Type: "expired", Key: "sess:a", ID: "a"}) {
+		t.Errorf("expected expired a, got: %+v", e)
+	}
+	if e := next(); e != (Event{Type: "del", Key: "sess:b", ID: "b"}) {
+		t.Errorf("expected del b, got: %+v", e)
+	}
+	if conns[0].sent[0] != `PSUBSCRIBE __keyspace@2__:sess:*` {
+		t.Errorf("expected psubscribe, got: %v", conns[0].sent)
+	}
+
+	// reconnect
+	close(conns[0].msgs)
+	if err := <-errs; err == nil || err.Error() != "connection reset" {
+		t.Errorf("expected connection reset, got: %v", err)
+	}
+	conns[1].notify("sess:c", "del")
+	if e := next(); e.ID != "c" {
+		t.Errorf("expected del c, got: %+v", e)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	select {
+	case <-conns[1].closed:
+	default:
+		t.Errorf("expected conn to be closed")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestStreamSink(t *testing.T) {
+	conn := newFakeConn()
+	ss := NewStreamSink(conn, "sessions")
+	ss.MaxLen = 1000
+
+	now := time.Unix(1500000000, 0)
+	for _, op := range []string{sessionmw.AuditCreate, sessionmw.AuditSet, sessionmw.AuditDestroy} {
+		ss.Audit(sessionmw.AuditEvent{Time: now, Op: op, SessionID: "abc", User: "alice", RequestID: "req-1"})
+	}
+
+	entries := conn.streams["sessions"]
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got: %v", entries)
+	}
+	exp := []interface{}{
+		"MAXLEN", "~", int64(1000), "*",
+		"op", "create",
+		"session", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"user", "alice",
+		"time", "1500000000000",
+		"request_id", "req-1",
+	}
+	if !reflect.DeepEqual(entries[0], exp) {
+		t.Errorf("expected %v, got: %v", exp, entries[0])
+	}
+	if entries[1][5] != "destroy" {
+		t.Errorf("expected destroy, got: %v", entries[1])
+	}
+
+	// impersonation
+	ss.Audit(sessionmw.AuditEvent{Time: now, Op: sessionmw.AuditImpersonate, SessionID: "abc", User: "bob", Impersonator: "alice"})
+	entries = conn.streams["sessions"]
+	if e := entries[len(entries)-1]; len(entries) != 3 || e[5] != "impersonate" || e[len(e)-2] != "impersonator" || e[len(e)-1] != "alice" {
+		t.Errorf("expected impersonate entry, got: %v", entries)
+	}
+
+	// errors
+	var errs []error
+	ss = NewStreamSink(errorConn{errors.New("connection refused")}, "sessions")
+	ss.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+	ss.Audit(sessionmw.AuditEvent{Time: now, Op: sessionmw.AuditSave, SessionID: "abc"})
+	if len(errs) != 1 || !errs[0].(*Error).Is(sessionmw.ErrStoreUnavailable) {
+		t.Errorf("expected unavailable error, got: %v", errs)
+	}
+}
+
+func TestRateCounter(t *testing.T) {
+	conn := newFakeConn()
+	rc := NewRateCounter(conn, "limit:")
+	for i := int64(1); i <= 3; i++ {
+		if n, err := rc.Incr("1.2.3.4", time.Minute); err != nil || n != i {
+			t.Errorf("expected %d, got: %d (%v)", i, n, err)
+		}
+	}
+	if n, err := rc.Count("1.2.3.4", time.Minute); err != nil || n != 3 {
+		t.Errorf("expected 3, got: %d (%v)", n, err)
+	}
+	if n, err := rc.Count("5.6.7.8", time.Minute); err != nil || n != 0 {
+		t.Errorf("expected 0, got: %d (%v)", n, err)
+	}
+	if conn.ttls["limit:1.2.3.4"] != 60000 {
+		t.Errorf("expected ttl 60000, got: %d", conn.ttls["limit:1.2.3.4"])
+	}
+}
+
+// nopConn discards all commands.
+type nopConn struct{}
+
+func (nopConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return int64(1), nil
+}
+
+// benchmarkObj is the session written by the benchmarks.
+var benchmarkObj = map[string]interface{}{
+	"name":  strings.Repeat("foo", 100),
+	"count": int64(1),
+	"admin": true,
+}
+
+func BenchmarkRedisStoreWrite(b *testing.B) {
+	rs := New(nopConn{}, "SESS_", time.Hour)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rs.Write("id", benchmarkObj); err != nil {
+			b.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func BenchmarkHashStoreWrite(b *testing.B) {
+	hs := NewHash(nopConn{}, "SESS_", time.Hour)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := hs.Write("id", benchmarkObj); err != nil {
+			b.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
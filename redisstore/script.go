@@ -0,0 +1,115 @@
+package redisstore
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessPrefix is the prefix of the keys recording the last access of
+// sessions (see LastAccess), preceding the key built by the store's
+// KeyBuilder, such that they are not enumerated as sessions.
+const AccessPrefix = "access:"
+
+// script is a Lua script run with EVALSHA, using the script cached by the
+// server.
+type script struct {
+	src  string
+	hash string
+}
+
+// newScript creates a script for the Lua source src.
+func newScript(src string) *script {
+	sum := sha1.Sum([]byte(src))
+	return &script{src: src, hash: hex.EncodeToString(sum[:])}
+}
+
+// load loads the script into the server's script cache.
+func (s *script) load(conn Conn) error {
+	_, err := conn.Do("SCRIPT", "LOAD", s.src)
+	return err
+}
+
+// do runs the script with EVALSHA, falling back to EVAL (which caches the
+// script) when the script is not cached by the server, ie, after a restart
+// or SCRIPT FLUSH.
+func (s *script) do(conn Conn, keys []interface{}, args ...interface{}) (interface{}, error) {
+	v, err := conn.Do("EVALSHA", append(append([]interface{}{s.hash, len(keys)}, keys...), args...)...)
+	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
+		v, err = conn.Do("EVAL", append(append([]interface{}{s.src, len(keys)}, keys...), args...)...)
+	}
+	return v, err
+}
+
+// touchScript returns the value of KEYS[1], expiring it after ARGV[1]
+// milliseconds (or never when ARGV[1] is not positive), and recording the
+// access time ARGV[2] at KEYS[2] with the same expiration.
+var touchScript = newScript(`local v = redis.call('GET', KEYS[1])
+if v then
+	if tonumber(ARGV[1]) > 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[1])
+		redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[1])
+	else
+		redis.call('SET', KEYS[2], ARGV[2])
+	end
+end
+return v`)
+
+// hashTouchScript returns all fields of the hash at KEYS[1], expiring it after
+// ARGV[1] milliseconds (or never when ARGV[1] is not positive), and recording
+// the access time ARGV[2] at KEYS[2] with the same expiration.
+var hashTouchScript = newScript(`local vals = redis.call('HGETALL', KEYS[1])
+if #vals ~= 0 then
+	if tonumber(ARGV[1]) > 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[1])
+		redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[1])
+	else
+		redis.call('SET', KEYS[2], ARGV[2])
+	end
+end
+return vals`)
+
+// lastAccess returns the access time recorded at key, or the zero time if
+// none was recorded.
+func lastAccess(conn Conn, key string) (time.Time, error) {
+	v, err := conn.Do("GET", key)
+	if err != nil || v == nil {
+		return time.Time{}, err
+	}
+	buf, ok := v.([]byte)
+	if !ok {
+		return time.Time{}, ErrUnexpectedReply
+	}
+	ms, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil {
+		return time.Time{}, ErrUnexpectedReply
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// LoadScripts loads the scripts used by ReadRefresh into the server's script
+// cache, and should be called at startup. Scripts that are not cached are
+// sent in full the first time they are run.
+func (rs *RedisStore) LoadScripts() error {
+	return touchScript.load(rs.conn)
+}
+
+// LastAccess returns the time the session with the provided id was last read
+// with ReadRefresh, or the zero time if it was not.
+func (rs *RedisStore) LastAccess(key string) (time.Time, error) {
+	return lastAccess(rs.conn, AccessPrefix+rs.KeyBuilder.Key(key))
+}
+
+// LoadScripts loads the scripts used by ReadRefresh into the server's script
+// cache. See RedisStore.LoadScripts.
+func (hs *HashStore) LoadScripts() error {
+	return hashTouchScript.load(hs.conn)
+}
+
+// LastAccess returns the time the session with the provided id was last read
+// with ReadRefresh, or the zero time if it was not.
+func (hs *HashStore) LastAccess(key string) (time.Time, error) {
+	return lastAccess(hs.conn, AccessPrefix+hs.KeyBuilder.Key(key))
+}
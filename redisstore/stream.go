@@ -0,0 +1,81 @@
+package redisstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/knq/sessionmw"
+)
+
+// StreamSink is a sessionmw.AuditSink publishing session lifecycle events to
+// a Redis Stream (using XADD), so that downstream consumers (ie, fraud
+// detection or analytics) can react to session activity.
+//
+// Each stream entry has the fields op, session (the hex encoded SHA-256 hash
+// of the session id, so that the id cannot be used to hijack the session),
+// user, and time (in Unix milliseconds), and request_id and impersonator when
+// available.
+type StreamSink struct {
+	conn   Conn
+	stream string
+
+	// Ops are the published audit operations. Defaults to the
+	// sessionmw.AuditCreate, sessionmw.AuditSave, and sessionmw.AuditDestroy
+	// lifecycle operations, and the sessionmw.AuditImpersonate and
+	// sessionmw.AuditStopImpersonate operations.
+	Ops []string
+
+	// MaxLen caps the approximate length of the stream (using MAXLEN ~).
+	// The length is not capped when 0.
+	MaxLen int64
+
+	// OnError is called with the errors publishing events.
+	OnError func(error)
+}
+
+// NewStreamSink creates a sink publishing session lifecycle events to the
+// stream using conn.
+func NewStreamSink(conn Conn, stream string) *StreamSink {
+	return &StreamSink{
+		conn:   errConn{conn},
+		stream: stream,
+		Ops: []string{
+			sessionmw.AuditCreate, sessionmw.AuditSave, sessionmw.AuditDestroy,
+			sessionmw.AuditImpersonate, sessionmw.AuditStopImpersonate,
+		},
+	}
+}
+
+// Audit satisfies the sessionmw.AuditSink interface.
+func (ss *StreamSink) Audit(ev sessionmw.AuditEvent) {
+	var publish bool
+	for _, op := range ss.Ops {
+		publish = publish || op == ev.Op
+	}
+	if !publish {
+		return
+	}
+
+	h := sha256.Sum256([]byte(ev.SessionID))
+	args := []interface{}{ss.stream}
+	if ss.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", ss.MaxLen)
+	}
+	args = append(args, "*",
+		"op", ev.Op,
+		"session", hex.EncodeToString(h[:]),
+		"user", ev.User,
+		"time", strconv.FormatInt(ev.Time.UnixNano()/1e6, 10),
+	)
+	if ev.RequestID != "" {
+		args = append(args, "request_id", ev.RequestID)
+	}
+	if ev.Impersonator != "" {
+		args = append(args, "impersonator", ev.Impersonator)
+	}
+
+	if _, err := ss.conn.Do("XADD", args...); err != nil && ss.OnError != nil {
+		ss.OnError(err)
+	}
+}
@@ -0,0 +1,229 @@
+package redisstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultMinBackoff is the default initial delay before reconnecting a
+	// subscriber.
+	DefaultMinBackoff = 100 * time.Millisecond
+
+	// DefaultMaxBackoff is the default maximum delay before reconnecting a
+	// subscriber.
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// PubSubConn is the interface for receiving Redis pub/sub messages, as
+// provided by most Redis clients (ie, the redis.Conn of
+// github.com/garyburd/redigo).
+//
+// Array replies must be returned as []interface{}, and bulk string replies as
+// []byte.
+type PubSubConn interface {
+	Send(cmd string, args ...interface{}) error
+	Flush() error
+	Receive() (interface{}, error)
+	Close() error
+}
+
+// Event is a session invalidation event.
+type Event struct {
+	// Type is the event type, either "expired" or "del".
+	Type string
+
+	// Key is the Redis key of the session.
+	Key string
+
+	// ID is the session id, or empty when the store hashes session ids (see
+	// sessionmw.KeyBuilder).
+	ID string
+}
+
+// SubscriberOptions are the subscriber options. Zero values are replaced by
+// their defaults.
+type SubscriberOptions struct {
+	// DB is the Redis database of the sessions.
+	DB int
+
+	// OnError is called with the error causing the subscriber to reconnect.
+	OnError func(error)
+
+	// MinBackoff is the initial delay before reconnecting, doubled after each
+	// failed attempt. Defaults to DefaultMinBackoff.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum delay before reconnecting. Defaults to
+	// DefaultMaxBackoff.
+	MaxBackoff time.Duration
+}
+
+// Subscriber listens to the Redis keyspace notifications of the sessions in a
+// namespace, invoking a callback when sessions expire or are deleted (ie, to
+// purge cached sessions, or to emit logout events).
+//
+// Redis must be configured to publish keyspace notifications for generic and
+// expired events (ie, notify-keyspace-events set to "Kgx").
+type Subscriber struct {
+	dial    func() (PubSubConn, error)
+	kb      sessionmw.KeyBuilder
+	fn      func(Event)
+	opts    SubscriberOptions
+	pattern string
+	prefix  string
+
+	mu     sync.Mutex
+	conn   PubSubConn
+	closed bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewSubscriber creates and starts a subscriber invoking fn for the sessions
+// with the keys built by kb that expire or are deleted.
+//
+// The subscriber connects with dial, and reconnects with exponential backoff
+// when the connection fails, until it is closed. Events occurring while the
+// subscriber is disconnected are lost.
+func NewSubscriber(dial func() (PubSubConn, error), kb sessionmw.KeyBuilder, fn func(Event), opts SubscriberOptions) *Subscriber {
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+
+	prefix := fmt.Sprintf("__keyspace@%d__:", opts.DB)
+	s := &Subscriber{
+		dial:    dial,
+		kb:      kb,
+		fn:      fn,
+		opts:    opts,
+		pattern: prefix + globEscaper.Replace(kb.Namespace()) + "*",
+		prefix:  prefix,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// run receives notifications, reconnecting until the subscriber is closed.
+func (s *Subscriber) run() {
+	defer close(s.stopped)
+
+	backoff := s.opts.MinBackoff
+	for {
+		received, err := s.subscribe()
+		if s.isClosed() {
+			return
+		}
+		if s.opts.OnError != nil {
+			s.opts.OnError(err)
+		}
+
+		// reset the backoff after a successful subscription
+		if received {
+			backoff = s.opts.MinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return
+		}
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// subscribe connects and receives notifications until the connection fails,
+// returning whether the subscription was confirmed, and the error.
+func (s *Subscriber) subscribe() (bool, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	if err = conn.Send("PSUBSCRIBE", s.pattern); err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var received bool
+	for {
+		v, err := conn.Receive()
+		if err != nil {
+			return received, err
+		}
+
+		r, ok := v.([]interface{})
+		if !ok || len(r) == 0 {
+			return received, ErrUnexpectedReply
+		}
+		switch kind, _ := r[0].([]byte); string(kind) {
+		case "psubscribe":
+			received = true
+		case "pmessage":
+			if len(r) != 4 {
+				return received, ErrUnexpectedReply
+			}
+			channel, _ := r[2].([]byte)
+			data, _ := r[3].([]byte)
+			s.notify(string(channel), string(data))
+		}
+	}
+}
+
+// notify invokes the callback for the keyspace notification of channel.
+func (s *Subscriber) notify(channel, typ string) {
+	if typ != "expired" && typ != "del" {
+		return
+	}
+	key := strings.TrimPrefix(channel, s.prefix)
+	id, _ := s.kb.ID(key)
+	s.fn(Event{Type: typ, Key: key, ID: id})
+}
+
+// isClosed determines if the subscriber was closed.
+func (s *Subscriber) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close stops the subscriber, closing its connection and waiting for it to
+// stop. Subsequent calls to Close have no effect.
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-s.stopped
+	return nil
+}
@@ -0,0 +1,326 @@
+// Package resilientstore provides a sessionmw.Store decorator adding retries
+// with exponential backoff and a circuit breaker to an underlying store.
+package resilientstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// ErrCircuitOpen is the error returned by writes and erases while the
+// circuit breaker is open. ErrCircuitOpen is a sessionmw.ErrStoreUnavailable
+// error.
+var ErrCircuitOpen error = &sessionmw.StoreError{
+	Kind: sessionmw.ErrStoreUnavailable,
+	Err:  errors.New("store circuit breaker open"),
+}
+
+// State is a circuit breaker state.
+type State int
+
+// State values.
+const (
+	// Closed is the normal state, where all operations are passed to the
+	// underlying store.
+	Closed State = iota
+
+	// Open is the state after repeated failures, where operations are short
+	// circuited without calling the underlying store.
+	Open
+
+	// HalfOpen is the state after the cooldown, where a single trial
+	// operation is passed to the underlying store.
+	HalfOpen
+)
+
+// String satisfies the fmt.Stringer interface.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Options are the resilient store options. Zero values are replaced by their
+// defaults.
+type Options struct {
+	// Retries is the number of retries after a failed operation. Defaults
+	// to 2. Use a negative value to disable retries.
+	Retries int
+
+	// Backoff is the initial delay between retries, doubled after each
+	// retry. Defaults to 10ms.
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum delay between retries. Defaults to 250ms.
+	MaxBackoff time.Duration
+
+	// Budget is the total time allowed for an operation, including all
+	// retries. No retry is made that would exceed the budget. Note that an
+	// in-flight call to the underlying store cannot be interrupted.
+	// Defaults to 1s.
+	Budget time.Duration
+
+	// Threshold is the number of consecutive failed operations that opens
+	// the circuit breaker. Defaults to 5.
+	Threshold int
+
+	// Cooldown is the time the circuit breaker stays open before allowing a
+	// trial operation. Defaults to 30s.
+	Cooldown time.Duration
+
+	// StaleCacheSize is the maximum number of sessions to keep from
+	// successful reads and writes, served by reads while the circuit breaker
+	// is open. Disabled when 0.
+	StaleCacheSize int
+
+	// IsPermanent determines if an error is permanent, and should neither be
+	// retried nor counted as a failure. Defaults to treating
+	// sessionmw.ErrSessionNotFound as permanent.
+	IsPermanent func(error) bool
+
+	// OnStateChange is called when the circuit breaker changes state.
+	OnStateChange func(from, to State)
+
+	// Clock is the time source for the cooldown and budget. Defaults to
+	// sessionmw.SystemClock.
+	Clock sessionmw.Clock
+}
+
+// Store is a resilient session store.
+type Store struct {
+	st   sessionmw.Store
+	opts Options
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	stale    map[string]interface{}
+}
+
+// Wrap wraps st with retries and a circuit breaker.
+func Wrap(st sessionmw.Store, opts Options) *Store {
+	if opts.Retries == 0 {
+		opts.Retries = 2
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = 10 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 250 * time.Millisecond
+	}
+	if opts.Budget == 0 {
+		opts.Budget = time.Second
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = 5
+	}
+	if opts.Cooldown == 0 {
+		opts.Cooldown = 30 * time.Second
+	}
+	if opts.Clock == nil {
+		opts.Clock = sessionmw.SystemClock
+	}
+	if opts.IsPermanent == nil {
+		opts.IsPermanent = func(err error) bool {
+			return err == sessionmw.ErrSessionNotFound
+		}
+	}
+
+	return &Store{
+		st:    st,
+		opts:  opts,
+		stale: make(map[string]interface{}),
+	}
+}
+
+// State returns the current circuit breaker state.
+func (s *Store) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// setState changes the breaker state. The store must be locked.
+func (s *Store) setState(state State) func() {
+	from := s.state
+	s.state = state
+	if state == Open {
+		s.openedAt = s.opts.Clock.Now()
+	}
+	if from == state || s.opts.OnStateChange == nil {
+		return func() {}
+	}
+	return func() {
+		s.opts.OnStateChange(from, state)
+	}
+}
+
+// allow determines if an operation may be passed to the underlying store.
+func (s *Store) allow() bool {
+	s.mu.Lock()
+	notify := func() {}
+	defer func() {
+		s.mu.Unlock()
+		notify()
+	}()
+
+	switch s.state {
+	case Open:
+		if s.opts.Clock.Now().Sub(s.openedAt) < s.opts.Cooldown {
+			return false
+		}
+		notify = s.setState(HalfOpen)
+		return true
+	case HalfOpen:
+		// only a single trial at a time
+		return false
+	}
+	return true
+}
+
+// done records the result of an operation.
+func (s *Store) done(err error) {
+	s.mu.Lock()
+	notify := func() {}
+	defer func() {
+		s.mu.Unlock()
+		notify()
+	}()
+
+	if err == nil || s.opts.IsPermanent(err) {
+		s.failures = 0
+		notify = s.setState(Closed)
+		return
+	}
+
+	s.failures++
+	if s.state == HalfOpen || s.failures >= s.opts.Threshold {
+		notify = s.setState(Open)
+	}
+}
+
+// do calls f with retries, recording the result.
+func (s *Store) do(f func() error) error {
+	start, backoff := s.opts.Clock.Now(), s.opts.Backoff
+
+	var err error
+	for i := 0; ; i++ {
+		if err = f(); err == nil || s.opts.IsPermanent(err) || i >= s.opts.Retries {
+			break
+		}
+		if s.opts.Clock.Now().Sub(start)+backoff > s.opts.Budget {
+			break
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+
+	s.done(err)
+	return err
+}
+
+// cache keeps obj for stale reads.
+func (s *Store) cache(key string, obj interface{}) {
+	if s.opts.StaleCacheSize <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.stale[key]; !ok && len(s.stale) >= s.opts.StaleCacheSize {
+		// evict an arbitrary entry
+		for k := range s.stale {
+			delete(s.stale, k)
+			break
+		}
+	}
+	s.stale[key] = obj
+}
+
+// uncache removes key from the stale cache.
+func (s *Store) uncache(key string) {
+	s.mu.Lock()
+	delete(s.stale, key)
+	s.mu.Unlock()
+}
+
+// Write saves the session for the provided id.
+func (s *Store) Write(key string, obj interface{}) error {
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := s.do(func() error {
+		return s.st.Write(key, obj)
+	})
+	if err == nil {
+		s.cache(key, obj)
+	}
+	return err
+}
+
+// Read retrieves the session for the provided id.
+//
+// While the circuit breaker is open, Read returns the stale cached session
+// (if available), or sessionmw.ErrSessionNotFound.
+func (s *Store) Read(key string) (interface{}, error) {
+	if !s.allow() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if obj, ok := s.stale[key]; ok {
+			return obj, nil
+		}
+		return nil, sessionmw.ErrSessionNotFound
+	}
+
+	var obj interface{}
+	err := s.do(func() error {
+		var err error
+		obj, err = s.st.Read(key)
+		return err
+	})
+	if err == nil {
+		s.cache(key, obj)
+	}
+	return obj, err
+}
+
+// Erase permanently destroys the session with the provided id.
+func (s *Store) Erase(key string) error {
+	s.uncache(key)
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	return s.do(func() error {
+		return s.st.Erase(key)
+	})
+}
+
+// Close closes the wrapped store.
+func (s *Store) Close() error {
+	return sessionmw.CloseStore(s.st)
+}
+
+// Ping checks the health of the wrapped store, bypassing the circuit
+// breaker. Satisfies the sessionmw.Pinger interface.
+func (s *Store) Ping(ctxt context.Context) error {
+	return sessionmw.PingStore(ctxt, s.st)
+}
@@ -0,0 +1,110 @@
+package resilientstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/knq/kv"
+
+	"github.com/knq/sessionmw"
+)
+
+// flakyStore fails the next n writes and reads.
+type flakyStore struct {
+	*kv.MemStore
+	fail  int
+	calls int
+}
+
+var errDown = errors.New("down")
+
+func (fs *flakyStore) Write(key string, obj interface{}) error {
+	fs.calls++
+	if fs.fail > 0 {
+		fs.fail--
+		return errDown
+	}
+	return fs.MemStore.Write(key, obj)
+}
+
+func (fs *flakyStore) Read(key string) (interface{}, error) {
+	fs.calls++
+	if fs.fail > 0 {
+		fs.fail--
+		return nil, errDown
+	}
+	return fs.MemStore.Read(key)
+}
+
+func TestRetry(t *testing.T) {
+	fs := &flakyStore{MemStore: kv.NewMemStore(), fail: 2}
+	s := Wrap(fs, Options{Backoff: time.Millisecond})
+
+	if err := s.Write("a", "foo"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if fs.calls != 3 {
+		t.Errorf("expected 3 calls, got: %d", fs.calls)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	fs := &flakyStore{MemStore: kv.NewMemStore()}
+
+	var changes []State
+	now := time.Now()
+	s := Wrap(fs, Options{
+		Clock:          sessionmw.ClockFunc(func() time.Time { return now }),
+		Retries:        -1,
+		Threshold:      2,
+		Cooldown:       time.Hour,
+		StaleCacheSize: 10,
+		OnStateChange: func(from, to State) {
+			changes = append(changes, to)
+		},
+	})
+
+	if err := s.Write("a", "foo"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	fs.fail = 100
+	for i := 0; i < 2; i++ {
+		if err := s.Write("b", "bar"); err != errDown {
+			t.Errorf("expected errDown, got: %v", err)
+		}
+	}
+	if s.State() != Open {
+		t.Fatalf("expected open, got: %s", s.State())
+	}
+
+	// short circuited
+	calls := fs.calls
+	if err := s.Write("b", "bar"); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got: %v", err)
+	}
+	if v, err := s.Read("a"); err != nil || v != "foo" {
+		t.Errorf("expected stale foo, got: %v (%v)", v, err)
+	}
+	if _, err := s.Read("b"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if fs.calls != calls {
+		t.Errorf("expected no calls while open")
+	}
+
+	// half open trial succeeds
+	fs.fail = 0
+	now = now.Add(2 * time.Hour)
+	if err := s.Write("b", "bar"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if s.State() != Closed {
+		t.Errorf("expected closed, got: %s", s.State())
+	}
+
+	if len(changes) != 3 || changes[0] != Open || changes[1] != HalfOpen || changes[2] != Closed {
+		t.Errorf("expected [open half-open closed], got: %v", changes)
+	}
+}
@@ -0,0 +1,111 @@
+package sessionmw
+
+import "time"
+
+const (
+	// DefaultRotateIDGrace is the default time a rotated session id remains
+	// valid (see Config.RotateIDGrace).
+	DefaultRotateIDGrace = 30 * time.Second
+
+	// metaRotatedKey is the metadata key holding the time the session id was
+	// last rotated.
+	metaRotatedKey = "rotated"
+
+	// metaForwardKey, metaForwardUntilKey, and metaForwardReadOnlyKey are the
+	// metadata keys of a forward stored under a previous session id, holding
+	// the new session id, the end of the grace period, and whether the
+	// session is loaded read only through the forward.
+	metaForwardKey         = "forward"
+	metaForwardUntilKey    = "forwarduntil"
+	metaForwardReadOnlyKey = "forwardro"
+)
+
+// rotateIDDue determines if the session id should be rotated, being when the
+// id was last rotated (or the session was created) at least RotateIDEvery
+// ago. The session must be locked.
+func (s *Manager) rotateIDDue(sess *session, now time.Time) bool {
+	last, ok := int64Value(sess.meta()[metaRotatedKey])
+	if !ok {
+		return now.Sub(sess.created(now)) >= s.rotateEvery
+	}
+	return now.Sub(time.Unix(0, last)) >= s.rotateEvery
+}
+
+// rotateID changes the id of the session, keeping the session values, as with
+// Regenerate. The session is saved under the new id immediately, and the
+// session stored under the previous id is replaced with a forward to the new
+// id (see writeForward), valid for RotateIDGrace, so that parallel requests
+// with the previous id load the session with the new id.
+//
+// The session is left unchanged when the new session cannot be saved, so
+// that the rotation is retried on the next request.
+func (s *Manager) rotateID(sess *session, now time.Time) error {
+	newID := s.idFn()
+	c, err := s.newCookie(newID)
+	if err != nil {
+		return err
+	}
+
+	sess.Lock()
+	oldID := sess.id
+	user := metadata(sess.data).indexed()
+	m := sess.meta()
+	prev, hasPrev := m[metaRotatedKey]
+	m[metaRotatedKey] = now.UnixNano()
+	if err = s.writeStore(newID, sess.data); err == nil {
+		sess.id, sess.modified, sess.version, sess.full = newID, true, 0, true
+		sess.issue(c, now)
+	} else if hasPrev {
+		m[metaRotatedKey] = prev
+	} else {
+		delete(m, metaRotatedKey)
+	}
+	sess.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = s.writeForward(oldID, newID, s.rotateGrace, false, now); err != nil {
+		return err
+	}
+	if user != "" {
+		if err = s.unindex(user, oldID); err != nil {
+			return err
+		}
+		return s.index(user, newID)
+	}
+	return nil
+}
+
+// writeForward replaces the session stored under oldID with a forward to
+// newID, valid for grace. Requests with oldID load the session with newID
+// (see forward), and are issued a cookie for newID unless readOnly is set,
+// in which case the session is neither saved nor issued a cookie.
+func (s *Manager) writeForward(oldID, newID string, grace time.Duration, readOnly bool, now time.Time) error {
+	fwd := map[string]interface{}{
+		metaKey: map[string]interface{}{
+			metaForwardKey:         newID,
+			metaForwardUntilKey:    now.Add(grace).UnixNano(),
+			metaForwardReadOnlyKey: readOnly,
+		},
+	}
+	if ts, ok := s.st.(TTLStore); ok {
+		return ts.WriteTTL(oldID, fwd, grace)
+	}
+	return s.st.Write(oldID, fwd)
+}
+
+// forward returns the new id of the stored session d when d is a forward
+// (see writeForward), whether the grace period has not ended, and whether the
+// session is loaded read only.
+func forward(d interface{}, now time.Time) (string, bool, bool) {
+	data, _ := d.(map[string]interface{})
+	m, _ := data[metaKey].(map[string]interface{})
+	id, _ := m[metaForwardKey].(string)
+	if id == "" {
+		return "", false, false
+	}
+	until, _ := int64Value(m[metaForwardUntilKey])
+	readOnly, _ := m[metaForwardReadOnlyKey].(bool)
+	return id, now.UnixNano() < until, readOnly
+}
@@ -0,0 +1,67 @@
+package sessionmw
+
+// metaSchemaKey is the session metadata key holding the session schema
+// version.
+const metaSchemaKey = "schema"
+
+// SchemaVersion returns the schema version of the stored session data obj,
+// or 0 if obj does not have a schema version.
+func SchemaVersion(obj interface{}) int {
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	m, _ := data[metaKey].(map[string]interface{})
+	n, _ := int64Value(m[metaSchemaKey])
+	return int(n)
+}
+
+// schemaVersion returns the current schema version, the highest version of
+// the migrations.
+func schemaVersion(migrations map[int]func(map[string]interface{}) map[string]interface{}) int {
+	var v int
+	for n := range migrations {
+		if n > v {
+			v = n
+		}
+	}
+	return v
+}
+
+// migrate runs the migrations for the versions following the session's
+// schema version, marking the session to be saved in full when migrated.
+// The session must be locked.
+func (s *Manager) migrate(sess *session) {
+	n := SchemaVersion(sess.data)
+	if n >= s.schema {
+		return
+	}
+
+	// migrations do not see the session metadata
+	meta := sess.meta()
+	data := make(map[string]interface{}, len(sess.data))
+	for k, v := range sess.data {
+		if k != metaKey {
+			data[k] = v
+		}
+	}
+	for v := n + 1; v <= s.schema; v++ {
+		if fn := s.migrations[v]; fn != nil {
+			data = fn(data)
+		}
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data[metaKey] = meta
+
+	// all values are considered changed (see MergeFn)
+	for _, d := range []map[string]interface{}{sess.data, data} {
+		for k := range d {
+			sess.dirty(k)
+		}
+	}
+
+	meta[metaSchemaKey] = int64(s.schema)
+	sess.data, sess.modified, sess.full = data, true, true
+}
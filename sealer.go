@@ -0,0 +1,15 @@
+package sessionmw
+
+// Sealer is the common interface for encoding and decoding the session cookie
+// value.
+//
+// A *securecookie.SecureCookie satisfies the Sealer interface. Please see the
+// chachasealer package for an XChaCha20-Poly1305 based Sealer.
+type Sealer interface {
+	// Encode encodes value for the cookie with the provided name.
+	Encode(name string, value interface{}) (string, error)
+
+	// Decode decodes the value of the cookie with the provided name into
+	// dst.
+	Decode(name, value string, dst interface{}) error
+}
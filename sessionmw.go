@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/securecookie"
@@ -20,32 +24,162 @@ import (
 // context store constants
 type contextKey int
 
-// the various keys stored in context.Context
-const (
-	sessionContextKey    contextKey = 0
-	sessionIDContextKey  contextKey = 1
-	storeContextKey      contextKey = 2
-	cookieNameContextKey contextKey = 3
-)
+// sessionContextKey is the context key for the *namedSession of the current
+// session, the only value stored in context.Context.
+const sessionContextKey contextKey = 0
 
 const (
 	// DefaultCookieName is the default cookie name.
 	DefaultCookieName = "SESSID"
+
+	// CookiePrefixHost is the __Host- cookie name prefix, requiring the
+	// Secure flag, the / path, and no domain.
+	CookiePrefixHost = "__Host-"
+
+	// CookiePrefixSecure is the __Secure- cookie name prefix, requiring the
+	// Secure flag.
+	CookiePrefixSecure = "__Secure-"
 )
 
+// DefaultDestroyExpires is the default expiration of the cookies expiring the
+// session cookie (see Config.DestroyExpires).
+var DefaultDestroyExpires = time.Unix(1, 0)
+
 // IDFn is the ID generation func type.
 type IDFn func() string
 
 // session is the session storage.
 type session struct {
 	sync.RWMutex
+	id   string
 	data map[string]interface{}
+
+	// s is the manager that loaded the session.
+	s *Manager
+
+	// isNew is set when the session was created for this request.
+	isNew bool
+
+	// cookie is the pending cookie to issue when the response headers are
+	// written.
+	cookie *http.Cookie
+
+	// modified is set when the session data is changed.
+	modified bool
+
+	// changed are the keys set or deleted by the handler.
+	changed map[string]bool
+
+	// version is the version of the session when loaded.
+	version int64
+
+	// full is set when the session must be saved in full, rather than
+	// patched.
+	full bool
+
+	// mismatch is set when the request did not match the session binding.
+	mismatch bool
+
+	// destroyed is set by Destroy.
+	destroyed bool
+
+	// cleared is set by ClearCookie.
+	cleared bool
+
+	// aliased is set when the session was loaded read only with the
+	// previous id of a regenerated session (see Config.RegenerateGrace).
+	aliased bool
+
+	// structs are the session structs retrieved with Struct, by type.
+	structs map[reflect.Type]*sessionStruct
+
+	// cookieless is set when the new session must not be persisted or
+	// issued a cookie (ie, for bots, see Config.BotClassifier).
+	cookieless bool
+
+	// ephemeral is set when the new session must not be persisted or issued
+	// a cookie until the client consents (see Config.Consent).
+	ephemeral bool
+
+	// domain is the cookie domain for the request (see Config.DomainFn).
+	domain string
+
+	// unlock releases the session lock, if held.
+	unlock func()
+
+	// machine serializes Machine transitions of the request's handlers.
+	machine sync.Mutex
+}
+
+// namedSession is the per-request state stored in the context for the
+// session of a named cookie. The session id, store, and cookie name are
+// retrieved through sess, and the sessions of outer session middlewares
+// through parent.
+type namedSession struct {
+	sess    *session
+	auditor *auditor
+	parent  *namedSession
+
+	// managed is set for sessions loaded by a Manager.
+	managed *managed
+}
+
+// withValue adds the named session to the context as the current session.
+func (ns *namedSession) withValue(ctxt context.Context) context.Context {
+	ns.parent, _ = ctxt.Value(sessionContextKey).(*namedSession)
+	return context.WithValue(ctxt, sessionContextKey, ns)
+}
+
+// named returns the named session for the cookie name, or nil.
+func (ns *namedSession) named(cookieName string) *namedSession {
+	for ; ns != nil; ns = ns.parent {
+		if ns.sess.s.name == cookieName {
+			return ns
+		}
+	}
+	return nil
+}
+
+// fromContext returns the current session of the context, panicking when
+// there is none.
+func fromContext(ctxt context.Context) *session {
+	return ctxt.Value(sessionContextKey).(*namedSession).sess
+}
+
+// FromName returns a context for the session of the session middleware using
+// the named cookie, for use when multiple session middlewares (with distinct
+// cookie names) are used for the same request. All session funcs operate on
+// the session of the innermost session middleware, unless passed the context
+// returned by FromName:
+//
+//	sessionmw.Get(sessionmw.FromName(ctxt, "admin"), "key")
+//
+// FromName panics when there is no session for the named cookie.
+func FromName(ctxt context.Context, cookieName string) context.Context {
+	cur, _ := ctxt.Value(sessionContextKey).(*namedSession)
+	ns := cur.named(cookieName)
+	if ns == nil {
+		panic(fmt.Errorf("sessionmw no session for cookie %s", cookieName))
+	}
+	return (&namedSession{sess: ns.sess, auditor: ns.auditor, managed: ns.managed}).withValue(ctxt)
 }
 
 // ID retrieves the id for this session from the context.
 func ID(ctxt context.Context) string {
-	sessID := ctxt.Value(sessionIDContextKey).(string)
-	return sessID
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return sess.id
+}
+
+// IsNew determines if the session in the context was created for this
+// request, because the request did not have a valid session cookie, or the
+// session was not found in the store.
+func IsNew(ctxt context.Context) bool {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+	return sess.isNew
 }
 
 // Set stores a session value into the context.
@@ -53,264 +187,1554 @@ func ID(ctxt context.Context) string {
 // Session values will be saved to the underlying store after Handler has
 // finished.
 func Set(ctxt context.Context, key string, val interface{}) {
-	sess := ctxt.Value(sessionContextKey).(session)
+	sess := fromContext(ctxt)
 	sess.Lock()
-	sess.data[key] = val
+	sess.data[key] = sess.s.normalize(val)
+	sess.persistKey(key)
+	sess.modified = true
+	sess.dirty(key)
 	sess.Unlock()
+
+	audit(ctxt, AuditSet, key)
 }
 
-// Get retrieves a previously stored session value from the context.
+// Get retrieves a previously stored session value from the context, removing
+// values stored with SetOnce.
 func Get(ctxt context.Context, key string) (interface{}, bool) {
-	sess := ctxt.Value(sessionContextKey).(session)
+	sess := fromContext(ctxt)
 	sess.RLock()
 	val, ok := sess.data[key]
+	once := ok && sess.isOnce(key)
+	sess.RUnlock()
+	if once {
+		val, ok = sess.take(ctxt, key)
+	}
+	return sess.s.denormalize(val), ok
+}
+
+// Has determines if a session value is stored for key in the context.
+func Has(ctxt context.Context, key string) bool {
+	if key == metaKey {
+		return false
+	}
+	sess := fromContext(ctxt)
+	sess.RLock()
+	_, ok := sess.data[key]
+	sess.RUnlock()
+	return ok
+}
+
+// Keys retrieves the sorted keys of the stored session values from the
+// context.
+func Keys(ctxt context.Context) []string {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	keys := make([]string, 0, len(sess.data))
+	for k := range sess.data {
+		if k != metaKey {
+			keys = append(keys, k)
+		}
+	}
 	sess.RUnlock()
-	return val, ok
+
+	sort.Strings(keys)
+	return keys
 }
 
 // Delete deletes a stored session value from the context.
 func Delete(ctxt context.Context, key string) {
-	sess := ctxt.Value(sessionContextKey).(session)
+	sess := fromContext(ctxt)
 	sess.Lock()
 	delete(sess.data, key)
+	sess.persistKey(key)
+	sess.modified = true
+	sess.dirty(key)
+	sess.Unlock()
+
+	audit(ctxt, AuditDelete, key)
+}
+
+// Values retrieves a copy of the session values from the context.
+func Values(ctxt context.Context) map[string]interface{} {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	defer sess.RUnlock()
+
+	vals := make(map[string]interface{}, len(sess.data))
+	for k, v := range sess.data {
+		if k != metaKey {
+			vals[k] = sess.s.denormalize(v)
+		}
+	}
+	return vals
+}
+
+// SetAll stores all of vals into the session in the context.
+func SetAll(ctxt context.Context, vals map[string]interface{}) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	keys := make([]string, 0, len(vals))
+	for k, v := range vals {
+		if k == metaKey {
+			continue
+		}
+		sess.data[k] = sess.s.normalize(v)
+		sess.persistKey(k)
+		sess.dirty(k)
+		keys = append(keys, k)
+	}
+	sess.modified = true
 	sess.Unlock()
+
+	for _, k := range keys {
+		audit(ctxt, AuditSet, k)
+	}
+}
+
+// Clear deletes all stored session values from the context.
+func Clear(ctxt context.Context) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	var keys []string
+	for k := range sess.data {
+		if k == metaKey {
+			continue
+		}
+		delete(sess.data, k)
+		sess.persistKey(k)
+		sess.dirty(k)
+		keys = append(keys, k)
+	}
+	sess.modified = true
+	sess.Unlock()
+
+	for _, k := range keys {
+		audit(ctxt, AuditDelete, k)
+	}
 }
 
 // GetStore retrieves the session store from the context.
 func GetStore(ctxt context.Context) Store {
-	st := ctxt.Value(storeContextKey).(Store)
-	return st
+	return fromContext(ctxt).s.st
 }
 
 // CookieName retrieves the cookie name from the context.
 func CookieName(ctxt context.Context) string {
-	return ctxt.Value(cookieNameContextKey).(string)
+	return fromContext(ctxt).s.name
 }
 
-// Destroy destroys a session in the underlying session store.
-//
-// Note that any existing values will continue to remain in the context after
-// destruction. The context should be closed (or destroyed).
+// Destroy destroys a session in the underlying session store, and clears the
+// session values in the context. The session is not saved at the end of the
+// request, and values set after Destroy are discarded. When
+// Config.TombstoneTTL is set, the stored session is replaced with a tombstone
+// rather than erased.
 //
-// If the optional http.ResponseWriter is provided, then an expired cookie will
-// be added to the response headers.
+// An expired cookie will be added to the response headers when they are
+// written, replacing any other session cookie. The optional
+// http.ResponseWriter is retained for compatibility, and is not used.
 func Destroy(ctxt context.Context, res ...http.ResponseWriter) error {
-	sessID := ID(ctxt)
-	st := GetStore(ctxt)
-
-	if len(res) > 0 {
-		http.SetCookie(res[0], &http.Cookie{
-			Name:    CookieName(ctxt),
-			Expires: time.Now(),
-			Value:   "-",
-			MaxAge:  -1,
-		})
+	sess := fromContext(ctxt)
+	sess.Lock()
+	sessID := sess.id
+	user := metadata(sess.data).indexed()
+	sess.destroyed = true
+	sess.cookie = nil
+	sess.data = make(map[string]interface{})
+	sess.structs = nil
+	for k := range sess.changed {
+		delete(sess.changed, k)
+	}
+	sess.Unlock()
+
+	audit(ctxt, AuditDestroy, "")
+
+	if err := sess.s.erase(sessID); err != nil {
+		return err
+	}
+	if user != "" {
+		return sess.s.unindex(user, sessID)
+	}
+	return nil
+}
+
+// Regenerate changes the id of the session, keeping the session values, and
+// erases the session stored under the previous id. A cookie with the new id
+// will be added to the response headers when they are written.
+//
+// When Config.RegenerateGrace is set, the session is instead saved under the
+// new id immediately, and requests with the previous id load the session
+// read only until the grace period ends.
+//
+// The session id should be regenerated whenever the privilege level of the
+// session changes (such as on login), to prevent session fixation. The CSRF
+// token of the session is discarded (see CSRFToken).
+func Regenerate(ctxt context.Context) error {
+	sess := fromContext(ctxt)
+	newID := sess.s.idFn()
+
+	c, err := sess.s.newCookie(newID)
+	if err != nil {
+		return err
+	}
+
+	now := sess.s.now()
+	grace := sess.s.regenerateGrace
+
+	sess.Lock()
+	oldID := sess.id
+	user := metadata(sess.data).indexed()
+	sess.id, sess.modified, sess.version = newID, true, 0
+	sess.issue(c, now)
+	sess.full = true
+	delete(sess.meta(), metaCSRFKey)
+	if grace > 0 {
+		err = sess.s.writeStore(newID, sess.data)
+	}
+	sess.Unlock()
+
+	switch {
+	case err != nil:
+		return err
+	case grace > 0:
+		err = sess.s.writeForward(oldID, newID, grace, true, now)
+	default:
+		err = sess.s.st.Erase(oldID)
+	}
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		if err = sess.s.unindex(user, oldID); err != nil {
+			return err
+		}
+		return sess.s.index(user, newID)
+	}
+	return nil
+}
+
+// Touch extends the lifetime of the session, independent of whether the
+// session was modified. A cookie with a refreshed expiration will be added to
+// the response headers when they are written, and the session will be saved
+// to the store (extending the store's expiration, if any) after Handler has
+// finished.
+func Touch(ctxt context.Context) error {
+	sess := fromContext(ctxt)
+	sess.RLock()
+	sessID := sess.id
+	sess.RUnlock()
+
+	c, err := sess.s.newCookie(sessID)
+	if err != nil {
+		return err
 	}
 
-	return st.Erase(sessID)
+	sess.Lock()
+	if !sess.destroyed {
+		sess.modified = true
+		sess.issue(c, sess.s.now())
+	}
+	sess.Unlock()
+
+	return nil
 }
 
 // Config contains the configuration parameters for the session middleware.
 type Config struct {
-	// Secret is
+	// Secret is the secret used to sign cookies, and BlockSecret is the
+	// secret used to encrypt cookies. Cookies are only signed when
+	// BlockSecret is empty.
 	Secret      []byte
 	BlockSecret []byte
 
+	// Serializer is the securecookie serializer used to encode cookie
+	// values. Defaults to securecookie.GobEncoder. Use
+	// securecookie.JSONEncoder for signed cookies readable by other
+	// services, or JSONSerializer to switch existing deployments to the
+	// cheaper to decode JSON encoding.
+	Serializer securecookie.Serializer
+
+	// MinAge and MaxLength are the securecookie minimum age and maximum
+	// encoded length of cookies. Uses the securecookie defaults when 0.
+	// Session cookies longer than MaxLength (or DefaultMaxCookieLength)
+	// are rejected before being decoded, including with a Sealer.
+	MinAge    int
+	MaxLength int
+
+	// Sealer is the sealer used to encode and decode cookie values. When
+	// provided, Secret, BlockSecret, Serializer, MinAge, and MaxLength are
+	// not used to encode cookies, and the middleware secrets cannot be
+	// changed with Rotate. Defaults to a securecookie created from Secret
+	// and BlockSecret.
+	Sealer Sealer
+
 	// Store is the underlying session store.
 	Store Store
 
+	// KeyBuilder namespaces the store keys of sessions (and of the user
+	// session indexes, see SetUser) by wrapping the Store (see
+	// NamespacedStore). Stores building their own keys (ie, redisstore)
+	// should instead be configured with the KeyBuilder directly.
+	KeyBuilder *KeyBuilder
+
+	// IntegritySecret, when set, encrypts and authenticates the sessions in
+	// the Store (see IntegrityStore). Sessions failing verification are
+	// destroyed when loaded and replaced with a new session.
+	IntegritySecret []byte
+
+	// ErrorHandler handles the requests for which the session could not be
+	// loaded because the store is unavailable (see ErrStoreUnavailable),
+	// could not be locked (see Config.Locking), or the session cookie was
+	// rejected (ErrMalformedCookie, see Config.DecodePolicy). Sessions that
+	// cannot be found or decoded are otherwise replaced with a new session.
+	// Defaults to responding with 400 Bad Request for rejected cookies, and
+	// 503 Service Unavailable otherwise.
+	ErrorHandler func(ctxt context.Context, res http.ResponseWriter, req *http.Request, err error)
+
+	// CreateLimit optionally limits the number of new sessions created per
+	// client.
+	CreateLimit *CreateLimit
+
+	// BotClassifier optionally classifies requests from bots (see IsBot),
+	// which are served without creating a session, so that crawlers do not
+	// fill the store with useless sessions. Requests from bots with an
+	// existing session are not affected.
+	BotClassifier func(*http.Request) bool
+
+	// Consent optionally determines if the client consented to cookies (see
+	// ConsentCookie and ConsentHeader). Until then, requests are served with
+	// ephemeral sessions, held in memory for the request only, that are
+	// neither saved nor issued a cookie (see IsEphemeral and GrantConsent).
+	// Requests with an existing session are not affected.
+	Consent func(*http.Request) bool
+
 	// IDFn is the id generation func.
 	IDFn IDFn
 
-	// Name is the cookie name.
+	// IDValidator validates the session ids decoded from session cookies
+	// before they are looked up in the store, so that arbitrary ids cannot
+	// be used to force store lookups, or to escape the directory of a file
+	// store. Cookies with invalid ids are treated as missing.
+	//
+	// Defaults to checking the length and characters of the ids generated
+	// by the default IDFn, or to ValidID when IDFn is set.
+	IDValidator func(string) bool
+
+	// Name is the cookie name. Cookies with the name set by handlers are
+	// removed from the response, in favor of the session cookie (see
+	// ClearCookie).
 	Name string
 
+	// CookiePrefix is the optional cookie name prefix, either
+	// CookiePrefixHost or CookiePrefixSecure, prepended to the names of the
+	// session and mirror cookies. The prefix forces the Secure flag, and
+	// CookiePrefixHost additionally forces the / path and no domain, as
+	// required by browsers enforcing the prefixes. Cookie names passed to
+	// FromName must include the prefix.
+	CookiePrefix string
+
 	// Path is the cookie path.
 	Path string
 
-	// Domain is the cookie domain.
+	// Domain is the cookie domain. When set, the session is shared with all
+	// subdomains of the domain. The domain is normalized (see
+	// NormalizeDomain).
 	Domain string
 
+	// CookieFn is optionally invoked with the session cookie before it is
+	// written to the response, so that the cookie attributes can vary per
+	// request (ie, Secure behind mixed TLS, or MaxAge for a "keep me signed
+	// in" checkbox). CookieFn is also invoked with the expired cookie
+	// written for destroyed sessions.
+	CookieFn func(*http.Request, *http.Cookie)
+
+	// DomainFn optionally selects the cookie domain per request (ie, for
+	// multi-domain sites, see MatchDomain), overriding Domain. Invalid
+	// domains are treated as empty, issuing host only cookies.
+	DomainFn func(*http.Request) string
+
 	// Expires is the cookie expiration time.
 	Expires time.Time
 
-	// MaxAge is the cookie max age.
+	// MaxAge is the cookie max age, truncated to seconds. MaxAge also limits
+	// the age of the cookies accepted, and is the expiration of the
+	// sessions saved to a TTLStore.
 	MaxAge time.Duration
 
+	// MaxAgeSeconds is the cookie max age in seconds, for use instead of
+	// MaxAge.
+	MaxAgeSeconds int
+
 	// Secure is the cookie secure flag.
 	Secure bool
 
 	// HttpOnly is the cookie http only flag.
 	HttpOnly bool
+
+	// DestroyExpires is the expiration of the cookie expiring the session
+	// cookie (see Destroy and ClearCookie), which is issued with the same
+	// path, domain, and flags as the session cookie, and a negative max age.
+	// Defaults to DefaultDestroyExpires, as some browsers and proxies
+	// mishandle expirations close to the current time.
+	DestroyExpires time.Time
+
+	// SaveUninitialized toggles issuing the cookie and saving new sessions
+	// to the store even when the handler has not modified the session.
+	//
+	// By default, a new session's cookie is only issued (and the session
+	// only saved) once the handler modifies the session, avoiding store
+	// writes for visitors such as crawlers. Note that the cookie is issued
+	// when the response headers are written, so the session must be
+	// modified before then.
+	SaveUninitialized bool
+
+	// AsyncSave toggles saving sessions to the store in the background,
+	// taking the store's latency off the request path. Saves are written in
+	// batches when the store is a BatchStore, and are written synchronously
+	// when more than AsyncQueueSize (defaults to DefaultAsyncQueueSize)
+	// saves are queued. Errors are reported to OnAsyncError.
+	//
+	// AsyncSave cannot be used with BufferResponse, Locking, or Merge. Use
+	// Shutdown to wait for queued saves to be written.
+	AsyncSave      bool
+	AsyncQueueSize int
+	OnAsyncError   func(id string, err error)
+
+	// BufferResponse toggles buffering the handler's response until the
+	// session has been saved, so that a failure saving the session results
+	// in a 500 Internal Server Error instead of a response whose session
+	// changes were lost.
+	BufferResponse bool
+
+	// MirrorKeys are the non-sensitive session keys to mirror into a
+	// separate, signed, JavaScript readable (ie, non-HttpOnly) cookie.
+	//
+	// The mirror cookie is kept in sync with the session values when the
+	// response headers are written, and can be verified using DecodeMirror.
+	MirrorKeys []string
+
+	// MirrorName is the mirror cookie name.
+	MirrorName string
+
+	// MirrorSecret is the key used to sign the mirror cookie. When not
+	// provided, a key is derived from Secret. MirrorSecret should be set
+	// when mirror cookies need to be verified (using DecodeMirror) outside
+	// of this process, so that Secret is never shared.
+	MirrorSecret []byte
+
+	// OnDuplicate is called when the session middleware detects that it has
+	// been applied more than once to the same request (for example, when
+	// used in nested muxes). The duplicate instance passes the request
+	// through to the next handler without loading or saving the session.
+	OnDuplicate func(context.Context, *http.Request)
+
+	// Skip is an optional func determining which requests bypass the session
+	// middleware entirely, without decoding the cookie or accessing the
+	// store. Skipped requests do not have a session in the context, and
+	// handlers serving them must not use the session funcs. See SkipPrefix
+	// and SkipPath.
+	Skip func(*http.Request) bool
+
+	// ReadOnly is an optional func determining which requests only save the
+	// session to the store when the session was modified by the handler.
+	// Use ReadOnlySafe to skip saving unmodified sessions for GET, HEAD, and
+	// OPTIONS requests.
+	//
+	// Note that changes made directly to values retrieved with Get (such as
+	// to a map or a pointer) are not detected as modifications, and that
+	// stores that expire sessions will not have their expiration extended
+	// by read only requests.
+	ReadOnly func(*http.Request) bool
+
+	// Locking toggles locking the session for the duration of each request,
+	// so that concurrent requests for the same session do not overwrite
+	// each other's changes. The Store's locks are used when it is a
+	// LockingStore, otherwise the Store is wrapped with LocalLocking.
+	//
+	// When the lock cannot be acquired within LockTimeout (defaults to
+	// DefaultLockTimeout), the request fails with a 503 Service Unavailable.
+	//
+	// Locking is required by Machine transitions.
+	Locking     bool
+	LockTimeout time.Duration
+
+	// Merge toggles optimistic concurrency, detecting when the session was
+	// saved by a concurrent request since it was loaded, and merging the
+	// session values with MergeFn (see MergeLastWriteWins and MergeKeys).
+	// The Store's versioned writes are used when it is a VersionedStore,
+	// otherwise the Store is wrapped with LocalVersioning.
+	Merge MergeFn
+
+	// BindIP and BindUserAgent toggle binding sessions to the IP address
+	// and User-Agent of the request that created the session. Requests
+	// that do not match are passed to OnBindMismatch.
+	BindIP        bool
+	BindUserAgent bool
+
+	// OnBindMismatch is called with the request and metadata of a session
+	// that the request did not match, and returns whether the session should
+	// be retained (see BindMismatch), allowing for custom handling such as
+	// logging or step-up authentication. When nil, or when false is
+	// returned, the session is destroyed and replaced with a new session.
+	OnBindMismatch func(*http.Request, Metadata) bool
+
+	// RemoteIPFn is the func retrieving the IP address of a request.
+	// Defaults to RemoteIP. Use ProxyIP when behind a reverse proxy.
+	RemoteIPFn func(*http.Request) string
+
+	// MaxUserSessions is the maximum number of sessions a user may have
+	// (see SetUser), with LimitPolicy determining how the limit is enforced.
+	// Unlimited when 0.
+	MaxUserSessions int
+	LimitPolicy     LimitPolicy
+
+	// DecodeCacheSize is the maximum number of decoded cookie values to
+	// cache. Caching skips the securecookie verification and decryption for
+	// repeated requests from the same client. Disabled when 0.
+	DecodeCacheSize int
+
+	// DecodeCacheTTL is the time decoded cookie values are cached for.
+	DecodeCacheTTL time.Duration
+
+	// MaxLifetime is the maximum lifetime of a session, regardless of cookie
+	// or store expiration. Sessions created longer than MaxLifetime ago are
+	// destroyed when loaded and replaced with a new session. Disabled when 0.
+	MaxLifetime time.Duration
+
+	// OnExpire is called with the id of a session that was destroyed at load
+	// because it exceeded MaxLifetime.
+	OnExpire func(ctxt context.Context, id string)
+
+	// RotateIDEvery is the interval at which session ids are transparently
+	// rotated, keeping the session values, limiting the time a stolen
+	// session cookie can be used. Disabled when 0.
+	RotateIDEvery time.Duration
+
+	// RotateIDGrace is the time the previous session id remains valid after
+	// being rotated, so that parallel requests sent with the previous id
+	// load the session with the new id. Defaults to DefaultRotateIDGrace.
+	RotateIDGrace time.Duration
+
+	// RegenerateGrace is the time the previous session id remains valid
+	// after Regenerate, so that parallel requests sent with the previous id
+	// load the session with the new id. Such requests are read only: the
+	// session is neither saved nor issued a cookie with the new id. Disabled
+	// when 0, erasing the session stored under the previous id.
+	RegenerateGrace time.Duration
+
+	// TombstoneTTL is the time a tombstone replaces a destroyed session in
+	// the store (see Destroy), so that instances holding a cached or tiered
+	// copy of the session see it as revoked rather than missing, and do not
+	// recreate it. Requests with the id of a revoked session are issued a
+	// new session with a new id. Disabled when 0, erasing destroyed
+	// sessions. Stores that are not a TTLStore retain tombstones until they
+	// are otherwise expired.
+	TombstoneTTL time.Duration
+
+	// Watermarks toggles checking the revocation watermarks stored with
+	// Manager.RevokeAll and Manager.RevokeUser when sessions are loaded, at
+	// the cost of one additional store read per request (two for sessions
+	// bound to a user). Watermarks are stored under reserved keys, without
+	// expiry when the store is a TTLStore; other stores must retain them for
+	// at least the session lifetime.
+	Watermarks bool
+
+	// OnTamper is called with the id of a session that was destroyed at load
+	// because it failed integrity verification (see IntegritySecret), ie, for
+	// logging or alerting.
+	OnTamper func(ctxt context.Context, id string)
+
+	// Migrations are the migrations of the session values, keyed by the
+	// schema version they migrate to. The schema version of new sessions is
+	// the highest version in Migrations, and loaded sessions with a lower
+	// schema version (or without one, ie, version 0) are migrated by running
+	// the migrations for each following version in order, and then saved.
+	//
+	// Migrations are passed and return the session values, without the
+	// session metadata.
+	Migrations map[int]func(map[string]interface{}) map[string]interface{}
+
+	// Audit is the optional sink recording every Set, Delete, and Destroy.
+	Audit AuditSink
+
+	// RequestIDFn is the func retrieving the request id recorded in audit
+	// events. Defaults to the value of the DefaultRequestIDHeader header.
+	RequestIDFn func(context.Context, *http.Request) string
+
+	// OnSuspiciousCookie is optionally called with the requests with a
+	// session cookie that could not be decoded (ie, forged, corrupted, or
+	// expired), and the decoding error, for logging. Such requests are then
+	// handled according to DecodePolicy.
+	OnSuspiciousCookie func(*http.Request, error)
+
+	// DecodePolicy is the policy for requests with a session cookie that
+	// could not be decoded. Defaults to DecodeRotate.
+	DecodePolicy DecodePolicy
+
+	// NormalizeValues toggles normalizing session values when stored, such
+	// that values are retrieved with the same type regardless of the store
+	// and codec: integers are retrieved as int64, floats as float64, and
+	// values of registered types (see RegisterValue), including time.Time
+	// and []string, as their type.
+	NormalizeValues bool
+
+	// Clock is the time source for session timestamps and expiration.
+	// Defaults to SystemClock.
+	Clock Clock
+
+	// OAuthTTL is the lifetime of the pending OAuth logins started with
+	// BeginOAuth. Defaults to DefaultOAuthTTL.
+	OAuthTTL time.Duration
+
+	// RedactKeys are the patterns of the session keys whose values are
+	// redacted when session data is rendered (see Redact, Redacted, and
+	// AdminHandler). Defaults to DefaultRedactKeys. Use an empty, non-nil
+	// slice to disable redaction.
+	RedactKeys []string
 }
 
-// Handler provides the goji.Handler for the session middleware.
-func (c Config) Handler(h goji.Handler) goji.Handler {
-	if len(c.Secret) < 1 {
-		panic(errors.New("sessionmw config Secret cannot be empty"))
+// Validate validates the configuration.
+func (c Config) Validate() error {
+	if len(c.Secret) < 1 && c.Sealer == nil {
+		return errors.New("sessionmw config Secret cannot be empty")
 	}
 
-	if len(c.BlockSecret) < 1 {
-		panic(errors.New("sessionmw config BlockSecret cannot be empty"))
+	if len(c.Secret) < 1 && len(c.MirrorKeys) > 0 && len(c.MirrorSecret) < 1 {
+		return errors.New("sessionmw config MirrorSecret must be provided when Secret is empty")
+	}
+
+	switch len(c.BlockSecret) {
+	case 0, 16, 24, 32:
+	default:
+		return errors.New("sessionmw config BlockSecret must be 16, 24, or 32 bytes")
 	}
 
 	if c.Store == nil {
-		panic(errors.New("sessionmw config Store was not provided"))
+		return errors.New("sessionmw config Store was not provided")
 	}
 
-	// create securecookie
-	sc := securecookie.New(c.Secret, c.BlockSecret)
-	sc.MaxAge(int(c.MaxAge))
+	if c.MaxAge < 0 || c.MaxAgeSeconds < 0 {
+		return errors.New("sessionmw config MaxAge cannot be negative")
+	}
+
+	if c.MaxAge != 0 && c.MaxAgeSeconds != 0 {
+		return errors.New("sessionmw config MaxAge and MaxAgeSeconds cannot both be set")
+	}
+
+	if c.LockTimeout < 0 {
+		return errors.New("sessionmw config LockTimeout cannot be negative")
+	}
+
+	if c.AsyncSave && (c.BufferResponse || c.Locking || c.Merge != nil) {
+		return errors.New("sessionmw config AsyncSave cannot be used with BufferResponse, Locking, or Merge")
+	}
+
+	if c.AsyncQueueSize < 0 {
+		return errors.New("sessionmw config AsyncQueueSize cannot be negative")
+	}
+
+	if c.MaxUserSessions < 0 {
+		return errors.New("sessionmw config MaxUserSessions cannot be negative")
+	}
+
+	if _, ok := NormalizeDomain(c.Domain); !ok {
+		return errors.New("sessionmw config Domain is not a valid cookie domain")
+	}
+
+	switch c.CookiePrefix {
+	case "", CookiePrefixSecure:
+	case CookiePrefixHost:
+		if c.Domain != "" || c.DomainFn != nil || (c.Path != "" && c.Path != "/") {
+			return errors.New("sessionmw config CookiePrefix __Host- cannot be used with a Domain, DomainFn, or a Path other than /")
+		}
+	default:
+		return errors.New("sessionmw config CookiePrefix must be __Host- or __Secure-")
+	}
+
+	if c.CreateLimit != nil && (c.CreateLimit.Counter == nil || c.CreateLimit.Max <= 0) {
+		return errors.New("sessionmw config CreateLimit requires a Counter and a positive Max")
+	}
 
-	idFn := c.IDFn
+	return nil
+}
+
+// NewMiddleware validates the configuration, returning the session
+// middleware.
+func NewMiddleware(c Config) (func(goji.Handler) goji.Handler, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c.Handler, nil
+}
+
+// Handler provides the goji.Handler for the session middleware.
+//
+// Handler panics when the configuration is not valid. Use NewMiddleware to
+// instead have configuration errors returned.
+func (c Config) Handler(h goji.Handler) goji.Handler {
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+
+	return c.manager().Handler(h)
+}
+
+// NewManager validates the configuration, returning a session Manager.
+func NewManager(c Config) (*Manager, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c.manager(), nil
+}
+
+// manager creates the session Manager for the configuration.
+func (c Config) manager() *Manager {
+	idFn, idValidator := c.IDFn, c.IDValidator
 	if idFn == nil {
 		idFn = defaultIDGen
 	}
+	if idValidator == nil {
+		idValidator = ValidID
+		if c.IDFn == nil {
+			idValidator = validDefaultID
+		}
+	}
 
 	name := c.Name
 	if name == "" {
 		name = DefaultCookieName
 	}
 
-	// load or create session
-	return &sessMiddleware{
-		h:  h,
-		sc: sc,
+	maxAge := c.MaxAge
+	if c.MaxAgeSeconds != 0 {
+		maxAge = time.Duration(c.MaxAgeSeconds) * time.Second
+	}
 
-		st:   c.Store,
-		idFn: idFn,
+	destroyExpires := c.DestroyExpires
+	if destroyExpires.IsZero() {
+		destroyExpires = DefaultDestroyExpires
+	}
+
+	domain, _ := NormalizeDomain(c.Domain)
+	path, secure := c.Path, c.Secure
+	if c.CookiePrefix != "" {
+		name, secure = c.CookiePrefix+name, true
+	}
+	if c.CookiePrefix == CookiePrefixHost {
+		path, domain = "/", ""
+	}
+
+	st := c.Store
+	if c.IntegritySecret != nil {
+		st = IntegrityStore(st, c.IntegritySecret)
+	}
+	if c.KeyBuilder != nil {
+		st = NamespacedStore(st, *c.KeyBuilder)
+	}
+	if c.Locking {
+		if _, ok := st.(LockingStore); !ok {
+			st = LocalLocking(st)
+		}
+	}
+
+	if c.Merge != nil {
+		if _, ok := st.(VersionedStore); !ok {
+			st = LocalVersioning(st)
+		}
+	}
+
+	clock := c.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	if c.CreateLimit != nil {
+		if mc, ok := c.CreateLimit.Counter.(*memCounter); ok {
+			mc.setClock(clock)
+		}
+	}
+
+	redactKeys := c.RedactKeys
+	if redactKeys == nil {
+		redactKeys = DefaultRedactKeys
+	}
+
+	errorHandler := c.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = defaultErrorHandler
+	}
+
+	remoteIPFn := c.RemoteIPFn
+	if remoteIPFn == nil {
+		remoteIPFn = RemoteIP
+	}
+
+	lockTimeout := c.LockTimeout
+	if lockTimeout == 0 {
+		lockTimeout = DefaultLockTimeout
+	}
+
+	oauthTTL := c.OAuthTTL
+	if oauthTTL == 0 {
+		oauthTTL = DefaultOAuthTTL
+	}
+
+	rotateGrace := c.RotateIDGrace
+	if rotateGrace == 0 {
+		rotateGrace = DefaultRotateIDGrace
+	}
+
+	var cache *decodeCache
+	if c.DecodeCacheSize > 0 {
+		cache = newDecodeCache(c.DecodeCacheSize, c.DecodeCacheTTL, clock)
+	}
+
+	var m *mirror
+	if len(c.MirrorKeys) > 0 {
+		m = &mirror{
+			secret: c.MirrorSecret,
+			name:   c.MirrorName,
+			keys:   c.MirrorKeys,
+		}
+		if m.name == "" {
+			m.name = DefaultMirrorCookieName
+		}
+		m.name = c.CookiePrefix + m.name
+		if len(m.secret) == 0 {
+			m.secret = deriveKey(c.Secret, "mirror")
+		}
+	}
+
+	s := &Manager{
+		scMaxAge:    int(maxAge / time.Second),
+		scMinAge:    c.MinAge,
+		scMaxLength: c.MaxLength,
+		serializer:  c.Serializer,
+		cache:       cache,
+
+		st:          st,
+		idFn:        idFn,
+		idValidator: idValidator,
+
+		locking:     c.Locking,
+		lockTimeout: lockTimeout,
+		merge:       c.Merge,
+
+		bindIP:         c.BindIP,
+		bindUserAgent:  c.BindUserAgent,
+		onBindMismatch: c.OnBindMismatch,
+		remoteIPFn:     remoteIPFn,
+
+		maxUserSessions: c.MaxUserSessions,
+		limitPolicy:     c.LimitPolicy,
 
 		name:     name,
-		path:     c.Path,
-		domain:   c.Domain,
+		path:     path,
+		domain:   domain,
+		domainFn: c.DomainFn,
+		cookieFn: c.CookieFn,
 		expires:  c.Expires,
-		maxAge:   c.MaxAge,
-		secure:   c.Secure,
+		maxAge:   maxAge,
+		secure:   secure,
 		httpOnly: c.HttpOnly,
+
+		destroyExpires: destroyExpires,
+
+		saveUninitialized: c.SaveUninitialized,
+		bufferResponse:    c.BufferResponse,
+
+		mirror: m,
+
+		onDuplicate: c.OnDuplicate,
+		skip:        c.Skip,
+		readOnly:    c.ReadOnly,
+
+		maxLifetime: c.MaxLifetime,
+		onExpire:    c.OnExpire,
+		onTamper:    c.OnTamper,
+
+		rotateEvery:     c.RotateIDEvery,
+		rotateGrace:     rotateGrace,
+		regenerateGrace: c.RegenerateGrace,
+		tombstoneTTL:    c.TombstoneTTL,
+		watermarks:      c.Watermarks,
+
+		errorHandler: errorHandler,
+		createLimit:  c.CreateLimit,
+
+		botClassifier: c.BotClassifier,
+		consent:       c.Consent,
+
+		schema:     schemaVersion(c.Migrations),
+		migrations: c.Migrations,
+
+		audit:       c.Audit,
+		requestIDFn: c.RequestIDFn,
+
+		redactKeys: redactKeys,
+		clock:      clock,
+		oauthTTL:   oauthTTL,
+
+		onSuspiciousCookie: c.OnSuspiciousCookie,
+		decodePolicy:       c.DecodePolicy,
+
+		normalizeValues: c.NormalizeValues,
 	}
+
+	// create securecookie
+	s.sc = c.Sealer
+	if s.sc == nil {
+		s.sc = s.newSecureCookie(c.Secret, c.BlockSecret)
+	}
+	s.customSealer = c.Sealer != nil
+
+	if c.AsyncSave {
+		size := c.AsyncQueueSize
+		if size == 0 {
+			size = DefaultAsyncQueueSize
+		}
+		s.async = newAsyncSaver(s, size, c.OnAsyncError)
+	}
+
+	return s
 }
 
-// sessMiddleware provides the actual session middleware.
-type sessMiddleware struct {
-	h  goji.Handler
-	sc *securecookie.SecureCookie
+// Rotate replaces the secrets used by the session middleware h, as previously
+// returned by Config.Handler, and purges any cached decoded cookies. Cookies
+// issued with the previous secrets will no longer be accepted.
+//
+// Cookies are only signed when blockSecret is empty.
+func Rotate(h goji.Handler, secret, blockSecret []byte) error {
+	s, ok := h.(*sessMiddleware)
+	if !ok {
+		return errors.New("sessionmw Rotate requires a session middleware handler")
+	}
+	if s.customSealer {
+		return errors.New("sessionmw Rotate cannot be used with a Config.Sealer")
+	}
+	if len(secret) < 1 {
+		return errors.New("sessionmw Rotate secret cannot be empty")
+	}
+
+	s.rotate(secret, blockSecret)
+	return nil
+}
+
+// Manager manages sessions, providing the session handling used by the session
+// middleware (see Manager.Handler), for use outside of the middleware (ie, in
+// CLIs, tests, workers, WebSocket connections, or custom transports).
+//
+// Sessions are loaded or created by a Manager as a context, for use with the
+// session funcs (Get, Set, etc), and must be released with Save, Release, or
+// Destroy. When locking (see Config.Locking), the session remains locked until
+// released.
+type Manager struct {
+	scMu        sync.RWMutex
+	sc          Sealer
+	scMaxAge    int
+	scMinAge    int
+	scMaxLength int
+	serializer  securecookie.Serializer
+	cache       *decodeCache
+
+	// customSealer indicates sc was provided with Config.Sealer.
+	customSealer bool
+
+	st          Store
+	idFn        IDFn
+	idValidator func(string) bool
 
-	st   Store
-	idFn IDFn
+	locking     bool
+	lockTimeout time.Duration
+	merge       MergeFn
+
+	bindIP         bool
+	bindUserAgent  bool
+	onBindMismatch func(*http.Request, Metadata) bool
+	remoteIPFn     func(*http.Request) string
+
+	maxUserSessions int
+	limitPolicy     LimitPolicy
+
+	// pending tracks the pending session saves.
+	pending pending
+
+	async *asyncSaver
+
+	// indexMu serializes updates to the per user session indexes, when the
+	// store is not a LockingStore.
+	indexMu sync.Mutex
 
 	name     string
 	path     string
 	domain   string
+	domainFn func(*http.Request) string
+	cookieFn func(*http.Request, *http.Cookie)
 	expires  time.Time
 	maxAge   time.Duration
 	secure   bool
 	httpOnly bool
+
+	destroyExpires time.Time
+
+	saveUninitialized bool
+	bufferResponse    bool
+
+	mirror *mirror
+
+	onDuplicate func(context.Context, *http.Request)
+	skip        func(*http.Request) bool
+	readOnly    func(*http.Request) bool
+
+	maxLifetime time.Duration
+	onExpire    func(context.Context, string)
+	onTamper    func(context.Context, string)
+
+	rotateEvery     time.Duration
+	rotateGrace     time.Duration
+	regenerateGrace time.Duration
+	tombstoneTTL    time.Duration
+	watermarks      bool
+
+	errorHandler func(context.Context, http.ResponseWriter, *http.Request, error)
+	createLimit  *CreateLimit
+
+	botClassifier func(*http.Request) bool
+	consent       func(*http.Request) bool
+
+	schema     int
+	migrations map[int]func(map[string]interface{}) map[string]interface{}
+
+	audit       AuditSink
+	requestIDFn func(context.Context, *http.Request) string
+
+	redactKeys []string
+	clock      Clock
+	oauthTTL   time.Duration
+
+	// decodeFailures is the number of decoding failures (accessed
+	// atomically, see DecodeFailures).
+	decodeFailures     int64
+	onSuspiciousCookie func(*http.Request, error)
+	decodePolicy       DecodePolicy
+
+	normalizeValues bool
+}
+
+// now returns the current time of the clock, or the system time for sessions
+// without a Manager.
+func (s *Manager) now() time.Time {
+	if s == nil || s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
 }
 
-// sessionID returns the session id from the http.Request if present.
-func (s *sessMiddleware) sessionID(req *http.Request) (string, bool) {
+// sessionID returns the session id from the http.Request if present, or
+// ErrMalformedCookie when the request must be rejected (see DecodeReject).
+func (s *Manager) sessionID(req *http.Request) (string, bool, error) {
 	// grab cookie from request
 	c, err := req.Cookie(s.name)
 	if err != nil {
-		return s.idFn(), false
+		return s.idFn(), false, nil
+	}
+
+	// check cache
+	if s.cache != nil {
+		if sessID, ok := s.cache.get(c.Value); ok {
+			return sessID, true, nil
+		}
 	}
 
 	// decode value
-	v := make(map[string]string)
-	err = s.sc.Decode(s.name, c.Value, &v)
+	v, err := s.decodeCookie(c.Value)
 	if err != nil {
-		return s.idFn(), false
+		return s.idFn(), false, s.suspicious(req, err)
 	}
 
-	// retrieve id
+	// retrieve and validate id
 	sessID, ok := v["id"]
-	if !ok {
-		return s.idFn(), false
+	if !ok || !s.idValidator(sessID) {
+		return s.idFn(), false, s.suspicious(req, ErrMalformedCookie)
+	}
+
+	// cache, but never past the cookie's expiration
+	if s.cache != nil {
+		if ts, err := strconv.ParseInt(v["ts"], 10, 64); err == nil {
+			var expires time.Time
+			if s.scMaxAge > 0 {
+				expires = time.Unix(ts+int64(s.scMaxAge), 0)
+			}
+			s.cache.add(c.Value, sessID, expires)
+		}
 	}
 
-	return sessID, true
+	return sessID, true, nil
 }
 
-func (s *sessMiddleware) encodeCookie(id string) (string, error) {
+// codec returns the sealer used to encode and decode cookies.
+func (s *Manager) codec() Sealer {
+	s.scMu.RLock()
+	defer s.scMu.RUnlock()
+	return s.sc
+}
+
+// newSecureCookie creates the securecookie for the secrets.
+func (s *Manager) newSecureCookie(secret, blockSecret []byte) *securecookie.SecureCookie {
+	if len(blockSecret) == 0 {
+		blockSecret = nil
+	}
+
+	sc := securecookie.New(secret, blockSecret)
+	sc.MaxAge(s.scMaxAge)
+	if s.scMinAge != 0 {
+		sc.MinAge(s.scMinAge)
+	}
+	if s.scMaxLength != 0 {
+		sc.MaxLength(s.scMaxLength)
+	}
+	if s.serializer != nil {
+		sc.SetSerializer(s.serializer)
+	}
+	return sc
+}
+
+// rotate replaces the securecookie, purging the decode cache.
+func (s *Manager) rotate(secret, blockSecret []byte) {
+	sc := s.newSecureCookie(secret, blockSecret)
+
+	s.scMu.Lock()
+	s.sc = sc
+	s.scMu.Unlock()
+
+	if s.cache != nil {
+		s.cache.purge()
+	}
+}
+
+func (s *Manager) encodeCookie(id string) (string, error) {
 	v := map[string]string{
 		"id": id,
+		"ts": strconv.FormatInt(s.now().Unix(), 10),
 	}
-	return s.sc.Encode(s.name, v)
+	return s.codec().Encode(s.name, v)
 }
 
-// getSession retrieves the session from the http request, returning the
-// session id and the session storage.
-func (s *sessMiddleware) getSession(ctxt context.Context, res http.ResponseWriter, req *http.Request) (string, session, bool) {
+// getSession retrieves the session from the http request into sess, returning
+// the session id.
+func (s *Manager) getSession(ctxt context.Context, res http.ResponseWriter, req *http.Request, sess *session) (string, bool, error) {
 	// grab id
-	sessID, ok := s.sessionID(req)
+	sessID, ok, err := s.sessionID(req)
+	if err != nil {
+		return "", false, err
+	}
 
 	// if there was a problem retrieving the session id
 	if !ok {
-		return sessID, session{
-			data: make(map[string]interface{}),
-		}, true
+		s.initSession(sess)
+		return sessID, true, nil
+	}
+
+	// lock before reading from storage
+	var unlock func()
+	if s.locking {
+		var err error
+		if unlock, err = s.st.(LockingStore).Lock(sessID, s.lockTimeout); err != nil {
+			return "", false, err
+		}
 	}
 
 	// retrieve session from storage
-	d, err := s.st.Read(sessID)
-	if err != nil {
-		return sessID, session{
-			data: make(map[string]interface{}),
-		}, true
+	d, err := s.read(sessID)
+
+	// load the session the id was rotated to or regenerated as (see
+	// Config.RotateIDEvery and Config.RegenerateGrace)
+	var rotated bool
+	if next, ok, readOnly := forward(d, s.now()); err == nil && next != "" {
+		if unlock != nil {
+			unlock()
+			unlock = nil
+		}
+		if !ok {
+			s.initSession(sess)
+			return s.idFn(), true, nil
+		}
+		if s.locking {
+			if unlock, err = s.st.(LockingStore).Lock(next, s.lockTimeout); err != nil {
+				return "", false, err
+			}
+		}
+		sessID, rotated, sess.aliased = next, !readOnly, readOnly
+		d, err = s.read(sessID)
+	}
+	if err == nil && revoked(d) {
+		if unlock != nil {
+			unlock()
+		}
+		s.initSession(sess)
+		return s.idFn(), true, nil
+	}
+	if err == ErrTampered {
+		s.tampered(ctxt, sessID)
+		if unlock != nil {
+			unlock()
+		}
+		s.initSession(sess)
+		return s.idFn(), true, nil
+	} else if isError(err, ErrStoreUnavailable) {
+		if unlock != nil {
+			unlock()
+		}
+		return "", false, err
+	} else if err != nil {
+		if isError(err, ErrDecodeFailed) {
+			atomic.AddInt64(&s.decodeFailures, 1)
+		}
+		s.initSession(sess)
+		sess.unlock = unlock
+		return sessID, true, nil
 	}
 
 	// cast to correct value
 	sessData, ok := d.(map[string]interface{})
 	if !ok {
-		return sessID, session{
-			data: make(map[string]interface{}),
-		}, true
+		s.initSession(sess)
+		sess.unlock = unlock
+		return sessID, true, nil
+	}
+
+	sess.data, sess.unlock, sess.version = copyData(sessData).(map[string]interface{}), unlock, Version(sessData)
+
+	// enforce revocation watermarks
+	if s.belowWatermark(sessData) {
+		s.st.Erase(sessID)
+		if unlock != nil {
+			unlock()
+		}
+		s.initSession(sess)
+		return s.idFn(), true, nil
 	}
 
+	// enforce maximum lifetime
+	now := s.now()
+	if created := sess.created(now); s.maxLifetime > 0 && now.Sub(created) > s.maxLifetime {
+		s.st.Erase(sessID)
+		if s.onExpire != nil {
+			s.onExpire(ctxt, sessID)
+		}
+		if unlock != nil {
+			unlock()
+		}
+		s.initSession(sess)
+		return s.idFn(), true, nil
+	}
+
+	// enforce binding
+	if (s.bindIP || s.bindUserAgent) && !s.bound(req, sessData) {
+		if s.onBindMismatch == nil || !s.onBindMismatch(req, metadata(sessData)) {
+			s.st.Erase(sessID)
+			if unlock != nil {
+				unlock()
+			}
+			s.initSession(sess)
+			return s.idFn(), true, nil
+		}
+		sess.mismatch = true
+	}
+
+	s.migrate(sess)
+	sess.expireKeys(now)
+
 	// FIXME: do logic here for determining when to refresh
-	var refresh = false
-	return sessID, session{data: sessData}, refresh
+	// (requests with a rotated id are issued the cookie for the new id)
+	var refresh = rotated
+	return sessID, refresh, nil
+}
+
+// read reads the session from the store, extending its expiration when the
+// store is a RefreshStore.
+func (s *Manager) read(id string) (interface{}, error) {
+	if rs, ok := s.st.(RefreshStore); ok {
+		return rs.ReadRefresh(id)
+	}
+	return s.st.Read(id)
+}
+
+// tampered destroys the session that failed integrity verification.
+func (s *Manager) tampered(ctxt context.Context, id string) {
+	s.st.Erase(id)
+	if s.onTamper != nil {
+		s.onTamper(ctxt, id)
+	}
+}
+
+// newSession creates a new, empty session.
+func (s *Manager) newSession() *session {
+	sess := new(session)
+	s.initSession(sess)
+	return sess
+}
+
+// initSession initializes sess as a new session.
+func (s *Manager) initSession(sess *session) {
+	sess.data, sess.isNew = make(map[string]interface{}), true
+	sess.created(s.now())
+	if s.schema > 0 {
+		sess.meta()[metaSchemaKey] = int64(s.schema)
+	}
+}
+
+// sessMiddleware provides the actual session middleware.
+type sessMiddleware struct {
+	h goji.Handler
+	*Manager
+}
+
+// Handler provides the goji.Handler for the session middleware using the
+// Manager. Sessions are shared by all middleware handlers of the Manager, and
+// the sessions it loads outside of the middleware.
+func (s *Manager) Handler(h goji.Handler) goji.Handler {
+	return &sessMiddleware{h: h, Manager: s}
 }
 
 // ServeHTTPC handles the actual session middleware logic.
 func (s *sessMiddleware) ServeHTTPC(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+	// pass through when an outer instance already provides the session
+	if cur, _ := ctxt.Value(sessionContextKey).(*namedSession); cur.named(s.name) != nil {
+		if s.onDuplicate != nil {
+			s.onDuplicate(ctxt, req)
+		}
+		s.h.ServeHTTPC(ctxt, res, req)
+		return
+	}
+
+	// pass through skipped requests
+	if s.skip != nil && s.skip(req) {
+		s.h.ServeHTTPC(ctxt, res, req)
+		return
+	}
+
+	s.pending.add()
+	defer s.pending.done()
+
+	r := s.acquire(res, req)
+	defer r.release()
+
 	// retrieve session
-	sessID, sess, refresh := s.getSession(ctxt, res, req)
-	//log.Printf(">> session id: %s, refresh: %t", sessID, refresh)
+	sess := &r.sess
+	sessID, refresh, err := s.getSession(ctxt, res, req, sess)
+	if err != nil {
+		s.errorHandler(ctxt, res, req, err)
+		return
+	}
+	if sess.unlock != nil {
+		defer sess.unlock()
+	}
+	sess.id, sess.s, sess.domain = sessID, s.Manager, s.cookieDomain(req)
+	if sess.isNew && s.botClassifier != nil && s.botClassifier(req) {
+		sess.cookieless = true
+	}
+	if sess.isNew && s.consent != nil && !s.consent(req) {
+		sess.ephemeral = true
+	}
+	if !s.limit(res, req, sess) {
+		return
+	}
+	sess.touch(req, s.now())
+
+	// rotate the session id, retrying on the next request on failure
+	if s.rotateEvery > 0 && !sess.isNew && !refresh && !sess.aliased {
+		now := s.now()
+		sess.Lock()
+		due := s.rotateIDDue(sess, now)
+		sess.Unlock()
+		if due {
+			s.rotateID(sess, now)
+		}
+	}
 
-	// refresh
+	// encode the cookie for new or refreshed sessions
 	if refresh {
-		// encode the cookie
-		v, err := s.encodeCookie(sessID)
+		c, err := s.newCookie(sessID)
 		if err != nil {
 			http.Error(res, "internal server error", http.StatusInternalServerError)
 			return
 		}
+		sess.issue(c, s.now())
+	}
+
+	// add context value
+	if s.audit != nil {
+		r.ns.auditor = s.newAuditor(ctxt, req)
+	}
+	ctxt = r.ns.withValue(ctxt)
+
+	// set cookies before the headers are written
+	w := &r.w
+	defer w.before()
+
+	// serve
+	if !s.bufferResponse {
+		s.h.ServeHTTPC(ctxt, w, req)
+		s.save(ctxt, req, sess)
+		return
+	}
+
+	// serve buffered, only writing the response once saved
+	bw := newBufferWriter()
+	s.h.ServeHTTPC(ctxt, bw, req)
+	if err := s.save(ctxt, req, sess); err != nil {
+		w.done = true
+		http.Error(res, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	bw.writeTo(w)
+}
+
+// save saves the session to the store, unless the session was destroyed or
+// loaded read only with a regenerated id, is new and should not be
+// persisted, or is an unmodified existing session and req is read only,
+// auditing the save. The req is nil for sessions loaded by a Manager.
+func (s *Manager) save(ctxt context.Context, req *http.Request, sess *session) error {
+	sess.RLock()
+	sessID, modified, destroyed, aliased := sess.id, sess.modified, sess.destroyed, sess.aliased
+	sess.RUnlock()
+
+	if destroyed || aliased {
+		return nil
+	}
+	if err := sess.flushStructs(); err != nil {
+		return err
+	}
+
+	if !sess.isNew && !modified && req != nil && s.readOnly != nil && s.readOnly(req) {
+		return nil
+	}
+
+	if !sess.isNew || s.persist(sess) {
+		if err := s.write(sessID, sess); err != nil {
+			return err
+		}
+		if sess.isNew {
+			audit(ctxt, AuditCreate, "")
+		} else {
+			audit(ctxt, AuditSave, "")
+		}
+	}
+	return nil
+}
+
+// write writes the session to the store.
+func (s *Manager) write(id string, sess *session) error {
+	if s.merge != nil {
+		return s.writeVersion(id, sess)
+	}
+	if ps, ok := s.st.(PatchStore); ok && !sess.isNew && !sess.full {
+		return s.patch(ps, id, sess)
+	}
+	if s.async != nil {
+		return s.async.write(id, sess.data)
+	}
+	return s.writeStore(id, sess.data)
+}
+
+// writeStore saves obj to the store, expiring it after the max age when the
+// store is a TTLStore.
+func (s *Manager) writeStore(id string, obj interface{}) error {
+	if ts, ok := s.st.(TTLStore); ok && s.maxAge > 0 {
+		return ts.WriteTTL(id, obj, s.maxAge)
+	}
+	return s.st.Write(id, obj)
+}
+
+// newCookie creates the session cookie for id.
+func (s *Manager) newCookie(id string) (*http.Cookie, error) {
+	v, err := s.encodeCookie(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Cookie{
+		Name:     s.name,
+		Path:     s.path,
+		Domain:   s.domain,
+		Expires:  s.expires,
+		MaxAge:   s.scMaxAge,
+		Secure:   s.secure,
+		HttpOnly: s.httpOnly,
+		Value:    v,
+	}, nil
+}
+
+// setCookie writes the pending session cookie to res, or an expired cookie
+// if the session was destroyed or its cookie cleared, replacing any session
+// cookie set by the handler.
+func (s *Manager) setCookie(res http.ResponseWriter, req *http.Request, sess *session) {
+	// changed session structs mark new sessions to be persisted (errors are
+	// returned when saving)
+	sess.flushStructs()
+
+	// the middleware's cookie is the only session cookie written
+	removeSetCookie(res.Header(), s.name)
+
+	sess.RLock()
+	destroyed, cleared, c, isNew := sess.destroyed, sess.cleared, sess.cookie, sess.isNew
+	sess.RUnlock()
 
-		// set the cookie
-		http.SetCookie(res, &http.Cookie{
+	if destroyed || cleared {
+		s.writeCookie(res, req, &http.Cookie{
 			Name:     s.name,
 			Path:     s.path,
-			Domain:   s.domain,
-			Expires:  s.expires,
-			MaxAge:   int(s.maxAge),
+			Domain:   sess.domain,
 			Secure:   s.secure,
 			HttpOnly: s.httpOnly,
-			Value:    v,
+			Expires:  s.destroyExpires,
+			Value:    "-",
+			MaxAge:   -1,
 		})
+		return
 	}
 
-	// add context values
-	ctxt = context.WithValue(ctxt, sessionIDContextKey, sessID)
-	ctxt = context.WithValue(ctxt, storeContextKey, s.st)
-	ctxt = context.WithValue(ctxt, sessionContextKey, sess)
-	ctxt = context.WithValue(ctxt, cookieNameContextKey, s.name)
+	if c != nil && (!isNew || s.persist(sess)) {
+		cookie := *c
+		cookie.Domain = sess.domain
+		s.writeCookie(res, req, &cookie)
+	}
+}
 
-	// serve
-	s.h.ServeHTTPC(ctxt, res, req)
+// writeCookie writes c to res, after passing it to the cookie func, if any.
+func (s *Manager) writeCookie(res http.ResponseWriter, req *http.Request, c *http.Cookie) {
+	if s.cookieFn != nil {
+		s.cookieFn(req, c)
+	}
+	http.SetCookie(res, c)
+}
+
+// persist determines if a new session should be issued a cookie and saved to
+// the store.
+func (s *Manager) persist(sess *session) bool {
+	if sess.cookieless {
+		return false
+	}
 
-	// save session
-	s.st.Write(sessID, sess.data)
+	sess.RLock()
+	defer sess.RUnlock()
+	if sess.ephemeral || sess.cleared {
+		return false
+	}
+	if s.saveUninitialized {
+		return true
+	}
+	return sess.modified
+}
+
+// defaultErrorHandler is the default error handler, responding with 503
+// Service Unavailable.
+func defaultErrorHandler(ctxt context.Context, res http.ResponseWriter, req *http.Request, err error) {
+	if err == ErrMalformedCookie {
+		http.Error(res, "bad request", http.StatusBadRequest)
+		return
+	}
+	http.Error(res, "service unavailable", http.StatusServiceUnavailable)
 }
 
 // defaultIDGen is the default session id generation func.
@@ -1,20 +1,31 @@
 package sessionmw
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"goji.io/pat"
 	"golang.org/x/net/context"
 
 	"goji.io"
 
+	"github.com/gorilla/securecookie"
 	"github.com/knq/baseconv"
 	"github.com/knq/kv"
 )
@@ -49,8 +60,9 @@ func newMux() (*kv.MemStore, *goji.Mux) {
 		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
 		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
 
-		Store: ms,
-		Name:  cookieName,
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
 	}
 
 	// create goji mux and add sessionmw
@@ -113,6 +125,7 @@ func TestHandler(t *testing.T) {
 	if len(ms.Data) != 1 {
 		t.Fatalf("ms.Data should be length 1")
 	}
+	sess, _ = ms.Data[sessID].(map[string]interface{})
 	if n, ok := sess["name"]; !ok || "foo" != n {
 		t.Fatalf("sess[name] should be foo")
 	}
@@ -125,6 +138,7 @@ func TestHandler(t *testing.T) {
 	if len(ms.Data) != 1 {
 		t.Fatalf("ms.Data should be length 1")
 	}
+	sess, _ = ms.Data[sessID].(map[string]interface{})
 	if _, ok := sess["name"]; ok {
 		t.Fatalf("sess[name] should not be defined")
 	}
@@ -147,51 +161,4878 @@ func TestHandler(t *testing.T) {
 	if newCookie.Value != "-" {
 		t.Fatalf("new cookie value should be -")
 	}
+	if len(ms.Data) != 0 {
+		t.Fatalf("destroyed session should not be saved, got: %v", ms.Data)
+	}
 }
 
-func get(mux *goji.Mux, path string, cookie *http.Cookie, t *testing.T) (*httptest.ResponseRecorder, string) {
+func TestMirror(t *testing.T) {
+	var bot bool
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:        kv.NewMemStore(),
+		Name:         cookieName,
+		MirrorKeys:   []string{"name", "fn"},
+		MirrorSecret: []byte("mirror secret"),
+		BotClassifier: func(*http.Request) bool {
+			return bot
+		},
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/set/:name"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
+		Set(ctxt, "secret", "hidden")
+	})
+	mux.HandleFuncC(pat.Get("/del"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Delete(ctxt, "name")
+	})
+	mux.HandleFuncC(pat.Get("/bad"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "fn", func() {})
+	})
+	mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt, res)
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+	})
+
+	mirrorCookie := func(rr *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range readSetCookies(rr) {
+			if c.Name == DefaultMirrorCookieName {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// issued
+	r0 := getCookies(mux, "/set/foo")
+	check(200, r0, t)
+	sc, mc := getCookie(r0, t), mirrorCookie(r0)
+	if mc == nil {
+		t.Fatalf("expected %s cookie", DefaultMirrorCookieName)
+	}
+	if mc.HttpOnly {
+		t.Errorf("mirror cookie should not be http only")
+	}
+	vals, err := DecodeMirror(conf.MirrorSecret, DefaultMirrorCookieName, mc.Value)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(vals) != 1 || vals["name"] != "foo" {
+		t.Errorf("expected only name=foo, got: %v", vals)
+	}
+	if _, err = DecodeMirror(conf.Secret, DefaultMirrorCookieName, mc.Value); err != ErrInvalidMirror {
+		t.Errorf("expected ErrInvalidMirror for session secret, got: %v", err)
+	}
+	if _, err = DecodeMirror(conf.MirrorSecret, "other", mc.Value); err != ErrInvalidMirror {
+		t.Errorf("expected ErrInvalidMirror for other cookie name, got: %v", err)
+	}
+
+	// unchanged
+	r1 := getCookies(mux, "/", sc, mc)
+	check(200, r1, t)
+	if c := mirrorCookie(r1); c != nil {
+		t.Errorf("unchanged mirror cookie should not be reissued, got: %v", c)
+	}
+
+	// changed
+	r2 := getCookies(mux, "/set/bar", sc, mc)
+	check(200, r2, t)
+	c := mirrorCookie(r2)
+	if c == nil {
+		t.Fatalf("expected changed mirror cookie")
+	}
+	if vals, err = DecodeMirror(conf.MirrorSecret, DefaultMirrorCookieName, c.Value); err != nil || vals["name"] != "bar" {
+		t.Errorf("expected name=bar, got: %v (%v)", vals, err)
+	}
+	mc = c
+
+	// deleted
+	r3 := getCookies(mux, "/del", sc, mc)
+	check(200, r3, t)
+	if c = mirrorCookie(r3); c == nil || c.MaxAge != -1 {
+		t.Errorf("expected expired mirror cookie, got: %v", c)
+	}
+
+	// unencodable
+	getCookies(mux, "/set/foo", sc, mc)
+	r4 := getCookies(mux, "/bad", sc, mc)
+	check(200, r4, t)
+	if c = mirrorCookie(r4); c == nil || c.MaxAge != -1 {
+		t.Errorf("expected expired mirror cookie on encode error, got: %v", c)
+	}
+
+	// destroyed
+	r5 := getCookies(mux, "/destroy", sc, mc)
+	check(200, r5, t)
+	if c = mirrorCookie(r5); c == nil || c.MaxAge != -1 {
+		t.Errorf("expected expired mirror cookie after destroy, got: %v", c)
+	}
+
+	// not persisted
+	bot = true
+	r6 := getCookies(mux, "/set/foo")
+	check(200, r6, t)
+	if c = mirrorCookie(r6); c != nil {
+		t.Errorf("expected no mirror cookie for cookieless session, got: %v", c)
+	}
+}
+
+func getCookies(mux *goji.Mux, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	q, _ := http.NewRequest("GET", path, nil)
-	if cookie != nil {
-		q.AddCookie(cookie)
+	for _, c := range cookies {
+		q.AddCookie(c)
 	}
 	mux.ServeHTTP(rr, q)
+	return rr
+}
 
-	l := ""
+func TestDuplicate(t *testing.T) {
+	ms := kv.NewMemStore()
 
-	switch {
-	case rr.Code >= 300 && rr.Code < 400:
-		if len(rr.HeaderMap["Location"]) != 1 {
-			t.Errorf("code %d redirect had 0 or more than 1 location header (count: %d)", rr.Code, len(rr.HeaderMap["Location"]))
-		} else {
-			l = rr.HeaderMap["Location"][0]
-			if len(l) < 1 {
-				t.Error("redirect location should not be empty string")
-			}
+	dups := 0
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ms,
+		Name:  cookieName,
+		OnDuplicate: func(context.Context, *http.Request) {
+			dups++
+		},
+	}
+
+	inner := goji.SubMux()
+	inner.UseC(conf.Handler)
+	inner.HandleFuncC(pat.Get("/set/:name"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
+	})
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleC(pat.New("/inner/*"), inner)
+
+	r0, _ := get(mux, "/inner/set/foo", nil, t)
+	check(200, r0, t)
+	if dups != 1 {
+		t.Errorf("expected 1 duplicate, got: %d", dups)
+	}
+	if n := len(r0.HeaderMap["Set-Cookie"]); n != 1 {
+		t.Errorf("expected 1 Set-Cookie header, got: %d", n)
+	}
+	if len(ms.Data) != 1 {
+		t.Fatalf("ms.Data should be length 1")
+	}
+	for _, v := range ms.Data {
+		if v.(map[string]interface{})["name"] != "foo" {
+			t.Errorf("expected name=foo, got: %v", v)
 		}
 	}
+}
 
-	return rr, l
+func TestSkip(t *testing.T) {
+	ms := kv.NewMemStore()
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
+		Skip:              SkipPrefix("/static/"),
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/*"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if _, ok := ctxt.Value(sessionContextKey).(*namedSession); ok {
+			res.Write([]byte("session"))
+		}
+	})
+
+	for _, z := range []struct {
+		path string
+		skip bool
+	}{
+		{"/static", true},
+		{"/static/app.js", true},
+		{"/staticfoo", false},
+		{"/", false},
+	} {
+		ms.Data = make(map[string]interface{})
+		rr, _ := get(mux, z.path, nil, t)
+		check(200, rr, t)
+		if z.skip != (rr.Body.String() == "") {
+			t.Errorf("%s expected skip %t, got body: %q", z.path, z.skip, rr.Body.String())
+		}
+		if z.skip != (len(rr.HeaderMap["Set-Cookie"]) == 0) {
+			t.Errorf("%s expected skip %t, got cookies: %v", z.path, z.skip, rr.HeaderMap["Set-Cookie"])
+		}
+		if z.skip != (len(ms.Data) == 0) {
+			t.Errorf("%s expected skip %t, got store: %v", z.path, z.skip, ms.Data)
+		}
+	}
+
+	skip := SkipPath("/healthz", "/metrics")
+	for _, z := range []struct {
+		path string
+		skip bool
+	}{
+		{"/healthz", true},
+		{"/metrics", true},
+		{"/healthz/x", false},
+	} {
+		req, _ := http.NewRequest("GET", z.path, nil)
+		if skip(req) != z.skip {
+			t.Errorf("%s expected skip %t", z.path, z.skip)
+		}
+	}
 }
 
-func getCookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
-	cookieStr := rexp.FindString(rr.HeaderMap["Set-Cookie"][0])
-	cookie := &http.Cookie{
-		Name:  cookieName,
-		Value: cookieStr[strings.Index(cookieStr, "=")+1:],
+// countStore counts writes.
+type countStore struct {
+	*kv.MemStore
+	writes int
+}
+
+func (cs *countStore) Write(key string, obj interface{}) error {
+	cs.writes++
+	return cs.MemStore.Write(key, obj)
+}
+
+func TestReadOnly(t *testing.T) {
+	cs := &countStore{MemStore: kv.NewMemStore()}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:    cs,
+		Name:     cookieName,
+		ReadOnly: ReadOnlySafe,
 	}
 
-	// sanity check
-	if len(cookie.Value) < 1 {
-		t.Errorf("cookie should not be empty")
+	h := func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
 	}
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/set/:name"), h)
+	mux.HandleFuncC(pat.Post("/set/:name"), h)
+	mux.HandleFuncC(pat.New("/"), func(context.Context, http.ResponseWriter, *http.Request) {})
 
-	return cookie
+	r0, _ := get(mux, "/set/foo", nil, t)
+	check(200, r0, t)
+	cookie := getCookie(r0, t)
+	for i, z := range []struct {
+		method, path string
+		writes       int
+	}{
+		{"GET", "/", 1},
+		{"HEAD", "/", 1},
+		{"POST", "/", 2},
+		{"GET", "/set/bar", 3},
+		{"POST", "/set/baz", 4},
+	} {
+		req, _ := http.NewRequest(z.method, z.path, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		check(200, rr, t)
+		if cs.writes != z.writes {
+			t.Errorf("test %d %s %s expected %d writes, got: %d", i, z.method, z.path, z.writes, cs.writes)
+		}
+	}
 }
 
-func check(code int, rr *httptest.ResponseRecorder, t *testing.T) {
-	if code != rr.Code {
-		t.Logf("GOT: %d -- %s", rr.Code, rr.Body.String())
-		t.Errorf("expected %d, got: %d", code, rr.Code)
+func TestLocking(t *testing.T) {
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:       kv.NewMemStore(),
+		Name:        cookieName,
+		Locking:     true,
+		LockTimeout: 50 * time.Millisecond,
+	}
+
+	release := make(chan bool)
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/incr"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := Get(ctxt, "n")
+		n, _ := v.(int)
+		Set(ctxt, "n", n+1)
+	})
+	mux.HandleFuncC(pat.Get("/block"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "blocked", true)
+		<-release
+	})
+	mux.HandleFuncC(pat.Get("/n"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := Get(ctxt, "n")
+		fmt.Fprintf(res, "%v", v)
+	})
+
+	r0, _ := get(mux, "/incr", nil, t)
+	check(200, r0, t)
+	cookie := getCookie(r0, t)
+
+	// concurrent increments are serialized
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getCookies(mux, "/incr", cookie)
+		}()
+	}
+	wg.Wait()
+	if r1 := getCookies(mux, "/n", cookie); r1.Body.String() != "11" {
+		t.Errorf("expected n to be 11, got: %s", r1.Body.String())
+	}
+
+	// lock timeout
+	done := make(chan bool)
+	go func() {
+		getCookies(mux, "/block", cookie)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	check(http.StatusServiceUnavailable, getCookies(mux, "/n", cookie), t)
+	close(release)
+	<-done
+	check(200, getCookies(mux, "/n", cookie), t)
+}
+
+func TestManager(t *testing.T) {
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:       copyStore{kv.NewMemStore()},
+		Name:        cookieName,
+		Locking:     true,
+		LockTimeout: 50 * time.Millisecond,
+	}
+
+	h := conf.Handler(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if v := req.URL.Query().Get("n"); v != "" {
+			Set(ctxt, "n", v)
+		}
+		v, _ := Get(ctxt, "n")
+		fmt.Fprintf(res, "%v", v)
+	}))
+	mux := goji.NewMux()
+	mux.HandleC(pat.Get("/"), h)
+
+	if _, err := HandlerManager(mux); err == nil {
+		t.Errorf("expected error for non session middleware handler")
+	}
+	m, err := HandlerManager(h)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	r0, _ := get(mux, "/?n=1", nil, t)
+	check(200, r0, t)
+	cookie := getCookie(r0, t)
+
+	// load with the Cookie header value
+	ctxt, err := Load(context.Background(), h, "other=foo; "+cookie.String())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, _ := Get(ctxt, "n"); v != "1" {
+		t.Errorf("expected n to be 1, got: %v", v)
+	}
+	Set(ctxt, "n", "2")
+
+	// session remains locked until saved
+	check(http.StatusServiceUnavailable, getCookies(mux, "/", cookie), t)
+	if err := m.Save(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.Release(ctxt); err != nil {
+		t.Errorf("expected no error releasing a saved session, got: %v", err)
+	}
+	if r1 := getCookies(mux, "/", cookie); r1.Body.String() != "2" {
+		t.Errorf("expected n to be 2, got: %s", r1.Body.String())
+	}
+
+	// released without saving
+	ctxt, err = m.LoadID(context.Background(), ID(ctxt))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	Set(ctxt, "n", "3")
+	if err := m.Release(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if r1 := getCookies(mux, "/", cookie); r1.Body.String() != "2" {
+		t.Errorf("expected n to be 2, got: %s", r1.Body.String())
+	}
+
+	// missing sessions
+	if _, err := m.Load(context.Background(), "other=foo"); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if _, err := m.LoadID(context.Background(), "missing"); err == nil {
+		t.Errorf("expected error for missing session")
+	}
+
+	// contexts not loaded by the manager
+	if err := m.Save(context.Background()); err == nil {
+		t.Errorf("expected error saving a context not loaded by the manager")
+	}
+}
+
+func TestManagerStandalone(t *testing.T) {
+	if _, err := NewManager(Config{}); err == nil {
+		t.Errorf("expected error for invalid config")
+	}
+
+	ms := kv.NewMemStore()
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:   ms,
+		Name:    cookieName,
+		Locking: true,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%v", v)
+	})
+
+	// create a session, issuing its cookie
+	ctxt, err := m.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	Set(ctxt, "name", "foo")
+	cookie, err := m.Cookie(ctxt)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.Save(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if r0 := getCookies(mux, "/", cookie); r0.Body.String() != "foo" {
+		t.Errorf("expected name to be foo, got: %s", r0.Body.String())
+	}
+
+	// renew the session id
+	ctxt, err = m.Load(context.Background(), cookie.String())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	id := ID(ctxt)
+	if err := m.RenewID(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if ID(ctxt) == id {
+		t.Errorf("expected a new session id")
+	}
+	if cookie, err = m.Cookie(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.Save(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := ms.Read(id); err == nil {
+		t.Errorf("expected previous session id to be erased")
+	}
+	if r0 := getCookies(mux, "/", cookie); r0.Body.String() != "foo" {
+		t.Errorf("expected name to be foo, got: %s", r0.Body.String())
+	}
+
+	// destroy the session
+	ctxt, err = m.Load(context.Background(), cookie.String())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.Destroy(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.Save(ctxt); err != nil {
+		t.Errorf("expected no error saving a released session, got: %v", err)
+	}
+	if _, err := ms.Read(ID(ctxt)); err == nil {
+		t.Errorf("expected session to be erased")
+	}
+}
+
+// copyStore stores copies of the session data, as stores that serialize the
+// session do.
+type copyStore struct {
+	*kv.MemStore
+}
+
+func (cs copyStore) Write(key string, obj interface{}) error {
+	return cs.MemStore.Write(key, copyData(obj))
+}
+
+func (cs copyStore) Read(key string) (interface{}, error) {
+	obj, err := cs.MemStore.Read(key)
+	return copyData(obj), err
+}
+
+func TestMerge(t *testing.T) {
+	for i, z := range []struct {
+		merge MergeFn
+		exp   string
+	}{
+		{MergeLastWriteWins, "a=<nil> b=2"},
+		{MergeKeys, "a=1 b=2"},
+	} {
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store: kv.NewMemStore(),
+			Name:  cookieName,
+			Merge: z.merge,
+		}
+
+		loaded, release := make(chan bool), make(chan bool)
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/init"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "init", true)
+		})
+		mux.HandleFuncC(pat.Get("/slow/:key"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			loaded <- true
+			<-release
+			Set(ctxt, pat.Param(ctxt, "key"), "2")
+		})
+		mux.HandleFuncC(pat.Get("/fast/:key"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, pat.Param(ctxt, "key"), "1")
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			a, _ := Get(ctxt, "a")
+			b, _ := Get(ctxt, "b")
+			fmt.Fprintf(res, "a=%v b=%v", a, b)
+		})
+
+		r0, _ := get(mux, "/init", nil, t)
+		cookie := getCookie(r0, t)
+
+		done := make(chan bool)
+		go func() {
+			getCookies(mux, "/slow/b", cookie)
+			close(done)
+		}()
+		<-loaded
+		getCookies(mux, "/fast/a", cookie)
+		close(release)
+		<-done
+
+		if s := getCookies(mux, "/get", cookie).Body.String(); s != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, s)
+		}
+	}
+}
+
+// patchStore records patches.
+type patchStore struct {
+	*kv.MemStore
+	writes  int
+	patches []string
+}
+
+func (ps *patchStore) Write(key string, obj interface{}) error {
+	ps.writes++
+	return ps.MemStore.Write(key, obj)
+}
+
+func (ps *patchStore) Patch(key string, set map[string]interface{}, del []string) error {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ps.patches = append(ps.patches, fmt.Sprintf("set=%v del=%v", keys, del))
+	return nil
+}
+
+func TestPatch(t *testing.T) {
+	ps := &patchStore{MemStore: kv.NewMemStore()}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ps,
+		Name:  cookieName,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/set/:name"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
+	})
+	mux.HandleFuncC(pat.Get("/del"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Delete(ctxt, "name")
+	})
+	mux.HandleFuncC(pat.Get("/regen"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Regenerate(ctxt)
+	})
+	mux.HandleFuncC(pat.Get("/"), func(context.Context, http.ResponseWriter, *http.Request) {})
+
+	r0, _ := get(mux, "/set/foo", nil, t)
+	cookie := getCookie(r0, t)
+	getCookies(mux, "/set/bar", cookie)
+	getCookies(mux, "/del", cookie)
+	getCookies(mux, "/", cookie)
+	getCookies(mux, "/regen", cookie)
+
+	if ps.writes != 2 {
+		t.Errorf("expected 2 writes, got: %d", ps.writes)
+	}
+	exp := []string{"set=[_sessionmw name] del=[]", "set=[_sessionmw] del=[name]", "set=[_sessionmw] del=[]"}
+	if !reflect.DeepEqual(ps.patches, exp) {
+		t.Errorf("expected patches %v, got: %v", exp, ps.patches)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             kv.NewMemStore(),
+		Name:              cookieName,
+		SaveUninitialized: true,
+	}
+
+	var md Metadata
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		md = Meta(ctxt)
+	})
+
+	start := time.Now()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test")
+	r0 := httptest.NewRecorder()
+	mux.ServeHTTP(r0, req)
+	check(200, r0, t)
+	first := md
+
+	if first.Created.Before(start) || first.LastActive.Before(first.Created) {
+		t.Errorf("expected created and last active to be now, got: %v %v", first.Created, first.LastActive)
+	}
+	if first.IP != "10.0.0.1" {
+		t.Errorf("expected ip 10.0.0.1, got: %s", first.IP)
+	}
+	if first.UserAgent != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("expected user agent hash, got: %s", first.UserAgent)
+	}
+
+	// the origin is retained on later requests
+	time.Sleep(time.Millisecond)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.AddCookie(getCookie(r0, t))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if !md.Created.Equal(first.Created) || !md.LastActive.After(first.LastActive) {
+		t.Errorf("expected last active to be updated, got: %v %v", md.Created, md.LastActive)
+	}
+	if md.IP != first.IP || md.UserAgent != first.UserAgent {
+		t.Errorf("expected origin to be retained, got: %s %s", md.IP, md.UserAgent)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	ms := kv.NewMemStore()
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ms,
+		Name:  cookieName,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/login/:user"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Regenerate(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := SetUser(ctxt, pat.Param(ctxt, "user")); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/sessions"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		infos, err := Sessions(ctxt, User(ctxt))
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for _, info := range infos {
+			fmt.Fprintf(res, "%s:%t ", info.ID, info.Current)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/destroy/:id"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := DestroyByID(ctxt, pat.Param(ctxt, "id")); err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/destroyothers"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := DestroyOthers(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/logout"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt)
+	})
+
+	var ids []string
+	var cookies []*http.Cookie
+	for _, user := range []string{"alice", "alice", "alice", "alice", "bob"} {
+		rr, _ := get(mux, "/login/"+user, nil, t)
+		check(200, rr, t)
+		ids, cookies = append(ids, rr.Body.String()), append(cookies, getCookie(rr, t))
+		time.Sleep(time.Millisecond)
+	}
+
+	sessions := func(i int) string {
+		return getCookies(mux, "/sessions", cookies[i]).Body.String()
+	}
+	exp := fmt.Sprintf("%s:false %s:true %s:false %s:false ", ids[0], ids[1], ids[2], ids[3])
+	if s := sessions(1); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+
+	// other users' sessions cannot be destroyed
+	check(http.StatusNotFound, getCookies(mux, "/destroy/"+ids[4], cookies[0]), t)
+
+	check(200, getCookies(mux, "/destroy/"+ids[0], cookies[1]), t)
+	check(200, getCookies(mux, "/logout", cookies[3]), t)
+	exp = fmt.Sprintf("%s:true %s:false ", ids[1], ids[2])
+	if s := sessions(1); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+
+	check(200, getCookies(mux, "/destroyothers", cookies[2]), t)
+	exp = fmt.Sprintf("%s:true ", ids[2])
+	if s := sessions(2); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	exp = fmt.Sprintf("%s:true ", ids[4])
+	if s := sessions(4); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+}
+
+// lockRecordStore records the keys locked in the wrapped store.
+type lockRecordStore struct {
+	LockingStore
+	mu     sync.Mutex
+	locked map[string]int
+}
+
+func (ls *lockRecordStore) Lock(key string, timeout time.Duration) (func(), error) {
+	ls.mu.Lock()
+	ls.locked[key]++
+	ls.mu.Unlock()
+	return ls.LockingStore.Lock(key, timeout)
+}
+
+func TestUserIndex(t *testing.T) {
+	now := time.Now()
+	ms := kv.NewMemStore()
+	ls := &lockRecordStore{LockingStore: LocalLocking(ms), locked: make(map[string]int)}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:   ls,
+		Name:    cookieName,
+		Locking: true,
+		Clock:   ClockFunc(func() time.Time { return now }),
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/login/:user"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := SetUser(ctxt, pat.Param(ctxt, "user")); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	login := func() string {
+		rr, _ := get(mux, "/login/alice", nil, t)
+		check(200, rr, t)
+		return rr.Body.String()
+	}
+	indexed := func() map[string]interface{} {
+		idx, _ := ms.Data[userIndexPrefix+"alice"].(map[string]interface{})
+		return idx
+	}
+
+	id0, id1 := login(), login()
+
+	// the index is updated with the store's lock
+	if ls.locked[userIndexPrefix+"alice"] == 0 {
+		t.Errorf("expected index to be locked with the store's lock")
+	}
+
+	// expired sessions are kept during the grace period
+	delete(ms.Data, id0)
+	id2 := login()
+	if idx := indexed(); len(idx) != 3 {
+		t.Errorf("expected 3 indexed sessions, got: %v", idx)
+	}
+
+	// and removed after
+	now = now.Add(2 * indexGrace)
+	id3 := login()
+	idx := indexed()
+	if _, ok := idx[id0]; ok || len(idx) != 3 {
+		t.Errorf("expected %s removed from index, got: %v", id0, idx)
+	}
+	for _, id := range []string{id1, id2, id3} {
+		if _, ok := idx[id]; !ok {
+			t.Errorf("expected %s in index, got: %v", id, idx)
+		}
+	}
+}
+
+type sizeStore struct {
+	Store
+	n int64
+}
+
+func (ss sizeStore) Count() (int64, error) {
+	return ss.n, nil
+}
+
+func TestAdmin(t *testing.T) {
+	conf := Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: kv.NewMemStore(),
+		Name:  cookieName,
+	}
+	m, err := NewManager(conf)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/login/:user"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+		if err := SetUser(ctxt, pat.Param(ctxt, "user")); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	var ids []string
+	for _, user := range []string{"alice", "alice", "bob"} {
+		rr, _ := get(mux, "/login/"+user, nil, t)
+		check(200, rr, t)
+		ids = append(ids, rr.Body.String())
+	}
+
+	admin := func(h http.Handler, method, path string, auth bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	h := AdminHandler(m, AdminOptions{Authorize: AdminBasicAuth("admin", "secret"), Prefix: "/admin"})
+
+	check(http.StatusUnauthorized, admin(h, "GET", "/admin/sessions/"+ids[0], false), t)
+	check(http.StatusNotFound, admin(h, "GET", "/admin/sessions/unknown", true), t)
+	check(http.StatusNotFound, admin(h, "GET", "/admin/sessions/"+userIndexPrefix+"alice", true), t)
+	check(http.StatusNotFound, admin(h, "GET", "/admin/other", true), t)
+	check(http.StatusMethodNotAllowed, admin(h, "POST", "/admin/sessions/"+ids[0], true), t)
+
+	// metadata only, unless values are shown
+	var as adminSession
+	rr := admin(h, "GET", "/admin/sessions/"+ids[0], true)
+	check(200, rr, t)
+	if err = json.Unmarshal(rr.Body.Bytes(), &as); err != nil || as.ID != ids[0] || as.User != "alice" || as.Values != nil {
+		t.Errorf("expected alice's session without values, got: %+v %v", as, err)
+	}
+	rr = admin(AdminHandler(m, AdminOptions{Authorize: AdminBasicAuth("admin", "secret"), ShowValues: true}), "GET", "/sessions/"+ids[0], true)
+	check(200, rr, t)
+	if err = json.Unmarshal(rr.Body.Bytes(), &as); err != nil || as.Values["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %+v %v", as, err)
+	}
+
+	// user sessions
+	var list []adminSession
+	rr = admin(h, "GET", "/admin/users/alice/sessions", true)
+	check(200, rr, t)
+	if err = json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Errorf("expected 2 sessions, got: %+v %v", list, err)
+	}
+
+	// destroy
+	check(http.StatusNoContent, admin(h, "DELETE", "/admin/sessions/"+ids[0], true), t)
+	check(http.StatusNotFound, admin(h, "DELETE", "/admin/sessions/"+ids[0], true), t)
+	check(http.StatusNoContent, admin(h, "DELETE", "/admin/users/alice/sessions", true), t)
+	rr = admin(h, "GET", "/admin/users/alice/sessions", true)
+	if rr.Body.String() != "[]" {
+		t.Errorf("expected no sessions, got: %s", rr.Body.String())
+	}
+	check(200, admin(h, "GET", "/admin/sessions/"+ids[2], true), t)
+
+	// count
+	check(http.StatusNotImplemented, admin(h, "GET", "/admin/count", true), t)
+	conf.Store = sizeStore{Store: kv.NewMemStore(), n: 3}
+	conf.Locking = true
+	if m, err = NewManager(conf); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	rr = admin(AdminHandler(m, AdminOptions{Authorize: AdminBasicAuth("admin", "secret")}), "GET", "/count", true)
+	check(200, rr, t)
+	if s := strings.TrimSpace(rr.Body.String()); s != `{"count":3}` {
+		t.Errorf("expected count 3, got: %s", s)
+	}
+}
+
+// keysStore is a KeysStore.
+type keysStore struct {
+	Store
+	keys []string
+}
+
+func (ks keysStore) Keys() ([]string, error) {
+	return ks.keys, nil
+}
+
+func TestActiveSessions(t *testing.T) {
+	for i, z := range []struct {
+		st  Store
+		n   int64
+		err error
+	}{
+		{kv.NewMemStore(), 0, ErrNotCountable},
+		{sizeStore{Store: kv.NewMemStore(), n: 5}, 5, nil},
+		{LocalLocking(sizeStore{Store: kv.NewMemStore(), n: 5}), 5, nil},
+		{keysStore{Store: kv.NewMemStore(), keys: []string{"a", "b"}}, 2, nil},
+	} {
+		if n, err := ActiveSessions(z.st); n != z.n || err != z.err {
+			t.Errorf("test %d expected %d (%v), got: %d (%v)", i, z.n, z.err, n, err)
+		}
+	}
+}
+
+func TestIDValidator(t *testing.T) {
+	for i, z := range []struct {
+		id              string
+		valid, defValid bool
+	}{
+		{"", false, false},
+		{defaultIDGen(), true, true},
+		{"3d2a9c3e-5d2f-4c1a-9e7b-8f0a1b2c3d4e", true, false},
+		{"abc_DEF-123,=", true, false},
+		{"../../etc/passwd", false, false},
+		{"a b", false, false},
+		{strings.Repeat("a", MaxIDLength), true, false},
+		{strings.Repeat("a", MaxIDLength+1), false, false},
+	} {
+		if v := ValidID(z.id); v != z.valid {
+			t.Errorf("test %d expected ValidID %t, got: %t", i, z.valid, v)
+		}
+		if v := validDefaultID(z.id); v != z.defValid {
+			t.Errorf("test %d expected validDefaultID %t, got: %t", i, z.defValid, v)
+		}
+	}
+
+	secret, blockSecret := []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"), []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp")
+	ms := kv.NewMemStore()
+	ms.Write("../sess", map[string]interface{}{"name": "foo"})
+	ms.Write("custom", map[string]interface{}{"name": "bar"})
+
+	for i, z := range []struct {
+		id        string
+		validator func(string) bool
+		exp       string
+	}{
+		{"../sess", nil, "<nil>"},
+		{"custom", nil, "bar"},
+		{"../sess", func(string) bool { return true }, "foo"},
+		{"custom", func(string) bool { return false }, "<nil>"},
+	} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      secret,
+			BlockSecret: blockSecret,
+			Store:       ms,
+			Name:        cookieName,
+			IDValidator: z.validator,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			v, _ := Get(ctxt, "name")
+			fmt.Fprintf(res, "%v", v)
+		})
+
+		val, err := securecookie.New(secret, blockSecret).Encode(cookieName, map[string]string{"id": z.id})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		rr := getCookies(mux, "/", &http.Cookie{Name: cookieName, Value: val})
+		if s := rr.Body.String(); s != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, s)
+		}
+	}
+}
+
+func TestIDFns(t *testing.T) {
+	uuidRE := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidRE := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		u, l := UUIDIDFn(), ULIDIDFn()
+		if !uuidRE.MatchString(u) || !ValidID(u) {
+			t.Errorf("expected v4 uuid, got: %s", u)
+		}
+		if !ulidRE.MatchString(l) || !ValidID(l) {
+			t.Errorf("expected ulid, got: %s", l)
+		}
+		if seen[u] || seen[l] {
+			t.Fatalf("expected unique ids")
+		}
+		seen[u], seen[l] = true, true
+	}
+
+	// ulids sort by creation time
+	a := ULIDIDFn()
+	time.Sleep(2 * time.Millisecond)
+	if b := ULIDIDFn(); a >= b {
+		t.Errorf("expected %s to sort before %s", a, b)
+	}
+
+	// timestamp
+	var ms uint64
+	for _, c := range ULIDIDFn()[:10] {
+		ms = ms<<5 | uint64(strings.IndexRune(crockford, c))
+	}
+	if d := time.Since(time.Unix(0, int64(ms)*int64(time.Millisecond))); d < 0 || d > time.Minute {
+		t.Errorf("expected ulid timestamp to be now, got: %v", d)
+	}
+
+	id := PrefixIDFn("sess_", UUIDIDFn)()
+	if !strings.HasPrefix(id, "sess_") || !uuidRE.MatchString(id[5:]) || !ValidID(id) {
+		t.Errorf("expected prefixed uuid, got: %s", id)
+	}
+}
+
+func TestKeyBuilder(t *testing.T) {
+	for i, z := range []struct {
+		kb  KeyBuilder
+		exp string
+	}{
+		{KeyBuilder{}, "abc"},
+		{KeyBuilder{Prefix: "sess:"}, "sess:abc"},
+		{KeyBuilder{Prefix: "sess:", Tenant: "acme"}, "sess:acme:abc"},
+		{KeyBuilder{Prefix: "sess:", HashIDs: true}, "sess:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{KeyBuilder{HashIDs: true, HashSecret: []byte("key")}, "9c196e32dc0175f86f4b1cb89289d6619de6bee699e4c378e68309ed97a1a6ab"},
+	} {
+		key := z.kb.Key("abc")
+		if key != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, key)
+		}
+		if id, ok := z.kb.ID(key); ok != !z.kb.HashIDs || (ok && id != "abc") {
+			t.Errorf("test %d expected id abc, got: %q %t", i, id, ok)
+		}
+	}
+	if _, ok := (KeyBuilder{Prefix: "sess:"}).ID("other:abc"); ok {
+		t.Errorf("expected key outside namespace to have no id")
+	}
+
+	// reserved keys are not hashed
+	kb := KeyBuilder{Prefix: "sess:", HashIDs: true}
+	if key := kb.Key(userIndexPrefix + "alice"); key != "sess:"+userIndexPrefix+"alice" || !kb.Reserved(key) {
+		t.Errorf("expected unhashed reserved key, got: %q", key)
+	}
+	if kb.Reserved(kb.Key("abc")) {
+		t.Errorf("expected session key not to be reserved")
+	}
+
+	// middleware
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+		KeyBuilder:  &KeyBuilder{Prefix: "sess:", Tenant: "acme"},
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+		res.Write([]byte(ID(ctxt)))
+	})
+	rr, _ := get(mux, "/", nil, t)
+	if _, err := ms.Read("sess:acme:" + rr.Body.String()); err != nil {
+		t.Errorf("expected session to be stored under namespaced key, got: %v", err)
+	}
+}
+
+func TestIntegrityStore(t *testing.T) {
+	ms := kv.NewMemStore()
+	st := IntegrityStore(ms, []byte("6Jr7KZLqvGoLsLwqx9gRmPEt8Ld3HvTY"))
+	if err := st.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	obj, err := st.Read("a")
+	if m, ok := obj.(map[string]interface{}); err != nil || !ok || m["name"] != "foo" {
+		t.Errorf("expected session a, got: %v (%v)", obj, err)
+	}
+
+	// stored payload is encrypted
+	raw, _ := ms.Read("a")
+	buf, ok := raw.([]byte)
+	if !ok || bytes.Contains(buf, []byte("foo")) {
+		t.Errorf("expected encrypted payload, got: %v", raw)
+	}
+
+	// swapped entries
+	ms.Write("b", buf)
+	if _, err = st.Read("b"); err != ErrTampered {
+		t.Errorf("expected ErrTampered for swapped entry, got: %v", err)
+	}
+
+	// modified entries
+	for i := range buf {
+		b := append([]byte(nil), buf...)
+		b[i] ^= 0x01
+		ms.Write("a", b)
+		if _, err = st.Read("a"); err != ErrTampered {
+			t.Errorf("byte %d expected ErrTampered, got: %v", i, err)
+		}
+	}
+	for i, v := range []interface{}{buf[:20], "foo", map[string]interface{}{"name": "foo"}} {
+		ms.Write("a", v)
+		if _, err = st.Read("a"); err != ErrTampered {
+			t.Errorf("test %d expected ErrTampered, got: %v", i, err)
+		}
+	}
+
+	// other secret
+	ms.Write("a", buf)
+	if _, err = IntegrityStore(ms, []byte("other")).Read("a"); err != ErrTampered {
+		t.Errorf("expected ErrTampered for other secret, got: %v", err)
+	}
+
+	// middleware
+	var tampered string
+	ms = kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:          []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret:     []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:           ms,
+		Name:            cookieName,
+		IntegritySecret: []byte("6Jr7KZLqvGoLsLwqx9gRmPEt8Ld3HvTY"),
+		OnTamper: func(ctxt context.Context, id string) {
+			tampered = id
+		},
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%s %v", ID(ctxt), v)
+	})
+
+	r0, _ := get(mux, "/set", nil, t)
+	id := r0.Body.String()
+	cookie := getCookie(r0, t)
+	if r1, _ := get(mux, "/get", cookie, t); r1.Body.String() != id+" foo" {
+		t.Errorf("expected %q, got: %q", id+" foo", r1.Body.String())
+	}
+
+	raw, _ = ms.Read(id)
+	buf = append([]byte(nil), raw.([]byte)...)
+	buf[len(buf)/2] ^= 0x01
+	ms.Write(id, buf)
+	r2, _ := get(mux, "/get", cookie, t)
+	if s := r2.Body.String(); s == id+" foo" || strings.HasPrefix(s, id) || !strings.HasSuffix(s, " <nil>") {
+		t.Errorf("expected new session, got: %q", s)
+	}
+	if tampered != id {
+		t.Errorf("expected OnTamper to be called with %q, got: %q", id, tampered)
+	}
+	if _, err = ms.Read(id); err == nil {
+		t.Errorf("expected tampered session to be destroyed")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ms := kv.NewMemStore()
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+	}
+	handler := func(conf *Config) *goji.Mux {
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+			res.Write([]byte(ID(ctxt)))
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			name, _ := Get(ctxt, "name")
+			first, _ := Get(ctxt, "first")
+			fmt.Fprintf(res, "%v %v", name, first)
+		})
+		return mux
+	}
+
+	// session without schema version
+	r0, _ := get(handler(conf), "/set", nil, t)
+	id, cookie := r0.Body.String(), getCookie(r0, t)
+	if d, _ := ms.Read(id); SchemaVersion(d) != 0 {
+		t.Errorf("expected schema version 0, got: %d", SchemaVersion(d))
+	}
+
+	var calls []int
+	conf.Migrations = map[int]func(map[string]interface{}) map[string]interface{}{
+		1: func(m map[string]interface{}) map[string]interface{} {
+			calls = append(calls, 1)
+			if _, ok := m[metaKey]; ok {
+				t.Errorf("expected migration not to be passed the metadata")
+			}
+			m["first"] = m["name"]
+			delete(m, "name")
+			return m
+		},
+		3: func(m map[string]interface{}) map[string]interface{} {
+			calls = append(calls, 3)
+			m["name"] = "bar"
+			return m
+		},
+	}
+	mux := handler(conf)
+	if r1, _ := get(mux, "/get", cookie, t); r1.Body.String() != "bar foo" {
+		t.Errorf("expected %q, got: %q", "bar foo", r1.Body.String())
+	}
+	if !reflect.DeepEqual(calls, []int{1, 3}) {
+		t.Errorf("expected migrations 1 and 3, got: %v", calls)
+	}
+	d, _ := ms.Read(id)
+	if SchemaVersion(d) != 3 {
+		t.Errorf("expected schema version 3, got: %d", SchemaVersion(d))
+	}
+	if md := metadata(d.(map[string]interface{})); md.Created.IsZero() {
+		t.Errorf("expected metadata to be retained")
+	}
+
+	// migrated sessions are not migrated again
+	if r2, _ := get(mux, "/get", cookie, t); r2.Body.String() != "bar foo" || len(calls) != 2 {
+		t.Errorf("expected no migrations, got: %q %v", r2.Body.String(), calls)
+	}
+
+	// new sessions have the current schema version
+	r3, _ := get(mux, "/set", nil, t)
+	if d, _ := ms.Read(r3.Body.String()); SchemaVersion(d) != 3 || len(calls) != 2 {
+		t.Errorf("expected schema version 3 and no migrations, got: %d %v", SchemaVersion(d), calls)
+	}
+}
+
+type structSession struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestStruct(t *testing.T) {
+	Register((*structSession)(nil))
+
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/inc"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		ss := Struct(ctxt, (*structSession)(nil)).(*structSession)
+		if ss != Struct(ctxt, (*structSession)(nil)).(*structSession) {
+			t.Errorf("expected the same struct for the request")
+		}
+		ss.Name, ss.Tags = "foo", append(ss.Tags, "t")
+		ss.Count++
+		fmt.Fprintf(res, "%s %d %d", ss.Name, ss.Count, len(ss.Tags))
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		ss := Struct(ctxt, (*structSession)(nil)).(*structSession)
+		fmt.Fprintf(res, "%q %d %t", ss.Name, ss.Count, IsNew(ctxt))
+	})
+
+	// new sessions only reading the struct are not saved
+	r0, _ := get(mux, "/get", nil, t)
+	if s := r0.Body.String(); s != `"" 0 true` {
+		t.Errorf("expected zero value, got: %q", s)
+	}
+	if len(r0.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected no cookie for unmodified new session")
+	}
+
+	r1, _ := get(mux, "/inc", nil, t)
+	cookie := getCookie(r1, t)
+	for i, exp := range []string{"foo 2 2", "foo 3 3"} {
+		if r, _ := get(mux, "/inc", cookie, t); r.Body.String() != exp {
+			t.Errorf("test %d expected %q, got: %q", i, exp, r.Body.String())
+		}
+	}
+	if r, _ := get(mux, "/get", cookie, t); r.Body.String() != `"foo" 3 false` {
+		t.Errorf("expected stored struct, got: %q", r.Body.String())
+	}
+
+	// unregistered types panic
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic for unregistered struct")
+			}
+		}()
+		Struct(context.Background(), (*Metadata)(nil))
+	}()
+}
+
+func TestSetWithTTL(t *testing.T) {
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetWithTTL(ctxt, "otp", "123456", time.Millisecond)
+		SetWithTTL(ctxt, "challenge", "abc", time.Hour)
+		SetWithTTL(ctxt, "name", "foo", time.Millisecond)
+		Set(ctxt, "name", "foo")
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(strings.Join(Keys(ctxt), ",")))
+	})
+
+	r0, _ := get(mux, "/set", nil, t)
+	id, cookie := r0.Body.String(), getCookie(r0, t)
+	time.Sleep(5 * time.Millisecond)
+
+	if r1, _ := get(mux, "/get", cookie, t); r1.Body.String() != "challenge,name" {
+		t.Errorf("expected %q, got: %q", "challenge,name", r1.Body.String())
+	}
+
+	// expired values are removed from the store
+	d, _ := ms.Read(id)
+	data := d.(map[string]interface{})
+	if _, ok := data["otp"]; ok {
+		t.Errorf("expected expired value to be removed from the store")
+	}
+	m, _ := data[metaKey].(map[string]interface{})
+	if exp, _ := m[metaExpiresKey].(map[string]interface{}); len(exp) != 1 || exp["challenge"] == nil {
+		t.Errorf("expected only the challenge expiration, got: %v", exp)
+	}
+}
+
+func TestSetOnce(t *testing.T) {
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetOnce(ctxt, "state", "abc")
+		SetOnceWithTTL(ctxt, "otp", "123456", time.Millisecond)
+		SetOnce(ctxt, "name", "foo")
+		Set(ctxt, "name", "foo")
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		has := Has(ctxt, "state")
+		state, _ := Get(ctxt, "state")
+		again, _ := Get(ctxt, "state")
+		name, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%t %v %v %v %s", has, state, again, name, strings.Join(Keys(ctxt), ","))
+	})
+
+	r0, _ := get(mux, "/set", nil, t)
+	id, cookie := r0.Body.String(), getCookie(r0, t)
+	time.Sleep(5 * time.Millisecond)
+
+	if r1, _ := get(mux, "/get", cookie, t); r1.Body.String() != "true abc <nil> foo name" {
+		t.Errorf("expected %q, got: %q", "true abc <nil> foo name", r1.Body.String())
+	}
+	if r2, _ := get(mux, "/get", cookie, t); r2.Body.String() != "false <nil> <nil> foo name" {
+		t.Errorf("expected %q, got: %q", "false <nil> <nil> foo name", r2.Body.String())
+	}
+
+	// retrieved values are removed from the store
+	d, _ := ms.Read(id)
+	m, _ := d.(map[string]interface{})[metaKey].(map[string]interface{})
+	if m[metaOnceKey] != nil || m[metaExpiresKey] != nil {
+		t.Errorf("expected no once values, got: %v", m)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       kv.NewMemStore(),
+		Name:        cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "id", "user")
+		cart, ab := Bucket(ctxt, "cart"), Bucket(ctxt, "ab")
+		cart.Set("id", "cart")
+		cart.Set("count", 2)
+		ab.Set("id", "ab")
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		cart, ab := Bucket(ctxt, "cart"), Bucket(ctxt, "ab")
+		id, _ := Get(ctxt, "id")
+		cartID, _ := cart.Get("id")
+		abID, _ := ab.Get("id")
+		fmt.Fprintf(res, "%v %v %v %v %t", id, cartID, abID, cart.Keys(), cart.Has("count"))
+	})
+	mux.HandleFuncC(pat.Get("/clear"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Bucket(ctxt, "cart").Clear()
+		res.Write([]byte(strings.Join(Keys(ctxt), ",")))
+	})
+
+	cookie := getCookie(getCookies(mux, "/set"), t)
+	if r, _ := get(mux, "/get", cookie, t); r.Body.String() != "user cart ab [count id] true" {
+		t.Errorf("expected bucket values, got: %q", r.Body.String())
+	}
+	if r, _ := get(mux, "/clear", cookie, t); r.Body.String() != "ab/id,id" {
+		t.Errorf("expected cart to be cleared, got: %q", r.Body.String())
+	}
+	if r, _ := get(mux, "/get", cookie, t); r.Body.String() != "user <nil> ab [] false" {
+		t.Errorf("expected cleared cart, got: %q", r.Body.String())
+	}
+}
+
+// batchReadStore is a store reading sessions in batches.
+type batchReadStore struct {
+	*kv.MemStore
+	batches int
+}
+
+func (bs *batchReadStore) ReadBatch(keys []string) (map[string]interface{}, error) {
+	bs.batches++
+	objs := make(map[string]interface{})
+	for _, key := range keys {
+		if obj, err := bs.Read(key); err == nil {
+			objs[key] = obj
+		}
+	}
+	return objs, nil
+}
+
+func TestPreload(t *testing.T) {
+	for i, st := range []Store{kv.NewMemStore(), &batchReadStore{MemStore: kv.NewMemStore()}} {
+		s, err := NewManager(Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       st,
+			IDFn:        UUIDIDFn,
+			Locking:     true,
+		})
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+
+		var ids []string
+		for _, name := range []string{"a", "b"} {
+			ctxt, _ := s.NewSession(context.Background())
+			Set(ctxt, "name", name)
+			if err := s.Save(ctxt); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			ids = append(ids, ID(ctxt))
+		}
+
+		ctxts, err := s.Preload(context.Background(), append(ids, UUIDIDFn(), "!"))
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if len(ctxts) != 2 {
+			t.Errorf("test %d expected 2 sessions, got: %d", i, len(ctxts))
+		}
+		for j, id := range ids {
+			ctxt := ctxts[id]
+			if ctxt == nil {
+				t.Errorf("test %d expected session %s", i, id)
+				continue
+			}
+			if v, _ := Get(ctxt, "name"); v != []string{"a", "b"}[j] {
+				t.Errorf("test %d expected name %s, got: %v", i, []string{"a", "b"}[j], v)
+			}
+			if err = s.Release(ctxt); err != nil {
+				t.Errorf("test %d expected no error, got: %v", i, err)
+			}
+		}
+
+		if bs, ok := st.(*batchReadStore); ok && bs.batches != 1 {
+			t.Errorf("test %d expected 1 batch, got: %d", i, bs.batches)
+		}
+	}
+}
+
+// unavailableStore is a store whose reads fail with err.
+type unavailableStore struct {
+	*kv.MemStore
+	err error
+}
+
+func (us unavailableStore) Read(key string) (interface{}, error) {
+	return nil, us.err
+}
+
+func TestStoreErrors(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := NewStoreError(ErrStoreUnavailable, cause)
+	if !isError(err, ErrStoreUnavailable) || !isError(err, cause) || isError(err, ErrDecodeFailed) {
+		t.Errorf("expected unavailable error wrapping cause, got: %v", err)
+	}
+	if err.Error() != "session store unavailable: connection refused" {
+		t.Errorf("expected error message, got: %q", err.Error())
+	}
+	if NewStoreError(ErrStoreUnavailable, nil) != nil {
+		t.Errorf("expected nil error")
+	}
+
+	for i, z := range []struct {
+		err  error
+		code int
+	}{
+		{ErrSessionNotFound, 200},
+		{NewStoreError(ErrDecodeFailed, errors.New("bad payload")), 200},
+		{errors.New("other"), 200},
+		{err, 503},
+		{NewStoreError(ErrStoreUnavailable, errors.New("timeout")), 418},
+	} {
+		var handled error
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       unavailableStore{MemStore: kv.NewMemStore(), err: z.err},
+			Name:        cookieName,
+		}
+		if z.code == 418 {
+			conf.ErrorHandler = func(ctxt context.Context, res http.ResponseWriter, req *http.Request, err error) {
+				handled = err
+				res.WriteHeader(http.StatusTeapot)
+			}
+		}
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+		})
+
+		cookie := getCookie(getCookies(mux, "/"), t)
+		if r, _ := get(mux, "/", cookie, t); r.Code != z.code {
+			t.Errorf("test %d expected %d, got: %d", i, z.code, r.Code)
+		}
+		if z.code == 418 && handled != z.err {
+			t.Errorf("test %d expected error handler to be passed %v, got: %v", i, z.err, handled)
+		}
+	}
+}
+
+func TestCreateLimit(t *testing.T) {
+	for i, cookieless := range []bool{false, true} {
+		now := time.Now()
+		ms := kv.NewMemStore()
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       ms,
+			Name:        cookieName,
+			Clock:       ClockFunc(func() time.Time { return now }),
+			CreateLimit: &CreateLimit{
+				Counter:    MemRateCounter(),
+				Max:        2,
+				Cookieless: cookieless,
+			},
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+		})
+
+		var cookie *http.Cookie
+		for j := 0; j < 2; j++ {
+			cookie = getCookie(getCookies(mux, "/set"), t)
+		}
+
+		r := getCookies(mux, "/set")
+		switch {
+		case !cookieless && r.Code != http.StatusTooManyRequests:
+			t.Errorf("test %d expected 429, got: %d", i, r.Code)
+		case cookieless && (r.Code != 200 || len(r.HeaderMap["Set-Cookie"]) != 0):
+			t.Errorf("test %d expected cookieless response, got: %d %v", i, r.Code, r.HeaderMap["Set-Cookie"])
+		}
+		if len(ms.Data) != 2 {
+			t.Errorf("test %d expected 2 sessions, got: %d", i, len(ms.Data))
+		}
+
+		// existing sessions are not limited
+		if r := getCookies(mux, "/set", cookie); r.Code != 200 {
+			t.Errorf("test %d expected 200, got: %d", i, r.Code)
+		}
+
+		// the window ends with the Manager's clock
+		now = now.Add(DefaultCreateLimitWindow)
+		if r := getCookies(mux, "/set"); r.Code != 200 || len(r.HeaderMap["Set-Cookie"]) == 0 {
+			t.Errorf("test %d expected new session, got: %d %v", i, r.Code, r.HeaderMap["Set-Cookie"])
+		}
+	}
+
+	// concurrent requests cannot exceed the limit
+	release := make(chan bool)
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       kv.NewMemStore(),
+		Name:        cookieName,
+		CreateLimit: &CreateLimit{
+			Counter: MemRateCounter(),
+			Max:     2,
+		},
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		<-release
+		Set(ctxt, "name", "foo")
+	})
+
+	codes := make(chan int, 5)
+	for j := 0; j < 5; j++ {
+		go func() {
+			codes <- getCookies(mux, "/set").Code
+		}()
+	}
+	var ok, limited int
+	for j := 0; j < 5; j++ {
+		// limited requests return without waiting for the release
+		if j == 3 {
+			close(release)
+		}
+		switch <-codes {
+		case http.StatusOK:
+			ok++
+		case http.StatusTooManyRequests:
+			limited++
+		}
+	}
+	if ok != 2 || limited != 3 {
+		t.Errorf("expected 2 sessions and 3 limited requests, got: %d, %d", ok, limited)
+	}
+}
+
+func TestBotClassifier(t *testing.T) {
+	tests := []struct {
+		ua, accept string
+		exp        bool
+	}{
+		{"", "text/html", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/45.0", "", true},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "*/*", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0)", "*/*", true},
+		{"Baiduspider+(+http://www.baidu.com/search/spider.htm)", "*/*", true},
+		{"curl/7.47.0", "*/*", true},
+		{"Go-http-client/1.1", "*/*", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/45.0", "text/html", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 9_3 like Mac OS X) Safari/601.1", "text/html", false},
+	}
+	for i, test := range tests {
+		q, _ := http.NewRequest("GET", "/", nil)
+		q.Header.Set("User-Agent", test.ua)
+		q.Header.Set("Accept", test.accept)
+		if b := IsBot(q); b != test.exp {
+			t.Errorf("test %d expected %t, got: %t", i, test.exp, b)
+		}
+	}
+
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:        []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret:   []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:         ms,
+		Name:          cookieName,
+		BotClassifier: IsBot,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%v", v)
+	})
+
+	// bots are served without a session
+	r := getCookies(mux, "/set")
+	if r.Code != 200 || len(r.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected cookieless response, got: %d %v", r.Code, r.HeaderMap["Set-Cookie"])
+	}
+	if len(ms.Data) != 0 {
+		t.Errorf("expected no sessions, got: %d", len(ms.Data))
+	}
+
+	// browsers are issued sessions
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("GET", "/set", nil)
+	q.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/45.0")
+	q.Header.Set("Accept", "text/html")
+	mux.ServeHTTP(rr, q)
+	cookie := getCookie(rr, t)
+	if len(ms.Data) != 1 {
+		t.Errorf("expected 1 session, got: %d", len(ms.Data))
+	}
+
+	// existing sessions are not affected
+	if r := getCookies(mux, "/get", cookie); r.Body.String() != "foo" {
+		t.Errorf("expected foo, got: %s", r.Body.String())
+	}
+}
+
+func TestCookiePrefix(t *testing.T) {
+	for i, z := range []struct {
+		prefix, path, domain string
+		exp                  string
+	}{
+		{CookiePrefixHost, "", "", "__Host-" + cookieName + " /  true"},
+		{CookiePrefixSecure, "/app", "example.com", "__Secure-" + cookieName + " /app example.com true"},
+	} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:       []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret:  []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:        kv.NewMemStore(),
+			Name:         cookieName,
+			CookiePrefix: z.prefix,
+			Path:         z.path,
+			Domain:       z.domain,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			v, _ := Get(FromName(ctxt, z.prefix+cookieName), "name")
+			fmt.Fprintf(res, "%v", v)
+		})
+
+		cookies := readSetCookies(getCookies(mux, "/set"))
+		if len(cookies) != 1 {
+			t.Fatalf("test %d expected 1 cookie, got: %d", i, len(cookies))
+		}
+		c := cookies[0]
+		if s := fmt.Sprintf("%s %s %s %t", c.Name, c.Path, c.Domain, c.Secure); s != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, s)
+		}
+
+		if r := getCookies(mux, "/get", c); r.Body.String() != "foo" {
+			t.Errorf("test %d expected foo, got: %s", i, r.Body.String())
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	for i, z := range []struct {
+		domain string
+		exp    string
+		ok     bool
+	}{
+		{"", "", true},
+		{"example.com", "example.com", true},
+		{" .Example.COM", "example.com", true},
+		{"app-1.example.com", "app-1.example.com", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"::1", "::1", false},
+		{"example.com:8080", "", false},
+		{"example..com", "", false},
+		{"-example.com", "", false},
+		{"example.com/", "", false},
+	} {
+		if d, ok := NormalizeDomain(z.domain); d != z.exp || ok != z.ok {
+			t.Errorf("test %d expected %q %t, got: %q %t", i, z.exp, z.ok, d, ok)
+		}
+	}
+
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       kv.NewMemStore(),
+		Name:        cookieName,
+		Domain:      "fallback.com",
+		DomainFn:    MatchDomain(".example.com", "Example.org"),
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt)
+	})
+
+	for i, z := range []struct {
+		host, exp string
+	}{
+		{"example.com", "example.com"},
+		{"app.example.com:8080", "example.com"},
+		{"APP.EXAMPLE.ORG", "example.org"},
+		{"badexample.com", ""},
+		{"other.net", ""},
+	} {
+		for _, path := range []string{"/set", "/destroy"} {
+			rr := httptest.NewRecorder()
+			q, _ := http.NewRequest("GET", path, nil)
+			q.Host = z.host
+			mux.ServeHTTP(rr, q)
+
+			cookies := readSetCookies(rr)
+			if len(cookies) != 1 {
+				t.Fatalf("test %d %s expected 1 cookie, got: %d", i, path, len(cookies))
+			}
+			if d := cookies[0].Domain; d != z.exp {
+				t.Errorf("test %d %s expected domain %q, got: %q", i, path, z.exp, d)
+			}
+		}
+	}
+}
+
+func TestCookieFn(t *testing.T) {
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       kv.NewMemStore(),
+		Name:        cookieName,
+		CookieFn: func(req *http.Request, c *http.Cookie) {
+			c.Secure = req.Header.Get("X-Forwarded-Proto") == "https"
+			if req.URL.Query().Get("remember") != "" {
+				c.MaxAge = 86400
+			}
+		},
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt)
+	})
+
+	for i, z := range []struct {
+		path, proto string
+		secure      bool
+		maxAge      int
+	}{
+		{"/set", "", false, 0},
+		{"/set", "https", true, 0},
+		{"/set?remember=1", "https", true, 86400},
+		{"/destroy", "https", true, -1},
+	} {
+		rr := httptest.NewRecorder()
+		q, _ := http.NewRequest("GET", z.path, nil)
+		q.Header.Set("X-Forwarded-Proto", z.proto)
+		mux.ServeHTTP(rr, q)
+
+		cookies := readSetCookies(rr)
+		if len(cookies) != 1 {
+			t.Fatalf("test %d expected 1 cookie, got: %d", i, len(cookies))
+		}
+		if c := cookies[0]; c.Secure != z.secure || c.MaxAge != z.maxAge {
+			t.Errorf("test %d expected %t %d, got: %t %d", i, z.secure, z.maxAge, c.Secure, c.MaxAge)
+		}
+	}
+}
+
+// ttlStore is a TTLStore recording the ttls of the written sessions.
+type ttlStore struct {
+	Store
+	ttls map[string]time.Duration
+}
+
+func (ts *ttlStore) TTL(key string) (time.Duration, error) {
+	return ts.ttls[key], nil
+}
+
+func (ts *ttlStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	ts.ttls[key] = ttl
+	return ts.Store.Write(key, obj)
+}
+
+func TestMaxAge(t *testing.T) {
+	for i, z := range []struct {
+		maxAge        time.Duration
+		maxAgeSeconds int
+		exp           int
+	}{
+		{0, 0, 0},
+		{time.Hour, 0, 3600},
+		{1500 * time.Millisecond, 0, 1},
+		{0, 60, 60},
+	} {
+		st := &ttlStore{Store: kv.NewMemStore(), ttls: make(map[string]time.Duration)}
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:        []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret:   []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:         st,
+			Name:          cookieName,
+			MaxAge:        z.maxAge,
+			MaxAgeSeconds: z.maxAgeSeconds,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			v, _ := Get(ctxt, "name")
+			fmt.Fprintf(res, "%v", v)
+		})
+
+		cookies := readSetCookies(getCookies(mux, "/set"))
+		if len(cookies) != 1 {
+			t.Fatalf("test %d expected 1 cookie, got: %d", i, len(cookies))
+		}
+		if c := cookies[0]; c.MaxAge != z.exp {
+			t.Errorf("test %d expected max age %d, got: %d", i, z.exp, c.MaxAge)
+		}
+
+		var ttl time.Duration
+		for _, v := range st.ttls {
+			ttl = v
+		}
+		if exp := z.maxAge + time.Duration(z.maxAgeSeconds)*time.Second; ttl != exp {
+			t.Errorf("test %d expected ttl %v, got: %v", i, exp, ttl)
+		}
+
+		// the cookie is accepted
+		if r := getCookies(mux, "/get", cookies[0]); r.Body.String() != "foo" {
+			t.Errorf("test %d expected foo, got: %s", i, r.Body.String())
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	for i, z := range []struct {
+		maxAge, maxLifetime time.Duration
+		exp                 time.Duration
+	}{
+		{0, 0, 0},
+		{time.Hour, 0, time.Hour},
+		{0, 2 * time.Hour, 2 * time.Hour},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{3 * time.Hour, 2 * time.Hour, 2 * time.Hour},
+	} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       kv.NewMemStore(),
+			Name:        cookieName,
+			MaxAge:      z.maxAge,
+			MaxLifetime: z.maxLifetime,
+		}).Handler)
+		var expires time.Time
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+			expires = ExpiresAt(ctxt)
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(res, "%d", ExpiresAt(ctxt).UnixNano())
+		})
+
+		now := time.Now()
+		cookie := getCookie(getCookies(mux, "/set"), t)
+		switch {
+		case z.exp == 0 && !expires.IsZero():
+			t.Errorf("test %d expected zero time, got: %v", i, expires)
+		case z.exp != 0 && (expires.Before(now.Add(z.exp-time.Second)) || expires.After(time.Now().Add(z.exp))):
+			t.Errorf("test %d expected expiration in %v, got: %v", i, z.exp, expires.Sub(now))
+		}
+
+		// the expiration is retained for existing sessions
+		if r := getCookies(mux, "/get", cookie); r.Body.String() != fmt.Sprintf("%d", expires.UnixNano()) {
+			t.Errorf("test %d expected %d, got: %s", i, expires.UnixNano(), r.Body.String())
+		}
+	}
+}
+
+func TestAuthLevel(t *testing.T) {
+	now := time.Now()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:            []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret:       []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:             kv.NewMemStore(),
+		Name:              cookieName,
+		SaveUninitialized: true,
+		Clock:             ClockFunc(func() time.Time { return now }),
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetAuthLevel(ctxt, 1, 0)
+	})
+	mux.HandleFuncC(pat.Get("/reauth"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetAuthLevel(ctxt, 2, 50*time.Millisecond)
+	})
+	mux.HandleC(pat.Get("/billing"), RequireAuthLevel(2)(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d", AuthLevel(ctxt))
+	})))
+	mux.HandleC(pat.Get("/account"), StepUp{
+		Level: 1,
+		FailureHandler: goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			http.Redirect(res, req, "/login", http.StatusFound)
+		}),
+	}.Handler(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d", AuthLevel(ctxt))
+	})))
+
+	r0, _ := get(mux, "/account", nil, t)
+	check(http.StatusFound, r0, t)
+	cookie := getCookie(r0, t)
+
+	check(http.StatusUnauthorized, getCookies(mux, "/billing", cookie), t)
+	check(200, getCookies(mux, "/login", cookie), t)
+	check(200, getCookies(mux, "/account", cookie), t)
+	check(http.StatusUnauthorized, getCookies(mux, "/billing", cookie), t)
+
+	check(200, getCookies(mux, "/reauth", cookie), t)
+	if r := getCookies(mux, "/billing", cookie); r.Code != 200 || r.Body.String() != "2" {
+		t.Errorf("expected 200 2, got: %d %s", r.Code, r.Body.String())
+	}
+
+	// the level downgrades after its ttl
+	now = now.Add(60 * time.Millisecond)
+	check(http.StatusUnauthorized, getCookies(mux, "/billing", cookie), t)
+	if r := getCookies(mux, "/account", cookie); r.Code != 200 || r.Body.String() != "1" {
+		t.Errorf("expected 200 1, got: %d %s", r.Code, r.Body.String())
+	}
+
+	// repeated step ups within the ttl downgrade to the original level
+	check(200, getCookies(mux, "/reauth", cookie), t)
+	now = now.Add(10 * time.Millisecond)
+	check(200, getCookies(mux, "/reauth", cookie), t)
+	check(200, getCookies(mux, "/billing", cookie), t)
+	now = now.Add(24 * time.Hour)
+	check(http.StatusUnauthorized, getCookies(mux, "/billing", cookie), t)
+	if r := getCookies(mux, "/account", cookie); r.Code != 200 || r.Body.String() != "1" {
+		t.Errorf("expected 200 1, got: %d %s", r.Code, r.Body.String())
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	var buf bytes.Buffer
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+		Audit:       AuditWriter(&buf),
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/impersonate"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%v", Impersonate(ctxt, "bob"))
+	})
+	mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetUser(ctxt, "alice")
+	})
+	mux.HandleFuncC(pat.Get("/stop"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%v", StopImpersonating(ctxt))
+	})
+	mux.HandleFuncC(pat.Get("/whoami"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		n, _ := Sessions(ctxt, "alice")
+		fmt.Fprintf(res, "%s %s %d", User(ctxt), Impersonator(ctxt), len(n))
+	})
+
+	r0, _ := get(mux, "/impersonate", nil, t)
+	if s := r0.Body.String(); s != ErrNoUser.Error() {
+		t.Errorf("expected %v, got: %s", ErrNoUser, s)
+	}
+	cookie := getCookie(getCookies(mux, "/login"), t)
+
+	for i, z := range []struct {
+		path, exp string
+	}{
+		{"/stop", ErrNotImpersonating.Error()},
+		{"/whoami", "alice  1"},
+		{"/impersonate", "<nil>"},
+		{"/whoami", "bob alice 1"},
+		{"/stop", "<nil>"},
+		{"/whoami", "alice  1"},
+	} {
+		if r := getCookies(mux, z.path, cookie); r.Body.String() != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, r.Body.String())
+		}
+	}
+
+	var events []AuditEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if ev.Op == AuditImpersonate || ev.Op == AuditStopImpersonate {
+			events = append(events, ev)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got: %v", events)
+	}
+	for i, ev := range events {
+		if ev.Key != "bob" || ev.User != "bob" || ev.Impersonator != "alice" {
+			t.Errorf("event %d unexpected: %+v", i, ev)
+		}
+	}
+
+	// destroying the impersonating session removes it from the
+	// impersonator's index
+	mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt)
+	})
+	getCookies(mux, "/impersonate", cookie)
+	getCookies(mux, "/destroy", cookie)
+	if d, ok := ms.Data[userIndexPrefix+"alice"]; ok {
+		t.Errorf("expected no index, got: %v", d)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	data := map[string]interface{}{
+		"name":         "foo",
+		"access_token": "abc",
+		"cart/Token":   "def",
+		"Password":     "secret",
+		"count":        1,
+		metaKey: map[string]interface{}{
+			metaCSRFKey: "ghi",
+			metaUserKey: "alice",
+		},
+	}
+	exp := map[string]interface{}{
+		"name":         "foo",
+		"access_token": RedactedValue,
+		"cart/Token":   RedactedValue,
+		"Password":     RedactedValue,
+		"count":        1,
+		metaKey: map[string]interface{}{
+			metaCSRFKey: RedactedValue,
+			metaUserKey: "alice",
+		},
+	}
+	if r := Redact(data, DefaultRedactKeys); !reflect.DeepEqual(r, exp) {
+		t.Errorf("expected %v, got: %v", exp, r)
+	}
+	if data["access_token"] != "abc" {
+		t.Errorf("expected data to be unchanged, got: %v", data)
+	}
+
+	for i, z := range []struct {
+		pattern, key string
+		exp          bool
+	}{
+		{"name", "name", true},
+		{"name", "names", false},
+		{"*name", "username", true},
+		{"name*", "username", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"*", "", true},
+	} {
+		if b := globMatch(z.pattern, z.key); b != z.exp {
+			t.Errorf("test %d expected %t, got: %t", i, z.exp, b)
+		}
+	}
+
+	for i, patterns := range [][]string{nil, {"name"}, {}} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       kv.NewMemStore(),
+			Name:        cookieName,
+			RedactKeys:  patterns,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+			Set(ctxt, "token", "abc")
+			r := Redacted(ctxt)
+			fmt.Fprintf(res, "%v %v", r["name"], r["token"])
+		})
+
+		exp := []string{"foo [REDACTED]", "[REDACTED] abc", "foo abc"}[i]
+		if r := getCookies(mux, "/"); r.Body.String() != exp {
+			t.Errorf("test %d expected %q, got: %q", i, exp, r.Body.String())
+		}
+	}
+}
+
+func TestSuspiciousCookie(t *testing.T) {
+	var errs []error
+	store := &unavailableStore{MemStore: kv.NewMemStore()}
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             store,
+		Name:              cookieName,
+		SaveUninitialized: true,
+		OnSuspiciousCookie: func(req *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	invalid, err := m.codec().Encode(cookieName, map[string]string{"id": "../../etc/passwd"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i, value := range []string{
+		"garbage",
+		strings.Repeat("A", DefaultMaxCookieLength+1),
+		invalid,
+	} {
+		rr, _ := get(mux, "/", &http.Cookie{Name: cookieName, Value: value}, t)
+		check(200, rr, t)
+		if rr.Body.Len() == 0 {
+			t.Errorf("test %d expected new session id", i)
+		}
+		if n := m.DecodeFailures(); n != int64(i+1) {
+			t.Errorf("test %d expected %d decode failures, got: %d", i, i+1, n)
+		}
+	}
+	if len(errs) != 3 || errs[1] != ErrMalformedCookie || errs[2] != ErrMalformedCookie {
+		t.Errorf("expected 3 suspicious cookies, got: %v", errs)
+	}
+
+	// stored payload decode failures are counted, but are not suspicious
+	rr, _ := get(mux, "/", nil, t)
+	c := getCookie(rr, t)
+	store.err = NewStoreError(ErrDecodeFailed, errors.New("truncated"))
+	rr, _ = get(mux, "/", c, t)
+	check(200, rr, t)
+	if n := m.DecodeFailures(); n != 4 {
+		t.Errorf("expected 4 decode failures, got: %d", n)
+	}
+	if len(errs) != 3 {
+		t.Errorf("expected 3 suspicious cookies, got: %d", len(errs))
+	}
+}
+
+func TestDecodeReject(t *testing.T) {
+	var errs []error
+	ms := kv.NewMemStore()
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
+		OnSuspiciousCookie: func(req *http.Request, err error) {
+			errs = append(errs, err)
+		},
+		DecodePolicy: DecodeReject,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	// valid and missing cookies are not affected
+	rr, _ := get(mux, "/", nil, t)
+	check(200, rr, t)
+	rr, _ = get(mux, "/", getCookie(rr, t), t)
+	check(200, rr, t)
+
+	rr, _ = get(mux, "/", &http.Cookie{Name: cookieName, Value: "garbage"}, t)
+	check(400, rr, t)
+	if len(errs) != 1 || m.DecodeFailures() != 1 || len(ms.Data) != 1 {
+		t.Errorf("expected rejected cookie to be counted and not create a session, got: %v %d %d", errs, m.DecodeFailures(), len(ms.Data))
+	}
+
+	if !expired(errors.New("securecookie: expired timestamp")) || expired(errors.New("securecookie: the value is not valid")) {
+		t.Errorf("expected only expired cookies to be identified")
+	}
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	obj := map[string]interface{}{
+		"name": "foo",
+		metaKey: map[string]interface{}{
+			metaCreatedKey: int64(1234567890123456789),
+		},
+	}
+	for _, c := range []Codec{CodecGob, CodecJSON} {
+		buf, err := EncodePayload(c, obj)
+		if err != nil {
+			f.Fatalf("codec %d expected no error, got: %v", c, err)
+		}
+		f.Add(buf)
+		f.Add(buf[:len(buf)/2])
+		f.Add(buf[:5])
+	}
+	var buf bytes.Buffer
+	var v interface{} = obj
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		f.Fatalf("expected no error, got: %v", err)
+	}
+	f.Add(buf.Bytes())
+	f.Add(buf.Bytes()[:buf.Len()-3])
+	f.Add([]byte("SMW"))
+	f.Add([]byte("SMW\x01\x09{}"))
+	f.Add(bytes.Repeat([]byte{0xff}, 8192))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if obj, err := DecodePayload(buf); err != nil && obj != nil {
+			t.Errorf("expected nil value on error, got: %v", obj)
+		}
+	})
+}
+
+func FuzzSessionCookie(f *testing.F) {
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             kv.NewMemStore(),
+		Name:              cookieName,
+		SaveUninitialized: true,
+	})
+	if err != nil {
+		f.Fatalf("expected no error, got: %v", err)
+	}
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	valid, err := m.codec().Encode(cookieName, map[string]string{"id": m.idFn()})
+	if err != nil {
+		f.Fatalf("expected no error, got: %v", err)
+	}
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(valid + "AAAA")
+	f.Add("")
+	f.Add("%zz")
+	f.Add(strings.Repeat("A", DefaultMaxCookieLength+1))
+
+	f.Fuzz(func(t *testing.T, value string) {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", cookieName+"="+value)
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.Len() == 0 {
+			t.Errorf("expected 200 with session id, got: %d %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestJSONSerializer(t *testing.T) {
+	ms := kv.NewMemStore()
+	newMux := func(serializer securecookie.Serializer) *goji.Mux {
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Serializer:  serializer,
+
+			Store:             ms,
+			Name:              cookieName,
+			SaveUninitialized: true,
+		}
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte(ID(ctxt)))
+		})
+		return mux
+	}
+
+	// gob cookies remain valid
+	rr, _ := get(newMux(nil), "/", nil, t)
+	check(200, rr, t)
+	id := rr.Body.String()
+	mux := newMux(JSONSerializer{})
+	rr, _ = get(mux, "/", getCookie(rr, t), t)
+	check(200, rr, t)
+	if s := rr.Body.String(); s != id {
+		t.Errorf("expected %s, got: %s", id, s)
+	}
+
+	// new cookies are JSON
+	rr, _ = get(mux, "/", nil, t)
+	check(200, rr, t)
+	v := make(map[string]string)
+	sc := securecookie.New([]byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"), []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"))
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	if err := sc.Decode(cookieName, getCookie(rr, t).Value, &v); err != nil || v["id"] != rr.Body.String() {
+		t.Errorf("expected id %s, got: %v %v", rr.Body.String(), v, err)
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	ms := kv.NewMemStore()
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	var other string
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if GetStore(ctxt) != ms || CookieName(ctxt) != cookieName || ID(ctxt) == "" {
+			t.Errorf("expected store, cookie name, and id from context")
+		}
+		if err := m.Save(ctxt); err == nil {
+			t.Errorf("expected error saving middleware session")
+		}
+		if other == "" {
+			res.Write([]byte(ID(ctxt)))
+			return
+		}
+
+		// sessions loaded by the manager during the request
+		lc, err := m.LoadID(ctxt, other)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		Set(lc, "name", "foo")
+		if err := m.Save(FromName(lc, cookieName)); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		if v, _ := Get(ctxt, "name"); v != nil {
+			t.Errorf("expected request session to be unchanged, got: %v", v)
+		}
+	})
+
+	rr, _ := get(mux, "/", nil, t)
+	check(200, rr, t)
+	other = rr.Body.String()
+
+	rr, _ = get(mux, "/", nil, t)
+	check(200, rr, t)
+	if v, err := ms.Read(other); err != nil || v.(map[string]interface{})["name"] != "foo" {
+		t.Errorf("expected loaded session to be saved, got: %v %v", v, err)
+	}
+}
+
+func TestConsent(t *testing.T) {
+	q, _ := http.NewRequest("GET", "/", nil)
+	if ConsentHeader("X-Consent", "")(q) || ConsentCookie("consent", "")(q) {
+		t.Errorf("expected no consent")
+	}
+	q.Header.Set("X-Consent", "no")
+	q.AddCookie(&http.Cookie{Name: "consent", Value: "no"})
+	if !ConsentHeader("X-Consent", "")(q) || ConsentHeader("X-Consent", "yes")(q) {
+		t.Errorf("expected consent header to match value")
+	}
+	if !ConsentCookie("consent", "")(q) || ConsentCookie("consent", "yes")(q) {
+		t.Errorf("expected consent cookie to match value")
+	}
+
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
+		Consent:           ConsentCookie("consent", "yes"),
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+		fmt.Fprintf(res, "%t", IsEphemeral(ctxt))
+	})
+	mux.HandleFuncC(pat.Get("/grant"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		GrantConsent(ctxt)
+		Set(ctxt, "name", "bar")
+		fmt.Fprintf(res, "%t", IsEphemeral(ctxt))
+	})
+
+	// ephemeral sessions without consent
+	r := getCookies(mux, "/set", &http.Cookie{Name: "consent", Value: "no"})
+	if r.Code != 200 || r.Body.String() != "true" || len(r.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected ephemeral session, got: %d %s %v", r.Code, r.Body.String(), r.HeaderMap["Set-Cookie"])
+	}
+	if len(ms.Data) != 0 {
+		t.Errorf("expected no sessions, got: %d", len(ms.Data))
+	}
+
+	// granted during the request
+	rr, _ := get(mux, "/grant", nil, t)
+	if rr.Body.String() != "false" {
+		t.Errorf("expected persistent session, got: %s", rr.Body.String())
+	}
+	cookie := getCookie(rr, t)
+	if len(ms.Data) != 1 {
+		t.Errorf("expected 1 session, got: %d", len(ms.Data))
+	}
+
+	// existing sessions are not affected
+	if r := getCookies(mux, "/set", cookie); r.Body.String() != "false" {
+		t.Errorf("expected persistent session, got: %s", r.Body.String())
+	}
+
+	// consented
+	r = getCookies(mux, "/set", &http.Cookie{Name: "consent", Value: "yes"})
+	if r.Body.String() != "false" || len(r.HeaderMap["Set-Cookie"]) != 1 || len(ms.Data) != 2 {
+		t.Errorf("expected persistent session, got: %s %v %d", r.Body.String(), r.HeaderMap["Set-Cookie"], len(ms.Data))
+	}
+}
+
+func TestCookieOverride(t *testing.T) {
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.SetCookie(res, &http.Cookie{Name: cookieName, Value: "bogus", Path: "/set"})
+		http.SetCookie(res, &http.Cookie{Name: "other", Value: "foo"})
+		if req.URL.Query().Get("name") != "" {
+			Set(ctxt, "name", req.URL.Query().Get("name"))
+		}
+	})
+	mux.HandleFuncC(pat.Get("/clear"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "bar")
+		ClearCookie(ctxt)
+	})
+
+	// handler cookie replaced by session cookie
+	rr, _ := get(mux, "/set?name=foo", nil, t)
+	cookies := rr.HeaderMap["Set-Cookie"]
+	if len(cookies) != 2 || !strings.HasPrefix(cookies[0], "other=foo") {
+		t.Fatalf("expected other and session cookies, got: %v", cookies)
+	}
+	var cookie *http.Cookie
+	for _, c := range (&http.Response{Header: rr.HeaderMap}).Cookies() {
+		if c.Name == cookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value == "bogus" || len(ms.Data) != 1 {
+		t.Fatalf("expected session cookie, got: %v", cookie)
+	}
+
+	// handler cookie removed for unchanged session
+	r := getCookies(mux, "/set", cookie)
+	if cookies = r.HeaderMap["Set-Cookie"]; len(cookies) != 1 || !strings.HasPrefix(cookies[0], "other=foo") {
+		t.Errorf("expected only other cookie, got: %v", cookies)
+	}
+
+	// cleared cookie
+	r = getCookies(mux, "/clear", cookie)
+	if cookies = r.HeaderMap["Set-Cookie"]; len(cookies) != 1 || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Errorf("expected expired session cookie, got: %v", cookies)
+	}
+	if len(ms.Data) != 1 {
+		t.Errorf("expected stored session to be kept, got: %d", len(ms.Data))
+	}
+
+	// new session with cleared cookie is not saved
+	r = getCookies(mux, "/clear")
+	if cookies = r.HeaderMap["Set-Cookie"]; len(cookies) != 1 || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Errorf("expected expired session cookie, got: %v", cookies)
+	}
+	if len(ms.Data) != 1 {
+		t.Errorf("expected new session to not be saved, got: %d", len(ms.Data))
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	now := time.Now()
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:       ms,
+		Name:        cookieName,
+		Clock:       ClockFunc(func() time.Time { return now }),
+	}).Handler)
+	var login OAuthLogin
+	mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		login = BeginOAuth(ctxt, res)
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/callback"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		l, err := CompleteOAuth(ctxt, req.URL.Query().Get("state"))
+		fmt.Fprintf(res, "%s %t %v", ID(ctxt), l == login, err)
+	})
+
+	begin := func() (string, *http.Cookie) {
+		rr, _ := get(mux, "/login", nil, t)
+		check(200, rr, t)
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("expected no-store, got: %q", rr.Header().Get("Cache-Control"))
+		}
+		return rr.Body.String(), getCookie(rr, t)
+	}
+	complete := func(state string, cookie *http.Cookie) []string {
+		rr, _ := get(mux, "/callback?state="+state, cookie, t)
+		check(200, rr, t)
+		return strings.SplitN(rr.Body.String(), " ", 3)
+	}
+
+	id, cookie := begin()
+	if login.State == "" || login.Nonce == "" || len(login.Verifier) < 43 || login.State == login.Nonce {
+		t.Errorf("expected random state, nonce, and verifier, got: %+v", login)
+	}
+	sum := sha256.Sum256([]byte(login.Verifier))
+	if c := login.Challenge(); c != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("expected S256 challenge, got: %s", c)
+	}
+
+	// completed logins regenerate the session, and are consumed
+	if r := complete(login.State, cookie); r[0] == id || r[1] != "true" || r[2] != "<nil>" {
+		t.Errorf("expected regenerated session and login, got: %v", r)
+	}
+	if _, err := ms.Read(id); err == nil {
+		t.Errorf("expected previous session to be erased")
+	}
+	if r := complete(login.State, cookie); r[2] != ErrInvalidOAuthState.Error() {
+		t.Errorf("expected ErrInvalidOAuthState, got: %v", r)
+	}
+
+	// mismatched states consume the login
+	id, cookie = begin()
+	if r := complete("invalid", cookie); r[0] != id || r[2] != ErrInvalidOAuthState.Error() {
+		t.Errorf("expected ErrInvalidOAuthState, got: %v", r)
+	}
+	if r := complete(login.State, cookie); r[2] != ErrInvalidOAuthState.Error() {
+		t.Errorf("expected ErrInvalidOAuthState, got: %v", r)
+	}
+
+	// expired logins
+	_, cookie = begin()
+	now = now.Add(DefaultOAuthTTL)
+	if r := complete(login.State, cookie); r[2] != ErrInvalidOAuthState.Error() {
+		t.Errorf("expected ErrInvalidOAuthState, got: %v", r)
+	}
+}
+
+func TestDestroyContext(t *testing.T) {
+	ms, mux := newMux()
+	mux.HandleFuncC(pat.Get("/destroy/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Destroy(ctxt)
+		if _, ok := Get(ctxt, "name"); ok {
+			t.Errorf("expected values to be cleared from the context")
+		}
+		Set(ctxt, "name", "bar")
+	})
+
+	r0, _ := get(mux, "/set/foo", nil, t)
+	cookie := getCookie(r0, t)
+	if len(ms.Data) != 1 {
+		t.Fatalf("expected 1 session, got: %d", len(ms.Data))
+	}
+
+	r1, _ := get(mux, "/destroy/set", cookie, t)
+	check(200, r1, t)
+	if cookies := r1.HeaderMap["Set-Cookie"]; len(cookies) != 1 || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Errorf("expected only the expired cookie, got: %v", cookies)
+	}
+	if len(ms.Data) != 0 {
+		t.Errorf("expected destroyed session to not be saved, got: %v", ms.Data)
+	}
+}
+
+func TestDestroyCookie(t *testing.T) {
+	for _, exp := range []time.Time{{}, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store:          kv.NewMemStore(),
+			Name:           cookieName,
+			Path:           "/app",
+			Domain:         "example.com",
+			Secure:         true,
+			HttpOnly:       true,
+			DestroyExpires: exp,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Destroy(ctxt)
+		})
+
+		if exp.IsZero() {
+			exp = DefaultDestroyExpires
+		}
+
+		r := getCookies(mux, "/destroy")
+		cookies := (&http.Response{Header: r.HeaderMap}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected 1 cookie, got: %v", r.HeaderMap["Set-Cookie"])
+		}
+		c := cookies[0]
+		if c.Name != cookieName || c.Value != "-" || c.MaxAge != -1 || !c.Expires.Equal(exp) {
+			t.Errorf("expected expired cookie with expires %v, got: %v", exp, c)
+		}
+		if c.Path != "/app" || c.Domain != "example.com" || !c.Secure || !c.HttpOnly {
+			t.Errorf("expected cookie attributes to match the session cookie, got: %v", c)
+		}
+	}
+}
+
+func TestRotateID(t *testing.T) {
+	now := time.Now()
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:         ms,
+		Name:          cookieName,
+		Clock:         ClockFunc(func() time.Time { return now }),
+		RotateIDEvery: 10 * time.Minute,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		name, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%s %v", ID(ctxt), name)
+	})
+
+	rr, _ := get(mux, "/set", nil, t)
+	a := getCookie(rr, t)
+
+	// not yet due
+	now = now.Add(5 * time.Minute)
+	rr, _ = get(mux, "/", a, t)
+	if len(rr.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected no rotation, got: %v", rr.HeaderMap["Set-Cookie"])
+	}
+	oldID := strings.Fields(rr.Body.String())[0]
+
+	// rotated
+	now = now.Add(6 * time.Minute)
+	rr, _ = get(mux, "/", a, t)
+	b := getCookie(rr, t)
+	body := strings.Fields(rr.Body.String())
+	if body[0] == oldID || body[1] != "foo" {
+		t.Fatalf("expected rotated id with name foo, got: %v", body)
+	}
+	newID := body[0]
+	if next, _, _ := forward(ms.Data[oldID], now); next != newID {
+		t.Errorf("expected %s to forward to %s, got: %q", oldID, newID, next)
+	}
+
+	// previous id within the grace period
+	now = now.Add(DefaultRotateIDGrace / 2)
+	rr, _ = get(mux, "/", a, t)
+	if body = strings.Fields(rr.Body.String()); body[0] != newID || body[1] != "foo" {
+		t.Errorf("expected %s with name foo, got: %v", newID, body)
+	}
+	if len(rr.HeaderMap["Set-Cookie"]) != 1 {
+		t.Errorf("expected cookie for the rotated id, got: %v", rr.HeaderMap["Set-Cookie"])
+	}
+
+	// previous id after the grace period
+	now = now.Add(DefaultRotateIDGrace)
+	rr, _ = get(mux, "/", a, t)
+	if body = strings.Fields(rr.Body.String()); body[0] == newID || body[1] == "foo" {
+		t.Errorf("expected new session, got: %v", body)
+	}
+
+	// not due again until the interval elapses
+	rr, _ = get(mux, "/", b, t)
+	if body = strings.Fields(rr.Body.String()); body[0] != newID || body[1] != "foo" || len(rr.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected %s with name foo and no rotation, got: %v %v", newID, body, rr.HeaderMap["Set-Cookie"])
+	}
+}
+
+func TestRegenerateGrace(t *testing.T) {
+	now := time.Now()
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:           copyStore{ms},
+		Name:            cookieName,
+		Clock:           ClockFunc(func() time.Time { return now }),
+		RegenerateGrace: time.Minute,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set/:name"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
+	})
+	mux.HandleFuncC(pat.Get("/regenerate"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Regenerate(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		name, _ := Get(ctxt, "name")
+		fmt.Fprintf(res, "%s %v", ID(ctxt), name)
+	})
+
+	rr, _ := get(mux, "/set/foo", nil, t)
+	a := getCookie(rr, t)
+	rr, _ = get(mux, "/regenerate", a, t)
+	getCookie(rr, t)
+	newID := rr.Body.String()
+
+	// previous id is read only within the grace period
+	rr, _ = get(mux, "/", a, t)
+	if body := strings.Fields(rr.Body.String()); body[0] != newID || body[1] != "foo" {
+		t.Errorf("expected %s with name foo, got: %v", newID, body)
+	}
+	if len(rr.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected no cookie for the previous id, got: %v", rr.HeaderMap["Set-Cookie"])
+	}
+	rr, _ = get(mux, "/set/bar", a, t)
+	if len(rr.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("expected no cookie for the previous id, got: %v", rr.HeaderMap["Set-Cookie"])
+	}
+	if m, _ := ms.Data[newID].(map[string]interface{}); m["name"] != "foo" {
+		t.Errorf("expected read only session to not be saved, got: %v", m["name"])
+	}
+
+	// previous id after the grace period
+	now = now.Add(2 * time.Minute)
+	rr, _ = get(mux, "/", a, t)
+	if body := strings.Fields(rr.Body.String()); body[0] == newID || body[1] == "foo" {
+		t.Errorf("expected new session, got: %v", body)
+	}
+}
+
+// payloadStore stores sessions encoded as session payloads.
+type payloadStore struct {
+	*kv.MemStore
+	c Codec
+}
+
+func (ps payloadStore) Write(key string, obj interface{}) error {
+	buf, err := EncodePayload(ps.c, obj)
+	if err != nil {
+		return err
+	}
+	return ps.MemStore.Write(key, buf)
+}
+
+func (ps payloadStore) Read(key string) (interface{}, error) {
+	buf, err := ps.MemStore.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePayload(buf.([]byte))
+}
+
+type testPoint struct {
+	X, Y int
+}
+
+func init() {
+	RegisterValue("testPoint", testPoint{})
+}
+
+func TestNormalizeValues(t *testing.T) {
+	now := time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC)
+	exp := map[string]interface{}{
+		"int":     int64(42),
+		"float":   1.5,
+		"time":    now,
+		"strings": []string{"a", "b"},
+		"point":   testPoint{1, 2},
+		"map":     map[string]interface{}{"n": int64(7), "t": now},
+	}
+
+	for i, st := range []Store{
+		copyStore{kv.NewMemStore()},
+		payloadStore{kv.NewMemStore(), CodecGob},
+		payloadStore{kv.NewMemStore(), CodecJSON},
+	} {
+		mux := goji.NewMux()
+		mux.UseC((&Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store:           st,
+			Name:            cookieName,
+			NormalizeValues: true,
+		}).Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "int", 42)
+			Set(ctxt, "float", float32(1.5))
+			Set(ctxt, "time", now)
+			Set(ctxt, "strings", []string{"a", "b"})
+			Set(ctxt, "point", testPoint{1, 2})
+			Set(ctxt, "map", map[string]interface{}{"n": 7, "t": now})
+			if v, _ := Get(ctxt, "int"); v != int64(42) {
+				t.Errorf("test %d expected int64 42 before saving, got: %T %v", i, v, v)
+			}
+		})
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			if vals := Values(ctxt); !reflect.DeepEqual(vals, exp) {
+				t.Errorf("test %d expected %#v, got: %#v", i, exp, vals)
+			}
+			if v, _ := Get(ctxt, "time"); v != now {
+				t.Errorf("test %d expected %v, got: %#v", i, now, v)
+			}
+		})
+
+		rr, _ := get(mux, "/set", nil, t)
+		get(mux, "/", getCookie(rr, t), t)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	Register((*structSession)(nil))
+
+	ms := kv.NewMemStore()
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ms,
+		Name:  cookieName,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "a", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/restore"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		ss := Struct(ctxt, (*structSession)(nil)).(*structSession)
+		ss.Name = "foo"
+		buf, err := Snapshot(ctxt)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		Set(ctxt, "a", "bar")
+		Set(ctxt, "b", "bar")
+		ss.Name, ss.Count = "bar", 1
+		if err = Restore(ctxt, buf); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err = Restore(ctxt, []byte("foo")); err != ErrInvalidSnapshot {
+			t.Errorf("expected ErrInvalidSnapshot, got: %v", err)
+		}
+
+		b, _ := Get(ctxt, "b")
+		fmt.Fprintf(res, "%s %v %s %d", Keys(ctxt), b, ss.Name, ss.Count)
+
+		Destroy(ctxt)
+		if err = Restore(ctxt, buf); err != ErrSessionDestroyed {
+			t.Errorf("expected ErrSessionDestroyed, got: %v", err)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/rollback"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		buf, err := Snapshot(ctxt)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		Set(ctxt, "a", "bar")
+		Delete(ctxt, "a")
+		Set(ctxt, "b", "bar")
+		if err = Restore(ctxt, buf); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		buf, err := Snapshot(ctxt)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err = SetUser(ctxt, "alice"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err = Restore(ctxt, buf); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		// injected metadata is ignored
+		buf, _ = EncodePayload(CodecGob, map[string]interface{}{
+			"a":     "baz",
+			metaKey: map[string]interface{}{metaUserKey: "mallory"},
+		})
+		if err = Restore(ctxt, buf); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		a, _ := Get(ctxt, "a")
+		fmt.Fprintf(res, "%s %v", User(ctxt), a)
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		a, _ := Get(ctxt, "a")
+		fmt.Fprintf(res, "%s %v", Keys(ctxt), a)
+	})
+
+	rr, _ := get(mux, "/set", nil, t)
+	cookie := getCookie(rr, t)
+	if rr, _ = get(mux, "/login", cookie, t); rr.Body.String() != "alice baz" {
+		t.Errorf("expected metadata to be kept, got: %q", rr.Body.String())
+	}
+
+	rr, _ = get(mux, "/set", nil, t)
+	cookie = getCookie(rr, t)
+	if rr, _ = get(mux, "/restore", cookie, t); rr.Body.String() != "[a] <nil> foo 0" {
+		t.Errorf("expected restored values, got: %q", rr.Body.String())
+	}
+
+	rr, _ = get(mux, "/set", nil, t)
+	cookie = getCookie(rr, t)
+	get(mux, "/rollback", cookie, t)
+	if rr, _ = get(mux, "/", cookie, t); rr.Body.String() != "[a] foo" {
+		t.Errorf("expected restored session to be saved, got: %q", rr.Body.String())
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	ms := kv.NewMemStore()
+	ts := &ttlStore{Store: ms, ttls: make(map[string]time.Duration)}
+	mux := goji.NewMux()
+	mux.UseC((&Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:        ts,
+		Name:         cookieName,
+		TombstoneTTL: time.Minute,
+	}).Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+		res.Write([]byte(ID(ctxt)))
+	})
+	mux.HandleFuncC(pat.Get("/destroy"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Destroy(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	})
+
+	rr, _ := get(mux, "/set", nil, t)
+	cookie, id := getCookie(rr, t), rr.Body.String()
+	get(mux, "/destroy", cookie, t)
+
+	m, _ := ms.Data[id].(map[string]interface{})
+	if !revoked(m) || len(m) != 1 {
+		t.Fatalf("expected tombstone, got: %v", ms.Data[id])
+	}
+	if ts.ttls[id] != time.Minute {
+		t.Errorf("expected tombstone ttl %v, got: %v", time.Minute, ts.ttls[id])
+	}
+
+	// revoked session ids are not reused
+	rr, _ = get(mux, "/set", cookie, t)
+	if newID := rr.Body.String(); newID == id {
+		t.Errorf("expected new session id, got: %s", newID)
+	}
+	if !revoked(ms.Data[id]) {
+		t.Errorf("expected tombstone to be retained, got: %v", ms.Data[id])
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	now := time.Now()
+	st := &ttlStore{Store: kv.NewMemStore(), ttls: make(map[string]time.Duration)}
+	m, err := NewManager(Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:      st,
+		Name:       cookieName,
+		Clock:      ClockFunc(func() time.Time { return now }),
+		MaxAge:     time.Hour,
+		Watermarks: true,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(m.Handler)
+	mux.HandleFuncC(pat.Get("/login/:user"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := SetUser(ctxt, pat.Param(ctxt, "user")); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(ID(ctxt)))
+	})
+
+	login := func(user string) (*http.Cookie, string) {
+		rr, _ := get(mux, "/login/"+user, nil, t)
+		cookie := getCookie(rr, t)
+		rr, _ = get(mux, "/", cookie, t)
+		return cookie, rr.Body.String()
+	}
+	valid := func(cookie *http.Cookie, id string) bool {
+		rr, _ := get(mux, "/", cookie, t)
+		return rr.Body.String() == id
+	}
+
+	alice, aliceID := login("alice")
+	bob, bobID := login("bob")
+
+	// per user
+	now = now.Add(time.Second)
+	if err := m.RevokeUser("alice", now); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if valid(alice, aliceID) || !valid(bob, bobID) {
+		t.Errorf("expected only alice's session to be revoked")
+	}
+	now = now.Add(time.Second)
+	if alice, aliceID = login("alice"); !valid(alice, aliceID) {
+		t.Errorf("expected sessions bound after the watermark to be valid")
+	}
+
+	// global
+	now = now.Add(time.Second)
+	if err := m.RevokeAll(now); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := m.LoadID(context.Background(), bobID); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if valid(alice, aliceID) || valid(bob, bobID) {
+		t.Errorf("expected all sessions to be revoked")
+	}
+
+	// watermarks are reserved, and do not expire
+	for _, key := range []string{watermarkKey, userWatermarkPrefix + "alice"} {
+		if !Reserved(key) {
+			t.Errorf("expected %s to be reserved", key)
+		}
+		if ttl, ok := st.ttls[key]; !ok || ttl != 0 {
+			t.Errorf("expected %s to be written without expiry, got: %v", key, ttl)
+		}
+	}
+
+	m, _ = NewManager(Config{
+		Secret: []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		Store:  kv.NewMemStore(),
+	})
+	if err := m.RevokeAll(now); err == nil {
+		t.Errorf("expected error when watermarks are not enabled")
+	}
+}
+
+// pingStore is a Pinger failing with err.
+type pingStore struct {
+	Store
+	err error
+}
+
+func (ps pingStore) Ping(ctxt context.Context) error {
+	return ps.err
+}
+
+func TestHealthz(t *testing.T) {
+	errPing := errors.New("ping")
+	for i, z := range []struct {
+		st   Store
+		code int
+	}{
+		{kv.NewMemStore(), http.StatusOK},
+		{pingStore{kv.NewMemStore(), nil}, http.StatusOK},
+		{pingStore{kv.NewMemStore(), errPing}, http.StatusServiceUnavailable},
+		{&localLockStore{Store: pingStore{kv.NewMemStore(), errPing}}, http.StatusServiceUnavailable},
+	} {
+		rr := httptest.NewRecorder()
+		Healthz(z.st).ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+		if rr.Code != z.code {
+			t.Errorf("test %d expected %d, got: %d", i, z.code, rr.Code)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	for i, z := range []struct {
+		bindIP, bindUA bool
+		retain         bool
+		ip, ua         string
+		exp            string
+	}{
+		{true, false, false, "10.0.0.1", "other", "foo false"},
+		{true, false, false, "10.0.0.2", "test", "<nil> false"},
+		{false, true, false, "10.0.0.2", "test", "foo false"},
+		{false, true, false, "10.0.0.1", "other", "<nil> false"},
+		{true, true, true, "10.0.0.2", "test", "foo true"},
+	} {
+		var mismatched Metadata
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store:         kv.NewMemStore(),
+			Name:          cookieName,
+			BindIP:        z.bindIP,
+			BindUserAgent: z.bindUA,
+			RemoteIPFn:    ProxyIP("X-Forwarded-For"),
+		}
+		if z.retain {
+			conf.OnBindMismatch = func(req *http.Request, md Metadata) bool {
+				mismatched = md
+				return true
+			}
+		}
+
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+		})
+		mux.HandleFuncC(pat.Get("/get"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			v, _ := Get(ctxt, "name")
+			fmt.Fprintf(res, "%v %t", v, BindMismatch(ctxt))
+		})
+
+		do := func(path, ip, ua string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", path, nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", "1.2.3.4, "+ip)
+			req.Header.Set("User-Agent", ua)
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			return rr
+		}
+
+		r0 := do("/set", "10.0.0.1", "test", nil)
+		check(200, r0, t)
+		if s := do("/get", z.ip, z.ua, getCookie(r0, t)).Body.String(); s != z.exp {
+			t.Errorf("test %d expected %q, got: %q", i, z.exp, s)
+		}
+		if z.retain && mismatched.IP != "10.0.0.1" {
+			t.Errorf("test %d expected mismatched ip 10.0.0.1, got: %q", i, mismatched.IP)
+		}
+	}
+}
+
+func TestUserSessionLimit(t *testing.T) {
+	for i, z := range []struct {
+		policy LimitPolicy
+		exp    []int
+		errs   int
+	}{
+		{LimitEvictOldest, []int{1, 2, 3}, 0},
+		{LimitEvictIdle, []int{0, 2, 3}, 0},
+		{LimitRefuse, []int{0, 1, 2}, 1},
+	} {
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store:           kv.NewMemStore(),
+			Name:            cookieName,
+			MaxUserSessions: 3,
+			LimitPolicy:     z.policy,
+		}
+
+		errs := 0
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			if err := SetUser(ctxt, "alice"); err == ErrSessionLimit {
+				errs++
+				return
+			}
+			res.Write([]byte(ID(ctxt)))
+		})
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {})
+		mux.HandleFuncC(pat.Get("/sessions"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			infos, _ := Sessions(ctxt, "alice")
+			for _, info := range infos {
+				res.Write([]byte(info.ID + " "))
+			}
+		})
+
+		var ids []string
+		var cookie *http.Cookie
+		for j := 0; j < 4; j++ {
+			rr, _ := get(mux, "/login", nil, t)
+			ids = append(ids, rr.Body.String())
+			if j == 0 {
+				cookie = getCookie(rr, t)
+			}
+			time.Sleep(time.Millisecond)
+
+			// keep the first session active
+			if j == 1 {
+				getCookies(mux, "/", cookie)
+			}
+		}
+
+		var exp string
+		for _, j := range z.exp {
+			exp += ids[j] + " "
+		}
+		if s := getCookies(mux, "/sessions", cookie).Body.String(); s != exp {
+			t.Errorf("test %d expected %q, got: %q", i, exp, s)
+		}
+		if errs != z.errs {
+			t.Errorf("test %d expected %d errors, got: %d", i, z.errs, errs)
+		}
+	}
+}
+
+func TestChunkedCookie(t *testing.T) {
+	big := strings.Repeat("a", DefaultCookieChunkSize*2+10)
+	for i, z := range []struct {
+		value   string
+		sent    []string
+		set     []string
+		expired []string
+		err     error
+	}{
+		{"small", nil, []string{"c"}, nil, nil},
+		{big, []string{"c"}, []string{"c.0", "c.1", "c.2"}, []string{"c"}, nil},
+		{"small", []string{"c.0", "c.1", "c.2"}, []string{"c"}, []string{"c.0", "c.1", "c.2"}, nil},
+		{big[:DefaultCookieChunkSize+1], []string{"c.0", "c.1", "c.2"}, []string{"c.0", "c.1"}, []string{"c.2"}, nil},
+		{big + big, nil, nil, nil, ErrCookieTooLarge},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		for _, name := range z.sent {
+			req.AddCookie(&http.Cookie{Name: name, Value: "x"})
+		}
+
+		rr := httptest.NewRecorder()
+		err := SetChunkedCookie(rr, req, &http.Cookie{Name: "c", Value: z.value}, 4)
+		if err != z.err {
+			t.Errorf("test %d expected error %v, got: %v", i, z.err, err)
+		}
+
+		var set, expired []string
+		req, _ = http.NewRequest("GET", "/", nil)
+		for _, c := range readSetCookies(rr) {
+			if c.MaxAge < 0 {
+				expired = append(expired, c.Name)
+				continue
+			}
+			set = append(set, c.Name)
+			req.AddCookie(c)
+		}
+		if !reflect.DeepEqual(set, z.set) || !reflect.DeepEqual(expired, z.expired) {
+			t.Errorf("test %d expected set %v expired %v, got: %v %v", i, z.set, z.expired, set, expired)
+		}
+
+		if err != nil {
+			continue
+		}
+		if v, err := ReadChunkedCookie(req, "c", 4); err != nil || v != z.value {
+			t.Errorf("test %d expected value to be reassembled, got: %d %v", i, len(v), err)
+		}
+		if _, err := ReadChunkedCookie(req, "c", len(z.set)-1); len(z.set) > 1 && err != http.ErrNoCookie {
+			t.Errorf("test %d expected http.ErrNoCookie, got: %v", i, err)
+		}
+	}
+}
+
+func TestSignOnly(t *testing.T) {
+	secret := []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7")
+	for i, z := range []struct {
+		maxLength int
+		code      int
+	}{
+		{0, 200},
+		{20, 500},
+	} {
+		conf := &Config{
+			Secret:     secret,
+			Serializer: securecookie.JSONEncoder{},
+			MaxLength:  z.maxLength,
+
+			Store:             kv.NewMemStore(),
+			Name:              cookieName,
+			SaveUninitialized: true,
+		}
+
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte(ID(ctxt)))
+		})
+
+		rr, _ := get(mux, "/", nil, t)
+		check(z.code, rr, t)
+		if z.code != 200 {
+			continue
+		}
+
+		// signed JSON is readable without the secret
+		c := getCookie(rr, t)
+		buf, err := base64.URLEncoding.DecodeString(c.Value)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		parts := strings.SplitN(string(buf), "|", 3)
+		if len(parts) != 3 {
+			t.Fatalf("test %d expected 3 parts, got: %d", i, len(parts))
+		}
+		if buf, err = base64.URLEncoding.DecodeString(parts[1]); err != nil || !strings.Contains(string(buf), rr.Body.String()) {
+			t.Errorf("test %d expected cookie to contain the plain id, got: %s %v", i, buf, err)
+		}
+
+		// and verifiable with it
+		v := make(map[string]string)
+		sc := securecookie.New(secret, nil)
+		sc.SetSerializer(securecookie.JSONEncoder{})
+		if err = sc.Decode(cookieName, c.Value, &v); err != nil || v["id"] != rr.Body.String() {
+			t.Errorf("test %d expected id %s, got: %v %v", i, rr.Body.String(), v, err)
+		}
+	}
+}
+
+// plainSealer is a Sealer encoding values as unsealed base64 JSON.
+type plainSealer struct{}
+
+func (plainSealer) Encode(name string, value interface{}) (string, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+func (plainSealer) Decode(name, value string, dst interface{}) error {
+	buf, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, dst)
+}
+
+func TestSealer(t *testing.T) {
+	conf := &Config{
+		Sealer: plainSealer{},
+
+		Store:             kv.NewMemStore(),
+		Name:              cookieName,
+		SaveUninitialized: true,
+	}
+
+	h := conf.Handler(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(ID(ctxt)))
+	}))
+	mux := goji.NewMux()
+	mux.HandleC(pat.Get("/"), h)
+
+	rr, _ := get(mux, "/", nil, t)
+	check(200, rr, t)
+	id := rr.Body.String()
+
+	// cookie is encoded with the sealer
+	c := getCookie(rr, t)
+	v := make(map[string]string)
+	if err := (plainSealer{}).Decode(cookieName, c.Value, &v); err != nil || v["id"] != id {
+		t.Fatalf("expected id %s, got: %v %v", id, v, err)
+	}
+
+	// and decoded with it
+	rr, _ = get(mux, "/", c, t)
+	check(200, rr, t)
+	if rr.Body.String() != id {
+		t.Errorf("expected id %s, got: %s", id, rr.Body.String())
+	}
+
+	if err := Rotate(h, []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"), nil); err == nil {
+		t.Errorf("expected Rotate error with a custom sealer")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7")
+	for i, z := range []struct {
+		conf Config
+		ok   bool
+	}{
+		{Config{Secret: secret, Store: kv.NewMemStore()}, true},
+		{Config{Secret: secret, BlockSecret: secret, Store: kv.NewMemStore()}, true},
+		{Config{Store: kv.NewMemStore()}, false},
+		{Config{Secret: secret}, false},
+		{Config{Secret: secret, BlockSecret: []byte("short"), Store: kv.NewMemStore()}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), LockTimeout: -1}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), MaxUserSessions: -1}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), MaxAge: -time.Second}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), MaxAge: time.Hour, MaxAgeSeconds: 3600}, false},
+		{Config{Sealer: plainSealer{}, Store: kv.NewMemStore()}, true},
+		{Config{Sealer: plainSealer{}, Store: kv.NewMemStore(), MirrorKeys: []string{"name"}}, false},
+		{Config{Sealer: plainSealer{}, Store: kv.NewMemStore(), MirrorKeys: []string{"name"}, MirrorSecret: secret}, true},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: CookiePrefixHost, Path: "/"}, true},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: CookiePrefixHost, Path: "/app"}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: CookiePrefixHost, Domain: "example.com"}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: CookiePrefixSecure, Path: "/app", Domain: "example.com"}, true},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: "__Other-"}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), CookiePrefix: CookiePrefixHost, DomainFn: MatchDomain("example.com")}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), Domain: ".Example.com"}, true},
+		{Config{Secret: secret, Store: kv.NewMemStore(), Domain: "example.com:8080"}, false},
+		{Config{Secret: secret, Store: kv.NewMemStore(), Domain: "http://example.com"}, false},
+	} {
+		mw, err := NewMiddleware(z.conf)
+		if z.ok != (err == nil) || z.ok != (mw != nil) {
+			t.Errorf("test %d expected ok %t, got: %v", i, z.ok, err)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ms := kv.NewMemStore()
+	common := Options(
+		WithSecret([]byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"), []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp")),
+		WithCookieName(cookieName),
+		WithPath("/app"),
+	)
+
+	if _, err := New(common); err == nil {
+		t.Fatalf("expected error when store is not provided")
+	}
+
+	mw, err := New(common, WithStore(ms), WithHttpOnly(true), WithSaveUninitialized(true))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(mw)
+	mux.HandleFuncC(pat.Get("/"), func(context.Context, http.ResponseWriter, *http.Request) {})
+
+	rr, _ := get(mux, "/", nil, t)
+	check(200, rr, t)
+	c := readSetCookies(rr)[0]
+	if c.Path != "/app" || !c.HttpOnly {
+		t.Errorf("expected path /app and http only, got: %s %t", c.Path, c.HttpOnly)
+	}
+	if len(ms.Data) != 1 {
+		t.Errorf("expected session to be saved")
+	}
+}
+
+func TestBulk(t *testing.T) {
+	ms := kv.NewMemStore()
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ms,
+		Name:  cookieName,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/setall"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetAll(ctxt, map[string]interface{}{"a": "1", "b": "2", metaKey: "ignored"})
+	})
+	mux.HandleFuncC(pat.Get("/clear"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Clear(ctxt)
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		vals := Values(ctxt)
+		vals["c"] = "3"
+		if _, ok := Get(ctxt, "c"); ok {
+			t.Errorf("expected Values to return a copy")
+		}
+		delete(vals, "c")
+		fmt.Fprintf(res, "%v %v %t %t", vals, Keys(ctxt), Has(ctxt, "a"), Has(ctxt, metaKey))
+	})
+
+	r0, _ := get(mux, "/setall", nil, t)
+	cookie := getCookie(r0, t)
+	if s := getCookies(mux, "/", cookie).Body.String(); s != "map[a:1 b:2] [a b] true false" {
+		t.Errorf("expected map[a:1 b:2] [a b] true false, got: %s", s)
+	}
+
+	getCookies(mux, "/clear", cookie)
+	if s := getCookies(mux, "/", cookie).Body.String(); s != "map[] [] false false" {
+		t.Errorf("expected map[] [] false false, got: %s", s)
+	}
+	for _, v := range ms.Data {
+		if _, ok := v.(map[string]interface{})[metaKey].(map[string]interface{}); !ok {
+			t.Errorf("expected metadata to be retained")
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	cs := &countStore{MemStore: kv.NewMemStore()}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:    cs,
+		Name:     cookieName,
+		ReadOnly: ReadOnlySafe,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/touch"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Touch(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	})
+	mux.HandleFuncC(pat.Get("/"), func(context.Context, http.ResponseWriter, *http.Request) {})
+
+	// new sessions are issued a cookie and saved
+	r0, _ := get(mux, "/touch", nil, t)
+	check(200, r0, t)
+	cookie := getCookie(r0, t)
+	if cs.writes != 1 {
+		t.Errorf("expected 1 write, got: %d", cs.writes)
+	}
+
+	// unmodified read only requests are not
+	r1 := getCookies(mux, "/", cookie)
+	if len(r1.HeaderMap["Set-Cookie"]) != 0 || cs.writes != 1 {
+		t.Errorf("expected no cookie and 1 write, got: %v %d", r1.HeaderMap["Set-Cookie"], cs.writes)
+	}
+
+	// touched sessions are
+	r2 := getCookies(mux, "/touch", cookie)
+	if len(r2.HeaderMap["Set-Cookie"]) != 1 || cs.writes != 2 {
+		t.Errorf("expected cookie and 2 writes, got: %v %d", r2.HeaderMap["Set-Cookie"], cs.writes)
+	}
+	if getCookie(r2, t).Value == cookie.Value {
+		t.Errorf("expected refreshed cookie value")
+	}
+}
+
+func TestIsNew(t *testing.T) {
+	ms, mux := newMux()
+	mux.HandleFuncC(pat.Get("/isnew"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%t", IsNew(ctxt))
+	})
+
+	r0, _ := get(mux, "/isnew", nil, t)
+	check(200, r0, t)
+	if r0.Body.String() != "true" {
+		t.Errorf("expected new session")
+	}
+
+	cookie := getCookie(r0, t)
+	if r1 := getCookies(mux, "/isnew", cookie); r1.Body.String() != "false" {
+		t.Errorf("expected existing session")
+	}
+
+	// missing from store
+	ms.Data = make(map[string]interface{})
+	if r2 := getCookies(mux, "/isnew", cookie); r2.Body.String() != "true" {
+		t.Errorf("expected new session")
+	}
+}
+
+func TestFromName(t *testing.T) {
+	userStore, adminStore := kv.NewMemStore(), kv.NewMemStore()
+	newConf := func(st Store, name string) *Config {
+		return &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store: st,
+			Name:  name,
+		}
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(newConf(userStore, "user").Handler)
+	mux.UseC(newConf(adminStore, "admin").Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if CookieName(ctxt) != "admin" {
+			t.Errorf("expected innermost session to be admin, got: %s", CookieName(ctxt))
+		}
+		Set(ctxt, "role", "admin")
+		Set(FromName(ctxt, "user"), "role", "user")
+
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic for missing session")
+			}
+		}()
+		FromName(ctxt, "missing")
+	})
+
+	rr, _ := get(mux, "/", nil, t)
+	check(200, rr, t)
+	if n := len(rr.HeaderMap["Set-Cookie"]); n != 2 {
+		t.Errorf("expected 2 cookies, got: %d", n)
+	}
+	for _, z := range []struct {
+		ms   *kv.MemStore
+		role string
+	}{
+		{userStore, "user"},
+		{adminStore, "admin"},
+	} {
+		if len(z.ms.Data) != 1 {
+			t.Fatalf("expected 1 %s session, got: %d", z.role, len(z.ms.Data))
+		}
+		for _, v := range z.ms.Data {
+			if r := v.(map[string]interface{})["role"]; r != z.role {
+				t.Errorf("expected role %s, got: %v", z.role, r)
+			}
+		}
+	}
+}
+
+// gcStore counts garbage collection runs.
+type gcStore struct {
+	*kv.MemStore
+	sync.Mutex
+	runs int
+}
+
+func (gs *gcStore) DeleteExpiredBefore(time.Time) (int, error) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.runs++
+	return 2, nil
+}
+
+func TestGC(t *testing.T) {
+	gs := &gcStore{MemStore: kv.NewMemStore()}
+
+	leader := false
+	gc := GCConfig{
+		Interval: time.Hour,
+		Leader:   func() bool { return leader },
+	}.Start(gs)
+	defer gc.Stop()
+
+	gc.Run()
+	leader = true
+	gc.Run()
+	gc.Run()
+
+	stats := gc.Stats()
+	if gs.runs != 2 || stats.Runs != 2 || stats.Skipped != 1 || stats.Deleted != 4 || stats.LastRun.IsZero() {
+		t.Errorf("expected 2 runs, 1 skipped, and 4 deleted, got: %d %+v", gs.runs, stats)
+	}
+
+	// scheduled
+	gc2 := StartGC(gs, 10*time.Millisecond)
+	time.Sleep(55 * time.Millisecond)
+	gc2.Stop()
+	gc2.Stop()
+	if n := gc2.Stats().Runs; n < 2 {
+		t.Errorf("expected at least 2 scheduled runs, got: %d", n)
+	}
+}
+
+// closeStore records being closed.
+type closeStore struct {
+	*kv.MemStore
+	closed bool
+}
+
+func (cs *closeStore) Close() error {
+	cs.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	cs := &closeStore{MemStore: kv.NewMemStore()}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:   cs,
+		Name:    cookieName,
+		Locking: true,
+	}
+
+	started, release := make(chan bool), make(chan bool)
+	var h goji.Handler
+	mux := goji.NewMux()
+	mux.UseC(func(next goji.Handler) goji.Handler {
+		h = conf.Handler(next)
+		return h
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})
+
+	if err := Shutdown(h, context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		get(mux, "/", nil, t)
+		close(done)
+	}()
+	<-started
+
+	// times out while the request is pending
+	ctxt, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(h, ctxt); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// waits for the request to complete
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if err := Shutdown(h, context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	<-done
+
+	if err := Shutdown(mux, context.Background()); err == nil {
+		t.Errorf("expected error for non session middleware handler")
+	}
+
+	// wrapped stores are closed
+	if err := CloseStore(h.(*sessMiddleware).st); err != nil || !cs.closed {
+		t.Errorf("expected store to be closed, got: %v", err)
+	}
+}
+
+// batchStore records batched writes.
+type batchStore struct {
+	*kv.MemStore
+	sync.Mutex
+	entered chan bool
+	block   chan bool
+	batches []int
+}
+
+func (bs *batchStore) WriteBatch(objs map[string]interface{}) error {
+	bs.entered <- true
+	<-bs.block
+	bs.Lock()
+	defer bs.Unlock()
+	for k, v := range objs {
+		bs.MemStore.Write(k, v)
+	}
+	bs.batches = append(bs.batches, len(objs))
+	return nil
+}
+
+func (bs *batchStore) Write(key string, obj interface{}) error {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.MemStore.Write(key, obj)
+}
+
+func TestAsyncSave(t *testing.T) {
+	bs := &batchStore{MemStore: kv.NewMemStore(), entered: make(chan bool), block: make(chan bool)}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:          bs,
+		Name:           cookieName,
+		AsyncSave:      true,
+		AsyncQueueSize: 4,
+	}
+
+	var h goji.Handler
+	mux := goji.NewMux()
+	mux.UseC(func(next goji.Handler) goji.Handler {
+		h = conf.Handler(next)
+		return h
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+
+	// first save blocks the worker, the next 4 fill the queue, and the
+	// remaining overflow and are saved synchronously
+	get(mux, "/", nil, t)
+	<-bs.entered
+	for i := 0; i < 6; i++ {
+		get(mux, "/", nil, t)
+	}
+	bs.Lock()
+	if n := len(bs.Data); n != 2 {
+		t.Errorf("expected 2 synchronous saves, got: %d", n)
+	}
+	bs.Unlock()
+
+	go func() {
+		bs.block <- true
+		<-bs.entered
+		bs.block <- true
+	}()
+	if err := Shutdown(h, context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+	if n := len(bs.Data); n != 7 {
+		t.Errorf("expected 7 saved sessions, got: %d", n)
+	}
+	if !reflect.DeepEqual(bs.batches, []int{1, 4}) {
+		t.Errorf("expected batches [1 4], got: %v", bs.batches)
+	}
+
+	conf.Locking = true
+	if conf.Validate() == nil {
+		t.Errorf("expected AsyncSave with Locking to be invalid")
+	}
+
+	// writes with a max age are not batched
+	ts := &batchTTLStore{
+		batchStore: &batchStore{MemStore: kv.NewMemStore(), entered: make(chan bool), block: make(chan bool)},
+		ttls:       make(map[string]time.Duration),
+	}
+	conf = &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:     ts,
+		Name:      cookieName,
+		MaxAge:    time.Hour,
+		AsyncSave: true,
+	}
+	h = conf.Handler(goji.HandlerFunc(func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	}))
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTPC(context.Background(), rr, q)
+	if err := Shutdown(h, context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	if len(ts.batches) != 0 || len(ts.ttls) != 1 {
+		t.Errorf("expected 1 write with ttl, got: %v %v", ts.batches, ts.ttls)
+	}
+	for k, ttl := range ts.ttls {
+		if ttl != time.Hour {
+			t.Errorf("expected %s written with 1h ttl, got: %v", k, ttl)
+		}
+	}
+}
+
+// batchTTLStore is a batchStore recording the ttls of writes.
+type batchTTLStore struct {
+	*batchStore
+	ttls map[string]time.Duration
+}
+
+func (ts *batchTTLStore) TTL(key string) (time.Duration, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.ttls[key], nil
+}
+
+func (ts *batchTTLStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	ts.Lock()
+	ts.ttls[key] = ttl
+	ts.Unlock()
+	return ts.batchStore.Write(key, obj)
+}
+
+// refreshStore counts refreshing reads.
+type refreshStore struct {
+	*kv.MemStore
+	refreshes int
+}
+
+func (rs *refreshStore) ReadRefresh(key string) (interface{}, error) {
+	rs.refreshes++
+	return rs.MemStore.Read(key)
+}
+
+func TestRefreshStore(t *testing.T) {
+	rs := &refreshStore{MemStore: kv.NewMemStore()}
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: rs,
+		Name:  cookieName,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+
+	r0, _ := get(mux, "/", nil, t)
+	getCookies(mux, "/", getCookie(r0, t))
+	if rs.refreshes != 1 {
+		t.Errorf("expected 1 refreshing read, got: %d", rs.refreshes)
+	}
+}
+
+func TestDecodeCache(t *testing.T) {
+	now := time.Now()
+	c := newDecodeCache(2, time.Hour, ClockFunc(func() time.Time { return now }))
+	c.add("a", "1", time.Time{})
+	c.add("b", "2", time.Time{})
+	if id, ok := c.get("a"); !ok || id != "1" {
+		t.Errorf("expected a to be cached as 1, got: %s", id)
+	}
+
+	// b is least recently used
+	c.add("c", "3", time.Time{})
+	if _, ok := c.get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Errorf("a should be cached")
+	}
+
+	// cookie expiration caps the ttl
+	c.add("d", "4", now.Add(-time.Second))
+	if _, ok := c.get("d"); ok {
+		t.Errorf("d should have expired with its cookie")
+	}
+
+	c.purge()
+	if _, ok := c.get("a"); ok {
+		t.Errorf("a should have been purged")
+	}
+
+	// simulated time
+	c.add("a", "1", time.Time{})
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.get("a"); ok {
+		t.Errorf("a should have expired")
+	}
+}
+
+func TestDecodeCacheRotate(t *testing.T) {
+	conf := &Config{
+		Secret:            []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret:       []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:             kv.NewMemStore(),
+		Name:              cookieName,
+		SaveUninitialized: true,
+		DecodeCacheSize:   16,
+	}
+
+	var h goji.Handler
+	mux := goji.NewMux()
+	mux.UseC(func(next goji.Handler) goji.Handler {
+		h = conf.Handler(next)
+		return h
+	})
+	mux.HandleFuncC(pat.Get("/id"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, ID(ctxt), http.StatusOK)
+	})
+
+	r0, _ := get(mux, "/id", nil, t)
+	cookie := getCookie(r0, t)
+	id := strings.TrimSpace(r0.Body.String())
+
+	// decoded and cached
+	for i := 0; i < 2; i++ {
+		r1, _ := get(mux, "/id", cookie, t)
+		if s := strings.TrimSpace(r1.Body.String()); s != id {
+			t.Fatalf("expected %s, got: %s", id, s)
+		}
+	}
+	if n := h.(*sessMiddleware).cache.ll.Len(); n != 1 {
+		t.Fatalf("expected 1 cached cookie, got: %d", n)
+	}
+
+	if err := Rotate(h, []byte("rotated hash secret"), []byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// old cookie no longer accepted
+	r2, _ := get(mux, "/id", cookie, t)
+	if s := strings.TrimSpace(r2.Body.String()); s == id {
+		t.Errorf("expected new session id after rotate, got: %s", s)
+	}
+
+	if err := Rotate(mux, []byte("a"), []byte("b")); err == nil {
+		t.Errorf("expected error rotating non session middleware")
+	}
+}
+
+func benchmarkSessionID(size int, b *testing.B) {
+	h := (&Config{
+		Secret:          []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret:     []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+		Store:           kv.NewMemStore(),
+		DecodeCacheSize: size,
+	}).Handler(nil).(*sessMiddleware)
+
+	v, err := h.encodeCookie("id")
+	if err != nil {
+		b.Fatalf("expected no error, got: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: v})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok, _ := h.sessionID(req); !ok {
+			b.Fatalf("expected valid session id")
+		}
+	}
+}
+
+func BenchmarkSessionID(b *testing.B) {
+	benchmarkSessionID(0, b)
+}
+
+func BenchmarkSessionIDCached(b *testing.B) {
+	benchmarkSessionID(1024, b)
+}
+
+// discardWriter is a http.ResponseWriter discarding the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func benchmarkHandler(cacheSize int, serializer securecookie.Serializer, b *testing.B) {
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:           kv.NewMemStore(),
+		Name:            cookieName,
+		DecodeCacheSize: cacheSize,
+		Serializer:      serializer,
+	}
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if v, _ := Get(ctxt, "name"); v == nil {
+			Set(ctxt, "name", "foo")
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	mux.ServeHTTP(rr, req)
+	c := rr.Result().Cookies()
+	if len(c) != 1 {
+		b.Fatalf("expected cookie")
+	}
+	req.AddCookie(c[0])
+
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mux.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	benchmarkHandler(0, nil, b)
+}
+
+func BenchmarkHandlerCached(b *testing.B) {
+	benchmarkHandler(1024, nil, b)
+}
+
+func BenchmarkHandlerJSON(b *testing.B) {
+	benchmarkHandler(0, JSONSerializer{}, b)
+}
+
+func benchmarkEncodePayload(c Codec, b *testing.B) {
+	obj := map[string]interface{}{
+		"name": strings.Repeat("foo", 100),
+		metaKey: map[string]interface{}{
+			metaCreatedKey: int64(1234567890123456789),
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodePayload(c, obj); err != nil {
+			b.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func BenchmarkEncodePayloadGob(b *testing.B) {
+	benchmarkEncodePayload(CodecGob, b)
+}
+
+func BenchmarkEncodePayloadJSON(b *testing.B) {
+	benchmarkEncodePayload(CodecJSON, b)
+}
+
+func TestMachine(t *testing.T) {
+	m := &Machine{
+		Name:    "checkout",
+		Initial: "cart",
+		Transitions: map[string][]string{
+			"cart":   {"paying"},
+			"paying": {"paid", "cart"},
+			"paid":   nil,
+		},
+		Guards: map[string]GuardFn{
+			"paid": func(ctxt context.Context, from, to string) error {
+				if v, _ := Get(ctxt, "payment"); v == nil {
+					return errors.New("no payment")
+				}
+				return nil
+			},
+		},
+	}
+
+	ctxt := context.WithValue(context.Background(), sessionContextKey, &namedSession{
+		sess: &session{data: make(map[string]interface{})},
+	})
+
+	if s := m.State(ctxt); s != "cart" {
+		t.Fatalf("expected cart, got: %s", s)
+	}
+	if !m.Changed(ctxt).IsZero() {
+		t.Errorf("expected zero changed time")
+	}
+	if err := m.Transition(ctxt, "paying"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if m.Changed(ctxt).IsZero() {
+		t.Errorf("expected non-zero changed time")
+	}
+
+	// double submission
+	err := m.Transition(ctxt, "paying")
+	if te, ok := err.(*TransitionError); !ok || te.From != "paying" || te.To != "paying" {
+		t.Errorf("expected *TransitionError, got: %v", err)
+	}
+
+	// guard
+	if err = m.Transition(ctxt, "paid"); err == nil || err.Error() != "no payment" {
+		t.Errorf("expected guard error, got: %v", err)
+	}
+	Set(ctxt, "payment", "txn")
+	if err = m.Transition(ctxt, "paid"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if m.Can(ctxt, "cart") {
+		t.Errorf("paid should be final")
+	}
+
+	m.Reset(ctxt)
+	if s := m.State(ctxt); s != "cart" {
+		t.Errorf("expected cart after reset, got: %s", s)
+	}
+}
+
+func TestMachineConcurrent(t *testing.T) {
+	m := &Machine{
+		Name:    "checkout",
+		Initial: "cart",
+		Transitions: map[string][]string{
+			"cart": {"paying"},
+		},
+	}
+
+	newMux := func(locking bool) *goji.Mux {
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+			Store:       kv.NewMemStore(),
+			Name:        cookieName,
+			Locking:     locking,
+			LockTimeout: time.Second,
+		}
+
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "cart", true)
+		})
+		mux.HandleFuncC(pat.Get("/pay"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			if err := m.Transition(ctxt, "paying"); err != nil {
+				http.Error(res, err.Error(), http.StatusConflict)
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		})
+		return mux
+	}
+
+	// transitions require locking
+	mux := newMux(false)
+	r0, _ := get(mux, "/", nil, t)
+	cookie := getCookie(r0, t)
+	r1, _ := get(mux, "/pay", cookie, t)
+	check(http.StatusConflict, r1, t)
+	if !strings.Contains(r1.Body.String(), ErrMachineUnlocked.Error()) {
+		t.Errorf("expected %v, got: %q", ErrMachineUnlocked, r1.Body.String())
+	}
+
+	// concurrent requests with the same session
+	mux = newMux(true)
+	r0, _ = get(mux, "/", nil, t)
+	cookie = getCookie(r0, t)
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rr, _ := get(mux, "/pay", cookie, t)
+			codes <- rr.Code
+		}()
+	}
+	var ok, conflict int
+	for i := 0; i < 2; i++ {
+		switch <-codes {
+		case http.StatusOK:
+			ok++
+		case http.StatusConflict:
+			conflict++
+		}
+	}
+	if ok != 1 || conflict != 1 {
+		t.Errorf("expected one transition to succeed, got: %d ok, %d conflict", ok, conflict)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	ms := kv.NewMemStore()
+
+	var expired []string
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store:             ms,
+		Name:              cookieName,
+		SaveUninitialized: true,
+		MaxLifetime:       time.Hour,
+		OnExpire: func(ctxt context.Context, id string) {
+			expired = append(expired, id)
+		},
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/id"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, ID(ctxt), http.StatusOK)
+	})
+
+	r0, _ := get(mux, "/id", nil, t)
+	cookie := getCookie(r0, t)
+	id := strings.TrimSpace(r0.Body.String())
+
+	r1, _ := get(mux, "/id", cookie, t)
+	if s := strings.TrimSpace(r1.Body.String()); s != id {
+		t.Fatalf("expected %s, got: %s", id, s)
+	}
+
+	// age the session
+	meta := ms.Data[id].(map[string]interface{})[metaKey].(map[string]interface{})
+	meta[metaCreatedKey] = time.Now().Add(-2 * time.Hour).UnixNano()
+
+	r2, _ := get(mux, "/id", cookie, t)
+	if s := strings.TrimSpace(r2.Body.String()); s == id {
+		t.Errorf("expected new session id for expired session")
+	}
+	if len(expired) != 1 || expired[0] != id {
+		t.Errorf("expected OnExpire for %s, got: %v", id, expired)
+	}
+	if _, ok := ms.Data[id]; ok {
+		t.Errorf("expired session should be erased from store")
+	}
+	if getCookie(r2, t).Value == cookie.Value {
+		t.Errorf("expected new cookie for expired session")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	ms := &ttlStore{Store: kv.NewMemStore(), ttls: make(map[string]time.Duration)}
+	aw, as := AuditWriter(&buf), AuditStore(ms, "app:", time.Hour)
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: kv.NewMemStore(),
+		Name:  cookieName,
+		Audit: AuditFunc(func(ev AuditEvent) {
+			aw.Audit(ev)
+			as.Audit(ev)
+		}),
+	}
+
+	var id string
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		id = ID(ctxt)
+		Set(ctxt, "name", "foo")
+		Delete(ctxt, "name")
+		Destroy(ctxt, res)
+	})
+
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("GET", "/", nil)
+	q.Header.Set(DefaultRequestIDHeader, "req-1")
+	mux.ServeHTTP(rr, q)
+
+	var events []AuditEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		events = append(events, ev)
+	}
+
+	ops := []string{AuditSet, AuditDelete, AuditDestroy}
+	if len(events) != len(ops) {
+		t.Fatalf("expected %d events, got: %v", len(ops), events)
+	}
+	for i, ev := range events {
+		if ev.Op != ops[i] || ev.RequestID != "req-1" || ev.SessionID == "" || ev.Time.IsZero() {
+			t.Errorf("event %d unexpected: %+v", i, ev)
+		}
+	}
+	if events[0].Key != "name" {
+		t.Errorf("expected key name, got: %s", events[0].Key)
+	}
+
+	// session ids are hashed
+	for i, ev := range events {
+		if ev.SessionID != hashID(id) {
+			t.Errorf("event %d expected hashed session id, got: %s", i, ev.SessionID)
+		}
+	}
+
+	// stored records are reserved and expire
+	data := ms.Store.(*kv.MemStore).Data
+	if len(data) != len(ops) {
+		t.Errorf("expected %d records, got: %d", len(ops), len(data))
+	}
+	for key, v := range data {
+		rec, _ := v.(map[string]interface{})
+		switch {
+		case !strings.HasPrefix(key, auditPrefix+"app:"+hashID(id)+":") || !Reserved(key):
+			t.Errorf("expected reserved audit key, got: %s", key)
+		case ms.ttls[key] != time.Hour:
+			t.Errorf("expected %s to expire after 1h, got: %v", key, ms.ttls[key])
+		case rec["session_id"] != hashID(id):
+			t.Errorf("expected hashed session id, got: %v", rec["session_id"])
+		}
+	}
+
+	// lifecycle events
+	buf.Reset()
+	mux = goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/set"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", "foo")
+	})
+	mux.HandleFuncC(pat.Get("/user"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		SetUser(ctxt, "alice")
+	})
+	cookie := getCookie(getCookies(mux, "/set"), t)
+	get(mux, "/user", cookie, t)
+	get(mux, "/set", cookie, t)
+
+	events = nil
+	dec = json.NewDecoder(&buf)
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if ev.Op == AuditCreate || ev.Op == AuditSave {
+			events = append(events, ev)
+		}
+	}
+	if len(events) != 3 || events[0].Op != AuditCreate || events[1].Op != AuditSave || events[2].User != "alice" {
+		t.Errorf("expected create and save events, got: %+v", events)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	ms, mux := newMux()
+	mux.UseC(CSRF{}.Handler)
+	mux.HandleFuncC(pat.Get("/csrf"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, CSRFToken(ctxt), http.StatusOK)
+	})
+	mux.HandleFuncC(pat.Post("/post"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "ok", http.StatusOK)
+	})
+	mux.HandleFuncC(pat.Post("/rotate"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, RotateCSRFToken(ctxt), http.StatusOK)
+	})
+	mux.HandleFuncC(pat.Post("/regenerate"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Regenerate(ctxt); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	r0, _ := get(mux, "/csrf", nil, t)
+	cookie := getCookie(r0, t)
+	tok := strings.TrimSpace(r0.Body.String())
+
+	r1, _ := get(mux, "/csrf", cookie, t)
+	if s := strings.TrimSpace(r1.Body.String()); s != tok {
+		t.Fatalf("expected token to be stable, got: %s", s)
+	}
+
+	post := func(path, header, form string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		q, _ := http.NewRequest("POST", path, strings.NewReader(form))
+		q.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			q.Header.Set(DefaultCSRFHeader, header)
+		}
+		q.AddCookie(cookie)
+		mux.ServeHTTP(rr, q)
+		return rr
+	}
+
+	check(403, post("/post", "", ""), t)
+	check(403, post("/post", "bad", ""), t)
+	check(200, post("/post", tok, ""), t)
+	check(200, post("/post", "", DefaultCSRFField+"="+tok), t)
+
+	r2 := post("/rotate", tok, "")
+	check(200, r2, t)
+	check(403, post("/post", tok, ""), t)
+	tok = strings.TrimSpace(r2.Body.String())
+	check(200, post("/post", tok, ""), t)
+
+	// regenerate discards the token
+	r3 := post("/regenerate", tok, "")
+	check(200, r3, t)
+	cookie = getCookie(r3, t)
+	check(403, post("/post", tok, ""), t)
+	r4, _ := get(mux, "/csrf", cookie, t)
+	if s := strings.TrimSpace(r4.Body.String()); s == "" || s == tok {
+		t.Errorf("expected new token after regenerate, got: %s", s)
+	}
+
+	// failed checks do not generate tokens
+	tokens := func() int {
+		var n int
+		for _, v := range ms.Data {
+			sess, _ := v.(map[string]interface{})
+			if m, ok := sess[metaKey].(map[string]interface{}); ok && m[metaCSRFKey] != nil {
+				n++
+			}
+		}
+		return n
+	}
+	n := tokens()
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("POST", "/post", nil)
+	q.Header.Set(DefaultCSRFHeader, "bad")
+	mux.ServeHTTP(rr, q)
+	check(403, rr, t)
+	if m := tokens(); m != n {
+		t.Errorf("expected %d sessions with tokens, got: %d", n, m)
+	}
+}
+
+func TestSaveUninitialized(t *testing.T) {
+	ms := kv.NewMemStore()
+	conf := &Config{
+		Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+		BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+		Store: ms,
+		Name:  cookieName,
+	}
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/set/:name"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Set(ctxt, "name", pat.Param(ctxt, "name"))
+		http.Error(res, "saved", http.StatusOK)
+	})
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "hello", http.StatusOK)
+	})
+
+	r0, _ := get(mux, "/", nil, t)
+	check(200, r0, t)
+	if n := len(r0.HeaderMap["Set-Cookie"]); n != 0 {
+		t.Errorf("expected no cookie for unmodified session, got: %d", n)
+	}
+	if len(ms.Data) != 0 {
+		t.Errorf("expected no store write for unmodified session")
+	}
+
+	r1, _ := get(mux, "/set/foo", nil, t)
+	check(200, r1, t)
+	cookie := getCookie(r1, t)
+	if len(ms.Data) != 1 {
+		t.Fatalf("expected store write for modified session")
+	}
+
+	// existing sessions are saved
+	r2, _ := get(mux, "/", cookie, t)
+	check(200, r2, t)
+	if n := len(r2.HeaderMap["Set-Cookie"]); n != 0 {
+		t.Errorf("expected no cookie for existing session, got: %d", n)
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	ms, mux := newMux()
+	mux.HandleFuncC(pat.Get("/login"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		if err := Regenerate(ctxt); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		Set(ctxt, "user", "alice")
+		http.Error(res, ID(ctxt), http.StatusOK)
+	})
+	mux.HandleFuncC(pat.Get("/logout"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		Regenerate(ctxt)
+		Destroy(ctxt)
+	})
+
+	r0, _ := get(mux, "/set/foo", nil, t)
+	cookie := getCookie(r0, t)
+	r1, _ := get(mux, "/id", cookie, t)
+	oldID := strings.TrimSpace(r1.Body.String())
+
+	r2, _ := get(mux, "/login", cookie, t)
+	check(200, r2, t)
+	newID := strings.TrimSpace(r2.Body.String())
+	if newID == oldID {
+		t.Fatalf("expected new session id")
+	}
+	if n := len(r2.HeaderMap["Set-Cookie"]); n != 1 {
+		t.Fatalf("expected exactly 1 Set-Cookie, got: %d", n)
+	}
+	if _, ok := ms.Data[oldID]; ok {
+		t.Errorf("expected old session to be erased")
+	}
+	sess, ok := ms.Data[newID].(map[string]interface{})
+	if !ok || sess["name"] != "foo" || sess["user"] != "alice" {
+		t.Errorf("expected session values to be kept, got: %v", sess)
+	}
+
+	cookie = getCookie(r2, t)
+	r3, _ := get(mux, "/id", cookie, t)
+	if s := strings.TrimSpace(r3.Body.String()); s != newID {
+		t.Errorf("expected %s, got: %s", newID, s)
+	}
+
+	r4, _ := get(mux, "/logout", cookie, t)
+	if n := len(r4.HeaderMap["Set-Cookie"]); n != 1 {
+		t.Fatalf("expected exactly 1 Set-Cookie, got: %d", n)
+	}
+	if c := getCookie(r4, t); c.Value != "-" {
+		t.Errorf("expected expired cookie, got: %s", c.Value)
+	}
+}
+
+// failStore fails all writes.
+type failStore struct {
+	*kv.MemStore
+}
+
+func (failStore) Write(string, interface{}) error {
+	return errors.New("write failed")
+}
+
+func TestBufferResponse(t *testing.T) {
+	for _, z := range []struct {
+		st   Store
+		code int
+		body string
+	}{
+		{kv.NewMemStore(), http.StatusCreated, "created"},
+		{failStore{kv.NewMemStore()}, http.StatusInternalServerError, "internal server error"},
+	} {
+		conf := &Config{
+			Secret:      []byte("LymWKG0UvJFCiXLHdeYJTR1xaAcRvrf7"),
+			BlockSecret: []byte("NxyECgzxiYdMhMbsBrUcAAbyBuqKDrpp"),
+
+			Store:          z.st,
+			Name:           cookieName,
+			BufferResponse: true,
+		}
+
+		mux := goji.NewMux()
+		mux.UseC(conf.Handler)
+		mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+			Set(ctxt, "name", "foo")
+			res.Header().Set("X-Test", "yes")
+			res.WriteHeader(http.StatusCreated)
+			res.Write([]byte("created"))
+		})
+
+		rr, _ := get(mux, "/", nil, t)
+		check(z.code, rr, t)
+		if s := strings.TrimSpace(rr.Body.String()); s != z.body {
+			t.Errorf("expected body %q, got: %q", z.body, s)
+		}
+
+		ok := z.code == http.StatusCreated
+		if (rr.HeaderMap.Get("X-Test") == "yes") != ok {
+			t.Errorf("expected X-Test header only on success")
+		}
+		if (len(rr.HeaderMap["Set-Cookie"]) == 1) != ok {
+			t.Errorf("expected cookie only on success")
+		}
+	}
+}
+
+func readSetCookies(rr *httptest.ResponseRecorder) []*http.Cookie {
+	res := http.Response{Header: rr.HeaderMap}
+	return res.Cookies()
+}
+
+func get(mux *goji.Mux, path string, cookie *http.Cookie, t *testing.T) (*httptest.ResponseRecorder, string) {
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("GET", path, nil)
+	if cookie != nil {
+		q.AddCookie(cookie)
+	}
+	mux.ServeHTTP(rr, q)
+
+	l := ""
+
+	switch {
+	case rr.Code >= 300 && rr.Code < 400:
+		if len(rr.HeaderMap["Location"]) != 1 {
+			t.Errorf("code %d redirect had 0 or more than 1 location header (count: %d)", rr.Code, len(rr.HeaderMap["Location"]))
+		} else {
+			l = rr.HeaderMap["Location"][0]
+			if len(l) < 1 {
+				t.Error("redirect location should not be empty string")
+			}
+		}
+	}
+
+	return rr, l
+}
+
+func getCookie(rr *httptest.ResponseRecorder, t *testing.T) *http.Cookie {
+	cookieStr := rexp.FindString(rr.HeaderMap["Set-Cookie"][0])
+	cookie := &http.Cookie{
+		Name:  cookieName,
+		Value: cookieStr[strings.Index(cookieStr, "=")+1:],
+	}
+
+	// sanity check
+	if len(cookie.Value) < 1 {
+		t.Errorf("cookie should not be empty")
+	}
+
+	return cookie
+}
+
+func check(code int, rr *httptest.ResponseRecorder, t *testing.T) {
+	if code != rr.Code {
+		t.Logf("GOT: %d -- %s", rr.Code, rr.Body.String())
+		t.Errorf("expected %d, got: %d", code, rr.Code)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	obj := map[string]interface{}{
+		"name": "foo",
+		metaKey: map[string]interface{}{
+			metaCreatedKey: int64(1234567890123456789),
+		},
+	}
+
+	for _, c := range []Codec{CodecGob, CodecJSON} {
+		buf, err := EncodePayload(c, obj)
+		if err != nil {
+			t.Fatalf("codec %d expected no error, got: %v", c, err)
+		}
+		if string(buf[:3]) != "SMW" || buf[3] != PayloadVersion || Codec(buf[4]) != c {
+			t.Errorf("codec %d invalid header: %v", c, buf[:5])
+		}
+
+		v, err := DecodePayload(buf)
+		if err != nil {
+			t.Fatalf("codec %d expected no error, got: %v", c, err)
+		}
+		sess := &session{data: v.(map[string]interface{})}
+		if sess.data["name"] != "foo" {
+			t.Errorf("codec %d expected name=foo, got: %v", c, sess.data["name"])
+		}
+		if n := sess.created(time.Now()).UnixNano(); n != 1234567890123456789 {
+			t.Errorf("codec %d expected created to round trip, got: %d", c, n)
+		}
+	}
+
+	// legacy gob payloads without a header
+	var buf bytes.Buffer
+	var v interface{} = obj
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := DecodePayload(buf.Bytes()); err != nil || v.(map[string]interface{})["name"] != "foo" {
+		t.Errorf("expected legacy payload to decode, got: %v (%v)", v, err)
+	}
+
+	if _, err := DecodePayload([]byte("SMW\x01\x09{}")); err != ErrUnknownCodec {
+		t.Errorf("expected ErrUnknownCodec, got: %v", err)
 	}
 }
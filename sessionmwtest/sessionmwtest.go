@@ -0,0 +1,204 @@
+// Package sessionmwtest provides utilities for testing handlers using the
+// sessionmw session middleware, without the whole middleware stack.
+package sessionmwtest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knq/sessionmw"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Secret is the cookie secret of the test configuration.
+	Secret = []byte("sessionmwtest-secret-0123456789a")
+
+	// BlockSecret is the cookie encryption secret of the test configuration.
+	BlockSecret = []byte("sessionmwtest-block-0123456789ab")
+)
+
+// Config returns a session middleware configuration for tests, using st and
+// the test secrets.
+func Config(st sessionmw.Store) sessionmw.Config {
+	return sessionmw.Config{
+		Secret:      Secret,
+		BlockSecret: BlockSecret,
+		Store:       st,
+	}
+}
+
+// Save is a session save recorded by a Store.
+type Save struct {
+	// ID is the session id.
+	ID string
+
+	// Data is a copy of the saved session data.
+	Data map[string]interface{}
+}
+
+// Store is an in memory sessionmw.Store recording the saved sessions, so
+// that tests can check what a handler saved.
+type Store struct {
+	mu    sync.Mutex
+	data  map[string]interface{}
+	saves []Save
+}
+
+// NewStore creates a recording store.
+func NewStore() *Store {
+	return &Store{data: make(map[string]interface{})}
+}
+
+// Read satisfies the sessionmw.Store interface.
+func (s *Store) Read(key string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.data[key]
+	if !ok {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+	return obj, nil
+}
+
+// Write satisfies the sessionmw.Store interface.
+func (s *Store) Write(key string, obj interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = obj
+	if m, ok := obj.(map[string]interface{}); ok {
+		data := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			data[k] = v
+		}
+		s.saves = append(s.saves, Save{ID: key, Data: data})
+	}
+	return nil
+}
+
+// Erase satisfies the sessionmw.Store interface.
+func (s *Store) Erase(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
+
+// Saves returns the recorded saves, in order.
+func (s *Store) Saves() []Save {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Save(nil), s.saves...)
+}
+
+// Session returns the session data stored for id.
+func (s *Store) Session(id string) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.data[id].(map[string]interface{})
+	return m, ok
+}
+
+// Reset clears the recorded saves.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saves = nil
+}
+
+// NewContext returns a context with an existing session holding values, for
+// calling handlers directly. The session is stored in a new Store (see
+// sessionmw.GetStore).
+//
+// NewContext panics when the session cannot be created.
+func NewContext(values map[string]interface{}) context.Context {
+	conf := Config(NewStore())
+	conf.SaveUninitialized = true
+	m, err := sessionmw.NewManager(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	ctxt, err := newSession(m, values)
+	if err != nil {
+		panic(err)
+	}
+	ctxt, err = m.LoadID(context.Background(), sessionmw.ID(ctxt))
+	if err != nil {
+		panic(err)
+	}
+	return ctxt
+}
+
+// NewCookie creates a session holding values, returning its session cookie,
+// for adding to httptest requests served by the session middleware created
+// with conf.
+func NewCookie(conf sessionmw.Config, values map[string]interface{}) (*http.Cookie, error) {
+	conf.SaveUninitialized = true
+	m, err := sessionmw.NewManager(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxt, err := newSession(m, values)
+	if err != nil {
+		return nil, err
+	}
+	return m.Cookie(ctxt)
+}
+
+// newSession creates and saves a session holding values.
+func newSession(m *sessionmw.Manager, values map[string]interface{}) (context.Context, error) {
+	ctxt, err := m.NewSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		sessionmw.Set(ctxt, k, v)
+	}
+	if err = m.Save(ctxt); err != nil {
+		return nil, err
+	}
+	return ctxt, nil
+}
+
+// Clock is a sessionmw.Clock for tests, reporting a time that only changes
+// when set or advanced, so that tests can simulate the passing of time (see
+// sessionmw.Config.Clock).
+type Clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewClock creates a clock reporting t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{t: t}
+}
+
+// Now satisfies the sessionmw.Clock interface.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set sets the reported time to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// Advance advances the reported time by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
@@ -0,0 +1,108 @@
+package sessionmwtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knq/sessionmw"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+func TestNewContext(t *testing.T) {
+	ctxt := NewContext(map[string]interface{}{"name": "foo"})
+	if v, ok := sessionmw.Get(ctxt, "name"); !ok || v != "foo" {
+		t.Errorf("expected foo, got: %v", v)
+	}
+	if sessionmw.ID(ctxt) == "" {
+		t.Errorf("expected session id")
+	}
+
+	if ctxt = NewContext(nil); len(sessionmw.Keys(ctxt)) != 0 {
+		t.Errorf("expected no values, got: %v", sessionmw.Keys(ctxt))
+	}
+}
+
+func TestNewCookie(t *testing.T) {
+	st := NewStore()
+	conf := Config(st)
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		v, _ := sessionmw.Get(ctxt, "name")
+		sessionmw.Set(ctxt, "count", 1)
+		fmt.Fprintf(res, "%v", v)
+	})
+
+	cookie, err := NewCookie(conf, map[string]interface{}{"name": "foo"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	st.Reset()
+
+	rr := httptest.NewRecorder()
+	q, _ := http.NewRequest("GET", "/", nil)
+	q.AddCookie(cookie)
+	mux.ServeHTTP(rr, q)
+	if s := rr.Body.String(); s != "foo" {
+		t.Errorf("expected foo, got: %s", s)
+	}
+
+	saves := st.Saves()
+	if len(saves) != 1 || saves[0].Data["count"] != 1 || saves[0].Data["name"] != "foo" {
+		t.Fatalf("expected 1 save, got: %v", saves)
+	}
+	if m, ok := st.Session(saves[0].ID); !ok || m["count"] != 1 {
+		t.Errorf("expected stored session, got: %v", m)
+	}
+
+	if _, err = NewCookie(sessionmw.Config{}, nil); err == nil {
+		t.Errorf("expected error for invalid config")
+	}
+}
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	clock := NewClock(now)
+
+	conf := Config(NewStore())
+	conf.Clock, conf.MaxLifetime = clock, time.Hour
+
+	mux := goji.NewMux()
+	mux.UseC(conf.Handler)
+	mux.HandleFuncC(pat.Get("/"), func(ctxt context.Context, res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d", sessionmw.Meta(ctxt).Created.Unix())
+	})
+
+	cookie, err := NewCookie(conf, map[string]interface{}{"name": "foo"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	serve := func() string {
+		rr := httptest.NewRecorder()
+		q, _ := http.NewRequest("GET", "/", nil)
+		q.AddCookie(cookie)
+		mux.ServeHTTP(rr, q)
+		return rr.Body.String()
+	}
+
+	if s := serve(); s != "1500000000" {
+		t.Errorf("expected 1500000000, got: %s", s)
+	}
+
+	// the session expires once past its maximum lifetime
+	clock.Advance(2 * time.Hour)
+	if s := serve(); s != "1500007200" {
+		t.Errorf("expected new session created at 1500007200, got: %s", s)
+	}
+
+	clock.Set(now)
+	if n := clock.Now(); !n.Equal(now) {
+		t.Errorf("expected %v, got: %v", now, n)
+	}
+}
@@ -0,0 +1,239 @@
+// Package shardstore provides a sharded sessionmw.Store, distributing
+// sessions across multiple backing stores (ie, several Redis instances
+// without cluster mode) by a consistent hash of the session id.
+//
+// Sessions are assigned to shards using rendezvous hashing, keyed by each
+// shard's position in the list of stores, so the stores must always be
+// provided in the same order. Appending a store moves approximately 1/n of
+// the sessions (for n shards after appending) to the new store, and leaves
+// the assignment of all other sessions unchanged. Removing or reordering
+// stores reassigns most sessions, and should be avoided: mark a failing
+// shard unhealthy instead (see Probe).
+//
+// Moved sessions are not found on their new shard, logging out their users,
+// unless they are copied before the new shard list is deployed. To rebalance
+// after appending a store, copy each existing shard to a store sharded over
+// the new list (see migrate.Copy), which writes each session to its new
+// shard:
+//
+//	next := shardstore.New(a, b, c)
+//	for _, st := range []sessionmw.Store{a, b} {
+//		migrate.Copy(st, next, migrate.Options{Rate: 1000})
+//	}
+//
+// The copies remaining on the old shards expire normally.
+package shardstore
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// probeKey is the key written when probing a shard.
+const probeKey = "__sessionmw_probe__"
+
+// ErrShardUnhealthy is the error wrapped (as a sessionmw.ErrStoreUnavailable
+// store error) by operations on a shard that failed its last probe.
+var ErrShardUnhealthy = errors.New("shard unhealthy")
+
+// ProbeFn is a store health check func.
+type ProbeFn func(sessionmw.Store) error
+
+// DefaultProbe checks a store's health by writing, reading, and erasing a
+// probe key.
+func DefaultProbe(st sessionmw.Store) error {
+	if err := st.Write(probeKey, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if _, err := st.Read(probeKey); err != nil {
+		return err
+	}
+	return st.Erase(probeKey)
+}
+
+// ShardStore is a sharded session store.
+//
+// Operations on a shard that failed its last probe fail immediately with a
+// sessionmw.ErrStoreUnavailable store error, rather than being sent to
+// another shard, as sessions written elsewhere would not be found once the
+// shard recovers.
+type ShardStore struct {
+	stores []sessionmw.Store
+
+	mu        sync.RWMutex
+	unhealthy []bool
+
+	// OnStateChange is called when the shard at index i fails a probe
+	// (healthy is false), or recovers (healthy is true).
+	OnStateChange func(i int, healthy bool)
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a sharded store distributing sessions across stores.
+func New(stores ...sessionmw.Store) *ShardStore {
+	if len(stores) == 0 {
+		panic("shardstore: no stores")
+	}
+
+	return &ShardStore{
+		stores:    stores,
+		unhealthy: make([]bool, len(stores)),
+		done:      make(chan struct{}),
+	}
+}
+
+// Shard returns the index of the shard storing the session with the provided
+// id.
+func (ss *ShardStore) Shard(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	var n int
+	var max uint64
+	for i := range ss.stores {
+		if w := mix(sum ^ uint64(i+1)*0x9e3779b97f4a7c15); i == 0 || w > max {
+			n, max = i, w
+		}
+	}
+	return n
+}
+
+// mix is the 64 bit finalizer of MurmurHash3, spreading the bits of the
+// weights of similar keys.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// store returns the store for key, or an error if its shard is unhealthy.
+func (ss *ShardStore) store(key string) (sessionmw.Store, error) {
+	i := ss.Shard(key)
+	if !ss.Healthy(i) {
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, ErrShardUnhealthy)
+	}
+	return ss.stores[i], nil
+}
+
+// Write saves the session for the provided id to its shard.
+func (ss *ShardStore) Write(key string, obj interface{}) error {
+	st, err := ss.store(key)
+	if err != nil {
+		return err
+	}
+	return st.Write(key, obj)
+}
+
+// Read retrieves the session for the provided id from its shard.
+func (ss *ShardStore) Read(key string) (interface{}, error) {
+	st, err := ss.store(key)
+	if err != nil {
+		return nil, err
+	}
+	return st.Read(key)
+}
+
+// Erase permanently destroys the session with the provided id on its shard.
+func (ss *ShardStore) Erase(key string) error {
+	st, err := ss.store(key)
+	if err != nil {
+		return err
+	}
+	return st.Erase(key)
+}
+
+// Healthy determines if the shard at index i passed its last probe. Shards
+// are healthy until probed.
+func (ss *ShardStore) Healthy(i int) bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return !ss.unhealthy[i]
+}
+
+// setHealthy sets the health of the shard at index i, calling OnStateChange
+// when changed.
+func (ss *ShardStore) setHealthy(i int, healthy bool) {
+	ss.mu.Lock()
+	changed := ss.unhealthy[i] == healthy
+	ss.unhealthy[i] = !healthy
+	ss.mu.Unlock()
+
+	if changed && ss.OnStateChange != nil {
+		ss.OnStateChange(i, healthy)
+	}
+}
+
+// Probe checks the health of each shard using probe (or DefaultProbe if
+// nil), returning the first error encountered.
+func (ss *ShardStore) Probe(probe ProbeFn) error {
+	if probe == nil {
+		probe = DefaultProbe
+	}
+
+	var err error
+	for i, st := range ss.stores {
+		e := probe(st)
+		ss.setHealthy(i, e == nil)
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// StartProbe starts a goroutine probing the shards every interval until the
+// store is closed.
+func (ss *ShardStore) StartProbe(interval time.Duration, probe ProbeFn) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				ss.Probe(probe)
+			case <-ss.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops probing, and closes the stores, returning the first error
+// encountered. Subsequent calls to Close have no effect.
+func (ss *ShardStore) Close() error {
+	var err error
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		for _, st := range ss.stores {
+			if e := sessionmw.CloseStore(st); err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Ping checks the health of each shard, returning the first error
+// encountered, as the sessions of an unhealthy shard cannot be served.
+// Satisfies the sessionmw.Pinger interface.
+func (ss *ShardStore) Ping(ctxt context.Context) error {
+	for _, st := range ss.stores {
+		if err := sessionmw.PingStore(ctxt, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
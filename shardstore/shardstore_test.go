@@ -0,0 +1,150 @@
+package shardstore
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+)
+
+// flakyStore fails all operations when down.
+type flakyStore struct {
+	*kv.MemStore
+	down   bool
+	closed bool
+}
+
+var errDown = errors.New("down")
+
+func (fs *flakyStore) Write(key string, obj interface{}) error {
+	if fs.down {
+		return errDown
+	}
+	return fs.MemStore.Write(key, obj)
+}
+
+func (fs *flakyStore) Ping(ctxt context.Context) error {
+	if fs.down {
+		return errDown
+	}
+	return nil
+}
+
+func (fs *flakyStore) Close() error {
+	fs.closed = true
+	return nil
+}
+
+func newStores(n int) []sessionmw.Store {
+	stores := make([]sessionmw.Store, n)
+	for i := range stores {
+		stores[i] = &flakyStore{MemStore: kv.NewMemStore()}
+	}
+	return stores
+}
+
+func TestShardStore(t *testing.T) {
+	stores := newStores(4)
+	ss := New(stores...)
+
+	for i := 0; i < 4000; i++ {
+		if err := ss.Write(strconv.Itoa(i), i); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	for i, st := range stores {
+		if n := len(st.(*flakyStore).Data); n < 800 || n > 1200 {
+			t.Errorf("expected shard %d to have ~1000 sessions, got: %d", i, n)
+		}
+	}
+
+	if v, err := ss.Read("42"); err != nil || v != 42 {
+		t.Errorf("expected 42, got: %v (%v)", v, err)
+	}
+	if _, ok := stores[ss.Shard("42")].(*flakyStore).Data["42"]; !ok {
+		t.Errorf("expected session on shard %d", ss.Shard("42"))
+	}
+	if err := ss.Erase("42"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := ss.Read("42"); err == nil {
+		t.Errorf("expected error reading erased session")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	stores := newStores(5)
+	prev, next := New(stores[:4]...), New(stores...)
+
+	var moved int
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		a, b := prev.Shard(key), next.Shard(key)
+		switch {
+		case a != b && b != 4:
+			t.Fatalf("expected %s to move only to the new shard, moved from %d to %d", key, a, b)
+		case a != b:
+			moved++
+		}
+	}
+	if moved < 800 || moved > 1200 {
+		t.Errorf("expected ~1000 moved sessions, got: %d", moved)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	stores := newStores(2)
+	ss := New(stores...)
+
+	var changes []bool
+	ss.OnStateChange = func(i int, healthy bool) {
+		if i != 1 {
+			t.Errorf("expected state change for shard 1, got: %d", i)
+		}
+		changes = append(changes, healthy)
+	}
+
+	var key string
+	for i := 0; ss.Shard(key) != 1; i++ {
+		key = strconv.Itoa(i)
+	}
+
+	stores[1].(*flakyStore).down = true
+	if err := ss.Ping(context.Background()); err != errDown {
+		t.Errorf("expected errDown, got: %v", err)
+	}
+	if err := ss.Probe(nil); err != errDown {
+		t.Errorf("expected errDown, got: %v", err)
+	}
+	if ss.Healthy(1) || !ss.Healthy(0) {
+		t.Errorf("expected only shard 1 to be unhealthy")
+	}
+	if _, err := ss.Read(key); !errors.Is(err, sessionmw.ErrStoreUnavailable) || !errors.Is(err, ErrShardUnhealthy) {
+		t.Errorf("expected ErrShardUnhealthy, got: %v", err)
+	}
+
+	stores[1].(*flakyStore).down = false
+	if err := ss.Probe(nil); err != nil || !ss.Healthy(1) {
+		t.Errorf("expected shard 1 to recover, got: %v", err)
+	}
+	if err := ss.Write(key, "foo"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	if len(changes) != 2 || changes[0] || !changes[1] {
+		t.Errorf("expected state changes [false true], got: %v", changes)
+	}
+
+	if err := ss.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i, st := range stores {
+		if !st.(*flakyStore).closed {
+			t.Errorf("expected shard %d to be closed", i)
+		}
+	}
+}
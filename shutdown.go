@@ -0,0 +1,71 @@
+package sessionmw
+
+import (
+	"errors"
+	"sync"
+
+	"goji.io"
+	"golang.org/x/net/context"
+)
+
+// pending tracks the number of pending session saves.
+type pending struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+// add adds a pending save.
+func (p *pending) add() {
+	p.mu.Lock()
+	p.n++
+	p.mu.Unlock()
+}
+
+// done marks a pending save as complete.
+func (p *pending) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.n--
+	if p.n == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// wait returns a channel that is closed when there are no pending saves.
+func (p *pending) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.n == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if p.idle == nil {
+		p.idle = make(chan struct{})
+	}
+	return p.idle
+}
+
+// Shutdown waits for the pending session saves of the session middleware h,
+// as previously returned by Config.Handler, to complete, or until ctxt is
+// done, returning the context's error.
+//
+// Shutdown should be called after the http.Server has stopped accepting
+// requests, and before closing the session store (see CloseStore).
+func Shutdown(h goji.Handler, ctxt context.Context) error {
+	s, ok := h.(*sessMiddleware)
+	if !ok {
+		return errors.New("sessionmw Shutdown requires a session middleware handler")
+	}
+
+	select {
+	case <-s.pending.wait():
+		return nil
+	case <-ctxt.Done():
+		return ctxt.Err()
+	}
+}
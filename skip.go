@@ -0,0 +1,45 @@
+package sessionmw
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SkipPrefix returns a func for use with Config.Skip that skips requests
+// whose URL path matches or is below any of the provided path prefixes (ie,
+// "/static" matches "/static" and "/static/app.js", but not "/staticfoo").
+func SkipPrefix(prefixes ...string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		for _, p := range prefixes {
+			p = strings.TrimSuffix(p, "/")
+			if req.URL.Path == p || strings.HasPrefix(req.URL.Path, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipPath returns a func for use with Config.Skip that skips requests whose
+// URL path exactly matches any of the provided paths (ie, "/healthz",
+// "/metrics").
+func SkipPath(paths ...string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		for _, p := range paths {
+			if req.URL.Path == p {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ReadOnlySafe is a func for use with Config.ReadOnly that treats requests
+// with the safe GET, HEAD, and OPTIONS methods as read only.
+func ReadOnlySafe(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
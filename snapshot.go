@@ -0,0 +1,122 @@
+package sessionmw
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+)
+
+// ErrInvalidSnapshot is the error returned when restoring a snapshot that
+// could not be decoded.
+var ErrInvalidSnapshot = errors.New("invalid session snapshot")
+
+// ErrSessionDestroyed is the error returned when restoring a snapshot into a
+// destroyed session.
+var ErrSessionDestroyed = errors.New("session destroyed")
+
+// Snapshot captures the state of the session in the context, including its
+// metadata and session structs, for restoring with Restore (ie, before a
+// risky operation in a retried request or a multi step workflow).
+//
+// Snapshots are encoded with CodecGob, so session values of custom types
+// must be registered with gob.Register.
+func Snapshot(ctxt context.Context) ([]byte, error) {
+	sess := fromContext(ctxt)
+	if err := sess.flushStructs(); err != nil {
+		return nil, err
+	}
+
+	sess.RLock()
+	defer sess.RUnlock()
+	return EncodePayload(CodecGob, sess.data)
+}
+
+// Restore rolls back the session in the context to the state captured by
+// Snapshot. The session is saved in full at the end of the request, and the
+// session structs retrieved with Struct are reset to their captured values.
+//
+// The session id is not restored, such that a snapshot taken before
+// Regenerate is restored under the new id. Likewise, the session metadata
+// (ie, the user bound with SetUser, the impersonator, the authentication
+// level and the CSRF token) is kept current, and only the session values and
+// structs are restored. Snapshots should nonetheless be kept server side, and
+// never restored from untrusted input. Restore returns ErrSessionDestroyed
+// after Destroy.
+func Restore(ctxt context.Context, buf []byte) error {
+	obj, err := DecodePayload(buf)
+	if err != nil {
+		return ErrInvalidSnapshot
+	}
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return ErrInvalidSnapshot
+	}
+
+	sess := fromContext(ctxt)
+	sess.Lock()
+	if sess.destroyed {
+		sess.Unlock()
+		return ErrSessionDestroyed
+	}
+	data[metaKey] = restoredMeta(sess.meta(), data[metaKey])
+
+	var set, del []string
+	for k := range sess.data {
+		if _, ok := data[k]; !ok {
+			sess.dirty(k)
+			if k != metaKey {
+				del = append(del, k)
+			}
+		}
+	}
+	for k, v := range data {
+		if reflect.DeepEqual(sess.data[k], v) {
+			continue
+		}
+		sess.dirty(k)
+		if k != metaKey {
+			set = append(set, k)
+		}
+	}
+	sess.data = data
+	sess.modified, sess.full = true, true
+
+	stored := sess.storedStructs()
+	for _, ss := range sess.structs {
+		v := reflect.New(reflect.TypeOf(ss.v).Elem())
+		if enc, ok := stored[ss.name].(string); ok {
+			json.Unmarshal([]byte(enc), v.Interface())
+		}
+		reflect.ValueOf(ss.v).Elem().Set(v.Elem())
+		enc, _ := json.Marshal(ss.v)
+		ss.enc = string(enc)
+	}
+	sess.Unlock()
+
+	for _, k := range del {
+		audit(ctxt, AuditDelete, k)
+	}
+	for _, k := range set {
+		audit(ctxt, AuditSet, k)
+	}
+	return nil
+}
+
+// restoredMeta returns a copy of the current session metadata m, with the
+// session structs of the snapshot metadata v.
+func restoredMeta(m map[string]interface{}, v interface{}) map[string]interface{} {
+	meta := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != metaStructsKey {
+			meta[k] = v
+		}
+	}
+	if snap, ok := v.(map[string]interface{}); ok {
+		if structs, ok := snap[metaStructsKey]; ok {
+			meta[metaStructsKey] = structs
+		}
+	}
+	return meta
+}
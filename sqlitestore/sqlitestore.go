@@ -0,0 +1,288 @@
+// Package sqlitestore provides a SQLite backed sessionmw.Store, suitable for
+// single node applications needing session persistence across restarts.
+package sqlitestore
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	// sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultPurgeInterval is the default interval between purges of expired
+	// sessions.
+	DefaultPurgeInterval = 10 * time.Minute
+)
+
+// the table schema
+const schema = `CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);`
+
+// the prepared statement queries
+const (
+	readQuery    = `SELECT data FROM sessions WHERE id = ? AND expires_at > ?`
+	writeQuery   = `INSERT OR REPLACE INTO sessions (id, data, expires_at) VALUES (?, ?, ?)`
+	eraseQuery   = `DELETE FROM sessions WHERE id = ?`
+	purgeQuery   = `DELETE FROM sessions WHERE expires_at <= ?`
+	keysQuery    = `SELECT id FROM sessions WHERE expires_at > ? AND ` + notReserved
+	expiresQuery = `SELECT expires_at FROM sessions WHERE id = ? AND expires_at > ?`
+	countQuery   = `SELECT COUNT(*) FROM sessions WHERE expires_at > ? AND ` + notReserved
+)
+
+// noExpiry is the expiration of sessions that do not expire.
+const noExpiry = math.MaxInt64
+
+// notReserved is the condition excluding the reserved keys (see
+// sessionmw.ReservedPrefix) from the listed and counted sessions.
+const notReserved = `id NOT LIKE '\_sessionmw\_%' ESCAPE '\'`
+
+// SQLiteStore is a SQLite backed session store.
+type SQLiteStore struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	read    *sql.Stmt
+	write   *sql.Stmt
+	erase   *sql.Stmt
+	purge   *sql.Stmt
+	keys    *sql.Stmt
+	expires *sql.Stmt
+	count   *sql.Stmt
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Codec is the codec used to encode stored sessions. Use
+	// sessionmw.CodecJSON when non-Go services need to read sessions.
+	Codec sessionmw.Codec
+
+	// Clock is the time source determining which sessions have expired.
+	Clock sessionmw.Clock
+}
+
+// New opens the SQLite database at path, creating the sessions table if it
+// does not exist, and starts a janitor that deletes expired sessions every
+// purgeInterval.
+//
+// Sessions expire ttl after they were last written, or never when ttl is 0 or
+// negative. If purgeInterval is 0, then DefaultPurgeInterval will be used.
+func New(path string, ttl, purgeInterval time.Duration) (*SQLiteStore, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	db, err := sql.Open("sqlite3", path+sep+"_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := open(db, ttl)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if purgeInterval == 0 {
+		purgeInterval = DefaultPurgeInterval
+	}
+	go st.janitor(purgeInterval)
+
+	return st, nil
+}
+
+// open configures db and prepares the statements.
+func open(db *sql.DB, ttl time.Duration) (*SQLiteStore, error) {
+	var err error
+
+	// enable write ahead logging
+	if _, err = db.Exec(`PRAGMA journal_mode=WAL`); err != nil {
+		return nil, err
+	}
+
+	// create schema
+	if _, err = db.Exec(schema); err != nil {
+		return nil, err
+	}
+
+	st := &SQLiteStore{
+		db:    db,
+		ttl:   ttl,
+		done:  make(chan struct{}),
+		Codec: sessionmw.CodecGob,
+		Clock: sessionmw.SystemClock,
+	}
+
+	// prepare statements
+	for _, z := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&st.read, readQuery},
+		{&st.write, writeQuery},
+		{&st.erase, eraseQuery},
+		{&st.purge, purgeQuery},
+		{&st.keys, keysQuery},
+		{&st.expires, expiresQuery},
+		{&st.count, countQuery},
+	} {
+		if *z.stmt, err = db.Prepare(z.query); err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// Write saves the session for the provided id.
+func (st *SQLiteStore) Write(key string, obj interface{}) error {
+	return st.WriteTTL(key, obj, st.ttl)
+}
+
+// WriteTTL saves the session for the provided id, expiring it after ttl, or
+// never when ttl is 0 or negative. Satisfies the sessionmw.TTLStore
+// interface.
+func (st *SQLiteStore) WriteTTL(key string, obj interface{}, ttl time.Duration) error {
+	buf, err := sessionmw.EncodePayload(st.Codec, obj)
+	if err != nil {
+		return err
+	}
+
+	expires := int64(noExpiry)
+	if ttl > 0 {
+		expires = st.Clock.Now().Add(ttl).Unix()
+	}
+	_, err = st.write.Exec(key, buf, expires)
+	return err
+}
+
+// TTL returns the remaining lifetime of the session with the provided id,
+// with a resolution of one second. Satisfies the sessionmw.TTLStore
+// interface.
+func (st *SQLiteStore) TTL(key string) (time.Duration, error) {
+	now := st.Clock.Now()
+
+	var expires int64
+	err := st.expires.QueryRow(key, now.Unix()).Scan(&expires)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, sessionmw.ErrSessionNotFound
+	case err != nil:
+		return 0, err
+	case expires == noExpiry:
+		return 0, nil
+	}
+
+	return time.Unix(expires, 0).Sub(now), nil
+}
+
+// Read retrieves the session for the provided id.
+func (st *SQLiteStore) Read(key string) (interface{}, error) {
+	var data []byte
+	err := st.read.QueryRow(key, st.Clock.Now().Unix()).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, sessionmw.ErrSessionNotFound
+	case err != nil:
+		return nil, sessionmw.NewStoreError(sessionmw.ErrStoreUnavailable, err)
+	}
+
+	obj, err := sessionmw.DecodePayload(data)
+	return obj, sessionmw.NewStoreError(sessionmw.ErrDecodeFailed, err)
+}
+
+// Erase permanently destroys the session with the provided id.
+func (st *SQLiteStore) Erase(key string) error {
+	_, err := st.erase.Exec(key)
+	return err
+}
+
+// Keys returns the ids of all unexpired sessions in the store. Satisfies the
+// sessionmw.KeysStore interface.
+func (st *SQLiteStore) Keys() ([]string, error) {
+	rows, err := st.keys.Query(st.Clock.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Count returns the number of unexpired sessions in the store. Satisfies the
+// sessionmw.CountableStore interface.
+func (st *SQLiteStore) Count() (int64, error) {
+	var n int64
+	err := st.count.QueryRow(st.Clock.Now().Unix()).Scan(&n)
+	return n, err
+}
+
+// Purge deletes all expired sessions.
+func (st *SQLiteStore) Purge() error {
+	_, err := st.DeleteExpiredBefore(st.Clock.Now())
+	return err
+}
+
+// DeleteExpiredBefore deletes all sessions expiring before t, returning the
+// number of deleted sessions. Satisfies the sessionmw.GCStore interface.
+func (st *SQLiteStore) DeleteExpiredBefore(t time.Time) (int, error) {
+	res, err := st.purge.Exec(t.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// janitor periodically purges expired sessions until the store is closed.
+func (st *SQLiteStore) janitor(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			st.Purge()
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// Close stops the janitor and closes the underlying database. Subsequent
+// calls to Close have no effect.
+func (st *SQLiteStore) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		close(st.done)
+		err = st.db.Close()
+	})
+	return err
+}
+
+// Ping checks the health of the database. Satisfies the sessionmw.Pinger
+// interface.
+func (st *SQLiteStore) Ping(ctxt context.Context) error {
+	return st.db.PingContext(ctxt)
+}
@@ -0,0 +1,189 @@
+package sqlitestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+func newStore(ttl time.Duration, t *testing.T) (*SQLiteStore, func()) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	st, err := New(filepath.Join(dir, "sessions.db"), ttl, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	return st, func() {
+		st.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore(t *testing.T) {
+	st, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if _, err := st.Read("missing"); err != sessionmw.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if err := st.Write("a", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	obj, err := st.Read("a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if m, ok := obj.(map[string]interface{}); !ok || m["name"] != "foo" {
+		t.Errorf("expected name=foo, got: %v", obj)
+	}
+
+	if err = st.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = st.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	st, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	// reserved keys are not sessions
+	for _, key := range []string{"b", "a", sessionmw.ReservedPrefix + "user:a"} {
+		if err := st.Write(key, map[string]interface{}{}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	keys, err := st.Keys()
+	sort.Strings(keys)
+	if err != nil || len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected keys [a b], got: %v (%v)", keys, err)
+	}
+
+	if n, err := st.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 sessions, got: %d (%v)", n, err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	st, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if _, err := st.TTL("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+	if err := st.WriteTTL("a", map[string]interface{}{}, time.Minute); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if ttl, err := st.TTL("a"); err != nil || ttl <= 58*time.Second || ttl > time.Minute {
+		t.Errorf("expected ttl of about 1m, got: %v (%v)", ttl, err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	st, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if err := st.Write("a", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// simulated time
+	later := time.Now().Add(2 * time.Hour)
+	st.Clock = sessionmw.ClockFunc(func() time.Time {
+		return later
+	})
+	if _, err := st.Read("a"); err != sessionmw.ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	if n, err := st.DeleteExpiredBefore(later); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted session, got: %d (%v)", n, err)
+	}
+	if err := st.Purge(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	var n int
+	if err := st.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected 0 rows after purge, got: %d (%v)", n, err)
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		st, cleanup := newStore(ttl, t)
+		defer cleanup()
+
+		if err := st.Write("a", map[string]interface{}{}); err != nil {
+			t.Fatalf("ttl %v expected no error, got: %v", ttl, err)
+		}
+		st.Clock = sessionmw.ClockFunc(func() time.Time {
+			return time.Now().Add(100 * 365 * 24 * time.Hour)
+		})
+		if _, err := st.Read("a"); err != nil {
+			t.Errorf("ttl %v expected no error, got: %v", ttl, err)
+		}
+		if d, err := st.TTL("a"); err != nil || d != 0 {
+			t.Errorf("ttl %v expected no ttl, got: %v (%v)", ttl, d, err)
+		}
+		if err := st.Purge(); err != nil {
+			t.Fatalf("ttl %v expected no error, got: %v", ttl, err)
+		}
+		if n, err := st.Count(); err != nil || n != 1 {
+			t.Errorf("ttl %v expected 1 session, got: %d (%v)", ttl, n, err)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := New("file:"+filepath.Join(dir, "sessions.db")+"?mode=rwc", time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = st.Write("a", map[string]interface{}{}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err = st.Close(); err != nil {
+		t.Errorf("expected no error on second close, got: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	st, cleanup := newStore(time.Hour, t)
+	defer cleanup()
+
+	if err := st.Ping(context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	st.Close()
+	if err := st.Ping(context.Background()); err == nil {
+		t.Errorf("expected error for closed store")
+	}
+}
@@ -1,5 +1,25 @@
 package sessionmw
 
+import (
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ReservedPrefix is the prefix of the store keys written by sessionmw that do
+// not hold sessions, such as the per user session indexes written by SetUser
+// and the audit records written by AuditStore. Stores do not list, count, or
+// destroy reserved keys as sessions (see KeysStore and CountableStore).
+const ReservedPrefix = "_sessionmw_"
+
+// Reserved determines if the store key (or session id) is reserved (see
+// ReservedPrefix).
+func Reserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
 // Store is the common interface for session storage.
 //
 // Please see github.com/knq/kv.Store for a compatible store.
@@ -16,3 +36,138 @@ type Store interface {
 	// Destroy permanently destroys the session with the provided id.
 	Erase(key string) error
 }
+
+// PatchStore is the interface for session stores that can persist only the
+// changed values of a session, instead of rewriting the entire session.
+//
+// Sessions are patched only when they were previously saved in full with
+// Write.
+type PatchStore interface {
+	Store
+
+	// Patch stores the set values and removes the deleted keys for the
+	// session with the provided id. Patch is called even when no values
+	// changed, so that stores may extend the session's expiration.
+	Patch(key string, set map[string]interface{}, del []string) error
+}
+
+// RefreshStore is the interface for session stores that can retrieve a
+// session and extend its expiration in a single operation (ie, a single
+// round trip). The middleware loads sessions with ReadRefresh, when
+// available, so that sessions remain active even when not saved (see
+// Config.ReadOnly).
+type RefreshStore interface {
+	Store
+
+	// ReadRefresh retrieves the session for the provided id, extending its
+	// expiration.
+	ReadRefresh(key string) (interface{}, error)
+}
+
+// TakeStore is the interface for session stores that can retrieve and erase
+// a session in a single atomic operation (ie, with Redis GETDEL), such that
+// concurrent callers cannot both retrieve the same session.
+type TakeStore interface {
+	Store
+
+	// Take retrieves and erases the session for the provided id.
+	Take(key string) (interface{}, error)
+}
+
+// KeysStore is the interface for session stores that can enumerate the ids
+// of the stored sessions.
+type KeysStore interface {
+	Store
+
+	// Keys returns the ids of all unexpired sessions in the store, excluding
+	// reserved keys (see Reserved).
+	Keys() ([]string, error)
+}
+
+// TTLStore is the interface for session stores that can report and set the
+// remaining lifetime of individual sessions, allowing sessions to be copied
+// between stores without extending their expiration.
+type TTLStore interface {
+	Store
+
+	// TTL returns the remaining lifetime of the session with the provided
+	// id, or 0 if the session does not expire.
+	TTL(key string) (time.Duration, error)
+
+	// WriteTTL saves the session for the provided id, expiring it after ttl.
+	WriteTTL(key string, obj interface{}, ttl time.Duration) error
+}
+
+// CountableStore is the interface for session stores that can count the
+// active sessions.
+//
+// Stores count all unexpired keys, excluding reserved keys (see Reserved).
+type CountableStore interface {
+	Store
+
+	// Count returns the number of active (unexpired) sessions.
+	Count() (int64, error)
+}
+
+// ActiveSessions returns the number of active sessions in st, using Count
+// when st is a CountableStore, or the number of ids returned by Keys when st
+// is a KeysStore. ErrNotCountable is returned for other stores.
+func ActiveSessions(st Store) (int64, error) {
+	switch x := baseStore(st).(type) {
+	case CountableStore:
+		return x.Count()
+	case KeysStore:
+		keys, err := x.Keys()
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(keys)), nil
+	}
+	return 0, ErrNotCountable
+}
+
+// baseStore returns the store wrapped by the local locking and versioning
+// stores, if any.
+func baseStore(st Store) Store {
+	for {
+		switch w := st.(type) {
+		case *localLockStore:
+			st = w.Store
+		case *versionedStore:
+			st = w.Store
+		default:
+			return st
+		}
+	}
+}
+
+// CloseStore closes st, if it is an io.Closer.
+//
+// Stores that hold resources, such as connection pools or background
+// goroutines, implement io.Closer, and stores wrapping other stores close the
+// wrapped stores.
+func CloseStore(st Store) error {
+	if c, ok := st.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Pinger is the interface for session stores that can check the health of
+// their backend (ie, with a Redis PING, or a database ping), for readiness
+// probes (see Healthz).
+type Pinger interface {
+	// Ping checks the health of the store.
+	Ping(ctxt context.Context) error
+}
+
+// PingStore checks the health of st, if it is a Pinger. Stores without a
+// backend to check (ie, kv.MemStore) are always healthy.
+//
+// Stores wrapping other stores ping the wrapped stores.
+func PingStore(ctxt context.Context, st Store) error {
+	if p, ok := st.(Pinger); ok {
+		return p.Ping(ctxt)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sessionmw
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// metaStructsKey is the session metadata key holding the JSON encoded
+// session structs.
+const metaStructsKey = "structs"
+
+var (
+	// structsMu protects structs.
+	structsMu sync.RWMutex
+
+	// structs are the names of the registered session struct types.
+	structs = make(map[reflect.Type]string)
+)
+
+// sessionStruct is a session struct retrieved with Struct.
+type sessionStruct struct {
+	name string
+	v    interface{}
+
+	// enc is the last saved encoding of v.
+	enc string
+}
+
+// Register registers the type of v, a pointer to a struct, as a session
+// struct type (see Struct), named by the struct's package path and name.
+//
+// Register should be called in an init func, before handling requests.
+// Register panics if v is not a pointer to a named struct.
+func Register(v interface{}) {
+	typ := reflect.TypeOf(v)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct || typ.Elem().Name() == "" {
+		panic(fmt.Sprintf("sessionmw: cannot register %T as a session struct", v))
+	}
+
+	structsMu.Lock()
+	defer structsMu.Unlock()
+	structs[typ] = typ.Elem().PkgPath() + "." + typ.Elem().Name()
+}
+
+// Struct retrieves the session struct with the type of v, a pointer to a
+// struct type previously registered with Register, from the context. A zero
+// value of the struct is returned when the session does not have one.
+//
+// The returned pointer is the same for the lifetime of the request, and the
+// struct's fields are persisted (as JSON) when the session is saved, ie:
+//
+//	us := sessionmw.Struct(ctxt, (*UserSession)(nil)).(*UserSession)
+//	us.Name = "foo"
+//
+// Struct panics if the type of v was not registered.
+func Struct(ctxt context.Context, v interface{}) interface{} {
+	typ := reflect.TypeOf(v)
+	structsMu.RLock()
+	name, ok := structs[typ]
+	structsMu.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("sessionmw: session struct %T was not registered", v))
+	}
+
+	sess := fromContext(ctxt)
+	sess.Lock()
+	defer sess.Unlock()
+
+	if ss, ok := sess.structs[typ]; ok {
+		return ss.v
+	}
+
+	ss := &sessionStruct{name: name, v: reflect.New(typ.Elem()).Interface()}
+	if buf, ok := sess.storedStructs()[name].(string); ok {
+		// undecodable structs are replaced with a zero value
+		json.Unmarshal([]byte(buf), ss.v)
+	}
+
+	// unchanged zero values are not saved (encoding errors are returned
+	// when saving)
+	buf, _ := json.Marshal(ss.v)
+	ss.enc = string(buf)
+
+	if sess.structs == nil {
+		sess.structs = make(map[reflect.Type]*sessionStruct)
+	}
+	sess.structs[typ] = ss
+	return ss.v
+}
+
+// storedStructs returns the JSON encoded session structs stored with the
+// session. The session must be locked.
+func (sess *session) storedStructs() map[string]interface{} {
+	m, _ := sess.meta()[metaStructsKey].(map[string]interface{})
+	return m
+}
+
+// flushStructs encodes the session structs retrieved with Struct, recording
+// the session as modified when any struct was changed.
+func (sess *session) flushStructs() error {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if len(sess.structs) == 0 || sess.destroyed {
+		return nil
+	}
+
+	var m map[string]interface{}
+	for _, ss := range sess.structs {
+		buf, err := json.Marshal(ss.v)
+		if err != nil {
+			return err
+		}
+		if string(buf) == ss.enc {
+			continue
+		}
+
+		if m == nil {
+			stored := sess.storedStructs()
+			m = make(map[string]interface{}, len(stored)+len(sess.structs))
+			for k, v := range stored {
+				m[k] = v
+			}
+		}
+		m[ss.name], ss.enc = string(buf), string(buf)
+	}
+
+	if m != nil {
+		sess.meta()[metaStructsKey] = m
+		sess.modified = true
+		sess.dirty(metaKey)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Package tieredstore provides a two level sessionmw.Store, composing a fast
+// local store (such as an in-process memory store) in front of a shared
+// remote store (such as Redis).
+package tieredstore
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/knq/sessionmw"
+)
+
+// TieredStore is a two level session store.
+//
+// Reads are served from the local store when the session was cached less
+// than the local TTL ago, and otherwise read through from the remote store.
+// Writes and erases are written through to both stores. Sessions that were
+// cached more than the local TTL ago are periodically erased from the local
+// store.
+type TieredStore struct {
+	local  sessionmw.Store
+	remote sessionmw.Store
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time
+
+	// Clock is the time source determining which cached sessions have
+	// expired.
+	Clock sessionmw.Clock
+}
+
+// New creates a tiered store caching sessions read from or written to remote
+// in local for ttl.
+func New(local, remote sessionmw.Store, ttl time.Duration) *TieredStore {
+	return &TieredStore{
+		local:   local,
+		remote:  remote,
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+		Clock:   sessionmw.SystemClock,
+	}
+}
+
+// cached determines if key is cached in the local store, erasing it from the
+// local store when expired.
+func (ts *TieredStore) cached(key string) bool {
+	ts.mu.Lock()
+	exp, ok := ts.expires[key]
+	expired := ok && ts.Clock.Now().After(exp)
+	if expired {
+		delete(ts.expires, key)
+	}
+	ts.mu.Unlock()
+
+	if expired {
+		ts.local.Erase(key)
+		return false
+	}
+	return ok
+}
+
+// cache writes obj to the local store.
+func (ts *TieredStore) cache(key string, obj interface{}) {
+	if err := ts.local.Write(key, obj); err != nil {
+		ts.Invalidate(key)
+		return
+	}
+
+	now := ts.Clock.Now()
+	ts.mu.Lock()
+	ts.expires[key] = now.Add(ts.ttl)
+	expired := ts.sweep(now)
+	ts.mu.Unlock()
+
+	for _, k := range expired {
+		ts.local.Erase(k)
+	}
+}
+
+// sweep removes the expired sessions from the cached sessions, at most once
+// per local TTL, returning their keys for erasing from the local store. The
+// store must be locked.
+func (ts *TieredStore) sweep(now time.Time) []string {
+	if now.Sub(ts.swept) < ts.ttl {
+		return nil
+	}
+
+	var keys []string
+	for k, exp := range ts.expires {
+		if now.After(exp) {
+			delete(ts.expires, k)
+			keys = append(keys, k)
+		}
+	}
+	ts.swept = now
+	return keys
+}
+
+// Write saves the session for the provided id to the remote and local
+// stores.
+func (ts *TieredStore) Write(key string, obj interface{}) error {
+	if err := ts.remote.Write(key, obj); err != nil {
+		ts.Invalidate(key)
+		return err
+	}
+
+	ts.cache(key, obj)
+	return nil
+}
+
+// Read retrieves the session for the provided id, from the local store if
+// cached, or otherwise from the remote store.
+func (ts *TieredStore) Read(key string) (interface{}, error) {
+	if ts.cached(key) {
+		if obj, err := ts.local.Read(key); err == nil {
+			return obj, nil
+		}
+	}
+
+	obj, err := ts.remote.Read(key)
+	if err != nil {
+		ts.Invalidate(key)
+		return nil, err
+	}
+
+	ts.cache(key, obj)
+	return obj, nil
+}
+
+// Erase permanently destroys the session with the provided id in both the
+// remote and local stores.
+func (ts *TieredStore) Erase(key string) error {
+	ts.Invalidate(key)
+	return ts.remote.Erase(key)
+}
+
+// Invalidate removes the session with the provided id from the local store
+// only, forcing the next read to be served from the remote store.
+//
+// Invalidate should be called when the session is known to have changed in
+// the remote store (for example, from a Redis keyspace notification).
+func (ts *TieredStore) Invalidate(key string) {
+	ts.mu.Lock()
+	delete(ts.expires, key)
+	ts.mu.Unlock()
+
+	ts.local.Erase(key)
+}
+
+// Close closes the local and remote stores.
+func (ts *TieredStore) Close() error {
+	err := sessionmw.CloseStore(ts.local)
+	if e := sessionmw.CloseStore(ts.remote); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Ping checks the health of the local and remote stores, returning the first
+// error encountered. Satisfies the sessionmw.Pinger interface.
+func (ts *TieredStore) Ping(ctxt context.Context) error {
+	if err := sessionmw.PingStore(ctxt, ts.local); err != nil {
+		return err
+	}
+	return sessionmw.PingStore(ctxt, ts.remote)
+}
@@ -0,0 +1,102 @@
+package tieredstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knq/kv"
+
+	"github.com/knq/sessionmw"
+)
+
+// countStore counts reads of the wrapped store.
+type countStore struct {
+	*kv.MemStore
+	reads int
+}
+
+func (cs *countStore) Read(key string) (interface{}, error) {
+	cs.reads++
+	return cs.MemStore.Read(key)
+}
+
+func TestTieredStore(t *testing.T) {
+	local, remote := kv.NewMemStore(), &countStore{MemStore: kv.NewMemStore()}
+	ts := New(local, remote, time.Hour)
+
+	if err := ts.Write("a", "foo"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := remote.Data["a"]; !ok {
+		t.Errorf("expected write through to remote")
+	}
+
+	// served locally
+	for i := 0; i < 3; i++ {
+		if v, err := ts.Read("a"); err != nil || v != "foo" {
+			t.Fatalf("expected foo, got: %v (%v)", v, err)
+		}
+	}
+	if remote.reads != 0 {
+		t.Errorf("expected no remote reads, got: %d", remote.reads)
+	}
+
+	// read through after invalidation
+	remote.Data["a"] = "bar"
+	ts.Invalidate("a")
+	if v, err := ts.Read("a"); err != nil || v != "bar" {
+		t.Errorf("expected bar, got: %v (%v)", v, err)
+	}
+	if remote.reads != 1 {
+		t.Errorf("expected 1 remote read, got: %d", remote.reads)
+	}
+
+	if err := ts.Erase("a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(local.Data) != 0 || len(remote.Data) != 0 {
+		t.Errorf("expected erase from both stores")
+	}
+}
+
+func TestLocalTTL(t *testing.T) {
+	local, remote := kv.NewMemStore(), &countStore{MemStore: kv.NewMemStore()}
+	ts := New(local, remote, -time.Second)
+
+	ts.Write("a", "foo")
+	ts.Read("a")
+	ts.Read("a")
+	if remote.reads != 2 {
+		t.Errorf("expected 2 remote reads with expired local ttl, got: %d", remote.reads)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	local, remote := kv.NewMemStore(), kv.NewMemStore()
+	ts := New(local, remote, time.Minute)
+	ts.Clock = sessionmw.ClockFunc(func() time.Time { return now })
+
+	ts.Write("a", "foo")
+	ts.Write("b", "bar")
+	now = now.Add(2 * time.Minute)
+
+	// expired sessions are erased from the local store
+	ts.Write("c", "baz")
+	if len(local.Data) != 1 || len(ts.expires) != 1 {
+		t.Errorf("expected only c cached, got: %v %v", local.Data, ts.expires)
+	}
+	if _, ok := local.Data["c"]; !ok {
+		t.Errorf("expected c in local store")
+	}
+	if len(remote.Data) != 3 {
+		t.Errorf("expected 3 remote sessions, got: %d", len(remote.Data))
+	}
+
+	// an expired session is erased when read
+	now = now.Add(2 * time.Minute)
+	ts.cached("c")
+	if len(local.Data) != 0 || len(ts.expires) != 0 {
+		t.Errorf("expected no cached sessions, got: %v %v", local.Data, ts.expires)
+	}
+}
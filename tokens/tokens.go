@@ -0,0 +1,131 @@
+// Package tokens provides single use tokens (ie, anti-replay nonces, email
+// confirmation or password reset tokens) backed by a sessionmw.Store.
+package tokens
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/knq/sessionmw"
+)
+
+const (
+	// DefaultPrefix is the default prefix for the store keys of issued
+	// tokens.
+	DefaultPrefix = "token_"
+
+	// expiresKey is the stored token key holding the token's expiration.
+	expiresKey = "expires"
+)
+
+// ErrInvalidToken is the error returned when consuming a token that was not
+// issued, was already consumed, or has expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Tokens issues and consumes single use tokens.
+//
+// Tokens are consumed atomically when the store is a sessionmw.TakeStore (ie,
+// redisstore). Otherwise the token is read and erased while holding the
+// store's lock, falling back to an in process lock (see
+// sessionmw.LocalLocking) for stores that are not a sessionmw.LockingStore,
+// in which case tokens may only be consumed once per process.
+type Tokens struct {
+	// Prefix is the prefix for the store keys of issued tokens.
+	Prefix string
+
+	// Clock is the time source for token expiration.
+	Clock sessionmw.Clock
+
+	st sessionmw.Store
+}
+
+// New creates single use tokens stored in st.
+func New(st sessionmw.Store) *Tokens {
+	if _, ok := st.(sessionmw.TakeStore); !ok {
+		if _, ok := st.(sessionmw.LockingStore); !ok {
+			st = sessionmw.LocalLocking(st)
+		}
+	}
+
+	return &Tokens{
+		Prefix: DefaultPrefix,
+		Clock:  sessionmw.SystemClock,
+		st:     st,
+	}
+}
+
+// Issue issues a token that can be consumed once within ttl. A ttl of 0 uses
+// the store's expiration.
+func (t *Tokens) Issue(ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	obj := map[string]interface{}{}
+	if ttl <= 0 {
+		return token, t.st.Write(t.Prefix+token, obj)
+	}
+
+	obj[expiresKey] = t.Clock.Now().Add(ttl).Format(time.RFC3339Nano)
+	if ts, ok := t.st.(sessionmw.TTLStore); ok {
+		return token, ts.WriteTTL(t.Prefix+token, obj, ttl)
+	}
+	return token, t.st.Write(t.Prefix+token, obj)
+}
+
+// Consume consumes the token, returning ErrInvalidToken if the token was not
+// issued, was already consumed, or has expired.
+func (t *Tokens) Consume(token string) error {
+	if token == "" {
+		return ErrInvalidToken
+	}
+
+	obj, err := t.take(t.Prefix + token)
+	switch {
+	case err == sessionmw.ErrSessionNotFound:
+		return ErrInvalidToken
+	case err != nil:
+		return err
+	}
+
+	d, ok := obj.(map[string]interface{})
+	if !ok {
+		return ErrInvalidToken
+	}
+	if s, ok := d[expiresKey].(string); ok {
+		exp, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || !t.Clock.Now().Before(exp) {
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
+
+// take retrieves and erases key from the store.
+func (t *Tokens) take(key string) (interface{}, error) {
+	if ts, ok := t.st.(sessionmw.TakeStore); ok {
+		return ts.Take(key)
+	}
+
+	unlock, err := t.st.(sessionmw.LockingStore).Lock(key, sessionmw.DefaultLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// stores do not consistently report missing keys with
+	// sessionmw.ErrSessionNotFound (ie, kv.MemStore), so treat any read
+	// error as a missing token
+	obj, err := t.st.Read(key)
+	if err != nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+	if err = t.st.Erase(key); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
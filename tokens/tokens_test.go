@@ -0,0 +1,122 @@
+package tokens
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knq/kv"
+	"github.com/knq/sessionmw"
+)
+
+// takeStore is a memory store satisfying the sessionmw.TakeStore interface.
+type takeStore struct {
+	*kv.MemStore
+	takes int
+}
+
+func (ts *takeStore) Take(key string) (interface{}, error) {
+	ts.takes++
+	obj, err := ts.Read(key)
+	if err != nil {
+		return nil, sessionmw.ErrSessionNotFound
+	}
+	return obj, ts.Erase(key)
+}
+
+func TestTokens(t *testing.T) {
+	now := time.Now()
+	ms := kv.NewMemStore()
+	tok := New(ms)
+	tok.Clock = sessionmw.ClockFunc(func() time.Time { return now })
+
+	a, err := tok.Issue(time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := ms.Data[DefaultPrefix+a]; !ok {
+		t.Fatalf("expected token to be stored")
+	}
+	if err = tok.Consume(a); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err = tok.Consume(a); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken on replay, got: %v", err)
+	}
+	if err = tok.Consume(""); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got: %v", err)
+	}
+	if err = tok.Consume("bogus"); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got: %v", err)
+	}
+
+	// expired
+	b, err := tok.Issue(time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if err = tok.Consume(b); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for expired token, got: %v", err)
+	}
+	if _, ok := ms.Data[DefaultPrefix+b]; ok {
+		t.Errorf("expected expired token to be erased")
+	}
+
+	// no expiration
+	c, err := tok.Issue(0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	now = now.Add(24 * time.Hour)
+	if err = tok.Consume(c); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestConcurrentConsume(t *testing.T) {
+	tok := New(kv.NewMemStore())
+	token, err := tok.Issue(time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var n int
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tok.Consume(token) == nil {
+				mu.Lock()
+				n++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n != 1 {
+		t.Errorf("expected token to be consumed once, got: %d", n)
+	}
+}
+
+func TestTakeStore(t *testing.T) {
+	ts := &takeStore{MemStore: kv.NewMemStore()}
+	tok := New(ts)
+
+	token, err := tok.Issue(time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = tok.Consume(token); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err = tok.Consume(token); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got: %v", err)
+	}
+	if ts.takes != 2 {
+		t.Errorf("expected consume to use Take, got: %d takes", ts.takes)
+	}
+}
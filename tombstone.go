@@ -0,0 +1,34 @@
+package sessionmw
+
+// metaRevokedKey is the metadata key of a tombstone stored in place of a
+// destroyed session (see Config.TombstoneTTL), holding the time the session
+// was destroyed.
+const metaRevokedKey = "revoked"
+
+// erase destroys the session stored under id. When TombstoneTTL is set, the
+// session is replaced with a tombstone valid for TombstoneTTL, rather than
+// erased, so that the caches and tiers of other instances holding a copy of
+// the session see it as revoked (see revoked), rather than missing.
+func (s *Manager) erase(id string) error {
+	if s.tombstoneTTL <= 0 {
+		return s.st.Erase(id)
+	}
+
+	ts := map[string]interface{}{
+		metaKey: map[string]interface{}{
+			metaRevokedKey: s.now().UnixNano(),
+		},
+	}
+	if tt, ok := s.st.(TTLStore); ok {
+		return tt.WriteTTL(id, ts, s.tombstoneTTL)
+	}
+	return s.st.Write(id, ts)
+}
+
+// revoked determines if the stored session d is a tombstone (see erase).
+func revoked(d interface{}) bool {
+	data, _ := d.(map[string]interface{})
+	m, _ := data[metaKey].(map[string]interface{})
+	_, ok := m[metaRevokedKey]
+	return ok
+}
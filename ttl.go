@@ -0,0 +1,80 @@
+package sessionmw
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// metaExpiresKey is the session metadata key holding the expiration times of
+// the session values set with SetWithTTL.
+const metaExpiresKey = "expires"
+
+// SetWithTTL stores a session value into the context, expiring the value
+// after ttl, independent of the session's lifetime (ie, for a one time
+// password challenge). Expired values are removed when the session is
+// loaded.
+//
+// Storing the value again with Set (or deleting it) removes its expiration.
+func SetWithTTL(ctxt context.Context, key string, val interface{}, ttl time.Duration) {
+	sess := fromContext(ctxt)
+	sess.Lock()
+	sess.persistKey(key)
+	sess.expireKey(key, sess.s.now().Add(ttl))
+	sess.data[key] = sess.s.normalize(val)
+	sess.modified = true
+	sess.dirty(key)
+	sess.dirty(metaKey)
+	sess.Unlock()
+
+	audit(ctxt, AuditSet, key)
+}
+
+// expires returns the expiration times of the session values, or nil if no
+// value has an expiration. The session must be locked.
+func (sess *session) expires() map[string]interface{} {
+	m, _ := sess.meta()[metaExpiresKey].(map[string]interface{})
+	return m
+}
+
+// expireKey records the expiration time of the session value for key. The
+// session must be locked.
+func (sess *session) expireKey(key string, t time.Time) {
+	m := sess.expires()
+	if m == nil {
+		m = make(map[string]interface{})
+		sess.meta()[metaExpiresKey] = m
+	}
+	m[key] = t.UnixNano()
+}
+
+// persistKey removes the expiration of the session value for key, and its
+// SetOnce marker, making it a regular value. The session must be locked.
+func (sess *session) persistKey(key string) {
+	for _, mk := range []string{metaExpiresKey, metaOnceKey} {
+		m, _ := sess.meta()[mk].(map[string]interface{})
+		if _, ok := m[key]; !ok {
+			continue
+		}
+		delete(m, key)
+		if len(m) == 0 {
+			delete(sess.meta(), mk)
+		}
+		sess.dirty(metaKey)
+	}
+}
+
+// expireKeys removes the session values that expired before now, marking the
+// session as modified when any value was removed. The session must be
+// locked.
+func (sess *session) expireKeys(now time.Time) {
+	for k, v := range sess.expires() {
+		if n, ok := int64Value(v); ok && now.UnixNano() < n {
+			continue
+		}
+		delete(sess.data, k)
+		sess.persistKey(k)
+		sess.modified = true
+		sess.dirty(k)
+	}
+}
@@ -0,0 +1,366 @@
+package sessionmw
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// userIndexPrefix is the store key prefix of the per user session indexes.
+const userIndexPrefix = "_sessionmw_user:"
+
+// indexGrace is the time after which a session in a user's index that was not
+// found in the store is removed from the index. Sessions are saved at the end
+// of the request binding them to the user, so recently indexed sessions may
+// not yet be stored.
+const indexGrace = time.Minute
+
+// ErrSessionLimit is the error returned by SetUser when the user already has
+// the maximum number of sessions (see Config.MaxUserSessions).
+var ErrSessionLimit = errors.New("session limit reached")
+
+// LimitPolicy is the policy used when binding a session to a user that
+// already has the maximum number of sessions.
+type LimitPolicy int
+
+// LimitPolicy values.
+const (
+	// LimitEvictOldest destroys the user's sessions that were created
+	// first.
+	LimitEvictOldest LimitPolicy = iota
+
+	// LimitEvictIdle destroys the user's sessions that were least recently
+	// active.
+	LimitEvictIdle
+
+	// LimitRefuse refuses to bind the session, with SetUser returning
+	// ErrSessionLimit.
+	LimitRefuse
+)
+
+// SessionInfo describes one of a user's sessions.
+type SessionInfo struct {
+	Metadata
+
+	// ID is the session id.
+	ID string
+
+	// Current is set when the session is the session of the current request.
+	Current bool
+}
+
+// SetUser binds the session to user, adding the session to the user's index
+// of sessions in the store. The index is used by Sessions, DestroyByID, and
+// DestroyOthers to provide users with a page for managing their sessions.
+//
+// The session id should be regenerated (see Regenerate) before binding the
+// session to a user.
+//
+// When the number of sessions of a user is limited (see
+// Config.MaxUserSessions), other sessions of the user are destroyed, or
+// ErrSessionLimit is returned, according to Config.LimitPolicy.
+//
+// The index is updated holding the Store's lock for the index when the Store
+// is a LockingStore (see Config.Locking), and otherwise holding a lock in
+// process, in which case concurrent updates of the index by multiple
+// processes can lose sessions from the index. Sessions that expired are
+// removed from the index when it is updated.
+func SetUser(ctxt context.Context, user string) error {
+	sess := fromContext(ctxt)
+	s := sess.s
+
+	var others []SessionInfo
+	if s.maxUserSessions > 0 {
+		infos, err := Sessions(ctxt, user)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !info.Current {
+				others = append(others, info)
+			}
+		}
+		if s.limitPolicy == LimitRefuse && len(others) >= s.maxUserSessions {
+			return ErrSessionLimit
+		}
+	}
+
+	sess.Lock()
+	sessID := sess.id
+	prev := metadata(sess.data).indexed()
+	m := sess.meta()
+	m[metaUserKey] = user
+	m[metaBoundKey] = s.now().UnixNano()
+	delete(m, metaImpersonatorKey)
+	sess.modified = true
+	sess.dirty(metaKey)
+	sess.Unlock()
+
+	if prev != "" && prev != user {
+		if err := s.unindex(prev, sessID); err != nil {
+			return err
+		}
+	}
+	if err := s.index(user, sessID); err != nil {
+		return err
+	}
+
+	// evict other sessions past the limit
+	if n := len(others) + 1 - s.maxUserSessions; s.maxUserSessions > 0 && n > 0 {
+		if s.limitPolicy == LimitEvictIdle {
+			sort.Sort(sessionsByActive(others))
+		}
+		for _, info := range others[:n] {
+			if err := s.erase(info.ID); err != nil {
+				return err
+			}
+			if err := s.unindex(user, info.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// User retrieves the user the session is bound to, if any.
+func User(ctxt context.Context) string {
+	return Meta(ctxt).User
+}
+
+// Sessions retrieves the active sessions of user, ordered by creation time.
+// Expired sessions are removed from the user's index.
+func Sessions(ctxt context.Context, user string) ([]SessionInfo, error) {
+	sess := fromContext(ctxt)
+	return sess.s.userSessions(user, sess)
+}
+
+// userSessions retrieves the active sessions of user, ordered by creation
+// time, marking cur as the current session. Expired sessions are removed from
+// the user's index.
+func (s *Manager) userSessions(user string, cur *session) ([]SessionInfo, error) {
+	var curID string
+	if cur != nil {
+		cur.RLock()
+		curID = cur.id
+		cur.RUnlock()
+	}
+
+	ids, err := s.indexed(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SessionInfo
+	for _, id := range ids {
+		var data map[string]interface{}
+		if cur != nil && id == curID {
+			cur.RLock()
+			info := SessionInfo{Metadata: metadata(cur.data), ID: id, Current: true}
+			cur.RUnlock()
+			infos = append(infos, info)
+			continue
+		}
+
+		d, err := s.st.Read(id)
+		if err == nil {
+			data, _ = d.(map[string]interface{})
+		}
+
+		md := metadata(data)
+		if md.indexed() != user {
+			// expired, or no longer bound to user
+			if err = s.unindex(user, id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		infos = append(infos, SessionInfo{Metadata: md, ID: id})
+	}
+
+	sort.Sort(sessionInfos(infos))
+	return infos, nil
+}
+
+// DestroyByID destroys the session with the provided id, which must belong to
+// the same user as the current session. Use Destroy to destroy the current
+// session.
+func DestroyByID(ctxt context.Context, id string) error {
+	sess := fromContext(ctxt)
+	s := sess.s
+
+	sess.RLock()
+	curID := sess.id
+	user, _ := sess.meta()[metaUserKey].(string)
+	sess.RUnlock()
+
+	if id == curID {
+		return Destroy(ctxt)
+	}
+	if user == "" {
+		return ErrSessionNotFound
+	}
+
+	return s.destroyID(id, user)
+}
+
+// destroyID destroys the session with the provided id, removing it from its
+// user's index. When user is not empty, the session must be bound to user.
+func (s *Manager) destroyID(id, user string) error {
+	if !s.idValidator(id) {
+		return ErrSessionNotFound
+	}
+
+	d, err := s.st.Read(id)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+	data, ok := d.(map[string]interface{})
+	if !ok || revoked(data) {
+		return ErrSessionNotFound
+	}
+	bound := metadata(data).indexed()
+	if user != "" && bound != user {
+		return ErrSessionNotFound
+	}
+
+	if err = s.erase(id); err != nil {
+		return err
+	}
+	if bound != "" {
+		return s.unindex(bound, id)
+	}
+	return nil
+}
+
+// DestroyOthers destroys all sessions of the current session's user, other
+// than the current session.
+func DestroyOthers(ctxt context.Context) error {
+	infos, err := Sessions(ctxt, User(ctxt))
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.Current {
+			continue
+		}
+		if err = DestroyByID(ctxt, info.ID); err != nil && err != ErrSessionNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionInfos provides sorting by creation time.
+type sessionInfos []SessionInfo
+
+func (si sessionInfos) Len() int           { return len(si) }
+func (si sessionInfos) Less(i, j int) bool { return si[i].Created.Before(si[j].Created) }
+func (si sessionInfos) Swap(i, j int)      { si[i], si[j] = si[j], si[i] }
+
+// sessionsByActive provides sorting by last active time.
+type sessionsByActive []SessionInfo
+
+func (si sessionsByActive) Len() int           { return len(si) }
+func (si sessionsByActive) Less(i, j int) bool { return si[i].LastActive.Before(si[j].LastActive) }
+func (si sessionsByActive) Swap(i, j int)      { si[i], si[j] = si[j], si[i] }
+
+// lockIndex locks user's index, with the Store's lock when it is a
+// LockingStore, otherwise with the in process index mutex, returning the func
+// releasing the lock.
+func (s *Manager) lockIndex(user string) (func(), error) {
+	if ls, ok := s.st.(LockingStore); ok {
+		return ls.Lock(userIndexPrefix+user, s.lockTimeout)
+	}
+	s.indexMu.Lock()
+	return s.indexMu.Unlock, nil
+}
+
+// indexed returns the session ids in user's index.
+func (s *Manager) indexed(user string) ([]string, error) {
+	unlock, err := s.lockIndex(user)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx := s.readIndex(user)
+	ids := make([]string, 0, len(idx))
+	for id := range idx {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// index adds id to user's index, removing the sessions that were indexed more
+// than indexGrace ago and have since expired or are no longer bound to user.
+func (s *Manager) index(user, id string) error {
+	unlock, err := s.lockIndex(user)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := s.now()
+	idx := s.readIndex(user)
+	for k, v := range idx {
+		// indexes written by previous versions hold true for each session
+		if n, ok := int64Value(v); ok && now.Sub(time.Unix(0, n)) < indexGrace {
+			continue
+		}
+		if !s.boundTo(k, user) {
+			delete(idx, k)
+		}
+	}
+	idx[id] = now.UnixNano()
+	return s.st.Write(userIndexPrefix+user, idx)
+}
+
+// boundTo determines if the stored session with the provided id is bound to
+// user.
+func (s *Manager) boundTo(id, user string) bool {
+	d, err := s.st.Read(id)
+	if err != nil {
+		return false
+	}
+	data, ok := d.(map[string]interface{})
+	return ok && !revoked(data) && metadata(data).indexed() == user
+}
+
+// unindex removes id from user's index.
+func (s *Manager) unindex(user, id string) error {
+	unlock, err := s.lockIndex(user)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx := s.readIndex(user)
+	if _, ok := idx[id]; !ok {
+		return nil
+	}
+
+	delete(idx, id)
+	if len(idx) == 0 {
+		return s.st.Erase(userIndexPrefix + user)
+	}
+	return s.st.Write(userIndexPrefix+user, idx)
+}
+
+// readIndex reads a copy of user's index from the store, returning an empty
+// index if it does not exist. The index maps the session ids to the time they
+// were indexed. The index must be locked.
+func (s *Manager) readIndex(user string) map[string]interface{} {
+	idx := make(map[string]interface{})
+	if d, err := s.st.Read(userIndexPrefix + user); err == nil {
+		m, _ := d.(map[string]interface{})
+		for id, v := range m {
+			idx[id] = v
+		}
+	}
+	return idx
+}
@@ -0,0 +1,199 @@
+package sessionmw
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// valueTypeKey and valueKey are the keys of a normalized value of a
+	// registered value type, holding the type's name and its JSON encoding.
+	valueTypeKey = "$type"
+	valueKey     = "$value"
+)
+
+var (
+	// valuesMu protects valueTypes and valueNames.
+	valuesMu sync.RWMutex
+
+	// valueTypes and valueNames are the registered value types and their
+	// names.
+	valueTypes = make(map[string]reflect.Type)
+	valueNames = make(map[reflect.Type]string)
+)
+
+func init() {
+	RegisterValue("time", time.Time{})
+	RegisterValue("[]string", []string(nil))
+}
+
+// RegisterValue registers the type of v as a session value type named name,
+// such that, when Config.NormalizeValues is set, values of the type are
+// retrieved with the same type regardless of the store and codec. Values of
+// registered types are stored as their JSON encoding, tagged with name.
+//
+// The time.Time and []string types are registered by default.
+//
+// RegisterValue should be called in an init func, before handling requests.
+// RegisterValue panics if name or the type of v was already registered.
+func RegisterValue(name string, v interface{}) {
+	typ := reflect.TypeOf(v)
+	if typ == nil || name == "" {
+		panic(fmt.Sprintf("sessionmw: cannot register %T as a session value type", v))
+	}
+
+	valuesMu.Lock()
+	defer valuesMu.Unlock()
+	if _, ok := valueTypes[name]; ok {
+		panic(fmt.Sprintf("sessionmw: session value type %s already registered", name))
+	}
+	if _, ok := valueNames[typ]; ok {
+		panic(fmt.Sprintf("sessionmw: session value type %T already registered", v))
+	}
+	valueTypes[name], valueNames[typ] = typ, name
+}
+
+// normalize returns val in the form stored in the session when
+// Config.NormalizeValues is set: integers as int64, floats as float64, and
+// values of registered types as their tagged JSON encoding (see
+// RegisterValue), converting the values of maps and slices recursively.
+//
+// Normalized values round trip identically through the JSON and gob codecs,
+// and through stores keeping values in memory.
+func (s *Manager) normalize(val interface{}) interface{} {
+	if s == nil || !s.normalizeValues {
+		return val
+	}
+	return normalizeValue(val)
+}
+
+// normalizeValue returns the normalized form of val (see normalize).
+func normalizeValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil, string, bool, int64, float64:
+		return val
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		return numberValue(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[k] = normalizeValue(x)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, x := range v {
+			a[i] = normalizeValue(x)
+		}
+		return a
+	}
+
+	valuesMu.RLock()
+	name, ok := valueNames[reflect.TypeOf(val)]
+	valuesMu.RUnlock()
+	if !ok {
+		return val
+	}
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	return map[string]interface{}{
+		valueTypeKey: name,
+		valueKey:     string(buf),
+	}
+}
+
+// denormalize returns the session value val as originally stored, when
+// Config.NormalizeValues is set, converting the tagged values of registered
+// types back to their types, and the numbers decoded by the JSON codec to
+// int64 or float64.
+func (s *Manager) denormalize(val interface{}) interface{} {
+	if s == nil || !s.normalizeValues {
+		return val
+	}
+	return denormalizeValue(val)
+}
+
+// denormalizeValue returns the denormalized form of val (see denormalize).
+func denormalizeValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		return numberValue(v)
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, x := range v {
+			a[i] = denormalizeValue(x)
+		}
+		return a
+	case map[string]interface{}:
+		if x, ok := registeredValue(v); ok {
+			return x
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[k] = denormalizeValue(x)
+		}
+		return m
+	}
+	return val
+}
+
+// registeredValue decodes m when it is the tagged JSON encoding of a value of
+// a registered type.
+func registeredValue(m map[string]interface{}) (interface{}, bool) {
+	if len(m) != 2 {
+		return nil, false
+	}
+	name, _ := m[valueTypeKey].(string)
+	buf, ok := m[valueKey].(string)
+	if name == "" || !ok {
+		return nil, false
+	}
+
+	valuesMu.RLock()
+	typ, ok := valueTypes[name]
+	valuesMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal([]byte(buf), v.Interface()); err != nil {
+		return nil, false
+	}
+	return v.Elem().Interface(), true
+}
+
+// numberValue converts n to int64, or float64 when n is not an integer.
+func numberValue(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
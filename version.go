@@ -0,0 +1,166 @@
+package sessionmw
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// metaVersionKey is the session metadata key holding the session version.
+const metaVersionKey = "version"
+
+// maxMergeAttempts is the maximum number of times a save is retried after a
+// version conflict.
+const maxMergeAttempts = 3
+
+// ErrVersionConflict is the error returned by VersionedStore providers when
+// the stored session version does not match the expected version.
+var ErrVersionConflict = errors.New("session version conflict")
+
+// VersionedStore is the interface for session stores that can atomically
+// write a session only when the stored session is at the expected version.
+type VersionedStore interface {
+	Store
+
+	// WriteVersion writes obj only when the version (see Version) of the
+	// session currently stored for key is version, otherwise returning
+	// ErrVersionConflict. A missing session has version 0.
+	WriteVersion(key string, obj interface{}, version int64) error
+}
+
+// Version returns the version of the stored session data obj, or 0 if obj
+// does not have a version.
+func Version(obj interface{}) int64 {
+	data, ok := obj.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	m, ok := data[metaKey].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	n, _ := int64Value(m[metaVersionKey])
+	return n
+}
+
+// MergeFn is the func type for merging the session values saved by the
+// current request (ours) with the session values concurrently saved by
+// another request (theirs). Changed contains the keys that were set or
+// deleted by the current request.
+type MergeFn func(ours, theirs map[string]interface{}, changed []string) (map[string]interface{}, error)
+
+// MergeLastWriteWins is a MergeFn that discards the concurrently saved
+// session values.
+func MergeLastWriteWins(ours, theirs map[string]interface{}, changed []string) (map[string]interface{}, error) {
+	return ours, nil
+}
+
+// MergeKeys is a MergeFn that applies the keys changed by the current request
+// to the concurrently saved session values.
+func MergeKeys(ours, theirs map[string]interface{}, changed []string) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(theirs))
+	for k, v := range theirs {
+		data[k] = v
+	}
+	for _, k := range changed {
+		if v, ok := ours[k]; ok {
+			data[k] = v
+		} else {
+			delete(data, k)
+		}
+	}
+	return data, nil
+}
+
+// versionedStore wraps a Store with in process versioned writes.
+type versionedStore struct {
+	Store
+	mu sync.Mutex
+}
+
+// LocalVersioning wraps st, providing versioned writes that are atomic in
+// process.
+//
+// This is only suitable for stores (such as github.com/knq/kv.MemStore) that
+// are used by a single process.
+func LocalVersioning(st Store) VersionedStore {
+	return &versionedStore{Store: st}
+}
+
+// WriteVersion satisfies the VersionedStore interface.
+func (vs *versionedStore) WriteVersion(key string, obj interface{}, version int64) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	var cur int64
+	if d, err := vs.Store.Read(key); err == nil {
+		cur = Version(d)
+	}
+	if cur != version {
+		return ErrVersionConflict
+	}
+
+	return vs.Store.Write(key, obj)
+}
+
+// Close closes the wrapped store.
+func (vs *versionedStore) Close() error {
+	return CloseStore(vs.Store)
+}
+
+// Ping checks the health of the wrapped store, if it is a Pinger.
+func (vs *versionedStore) Ping(ctxt context.Context) error {
+	return PingStore(ctxt, vs.Store)
+}
+
+// writeVersion writes the session to the versioned store, merging with any
+// concurrently saved session values.
+func (s *Manager) writeVersion(id string, sess *session) error {
+	vs := s.st.(VersionedStore)
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	changed := make([]string, 0, len(sess.changed))
+	for k := range sess.changed {
+		changed = append(changed, k)
+	}
+
+	version := sess.version
+	for i := 0; ; i++ {
+		// stamp a copy, as the loaded metadata may be shared with the
+		// stored session (ie, with kv.MemStore)
+		data := copyData(sess.data).(map[string]interface{})
+		meta, _ := data[metaKey].(map[string]interface{})
+		if meta == nil {
+			meta = make(map[string]interface{})
+			data[metaKey] = meta
+		}
+		meta[metaVersionKey] = version + 1
+
+		err := vs.WriteVersion(id, data, version)
+		if err == nil {
+			sess.data = data
+		}
+		if err != ErrVersionConflict || i == maxMergeAttempts-1 {
+			return err
+		}
+
+		// merge with the stored session
+		theirs, err := vs.Read(id)
+		if err != nil {
+			return err
+		}
+		td, ok := theirs.(map[string]interface{})
+		if !ok {
+			return ErrVersionConflict
+		}
+		merged, err := s.merge(sess.data, td, changed)
+		if err != nil {
+			return err
+		}
+
+		version, sess.data = Version(td), merged
+	}
+}
@@ -0,0 +1,100 @@
+package sessionmw
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// watermarkKey is the store key of the global revocation watermark.
+	// Watermarks are reserved keys, and are not listed as sessions.
+	watermarkKey = ReservedPrefix + "watermark"
+
+	// userWatermarkPrefix is the store key prefix of the per user revocation
+	// watermarks.
+	userWatermarkPrefix = ReservedPrefix + "watermark:"
+
+	// watermarkBeforeKey is the key of a stored watermark holding the time
+	// before which sessions are revoked.
+	watermarkBeforeKey = "before"
+
+	// metaBoundKey is the metadata key holding the time the session was
+	// bound to its user with SetUser.
+	metaBoundKey = "bound"
+)
+
+// errWatermarksDisabled is the error returned by RevokeAll and RevokeUser
+// when Config.Watermarks is not set.
+var errWatermarksDisabled = errors.New("sessionmw Config.Watermarks is not set")
+
+// RevokeAll revokes all sessions created before t (ie, after rotating a
+// compromised secret, or to force a global logout), by storing a watermark
+// checked when sessions are loaded, rather than erasing every session.
+// Requests with a revoked session are issued a new session.
+//
+// RevokeAll requires Config.Watermarks.
+func (s *Manager) RevokeAll(t time.Time) error {
+	return s.writeWatermark(watermarkKey, t)
+}
+
+// RevokeUser revokes the sessions bound to user (see SetUser) before t, as
+// with RevokeAll.
+//
+// RevokeUser requires Config.Watermarks.
+func (s *Manager) RevokeUser(user string, t time.Time) error {
+	return s.writeWatermark(userWatermarkPrefix+user, t)
+}
+
+// writeWatermark stores the watermark t under key. Watermarks are written
+// without expiry when the store is a TTLStore, as they must outlive the
+// sessions they revoke.
+func (s *Manager) writeWatermark(key string, t time.Time) error {
+	if !s.watermarks {
+		return errWatermarksDisabled
+	}
+	obj := map[string]interface{}{
+		watermarkBeforeKey: t.UnixNano(),
+	}
+	if ts, ok := s.st.(TTLStore); ok {
+		return ts.WriteTTL(key, obj, 0)
+	}
+	return s.st.Write(key, obj)
+}
+
+// watermark reads the watermark stored under key, as unix nanoseconds.
+func (s *Manager) watermark(key string) (int64, bool) {
+	d, err := s.st.Read(key)
+	if err != nil {
+		return 0, false
+	}
+	m, _ := d.(map[string]interface{})
+	return int64Value(m[watermarkBeforeKey])
+}
+
+// belowWatermark determines if the stored session data was revoked by the
+// global watermark, being created before it, or by the watermark of its
+// user, being created and bound to the user before it.
+func (s *Manager) belowWatermark(data map[string]interface{}) bool {
+	if !s.watermarks {
+		return false
+	}
+
+	m, _ := data[metaKey].(map[string]interface{})
+	created, ok := int64Value(m[metaCreatedKey])
+	if !ok {
+		return false
+	}
+	if before, ok := s.watermark(watermarkKey); ok && created < before {
+		return true
+	}
+
+	user := metadata(data).indexed()
+	if user == "" {
+		return false
+	}
+	if bound, ok := int64Value(m[metaBoundKey]); ok && bound > created {
+		created = bound
+	}
+	before, ok := s.watermark(userWatermarkPrefix + user)
+	return ok && created < before
+}
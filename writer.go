@@ -0,0 +1,105 @@
+package sessionmw
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// hookWriter wraps a http.ResponseWriter, calling hook exactly once before the
+// response headers are written.
+type hookWriter struct {
+	http.ResponseWriter
+	hook func(http.ResponseWriter)
+	done bool
+}
+
+// before calls the hook if it has not yet been called.
+func (w *hookWriter) before() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.hook(w.ResponseWriter)
+}
+
+// WriteHeader satisfies the http.ResponseWriter interface.
+func (w *hookWriter) WriteHeader(code int) {
+	w.before()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write satisfies the http.ResponseWriter interface.
+func (w *hookWriter) Write(buf []byte) (int, error) {
+	w.before()
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush satisfies the http.Flusher interface.
+func (w *hookWriter) Flush() {
+	w.before()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack satisfies the http.Hijacker interface.
+func (w *hookWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("sessionmw underlying http.ResponseWriter is not a http.Hijacker")
+	}
+	w.done = true
+	return h.Hijack()
+}
+
+// bufferWriter buffers a response until it is explicitly written to an
+// underlying http.ResponseWriter.
+type bufferWriter struct {
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+}
+
+// newBufferWriter creates a bufferWriter.
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{
+		header: make(http.Header),
+	}
+}
+
+// Header satisfies the http.ResponseWriter interface.
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader satisfies the http.ResponseWriter interface.
+func (w *bufferWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// Write satisfies the http.ResponseWriter interface.
+func (w *bufferWriter) Write(buf []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.buf.Write(buf)
+}
+
+// writeTo writes the buffered response to res.
+func (w *bufferWriter) writeTo(res http.ResponseWriter) {
+	h := res.Header()
+	for k, v := range w.header {
+		h[k] = v
+	}
+
+	code := w.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	res.WriteHeader(code)
+	res.Write(w.buf.Bytes())
+}